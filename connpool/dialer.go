@@ -1,6 +1,7 @@
 package connpool
 
 import (
+	"context"
 	"math/rand"
 	"net"
 	"sync"
@@ -10,12 +11,45 @@ import (
 	"github.com/shell909090/goproxy/tunnel"
 )
 
+const (
+	// a session quit.
+	EV_LOST = iota
+	// reconnect failed, will try again after Delay.
+	EV_RETRY
+	// session back after Attempt tries.
+	EV_RECONNECTED
+)
+
+// Event tells what happened in reconnecting, for alert on flapping.
+type Event struct {
+	Kind    int
+	Attempt int
+	Delay   time.Duration
+	Err     error
+}
+
 type Dialer struct {
 	*Pool
 	MinSess  int
 	MaxConn  int
 	lock     sync.Mutex
 	creators []*tunnel.DialerCreator
+
+	// dials wait for reconnecting, bounded by their context.
+	// otherwise they fail with ErrReconnecting.
+	WaitReconnect bool
+	// called in reconnecting goroutine, should not block.
+	OnEvent func(Event)
+	// RECONNECT_MIN and RECONNECT_MAX seconds if 0.
+	BackoffMin time.Duration
+	BackoffMax time.Duration
+
+	// closed when reconnect finished, nil if not reconnecting.
+	rlock sync.Mutex
+	ch_up chan struct{}
+	// closed by Close, made when first needed so literals work too.
+	closed    bool
+	ch_closed chan struct{}
 }
 
 func NewDialer(MinSess, MaxConn int) (dialer *Dialer) {
@@ -29,11 +63,49 @@ func NewDialer(MinSess, MaxConn int) (dialer *Dialer) {
 		Pool:    NewPool(),
 		MinSess: MinSess,
 		MaxConn: MaxConn,
+
+		BackoffMin: RECONNECT_MIN * time.Second,
+		BackoffMax: RECONNECT_MAX * time.Second,
 	}
 	go dialer.loop()
 	return
 }
 
+// done is closed when dialer closed.
+func (dialer *Dialer) done() <-chan struct{} {
+	dialer.rlock.Lock()
+	defer dialer.rlock.Unlock()
+	if dialer.ch_closed == nil {
+		dialer.ch_closed = make(chan struct{})
+	}
+	return dialer.ch_closed
+}
+
+func (dialer *Dialer) isClosed() bool {
+	dialer.rlock.Lock()
+	defer dialer.rlock.Unlock()
+	return dialer.closed
+}
+
+// Close stops balancing and reconnecting, and cuts all sessions. Get
+// fails with ErrDialerClosed after it.
+func (dialer *Dialer) Close() error {
+	dialer.rlock.Lock()
+	if dialer.closed {
+		dialer.rlock.Unlock()
+		return nil
+	}
+	dialer.closed = true
+	if dialer.ch_closed == nil {
+		dialer.ch_closed = make(chan struct{})
+	}
+	close(dialer.ch_closed)
+	dialer.rlock.Unlock()
+
+	dialer.CutAll()
+	return nil
+}
+
 func (dialer *Dialer) AddDialerCreator(orig *tunnel.DialerCreator) {
 	dialer.lock.Lock()
 	defer dialer.lock.Unlock()
@@ -43,8 +115,13 @@ func (dialer *Dialer) AddDialerCreator(orig *tunnel.DialerCreator) {
 // CAUTION: balance should run after loop begin
 // because creators are added one by one, it will take a while.
 func (dialer *Dialer) loop() {
+	done := dialer.done()
 	for {
-		time.Sleep(60 * time.Second)
+		select {
+		case <-time.After(BALANCE_INTERVAL * time.Second):
+		case <-done:
+			return
+		}
 		err := dialer.balance()
 		if err != nil {
 			logger.Error(err.Error())
@@ -75,14 +152,48 @@ func (dialer *Dialer) balance() (err error) {
 
 // Get one or create one.
 func (dialer *Dialer) Get() (tun tunnel.Tunnel, err error) {
+	return dialer.GetContext(context.Background())
+}
+
+// GetContext works like Get, waiting for reconnecting is bounded by ctx.
+func (dialer *Dialer) GetContext(ctx context.Context) (tun tunnel.Tunnel, err error) {
+	if dialer.isClosed() {
+		return nil, ErrDialerClosed
+	}
 	if dialer.GetSize() == 0 {
-		err = dialer.newTunnel(true)
-		if err != nil {
-			return
+		dialer.rlock.Lock()
+		ch_up := dialer.ch_up
+		dialer.rlock.Unlock()
+
+		switch {
+		case ch_up == nil:
+			err = dialer.newTunnel(true)
+			if err != nil {
+				return
+			}
+		case !dialer.WaitReconnect:
+			return nil, ErrReconnecting
+		default:
+			select {
+			case <-ch_up:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if dialer.isClosed() {
+				return nil, ErrDialerClosed
+			}
 		}
 	}
 
 	tun, _ = dialer.getMinimum()
+	if tun == nil {
+		// all tunnels going away.
+		err = dialer.newTunnel(false)
+		if err != nil {
+			return
+		}
+		tun, _ = dialer.getMinimum()
+	}
 	if tun == nil {
 		err = ErrNoSession
 		return
@@ -127,6 +238,11 @@ func (dialer *Dialer) newTunnel(create bool) (err error) {
 		logger.Critical("can't connect to any server, quit.")
 		return
 	}
+	if dialer.isClosed() {
+		// closed while dialing.
+		tun.Close()
+		return ErrDialerClosed
+	}
 	logger.Notice("session created.")
 
 	dialer.Add(tun)
@@ -145,6 +261,8 @@ func (dialer *Dialer) sessRun(tun tunnel.Tunnel) {
 		if err != nil {
 			logger.Error(err.Error())
 		}
+		dialer.emit(Event{Kind: EV_LOST})
+		dialer.startReconnect()
 	}()
 
 	tun.Loop()
@@ -152,8 +270,85 @@ func (dialer *Dialer) sessRun(tun tunnel.Tunnel) {
 	return
 }
 
+func (dialer *Dialer) emit(ev Event) {
+	if dialer.OnEvent != nil {
+		dialer.OnEvent(ev)
+	}
+}
+
+// startReconnect reconnects in background if sessions not enough,
+// only one reconnecting at a time.
+func (dialer *Dialer) startReconnect() {
+	need := dialer.MinSess
+	if need < 1 {
+		need = 1
+	}
+	if dialer.GetSize() >= need {
+		return
+	}
+
+	dialer.rlock.Lock()
+	defer dialer.rlock.Unlock()
+	if dialer.ch_up != nil || dialer.closed {
+		return
+	}
+	dialer.ch_up = make(chan struct{})
+	go dialer.reconnect()
+}
+
+// reconnect retries with exponential backoff and jitter, until success or
+// dialer closed.
+func (dialer *Dialer) reconnect() {
+	delay := dialer.BackoffMin
+	if delay <= 0 {
+		delay = RECONNECT_MIN * time.Second
+	}
+	limit := dialer.BackoffMax
+	if limit <= 0 {
+		limit = RECONNECT_MAX * time.Second
+	}
+	done := dialer.done()
+	attempt := 1
+	var err error
+retry:
+	for ; ; attempt++ {
+		err = dialer.newTunnel(false)
+		if err == nil || err == ErrDialerClosed {
+			break
+		}
+		// in [delay/2, delay*3/2), so clients not retry all together.
+		d := delay/2 + time.Duration(rand.Int63n(int64(delay)+1))
+		logger.Warningf("reconnect failed %d times, retry in %s.", attempt, d)
+		dialer.emit(Event{Kind: EV_RETRY, Attempt: attempt, Delay: d, Err: err})
+		select {
+		case <-time.After(d):
+		case <-done:
+			err = ErrDialerClosed
+			break retry
+		}
+		delay *= 2
+		if delay > limit {
+			delay = limit
+		}
+	}
+
+	dialer.rlock.Lock()
+	close(dialer.ch_up)
+	dialer.ch_up = nil
+	dialer.rlock.Unlock()
+	if err != nil {
+		logger.Notice("dialer closed, reconnect stopped.")
+		return
+	}
+	logger.Noticef("reconnected after %d tries.", attempt)
+	dialer.emit(Event{Kind: EV_RECONNECTED, Attempt: attempt})
+}
+
 func (dialer *Dialer) Dial(network, address string) (net.Conn, error) {
-	tun, err := dialer.Get()
+	ctx, cancel := context.WithTimeout(
+		context.Background(), tunnel.DIAL_TIMEOUT*time.Millisecond)
+	defer cancel()
+	tun, err := dialer.GetContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -163,3 +358,51 @@ func (dialer *Dialer) Dial(network, address string) (net.Conn, error) {
 	}
 	return d.Dial(network, address)
 }
+
+func (dialer *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	tun, err := dialer.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := tun.(netutil.ContextDialer)
+	if !ok {
+		panic("tunnel not a context dialer in client side.")
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+// DialWithData dials with data as the first bytes of stream, in syn if
+// server agreed. see tunnel.Conn.ConnectWithData.
+func (dialer *Dialer) DialWithData(ctx context.Context, network, address string, data []byte) (net.Conn, error) {
+	tun, err := dialer.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := tun.(interface {
+		DialWithData(ctx context.Context, network, address string, data []byte) (net.Conn, error)
+	})
+	if !ok {
+		panic("tunnel can't dial with data in client side.")
+	}
+	return d.DialWithData(ctx, network, address, data)
+}
+
+// LookupIP resolves host by server, so nothing leaks locally.
+func (dialer *Dialer) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	tun, err := dialer.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := tun.(tunnel.IPResolver)
+	if !ok {
+		panic("tunnel not a resolver in client side.")
+	}
+	return r.LookupIP(ctx, "ip", host)
+}
+
+// ResolverDial is Dial of net.Resolver, dns server in address is talked to
+// through tunnel. It is always tcp, the resolver talks dns over tcp then,
+// since the conn is not a PacketConn.
+func (dialer *Dialer) ResolverDial(ctx context.Context, network, address string) (net.Conn, error) {
+	return dialer.DialContext(ctx, "tcp", address)
+}
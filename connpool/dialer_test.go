@@ -0,0 +1,151 @@
+package connpool
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/tunnel"
+)
+
+var errDown = errors.New("server down.")
+
+// flakyDialer fails first fails dials, then dials server over pipe.
+type flakyDialer struct {
+	server *Server
+	fails  int32
+	dials  int32
+}
+
+func (fd *flakyDialer) Dial(network, address string) (net.Conn, error) {
+	if atomic.AddInt32(&fd.dials, 1) <= fd.fails {
+		return nil, errDown
+	}
+	p1, p2 := net.Pipe()
+	go fd.server.Handle(p2)
+	return p1, nil
+}
+
+func newFlakyDialer(fails int32, ch_ev chan Event) (dialer *Dialer, fd *flakyDialer) {
+	fd = &flakyDialer{
+		server: NewServer(&map[string]string{"alice": "secret"}),
+		fails:  fails,
+	}
+	dialer = &Dialer{
+		Pool:       NewPool(),
+		BackoffMin: 10 * time.Millisecond,
+		BackoffMax: 40 * time.Millisecond,
+		OnEvent:    func(ev Event) { ch_ev <- ev },
+	}
+	dialer.AddDialerCreator(
+		tunnel.NewDialerCreator(fd, "pipe", "pipe", "alice", "secret"))
+	return
+}
+
+func nextEvent(t *testing.T, ch_ev chan Event) Event {
+	select {
+	case ev := <-ch_ev:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event in time")
+	}
+	return Event{}
+}
+
+// waitStopped waits for reconnecting goroutine to quit.
+func waitStopped(t *testing.T, dialer *Dialer) {
+	for i := 0; i < 500; i++ {
+		dialer.rlock.Lock()
+		ch_up := dialer.ch_up
+		dialer.rlock.Unlock()
+		if ch_up == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("reconnect not stopped")
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	tunnel.SetLogging()
+	ch_ev := make(chan Event, 16)
+	dialer, fd := newFlakyDialer(1<<30, ch_ev)
+	dialer.startReconnect()
+
+	base := dialer.BackoffMin
+	for i := 1; i <= 5; i++ {
+		ev := nextEvent(t, ch_ev)
+		if ev.Kind != EV_RETRY || ev.Attempt != i || ev.Err == nil {
+			t.Fatalf("expect retry %d, got %+v", i, ev)
+		}
+		if ev.Delay < base/2 || ev.Delay > base*3/2 {
+			t.Fatalf("retry %d delay %s out of [%s, %s]", i, ev.Delay, base/2, base*3/2)
+		}
+		base *= 2
+		if base > dialer.BackoffMax {
+			base = dialer.BackoffMax
+		}
+	}
+
+	dialer.Close()
+	waitStopped(t, dialer)
+	dials := atomic.LoadInt32(&fd.dials)
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&fd.dials); n != dials {
+		t.Fatalf("dialed %d times after closed", n-dials)
+	}
+}
+
+func TestReconnectDefaultBackoff(t *testing.T) {
+	tunnel.SetLogging()
+	ch_ev := make(chan Event, 16)
+	dialer, _ := newFlakyDialer(1<<30, ch_ev)
+	dialer.BackoffMin, dialer.BackoffMax = 0, 0
+	dialer.startReconnect()
+
+	ev := nextEvent(t, ch_ev)
+	if ev.Kind != EV_RETRY || ev.Delay < RECONNECT_MIN*time.Second/2 {
+		t.Fatalf("expect retry after default backoff, got %+v", ev)
+	}
+	// closed while waiting to retry.
+	dialer.Close()
+	waitStopped(t, dialer)
+	select {
+	case ev = <-ch_ev:
+		t.Fatalf("expect no event after closed, got %+v", ev)
+	default:
+	}
+}
+
+func TestReconnectEvents(t *testing.T) {
+	tunnel.SetLogging()
+	ch_ev := make(chan Event, 16)
+	// one attempt dials DIAL_RETRY times.
+	dialer, _ := newFlakyDialer(DIAL_RETRY, ch_ev)
+	dialer.startReconnect()
+
+	if ev := nextEvent(t, ch_ev); ev.Kind != EV_RETRY || ev.Attempt != 1 {
+		t.Fatalf("expect retry 1, got %+v", ev)
+	}
+	if ev := nextEvent(t, ch_ev); ev.Kind != EV_RECONNECTED || ev.Attempt != 2 {
+		t.Fatalf("expect reconnected after 2 tries, got %+v", ev)
+	}
+	if n := dialer.GetSize(); n != 1 {
+		t.Fatalf("expect 1 session, got %d", n)
+	}
+	if _, err := dialer.GetContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	dialer.Close()
+	if ev := nextEvent(t, ch_ev); ev.Kind != EV_LOST {
+		t.Fatalf("expect session lost, got %+v", ev)
+	}
+	waitStopped(t, dialer)
+	if _, err := dialer.GetContext(context.Background()); err != ErrDialerClosed {
+		t.Fatalf("expect dialer closed, got %v", err)
+	}
+}
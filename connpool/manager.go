@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"strconv"
 
 	"github.com/miekg/dns"
 	mydns "github.com/shell909090/goproxy/dns"
+	"github.com/shell909090/goproxy/tunnel"
 )
 
 const (
@@ -77,12 +79,125 @@ const (
 {{.}}
     </pre>
   </body>
+</html>`
+	str_users = `
+<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 4.01//EN" "http://www.w3.org/TR/html4/strict.dtd">
+<html>
+  <head>
+    <title>user list</title>
+    <meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
+    <meta name="author" content="Shell.Xu">
+  </head>
+  <body>
+    <table>
+      <tr>
+	<th>User</th><th>Fabrics</th><th>Streams</th>
+      </tr>
+      {{range .}}
+      <tr>
+	<td>{{.Username}}</td>
+	<td>{{.Fabrics}}/{{.MaxFabrics}}</td>
+	<td>{{.Streams}}/{{.MaxStreams}}</td>
+      </tr>
+      {{else}}
+      <tr><td>no user</td></tr>
+      {{end}}
+    </table>
+  </body>
+</html>`
+	str_lockout = `
+<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 4.01//EN" "http://www.w3.org/TR/html4/strict.dtd">
+<html>
+  <head>
+    <title>auth lockout</title>
+    <meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
+    <meta name="author" content="Shell.Xu">
+  </head>
+  <body>
+    <p>
+      failures: {{.Stats.Failures}}, bans: {{.Stats.Bans}},
+      refused: {{.Stats.Refused}}, banned now: {{.Stats.Banned}}/{{.Stats.Sources}},
+      auth timeouts: {{.Timeouts}}, fallbacks: {{.Fallbacks}}, replays: {{.Replays.Replays}}
+    </p>
+    <table>
+      <tr>
+	<th>IP</th><th>Failures</th><th>Banned until</th><th></th>
+      </tr>
+      {{range .Entries}}
+      <tr>
+	<td>{{.IP}}</td>
+	<td>{{.Failures}}</td>
+	<td>{{if not .Until.IsZero}}{{.Until.Format "2006-01-02 15:04:05"}}{{end}}</td>
+	<td><a href="?unban={{.IP}}">unban</a></td>
+      </tr>
+      {{else}}
+      <tr><td>no source</td></tr>
+      {{end}}
+    </table>
+  </body>
+</html>`
+	str_quotas = `
+<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 4.01//EN" "http://www.w3.org/TR/html4/strict.dtd">
+<html>
+  <head>
+    <title>quota list</title>
+    <meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
+    <meta name="author" content="Shell.Xu">
+  </head>
+  <body>
+    <table>
+      <tr>
+	<th>User</th><th>Used</th><th>Quota</th><th>Over</th><th></th>
+      </tr>
+      {{range .}}
+      <tr>
+	<td>{{.Username}}</td>
+	<td>{{.Used}}</td>
+	<td>{{.Quota}}</td>
+	<td>{{.Over}}</td>
+	<td><a href="?reset={{.Username}}">reset</a></td>
+      </tr>
+      {{else}}
+      <tr><td>no user</td></tr>
+      {{end}}
+    </table>
+  </body>
+</html>`
+	str_dests = `
+<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 4.01//EN" "http://www.w3.org/TR/html4/strict.dtd">
+<html>
+  <head>
+    <title>destination list</title>
+    <meta http-equiv="Content-Type" content="text/html; charset=utf-8"/>
+    <meta name="author" content="Shell.Xu">
+  </head>
+  <body>
+    <table>
+      <tr>
+	<th>Destination</th><th>Conns</th><th>Waiting</th><th>Refused</th>
+      </tr>
+      {{range .}}
+      <tr>
+	<td>{{.Dest}}</td>
+	<td>{{.Conns}}</td>
+	<td>{{.Waiting}}</td>
+	<td>{{.Refused}}</td>
+      </tr>
+      {{else}}
+      <tr><td>no destination</td></tr>
+      {{end}}
+    </table>
+  </body>
 </html>`
 )
 
 var (
-	tmpl_sess *template.Template
-	tmpl_addr *template.Template
+	tmpl_sess    *template.Template
+	tmpl_addr    *template.Template
+	tmpl_users   *template.Template
+	tmpl_dests   *template.Template
+	tmpl_lockout *template.Template
+	tmpl_quotas  *template.Template
 )
 
 func init() {
@@ -96,6 +211,26 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+
+	tmpl_users, err = template.New("users").Parse(str_users)
+	if err != nil {
+		panic(err)
+	}
+
+	tmpl_dests, err = template.New("dests").Parse(str_dests)
+	if err != nil {
+		panic(err)
+	}
+
+	tmpl_lockout, err = template.New("lockout").Parse(str_lockout)
+	if err != nil {
+		panic(err)
+	}
+
+	tmpl_quotas, err = template.New("quotas").Parse(str_quotas)
+	if err != nil {
+		panic(err)
+	}
 }
 
 func (pool *Pool) HandlerMain(w http.ResponseWriter, req *http.Request) {
@@ -148,6 +283,93 @@ func HandlerLookup(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
+// HandlerUsers shows usage of users online, limits 0 means none.
+func (server *Server) HandlerUsers(w http.ResponseWriter, req *http.Request) {
+	err := tmpl_users.Execute(w, server.accounts.Usage())
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	return
+}
+
+// HandlerDests shows destinations with most conns, n in query, 100 by
+// default.
+func (server *Server) HandlerDests(w http.ResponseWriter, req *http.Request) {
+	var counts []tunnel.DestCount
+	if server.DestLimits != nil {
+		n, err := strconv.Atoi(req.URL.Query().Get("n"))
+		if err != nil {
+			n = 100
+		}
+		counts = server.DestLimits.Top(n)
+	}
+	err := tmpl_dests.Execute(w, counts)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	return
+}
+
+// HandlerLockout shows sources failed in auth and counters, with conns not
+// authed in time and replays, unbans ip in query.
+func (server *Server) HandlerLockout(w http.ResponseWriter, req *http.Request) {
+	lo := server.Lockout
+	if lo == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("no lockout"))
+		return
+	}
+	if ip := req.URL.Query().Get("unban"); ip != "" {
+		lo.Unban(ip)
+	}
+	err := tmpl_lockout.Execute(w, struct {
+		Stats     tunnel.LockoutStats
+		Entries   []tunnel.LockoutEntry
+		Timeouts  uint64
+		Fallbacks uint64
+		Replays   tunnel.ReplayStats
+	}{lo.Stats(), lo.List(), server.AuthTimeouts(), server.Fallbacks(), server.Replays.Stats()})
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	return
+}
+
+// HandlerQuotas shows usage of users seen, or user in query, resets user
+// in reset of query.
+func (server *Server) HandlerQuotas(w http.ResponseWriter, req *http.Request) {
+	q := server.Quotas
+	if q == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("no quotas"))
+		return
+	}
+	query := req.URL.Query()
+	if username, ok := query["reset"]; ok {
+		err := q.Reset(username[0])
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "error %s", err)
+			return
+		}
+	}
+	usages := q.List()
+	if username, ok := query["user"]; ok {
+		u, err := q.Usage(username[0])
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "error %s", err)
+			return
+		}
+		usages = []tunnel.QuotaUsage{u}
+	}
+	err := tmpl_quotas.Execute(w, usages)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	return
+}
+
 func (pool *Pool) HandlerCutoff(w http.ResponseWriter, req *http.Request) {
 	pool.CutAll()
 	return
@@ -15,12 +15,17 @@ const (
 	BALANCE_INTERVAL = 60
 	DIAL_RETRY       = 2
 	AUTH_TIMEOUT     = 10
+	// backoff of reconnect, in seconds.
+	RECONNECT_MIN = 1
+	RECONNECT_MAX = 60
 )
 
 var (
 	ErrNoSession       = errors.New("session in pool but can't pick one.")
 	ErrSessionNotFound = errors.New("session not found.")
 	ErrNoCreator       = errors.New("can't create tunnel with no creator.")
+	ErrReconnecting    = errors.New("reconnecting to server.")
+	ErrDialerClosed    = errors.New("dialer closed.")
 )
 
 var (
@@ -59,6 +64,9 @@ func (pool *Pool) getMinimum() (tun tunnel.Tunnel, size int) {
 	pool.lock.RLock()
 	defer pool.lock.RUnlock()
 	for t, _ := range pool.tunpool {
+		if t.GoingAway() {
+			continue
+		}
 		n := t.GetSize()
 		if size == -1 || n < size {
 			tun = t
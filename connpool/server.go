@@ -1,51 +1,392 @@
 package connpool
 
 import (
+	"crypto/tls"
 	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/shell909090/goproxy/tunnel"
 )
 
+// RateLimit in bytes per second for fabrics of a user, 0 means no limit.
+// Stream limits what each stream of the user sends.
+type RateLimit struct {
+	Send   int
+	Recv   int
+	Burst  int
+	Stream int
+}
+
 type Server struct {
 	*Pool
 	tunnel.Server
 	auth *map[string]string
+	// checks users instead of auth map if set. clients challenged if it's
+	// a tunnel.ChallengeAuthenticator, or the map used.
+	Authenticator tunnel.Authenticator
+	// lets anyone in if no auth map or Authenticator, refused by default.
+	Anonymous bool
+	// lets clients without credentials in as tunnel.GUEST_USER, even with
+	// auth map or Authenticator. Limits, Rates, UserPorts and SetUserACL of
+	// that user apply to guests, tight GUEST_* defaults if not set. guests
+	// never dial private addresses.
+	Guest bool
+	// accepts passwords in plaintext from clients challenged, for tls.
+	Plaintext bool
+	// passes users on tls as identity in client cert, see tunnel.CertUser,
+	// before password checked. certs verified by TLSConfig.
+	CertUsers bool
+	// checks bearer tokens from clients, users by token need no password.
+	// fabrics drained after token expired and TokenGrace, if not renewed.
+	Tokens      tunnel.TokenValidator
+	TokenGrace  time.Duration
+	auth_failed uint64
+	// tokens passed auth, replays of them and stale proofs refused. set options
+	// in it before serving.
+	Replays *tunnel.ReplayCache
+	// by username, "" for users not listed.
+	Rates map[string]RateLimit
+	// by username like Rates, swapped by SetLimits.
+	limits   atomic.Pointer[map[string]tunnel.UserLimits]
+	accounts *tunnel.Accounts
+	// pre-shared key for fabric encryption, nil means not supported.
+	Key []byte
+	// encrypted fabrics rekeyed after so many bytes or so long, defaults
+	// of tunnel if 0.
+	RekeyBytes    uint64
+	RekeyInterval time.Duration
+	// checks targets of all fabrics, set acl in it at runtime.
+	Guard *tunnel.Guard
+	// rules by username checked before Guard, see SetUserACL.
+	guard_lock  sync.Mutex
+	user_guards map[string]*tunnel.Guard
+	// ports targets of all fabrics can be on, set in it at runtime. those
+	// by username in UserPorts, or from Authenticator, checked instead if
+	// not empty.
+	Ports     *tunnel.PortFilter
+	UserPorts map[string]*tunnel.PortFilter
+	// fabrics refuse private targets if set, except those of Admins.
+	DenyPrivate bool
+	Admins      map[string]bool
+	// upstream proxies by target for all fabrics, nil dials directly.
+	Router *tunnel.Router
+	// counts data of users in all fabrics, Quota of limits enforced by it.
+	// see NewQuotas.
+	Quotas *tunnel.Quotas
+	// caps conns to each destination of all fabrics, nil means no limit.
+	DestLimits *tunnel.DestLimits
+	// rewrites targets for all fabrics, set rules in it at runtime.
+	Rewriter *tunnel.Rewriter
+	// resolves targets and dns queries for all fabrics, a tunnel.DnsCache
+	// shares answers in them. nil uses net.DefaultResolver.
+	Resolver tunnel.IPResolver
+	// source ip of dials, by username in Binds first, then Bind. BindFor
+	// overrides them by stream if set and not returns nil.
+	Bind    net.IP
+	Binds   map[string]net.IP
+	BindFor func(username string, c *tunnel.Conn) net.IP
+	// gets records of streams in all fabrics, see SetAccessLogger.
+	AccessLog *tunnel.AccessLog
+	// gets records of fabrics, see SetSessionLogger.
+	SessionLog *tunnel.SessionLog
+	// listeners each client can ask for, and ports allowed. see
+	// tunnel.Fabric.
+	MaxBinds    int
+	BindPortMin int
+	BindPortMax int
 }
 
+// ports of guests if UserPorts has none for them.
+var guestPorts = func() *tunnel.PortFilter {
+	ps, _ := tunnel.ParsePorts(tunnel.GUEST_PORTS)
+	return tunnel.NewPortFilter(ps)
+}()
+
 func NewServer(auth *map[string]string) (server *Server) {
 	if auth != nil && len(*auth) == 0 {
 		auth = nil
 	}
 	server = &Server{
-		Pool: NewPool(),
-		auth: auth,
+		Pool:     NewPool(),
+		auth:     auth,
+		accounts: tunnel.NewAccounts(),
+		Replays:  &tunnel.ReplayCache{},
 	}
 	server.Server.Handler = server
 	return
 }
 
+// Auth checks user by Authenticator, or auth map, or passes anyone if
+// Anonymous.
+func (server *Server) Auth(username, password string) (tunnel.UserInfo, error) {
+	switch {
+	case server.Authenticator != nil:
+		return server.Authenticator.Auth(username, password)
+	case server.auth != nil:
+		return tunnel.MapAuthenticator(*server.auth).Auth(username, password)
+	case server.Anonymous:
+		return tunnel.UserInfo{Username: username}, nil
+	}
+	return tunnel.UserInfo{}, tunnel.ErrAuthFailed
+}
+
 func (server *Server) AuthPass(username, password string) bool {
-	if server.auth == nil {
-		return true
+	_, err := server.Auth(username, password)
+	return err == nil
+}
+
+func (server *Server) AuthCert(state *tls.ConnectionState, username string) (tunnel.UserInfo, bool) {
+	if !server.CertUsers {
+		return tunnel.UserInfo{}, false
+	}
+	return tunnel.CertUser(state, nil)
+}
+
+func (server *Server) ValidateToken(token string) (tunnel.UserInfo, time.Time, error) {
+	if server.Tokens == nil {
+		return tunnel.UserInfo{}, time.Time{}, tunnel.ErrAuthFailed
+	}
+	return server.Tokens.ValidateToken(token)
+}
+
+func (server *Server) AllowPlaintext() bool {
+	return server.Plaintext
+}
+
+func (server *Server) AuthFailed(username string, addr net.Addr) {
+	n := atomic.AddUint64(&server.auth_failed, 1)
+	logger.Warningf("user %s from %s failed in auth, %d failures so far.",
+		username, addr, n)
+}
+
+// AuthLockout is Lockout of Server, auth failures slowed down and banned
+// by it if set.
+func (server *Server) AuthLockout() *tunnel.Lockout {
+	return server.Lockout
+}
+
+func (server *Server) AuthReplays() *tunnel.ReplayCache {
+	return server.Replays
+}
+
+// AuthFailures tells how many clients failed in auth.
+func (server *Server) AuthFailures() uint64 {
+	return atomic.LoadUint64(&server.auth_failed)
+}
+
+// challengeServer challenges clients by keys from Authenticator or map.
+type challengeServer struct {
+	*Server
+}
+
+func (cs challengeServer) UserKey(username string) ([]byte, error) {
+	if ca, ok := cs.Authenticator.(tunnel.ChallengeAuthenticator); ok {
+		return ca.UserKey(username)
+	}
+	return tunnel.MapAuthenticator(*cs.auth).UserKey(username)
+}
+
+// authenticator returns server, as a tunnel.ChallengeAuthenticator if keys
+// of users can be known.
+func (server *Server) authenticator() tunnel.Authenticator {
+	if _, ok := server.Authenticator.(tunnel.ChallengeAuthenticator); ok ||
+		server.Authenticator == nil && server.auth != nil {
+		return challengeServer{server}
+	}
+	return server
+}
+
+func (server *Server) PreSharedKey() []byte {
+	return server.Key
+}
+
+// SetLimits takes limits by username, "" for users not listed. Users
+// online get them now, nil limits nobody. It can be called at runtime.
+func (server *Server) SetLimits(limits map[string]tunnel.UserLimits) {
+	server.limits.Store(&limits)
+	for _, u := range server.accounts.Usage() {
+		server.accounts.SetLimits(u.Username, server.Limits(u.Username))
+	}
+}
+
+func (server *Server) Limits(username string) tunnel.UserLimits {
+	var limits tunnel.UserLimits
+	ok := false
+	if p := server.limits.Load(); p != nil {
+		limits, ok = (*p)[username]
+		if !ok && !server.isGuest(username) {
+			limits, ok = (*p)[""]
+		}
+	}
+	if !ok && server.isGuest(username) {
+		limits = tunnel.UserLimits{
+			MaxStreams: tunnel.GUEST_MAX_STREAMS,
+			MaxFabrics: tunnel.GUEST_MAX_FABRICS,
+		}
+	}
+	return limits
+}
+
+func (server *Server) isGuest(username string) bool {
+	return server.Guest && username == tunnel.GUEST_USER
+}
+
+// GuestUser lets clients without credentials in, if Guest set.
+func (server *Server) GuestUser() (tunnel.UserInfo, bool) {
+	return tunnel.UserInfo{Username: tunnel.GUEST_USER}, server.Guest
+}
+
+// NewQuotas sets Quotas with usage kept in store, quota of each user in
+// limits. call Close of it after serving.
+func (server *Server) NewQuotas(store tunnel.QuotaStore, trickle int) *tunnel.Quotas {
+	server.Quotas = tunnel.NewQuotas(store, func(username string) uint64 {
+		return server.Limits(username).Quota
+	})
+	server.Quotas.Trickle = trickle
+	return server.Quotas
+}
+
+// UserGuard returns rules of user from Authenticator if it's a
+// tunnel.ACLAuthenticator, or by SetUserACL, nil if never set. Fabrics of
+// user share it, so SetUserACL reaches those online, except ones came
+// before the first.
+func (server *Server) UserGuard(username string) *tunnel.Guard {
+	if aa, ok := server.Authenticator.(tunnel.ACLAuthenticator); ok {
+		if g := aa.UserGuard(username); g != nil {
+			return g
+		}
 	}
-	password1, ok := (*server.auth)[username]
+	server.guard_lock.Lock()
+	defer server.guard_lock.Unlock()
+	return server.user_guards[username]
+}
+
+// SetUserACL takes rules of user for new streams, checked before Guard.
+// nil checks Guard only. It can be called at runtime.
+func (server *Server) SetUserACL(username string, acl *tunnel.ACL) {
+	server.guard_lock.Lock()
+	defer server.guard_lock.Unlock()
+	g, ok := server.user_guards[username]
 	if !ok {
-		return false
+		if server.user_guards == nil {
+			server.user_guards = make(map[string]*tunnel.Guard)
+		}
+		g = &tunnel.Guard{}
+		server.user_guards[username] = g
 	}
-	if password1 != password {
-		return false
+	g.Set(acl)
+}
+
+// Accounts tells fabrics and streams each user holds.
+func (server *Server) Accounts() *tunnel.Accounts {
+	return server.accounts
+}
+
+func (server *Server) Register(mux *http.ServeMux) {
+	server.Pool.Register(mux)
+	mux.HandleFunc("/users", server.HandlerUsers)
+	mux.HandleFunc("/dests", server.HandlerDests)
+	mux.HandleFunc("/lockout", server.HandlerLockout)
+	mux.HandleFunc("/quotas", server.HandlerQuotas)
+}
+
+// SetAccessLogger calls fn with a record for each stream finished, out of
+// the data path. call it before serving.
+func (server *Server) SetAccessLogger(fn func(rec tunnel.AccessRecord)) {
+	if server.AccessLog != nil {
+		server.AccessLog.Close()
+	}
+	server.AccessLog = tunnel.NewAccessLog(fn, 0)
+}
+
+// SetSessionLogger calls fn with a record for each fabric ended, and
+// started too if starts, out of the data path. call it before serving.
+func (server *Server) SetSessionLogger(fn func(rec tunnel.SessionRecord), starts bool) {
+	if server.SessionLog != nil {
+		server.SessionLog.Close()
+	}
+	server.SessionLog = tunnel.NewSessionLog(fn, 0)
+	server.SessionLog.Starts = starts
+}
+
+func (server *Server) setRate(tun *tunnel.TunnelServer, username string) {
+	rate, ok := server.Rates[username]
+	switch {
+	case ok:
+	case server.isGuest(username):
+		rate = RateLimit{Send: tunnel.GUEST_RATE, Recv: tunnel.GUEST_RATE}
+	default:
+		rate, ok = server.Rates[""]
+		if !ok {
+			return
+		}
+	}
+	// we send what user downloads.
+	tun.SetSendRate(rate.Send, rate.Burst)
+	tun.SetRecvRate(rate.Recv, rate.Burst)
+	if rate.Stream != 0 {
+		tun.OnAccept = func(c *tunnel.Conn) {
+			c.SetRateLimit(rate.Stream)
+		}
+	}
+}
+
+func (server *Server) setBind(tun *tunnel.TunnelServer, username string) {
+	tun.Bind = server.Bind
+	if ip, ok := server.Binds[username]; ok {
+		tun.Bind = ip
+	}
+	if server.BindFor != nil {
+		tun.BindFor = func(c *tunnel.Conn) net.IP {
+			return server.BindFor(username, c)
+		}
 	}
-	return true
 }
 
 func (server *Server) Handle(conn net.Conn) (err error) {
-	err = tunnel.AuthConn(server, conn)
+	info, err := tunnel.AuthConnWith(server.authenticator(), conn, server.AuthTimeout)
 	if err != nil {
 		logger.Error(err.Error())
 		return
 	}
 
-	tun := tunnel.NewTunnelServer(conn)
+	tun := tunnel.NewTunnelServer(info.Conn)
+	tun.SetCaps(info.Caps)
+	tun.Guard = server.Guard
+	tun.UserGuard = info.UserGuard
+	tun.Ports, tun.UserPorts = server.Ports, info.Ports
+	if tun.UserPorts == nil {
+		tun.UserPorts = server.UserPorts[info.Username]
+	}
+	if tun.UserPorts == nil && info.Guest {
+		tun.UserPorts = guestPorts
+	}
+	tun.DenyPrivate = server.DenyPrivate && !server.Admins[info.Username] || info.Guest
+	tun.Router = server.Router
+	tun.Rewriter = server.Rewriter
+	tun.DestLimits = server.DestLimits
+	tun.Quotas = server.Quotas
+	tun.Resolver = server.Resolver
+	tun.Username, tun.Groups, tun.Guest = info.Username, info.Groups, info.Guest
+	if !info.Expires.IsZero() {
+		tun.TokenGrace = server.TokenGrace
+		tun.SetToken(server, info.Expires)
+	}
+	tun.Account = info.Account
+	defer info.Account.Release()
+	tun.AccessLog = server.AccessLog
+	tun.SessionLog, tun.AuthMethod = server.SessionLog, info.Method
+	tun.RekeyBytes, tun.RekeyInterval = server.RekeyBytes, server.RekeyInterval
+	tun.MaxBinds = server.MaxBinds
+	tun.BindPortMin, tun.BindPortMax = server.BindPortMin, server.BindPortMax
+	server.setRate(tun, info.Username)
+	server.setBind(tun, info.Username)
+	if info.Syn != nil {
+		tun.Replay(info.Syn)
+	}
 	server.Pool.Add(tun)
 	defer server.Pool.Remove(tun)
 	tun.Loop()
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/base64"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/shell909090/goproxy/connpool"
 	"github.com/shell909090/goproxy/cryptconn"
@@ -24,6 +28,30 @@ type ServerDefine struct {
 	Key         string
 	Username    string
 	Password    string
+	// crc32c on every frame, server should support it.
+	Checksum bool
+	// compress data frames if server agrees.
+	Compress bool
+	// base64 pre-shared key, fabric encrypted with it. server must have
+	// the same FabricKey.
+	FabricKey string
+	// rekey fabric encrypted after so many bytes written or so long.
+	RekeyBytes    uint64
+	RekeyInterval int // in ms
+	// send password as is to servers can't challenge, tls only.
+	Plaintext bool
+	// alpn in tls, like h2 and http/1.1 of browsers, for server with
+	// Fallback.
+	ALPN []string
+	// server passes only if sha256 of its key in them, in hex by -pin.
+	// chain verified by RootCAs as well if PinChain, or not at all.
+	Pins     []string
+	PinChain bool
+	// in as guest, Username and Password not sent. server must set Guest.
+	Anonymous bool
+	// token read from it for auth instead of password, and again to renew.
+	// kept fresh by others.
+	TokenFile string
 }
 
 type ClientConfig struct {
@@ -63,9 +91,18 @@ func httpserver(addr string, handler http.Handler) {
 	}
 }
 
-func (sd *ServerDefine) MakeDialer() (dialer netutil.Dialer, err error) {
+// MakeDialer returns dialer for server, and tls config for creator if in
+// tls mode. tls is done by creator.
+func (sd *ServerDefine) MakeDialer() (dialer netutil.Dialer, tlsConfig *tls.Config, err error) {
 	if strings.ToLower(sd.CryptMode) == "tls" {
-		dialer, err = NewTlsDialer(sd.CertFile, sd.CertKeyFile, sd.RootCAs)
+		dialer = netutil.DefaultTcpDialer
+		tlsConfig, err = ClientTlsConfig(sd.CertFile, sd.CertKeyFile, sd.RootCAs)
+		if err == nil {
+			tlsConfig.NextProtos = sd.ALPN
+		}
+		if err == nil && len(sd.Pins) != 0 {
+			err = tunnel.PinServer(tlsConfig, sd.PinChain, sd.Pins...)
+		}
 	} else {
 		cipher := sd.Cipher
 		if cipher == "" {
@@ -76,17 +113,42 @@ func (sd *ServerDefine) MakeDialer() (dialer netutil.Dialer, err error) {
 	return
 }
 
+// readToken returns token source of file, spaces around trimmed.
+func readToken(path string) func() (string, error) {
+	return func() (string, error) {
+		b, err := os.ReadFile(path)
+		return strings.TrimSpace(string(b)), err
+	}
+}
+
 func RunHttproxy(cfg *ClientConfig) (err error) {
 	var dialer netutil.Dialer
 	pool := connpool.NewDialer(cfg.MinSess, cfg.MaxConn)
 
 	for _, srv := range cfg.Servers {
-		dialer, err = srv.MakeDialer()
+		var tlsConfig *tls.Config
+		dialer, tlsConfig, err = srv.MakeDialer()
 		if err != nil {
 			return
 		}
 		creator := tunnel.NewDialerCreator(
 			dialer, "tcp4", srv.Server, srv.Username, srv.Password)
+		creator.TLSConfig = tlsConfig
+		creator.Checksum = srv.Checksum
+		creator.Compress = srv.Compress
+		creator.Plaintext = srv.Plaintext
+		creator.Anonymous = srv.Anonymous
+		if srv.TokenFile != "" {
+			creator.Token = readToken(srv.TokenFile)
+		}
+		if srv.FabricKey != "" {
+			creator.Key, err = base64.StdEncoding.DecodeString(srv.FabricKey)
+			if err != nil {
+				return
+			}
+			creator.RekeyBytes = srv.RekeyBytes
+			creator.RekeyInterval = time.Duration(srv.RekeyInterval) * time.Millisecond
+		}
 		pool.AddDialerCreator(creator)
 	}
 
@@ -9,12 +9,14 @@ import (
 
 	logging "github.com/op/go-logging"
 	"github.com/shell909090/goproxy/dns"
+	"github.com/shell909090/goproxy/tunnel"
 )
 
 var logger = logging.MustGetLogger("")
 
 var (
 	ConfigFile string
+	PinFile    string
 )
 
 type Config struct {
@@ -31,6 +33,7 @@ type Config struct {
 
 func init() {
 	flag.StringVar(&ConfigFile, "config", "/etc/goproxy/config.json", "config file")
+	flag.StringVar(&PinFile, "pin", "", "print pin of cert file for pins, and exit")
 	flag.Parse()
 }
 
@@ -81,6 +84,16 @@ func SetLogging(cfg *Config) (err error) {
 }
 
 func main() {
+	if PinFile != "" {
+		pin, err := tunnel.SPKIPinFile(PinFile)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		fmt.Println(pin)
+		return
+	}
+
 	basecfg, err := LoadConfig()
 	if err != nil {
 		fmt.Println(err.Error())
@@ -37,6 +37,8 @@ func TestGoproxy(t *testing.T) {
 		RootCAs:     AbsPath("../keys/ca.crt"),
 		CertFile:    AbsPath("../keys/localhost.crt"),
 		CertKeyFile: AbsPath("../keys/localhost.key"),
+		// clients checked by certs only.
+		Anonymous: true,
 	}
 	go func() {
 		err := RunServer(&srvcfg)
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/base64"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/shell909090/goproxy/connpool"
 	"github.com/shell909090/goproxy/cryptconn"
 	"github.com/shell909090/goproxy/dns"
 	"github.com/shell909090/goproxy/netutil"
+	"github.com/shell909090/goproxy/tunnel"
 )
 
 type ServerConfig struct {
@@ -21,6 +30,74 @@ type ServerConfig struct {
 	Cipher      string
 	Key         string
 	Auth        map[string]string
+	// base64 keys by tunnel.DeriveKey, by username. used instead of Auth,
+	// so passwords not kept here.
+	AuthKeys map[string]string
+	// lines of "user:hash", hashes by tunnel.HashPassword or htpasswd -B.
+	// used instead of Auth and AuthKeys, loaded again on SIGHUP.
+	AuthFile string
+	// users by identity in client certs, tls only. certs verified by
+	// RootCAs, or sha256 fingerprints in CertPins, or both.
+	CertUsers bool
+	CertPins  []string
+	// tls only. conns sent no hello, browsers or probes, served by it as
+	// a web server: url proxied to, or directory of files. alpn of ALPN
+	// advertised, h2 and http/1.1 if empty.
+	Fallback string
+	ALPN     []string
+	// base64 key of tunnel.HMACTokens, clients may auth by tokens signed
+	// by it. fabrics drained after token expired and TokenGrace.
+	TokenKey   string
+	TokenGrace int // in ms
+	// tokens pass auth once by default, set it if clients share one in
+	// fabrics. tls or FabricKey only then.
+	TokenReuse bool
+	// time of clients in challenge off ours by it at most.
+	AuthSkew int // in ms
+	// lets clients in without auth if Auth empty.
+	Anonymous bool
+	// lets clients without credentials in as guest "anonymous", limited
+	// by Limits, Rates and UserPorts of that user, or tight defaults.
+	Guest bool
+	// accepts passwords in plaintext, for clients before challenge. tls only.
+	Plaintext   bool
+	AuthTimeout int // in ms
+	// sources banned after so many auth failures in a row, 0 never. ban
+	// lasts AuthBanTime. failures delayed anyway.
+	AuthBan     int
+	AuthBanTime int // in ms
+	// by username, "" for others.
+	Rates map[string]connpool.RateLimit
+	// base64 pre-shared key, clients can encrypt fabric with it.
+	FabricKey string
+	// fabrics encrypted by it get new keys after so many bytes written
+	// or so long, the side reaching it first starts.
+	RekeyBytes    uint64
+	RekeyInterval int // in ms
+	DialTimeout   int // in ms
+	// options of conns to targets, see tunnel.TcpOptions.
+	KeepAlive   int // in ms, negative disables
+	Nagle       bool
+	ReadBuffer  int
+	WriteBuffer int
+	// refuse dials to private addresses, except for users in Admins.
+	DenyPrivate bool
+	Admins      []string
+	// ports targets can be on, like "80,443,8080-8090", empty for any.
+	// by username in UserPorts, checked instead if set.
+	Ports     string
+	UserPorts map[string]string
+	// streams and fabrics each user holds, by username, "" for others.
+	Limits map[string]tunnel.UserLimits
+	// usage of users kept in it, so Quota in Limits works over restarts.
+	// streams of users over quota slowed down to QuotaTrickle bytes per
+	// second, or reset if 0.
+	QuotaFile    string
+	QuotaTrickle int
+	// conns to each destination at the same time, 0 means no limit.
+	// streams over it wait DestWait at most.
+	DestMax  int
+	DestWait int // in ms
 }
 
 func LoadServerConfig(basecfg *Config) (cfg *ServerConfig, err error) {
@@ -43,9 +120,19 @@ func RunServer(cfg *ServerConfig) (err error) {
 		return
 	}
 
+	// tls done by server, so client certs can be seen in fabrics.
+	var tlsConfig *tls.Config
 	if strings.ToLower(cfg.CryptMode) == "tls" {
-		listener, err = TlsListener(
-			listener, cfg.CertFile, cfg.CertKeyFile, cfg.RootCAs)
+		tlsConfig, err = ServerTlsConfig(cfg.CertFile, cfg.CertKeyFile, cfg.RootCAs)
+		if err == nil && len(cfg.CertPins) != 0 {
+			err = pinClientCerts(tlsConfig, cfg.CertPins)
+		}
+		if err == nil {
+			tlsConfig.NextProtos = cfg.ALPN
+			if len(cfg.ALPN) == 0 && cfg.Fallback != "" {
+				tlsConfig.NextProtos = WebALPN
+			}
+		}
 	} else {
 		listener, err = cryptconn.NewListener(listener, cfg.Cipher, cfg.Key)
 	}
@@ -53,12 +140,119 @@ func RunServer(cfg *ServerConfig) (err error) {
 		return
 	}
 
+	if cfg.DialTimeout != 0 {
+		tunnel.DefaultTcpProxy.Timeout = time.Duration(cfg.DialTimeout) * time.Millisecond
+	}
+
+	tunnel.DefaultTcpProxy.TcpOptions = tunnel.TcpOptions{
+		KeepAlive:   time.Duration(cfg.KeepAlive) * time.Millisecond,
+		Nagle:       cfg.Nagle,
+		ReadBuffer:  cfg.ReadBuffer,
+		WriteBuffer: cfg.WriteBuffer,
+	}
+
 	if cfg.ForceIPv4 {
 		logger.Info("force ipv4 dailer.")
 		netutil.DefaultTcpDialer = netutil.DefaultTcp4Dialer
+		// dual stack dialing would go around it.
+		tunnel.DefaultTcpProxy.FallbackDelay = -1
 	}
 
 	server := connpool.NewServer(&cfg.Auth)
+	server.TLSConfig = tlsConfig
+	if tlsConfig != nil && cfg.Fallback != "" {
+		server.Fallback, err = fallbackHandler(cfg.Fallback)
+		if err != nil {
+			return
+		}
+	}
+	server.CertUsers = cfg.CertUsers
+	server.Anonymous = cfg.Anonymous
+	server.Guest = cfg.Guest
+	server.Plaintext = cfg.Plaintext
+	server.AuthTimeout = time.Duration(cfg.AuthTimeout) * time.Millisecond
+	server.Replays.Skew = time.Duration(cfg.AuthSkew) * time.Millisecond
+	server.Replays.TokenReuse = cfg.TokenReuse
+	server.Lockout = tunnel.NewLockout(
+		cfg.AuthBan, time.Duration(cfg.AuthBanTime)*time.Millisecond)
+	if len(cfg.AuthKeys) != 0 {
+		keys := make(tunnel.KeyMapAuthenticator)
+		for username, s := range cfg.AuthKeys {
+			keys[username], err = base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return
+			}
+		}
+		server.Authenticator = keys
+	}
+	if cfg.AuthFile != "" {
+		ha := &tunnel.HashAuthenticator{}
+		err = ha.LoadFile(cfg.AuthFile)
+		if err != nil {
+			return
+		}
+		go reloadOnHup(ha, cfg.AuthFile)
+		server.Authenticator = ha
+	}
+	if cfg.TokenKey != "" {
+		var key []byte
+		key, err = base64.StdEncoding.DecodeString(cfg.TokenKey)
+		if err != nil {
+			return
+		}
+		server.Tokens = tunnel.HMACTokens{Key: key}
+		server.TokenGrace = time.Duration(cfg.TokenGrace) * time.Millisecond
+	}
+	if len(cfg.Auth) == 0 && len(cfg.AuthKeys) == 0 && cfg.AuthFile == "" && !cfg.CertUsers && cfg.TokenKey == "" && !cfg.Anonymous && !cfg.Guest {
+		logger.Warning("no auth and not anonymous, all clients refused.")
+	}
+	server.Rates = cfg.Rates
+	server.SetLimits(cfg.Limits)
+	server.DenyPrivate = cfg.DenyPrivate
+	if cfg.Ports != "" {
+		var ps tunnel.PortSet
+		ps, err = tunnel.ParsePorts(cfg.Ports)
+		if err != nil {
+			return
+		}
+		server.Ports = tunnel.NewPortFilter(ps)
+	}
+	if len(cfg.UserPorts) != 0 {
+		server.UserPorts = make(map[string]*tunnel.PortFilter)
+		for username, s := range cfg.UserPorts {
+			var ps tunnel.PortSet
+			ps, err = tunnel.ParsePorts(s)
+			if err != nil {
+				return
+			}
+			server.UserPorts[username] = tunnel.NewPortFilter(ps)
+		}
+	}
+	if cfg.QuotaFile != "" {
+		var store *tunnel.FileQuotaStore
+		store, err = tunnel.NewFileQuotaStore(cfg.QuotaFile)
+		if err != nil {
+			return
+		}
+		quotas := server.NewQuotas(store, cfg.QuotaTrickle)
+		defer quotas.Close()
+	}
+	if cfg.DestMax > 0 {
+		server.DestLimits = tunnel.NewDestLimits(
+			cfg.DestMax, time.Duration(cfg.DestWait)*time.Millisecond)
+	}
+	server.Admins = make(map[string]bool)
+	for _, username := range cfg.Admins {
+		server.Admins[username] = true
+	}
+	if cfg.FabricKey != "" {
+		server.Key, err = base64.StdEncoding.DecodeString(cfg.FabricKey)
+		if err != nil {
+			return
+		}
+		server.RekeyBytes = cfg.RekeyBytes
+		server.RekeyInterval = time.Duration(cfg.RekeyInterval) * time.Millisecond
+	}
 
 	if cfg.AdminIface != "" {
 		mux := http.NewServeMux()
@@ -68,3 +262,28 @@ func RunServer(cfg *ServerConfig) (err error) {
 
 	return server.Serve(listener)
 }
+
+// fallbackHandler proxies to s if it's an url, or serves files in it.
+func fallbackHandler(s string) (handler http.Handler, err error) {
+	if !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
+		return http.FileServer(http.Dir(s)), nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return
+	}
+	return httputil.NewSingleHostReverseProxy(u), nil
+}
+
+// reloadOnHup loads users in path again on each SIGHUP, fabrics alive
+// stay. users kept if file is bad.
+func reloadOnHup(ha *tunnel.HashAuthenticator, path string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		err := ha.LoadFile(path)
+		if err != nil {
+			logger.Errorf("reload users: %s", err.Error())
+		}
+	}
+}
@@ -5,11 +5,9 @@ import (
 	"crypto/x509"
 	"errors"
 	"io/ioutil"
-	"net"
 	"strings"
-	"time"
 
-	"github.com/shell909090/goproxy/netutil"
+	"github.com/shell909090/goproxy/tunnel"
 )
 
 var ErrLoadPEM = errors.New("certpool: append cert to pem failed")
@@ -47,13 +45,15 @@ func loadCertPool(caCerts string) (caCertPool *x509.CertPool, err error) {
 	return
 }
 
-func TlsListener(raw net.Listener, CertFile, CertKeyFile, RootCAs string) (wrapped net.Listener, err error) {
+// ServerTlsConfig is for tunnel.Server, client certs required if RootCAs
+// set.
+func ServerTlsConfig(CertFile, CertKeyFile, RootCAs string) (config *tls.Config, err error) {
 	cert, err := tls.LoadX509KeyPair(CertFile, CertKeyFile)
 	if err != nil {
 		return
 	}
 
-	config := &tls.Config{
+	config = &tls.Config{
 		Certificates:     []tls.Certificate{cert},
 		CipherSuites:     CipherSuites,
 		MinVersion:       tls.VersionTLS12,
@@ -67,22 +67,31 @@ func TlsListener(raw net.Listener, CertFile, CertKeyFile, RootCAs string) (wrapp
 		}
 		config.ClientAuth = tls.RequireAndVerifyClientCert
 	}
-
-	wrapped = tls.NewListener(raw, config)
 	return
 }
 
-type TlsDialer struct {
-	config *tls.Config
+// WebALPN is what web servers and browsers advertise in tls.
+var WebALPN = []string{"h2", "http/1.1"}
+
+// pinClientCerts requires client certs with fingerprints in pins, by ca
+// as well if ClientCAs set.
+func pinClientCerts(config *tls.Config, pins []string) (err error) {
+	config.VerifyConnection, err = tunnel.CertPins(pins...)
+	if config.ClientAuth != tls.RequireAndVerifyClientCert {
+		config.ClientAuth = tls.RequireAnyClientCert
+	}
+	return
 }
 
-func NewTlsDialer(CertFile, CertKeyFile, RootCAs string) (dialer netutil.Dialer, err error) {
+// ClientTlsConfig is for tunnel.DialerCreator, server verified by RootCAs
+// if set, or system roots.
+func ClientTlsConfig(CertFile, CertKeyFile, RootCAs string) (config *tls.Config, err error) {
 	cert, err := tls.LoadX509KeyPair(CertFile, CertKeyFile)
 	if err != nil {
 		return
 	}
 
-	config := &tls.Config{
+	config = &tls.Config{
 		Certificates:     []tls.Certificate{cert},
 		CipherSuites:     CipherSuites,
 		MinVersion:       tls.VersionTLS12,
@@ -95,16 +104,5 @@ func NewTlsDialer(CertFile, CertKeyFile, RootCAs string) (dialer netutil.Dialer,
 			return
 		}
 	}
-
-	dialer = &TlsDialer{config: config}
 	return
 }
-
-func (td *TlsDialer) Dial(network, address string) (net.Conn, error) {
-	return tls.Dial(network, address, td.config)
-}
-
-func (td *TlsDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
-	d := &net.Dialer{Timeout: timeout}
-	return tls.DialWithDialer(d, network, address, td.config)
-}
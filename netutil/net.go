@@ -1,6 +1,7 @@
 package netutil
 
 import (
+	"context"
 	"io"
 	"net"
 	"sync"
@@ -35,6 +36,38 @@ func CopyLink(dst, src io.ReadWriteCloser) {
 	io.CopyBuffer(dst, src, nil)
 }
 
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// CopyHalf copies both way like CopyLink, but the end of one way only
+// closes the writing side of the other, if it can, so reply after eof
+// still comes back. Both closed after both way ended, or any broken.
+func CopyHalf(dst, src io.ReadWriteCloser) {
+	half := func(to, from io.ReadWriteCloser) {
+		buf := BufferPool.Get().([]byte)
+		defer BufferPool.Put(buf)
+		_, err := io.CopyBuffer(to, from, buf)
+		if cw, ok := to.(closeWriter); ok && err == nil {
+			if cw.CloseWrite() == nil {
+				return
+			}
+		}
+		// wake up the other way.
+		to.Close()
+		from.Close()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		half(src, dst)
+	}()
+	half(dst, src)
+	<-done
+	dst.Close()
+	src.Close()
+}
+
 type Dialer interface {
 	Dial(string, string) (net.Conn, error)
 }
@@ -44,6 +77,11 @@ type TimeoutDialer interface {
 	DialTimeout(string, string, time.Duration) (net.Conn, error)
 }
 
+type ContextDialer interface {
+	Dialer
+	DialContext(context.Context, string, string) (net.Conn, error)
+}
+
 type TcpDialer struct {
 }
 
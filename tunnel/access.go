@@ -0,0 +1,167 @@
+package tunnel
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how a stream ended.
+const (
+	END_NONE = iota
+	// fin both ways.
+	END_FIN
+	// reset by us or peer.
+	END_RST
+	// reset for idle, or timeout in closing and dialing.
+	END_TIMEOUT
+	// dial failed, or the fabric is gone.
+	END_ERROR
+)
+
+type EndReason uint8
+
+func (e EndReason) String() string {
+	s, ok := EndText[uint8(e)]
+	if !ok {
+		return "unknown"
+	}
+	return s
+}
+
+var EndText = map[uint8]string{
+	END_NONE:    "none",
+	END_FIN:     "fin",
+	END_RST:     "rst",
+	END_TIMEOUT: "timeout",
+	END_ERROR:   "error",
+}
+
+// AccessRecord tells about a stream from peer after it finished.
+type AccessRecord struct {
+	// remote address of the fabric, and user authenticated on it.
+	Remote   string
+	Username string
+	// user is guest, see GuestAuthenticator.
+	Guest bool
+	// target in syn, and what it's rewritten to, empty if not.
+	Network   string
+	Address   string
+	Rewritten string
+	// address handler connected to, empty if not dialed.
+	Target string
+	// ACLs checked for target in order, and the rule decided.
+	ACL      Verdict
+	Start    time.Time
+	Duration time.Duration
+	// up is from peer to target.
+	BytesUp   uint64
+	BytesDown uint64
+	End       EndReason
+	// errno in rst or result, ERR_NONE if none.
+	Code uint32
+}
+
+// AccessLog calls fn with records in its own goroutine, so data path never
+// waits for it. Records over the queue are dropped.
+type AccessLog struct {
+	recordQueue[AccessRecord]
+}
+
+// NewAccessLog queues size records at most, ACCESS_LOG_QUEUE if 0.
+func NewAccessLog(fn func(rec AccessRecord), size int) (l *AccessLog) {
+	l = &AccessLog{}
+	l.start(fn, size)
+	return
+}
+
+// recordQueue delivers records of T to fn in its own goroutine, for
+// AccessLog and SessionLog.
+type recordQueue[T any] struct {
+	fn      func(rec T)
+	lock    sync.RWMutex
+	closed  bool
+	ch      chan T
+	done    chan struct{}
+	dropped uint64
+}
+
+func (q *recordQueue[T]) start(fn func(rec T), size int) {
+	if size <= 0 {
+		size = ACCESS_LOG_QUEUE
+	}
+	q.fn = fn
+	q.ch = make(chan T, size)
+	q.done = make(chan struct{})
+	go q.run()
+}
+
+func (q *recordQueue[T]) run() {
+	defer close(q.done)
+	for rec := range q.ch {
+		q.fn(rec)
+	}
+}
+
+// Log queues rec, never blocks.
+func (q *recordQueue[T]) Log(rec T) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.closed {
+		atomic.AddUint64(&q.dropped, 1)
+		return
+	}
+	select {
+	case q.ch <- rec:
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+	}
+}
+
+// Dropped returns how many records dropped for queue full or closed.
+func (q *recordQueue[T]) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// Close returns after records queued delivered.
+func (q *recordQueue[T]) Close() error {
+	q.lock.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.ch)
+	}
+	q.lock.Unlock()
+	<-q.done
+	return nil
+}
+
+// logAccess sends record of c to AccessLog, if c came from peer.
+func (fab *Fabric) logAccess(c *Conn) {
+	if fab.AccessLog == nil {
+		return
+	}
+	rec := AccessRecord{
+		Username: fab.Username,
+		Guest:    fab.Guest,
+	}
+	if addr := fab.RemoteAddr(); addr != nil {
+		rec.Remote = addr.String()
+	}
+	c.lock.Lock()
+	rec.Network, rec.Address = c.Network, c.Address
+	if c.asked != "" {
+		rec.Address, rec.Rewritten = c.asked, c.Address
+	}
+	if c.dialed_at != nil {
+		rec.Target = c.dialed_at.String()
+	}
+	rec.ACL = c.verdict
+	rec.Start, rec.Duration = c.created, time.Since(c.created)
+	rec.BytesUp, rec.BytesDown = c.recved, c.sent
+	rec.End, rec.Code = c.end, c.end_code
+	c.lock.Unlock()
+	if rec.End == END_NONE {
+		rec.End = END_ERROR
+	}
+	fab.AccessLog.Log(rec)
+}
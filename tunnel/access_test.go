@@ -0,0 +1,123 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAccessLogDrop(t *testing.T) {
+	block := make(chan struct{})
+	var got []AccessRecord
+	l := NewAccessLog(func(rec AccessRecord) {
+		<-block
+		got = append(got, rec)
+	}, 1)
+
+	// one in fn, one in queue, the others dropped without waiting.
+	for i := 0; i < 4; i++ {
+		l.Log(AccessRecord{Address: "x"})
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := l.Dropped(); n != 2 {
+		t.Fatalf("expect 2 dropped, got %d", n)
+	}
+	close(block)
+	l.Close()
+	if len(got) != 2 {
+		t.Fatalf("expect 2 delivered, got %d", len(got))
+	}
+	l.Log(AccessRecord{})
+	if n := l.Dropped(); n != 3 {
+		t.Fatalf("expect dropped after close, got %d", n)
+	}
+}
+
+// replySink reads request of n bytes, replies and closes.
+func replySink(t *testing.T, n int, reply string) (addr string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			io.ReadFull(conn, make([]byte, n))
+			conn.Write([]byte(reply))
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func nextRecord(t *testing.T, ch chan AccessRecord) (rec AccessRecord) {
+	select {
+	case rec = <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("no access record")
+	}
+	return
+}
+
+func TestAccessRecord(t *testing.T) {
+	addr := replySink(t, 5, "world!")
+	cli, srv := newConnPair(t)
+	ch := make(chan AccessRecord, 4)
+	l := NewAccessLog(func(rec AccessRecord) { ch <- rec }, 0)
+	defer l.Close()
+	srv.fab.Username = "alice"
+	srv.fab.AccessLog = l
+	client := &Client{Fabric: cli.fab}
+
+	conn, err := client.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello"))
+	data, err := io.ReadAll(conn)
+	if err != nil || string(data) != "world!" {
+		t.Fatalf("wrong reply %q: %v", data, err)
+	}
+	conn.Close()
+
+	rec := nextRecord(t, ch)
+	if rec.Username != "alice" || rec.Remote == "" || rec.Network != "tcp" ||
+		rec.Address != addr || rec.Target != addr {
+		t.Fatalf("wrong record: %+v", rec)
+	}
+	if rec.BytesUp != 5 || rec.BytesDown != 6 || rec.End != END_FIN || rec.Code != ERR_NONE {
+		t.Fatalf("wrong record: %+v", rec)
+	}
+	if rec.Start.IsZero() || rec.Duration <= 0 {
+		t.Fatalf("wrong time in record: %+v", rec)
+	}
+
+	// refused by handler.
+	RegisterNetwork("deny", denyHandler{})
+	client.Dial("deny", "pair")
+	rec = nextRecord(t, ch)
+	if rec.Network != "deny" || rec.Target != "" || rec.End != END_ERROR || rec.Code != ERR_CONNFAILED {
+		t.Fatalf("wrong record of denied: %+v", rec)
+	}
+
+	// reset by client.
+	conn, err = client.Dial("tcp", replySink(t, 1, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.(*Conn).Reset()
+	rec = nextRecord(t, ch)
+	if rec.End != END_RST || rec.Code != ERR_ABORT {
+		t.Fatalf("wrong record of reset: %+v", rec)
+	}
+
+	// stream of newConnPair still alive.
+	if len(ch) != 0 {
+		t.Fatalf("unexpected record: %+v", <-ch)
+	}
+}
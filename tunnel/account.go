@@ -0,0 +1,150 @@
+package tunnel
+
+import (
+	"sort"
+	"sync"
+)
+
+// UserLimits is what a user can hold at the same time, 0 means no limit.
+type UserLimits struct {
+	// streams from peer, in all fabrics of user.
+	MaxStreams int
+	// fabrics authed as user.
+	MaxFabrics int
+	// bytes both ways of streams from peer, 0 means no limit. counted by
+	// Quotas, over restarts if it has a store.
+	Quota uint64
+}
+
+// LimitAuthenticator tells limits of user in record of auth backend, asked
+// after password passed. Fabrics over limits are refused in auth with
+// ERR_TOOMANYFABRICS, and streams over limits with ERR_TOOMANYSTREAMS.
+type LimitAuthenticator interface {
+	Limits(username string) UserLimits
+	Accounts() *Accounts
+}
+
+// Accounts counts fabrics and streams by user, shared by fabrics of a
+// server. Zero value is ready to use.
+type Accounts struct {
+	lock  sync.Mutex
+	users map[string]*Account
+}
+
+// Account is usage of one user, Fabric counts streams in it. Methods of nil
+// Account count nothing and refuse nothing.
+type Account struct {
+	accounts *Accounts
+	username string
+	limits   UserLimits
+	streams  int
+	fabrics  int
+}
+
+// Usage is a snapshot of Account, for admin.
+type Usage struct {
+	Username string
+	UserLimits
+	Streams int
+	Fabrics int
+}
+
+func NewAccounts() *Accounts {
+	return &Accounts{}
+}
+
+// Admit counts a fabric of user, limits replaces those of fabrics before.
+// ErrTooManyFabrics if user holds MaxFabrics already. Release the account
+// after fabric closed.
+func (a *Accounts) Admit(username string, limits UserLimits) (acct *Account, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.users == nil {
+		a.users = make(map[string]*Account)
+	}
+	acct, ok := a.users[username]
+	if !ok {
+		acct = &Account{accounts: a, username: username}
+		a.users[username] = acct
+	}
+	acct.limits = limits
+	if limits.MaxFabrics > 0 && acct.fabrics >= limits.MaxFabrics {
+		a.drop(acct)
+		return nil, ErrTooManyFabrics
+	}
+	acct.fabrics++
+	return acct, nil
+}
+
+// SetLimits swaps limits of user online now, streams and fabrics over
+// them are kept, new ones refused. Users offline get limits in Admit.
+func (a *Accounts) SetLimits(username string, limits UserLimits) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if acct, ok := a.users[username]; ok {
+		acct.limits = limits
+	}
+}
+
+// Usage returns users online, by username.
+func (a *Accounts) Usage() (usages []Usage) {
+	a.lock.Lock()
+	for _, acct := range a.users {
+		usages = append(usages, Usage{
+			Username:   acct.username,
+			UserLimits: acct.limits,
+			Streams:    acct.streams,
+			Fabrics:    acct.fabrics,
+		})
+	}
+	a.lock.Unlock()
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].Username < usages[j].Username
+	})
+	return
+}
+
+// drop forgets user holds nothing, call with lock held.
+func (a *Accounts) drop(acct *Account) {
+	if acct.fabrics == 0 && acct.streams == 0 {
+		delete(a.users, acct.username)
+	}
+}
+
+// Release uncounts the fabric admitted.
+func (acct *Account) Release() {
+	if acct == nil {
+		return
+	}
+	a := acct.accounts
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	acct.fabrics--
+	a.drop(acct)
+}
+
+// addStream counts a stream from peer, false if over MaxStreams.
+func (acct *Account) addStream() bool {
+	if acct == nil {
+		return true
+	}
+	a := acct.accounts
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if acct.limits.MaxStreams > 0 && acct.streams >= acct.limits.MaxStreams {
+		return false
+	}
+	acct.streams++
+	return true
+}
+
+func (acct *Account) doneStream() {
+	if acct == nil {
+		return
+	}
+	a := acct.accounts
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	acct.streams--
+	a.drop(acct)
+}
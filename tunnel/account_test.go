@@ -0,0 +1,135 @@
+package tunnel
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// limitAuth gives the same limits to all users.
+type limitAuth struct {
+	limits   UserLimits
+	accounts *Accounts
+}
+
+func (limitAuth) AuthPass(string, string) bool { return true }
+func (la *limitAuth) Limits(string) UserLimits { return la.limits }
+func (la *limitAuth) Accounts() *Accounts      { return la.accounts }
+
+func TestAccounts(t *testing.T) {
+	a := NewAccounts()
+	limits := UserLimits{MaxStreams: 2, MaxFabrics: 1}
+	acct, err := a.Admit("alice", limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.Admit("alice", limits); err != ErrTooManyFabrics {
+		t.Fatalf("expect too many fabrics, got %v", err)
+	}
+	bob, err := a.Admit("bob", UserLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acct.addStream() || !acct.addStream() || acct.addStream() {
+		t.Fatal("wrong stream limit")
+	}
+	usages := a.Usage()
+	if len(usages) != 2 || usages[0] != (Usage{"alice", limits, 2, 1}) {
+		t.Fatalf("wrong usage %+v", usages)
+	}
+
+	// swapped online.
+	a.SetLimits("alice", UserLimits{MaxStreams: 3})
+	if !acct.addStream() {
+		t.Fatal("new limit not applied")
+	}
+
+	// streams outlive fabric, user kept until all gone.
+	acct.Release()
+	bob.Release()
+	if usages = a.Usage(); len(usages) != 1 || usages[0].Streams != 3 {
+		t.Fatalf("wrong usage %+v", usages)
+	}
+	for i := 0; i < 3; i++ {
+		acct.doneStream()
+	}
+	if usages = a.Usage(); len(usages) != 0 {
+		t.Fatalf("users left %+v", usages)
+	}
+
+	// nil account counts nothing.
+	var none *Account
+	if !none.addStream() {
+		t.Fatal("nil account refused")
+	}
+	none.doneStream()
+	none.Release()
+}
+
+func TestAccountLimits(t *testing.T) {
+	SetLogging()
+	la := &limitAuth{limits: UserLimits{MaxStreams: 1, MaxFabrics: 1}, accounts: NewAccounts()}
+	pd := &pipeDialer{auth: la, ch_err: make(chan error, 1)}
+	dc := NewDialerCreator(pd, "pipe", "pipe", "user", "secret")
+	// limitAuth can't challenge.
+	dc.Plaintext = true
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-pd.ch_err; err != nil {
+		t.Fatal(err)
+	}
+	go client.Loop()
+
+	// the second fabric refused in auth.
+	_, err = dc.Create()
+	if !errors.Is(err, ErrTooManyFabrics) {
+		t.Fatalf("expect too many fabrics, got %v", err)
+	}
+	<-pd.ch_err
+
+	c, err := client.Dial("test", "one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := <-accepted
+	if _, err = client.Dial("test", "two"); !errors.Is(err, ErrTooManyStreams) {
+		t.Fatalf("expect too many streams, got %v", err)
+	}
+	if u := la.accounts.Usage(); len(u) != 1 || u[0].Streams != 1 || u[0].Fabrics != 1 {
+		t.Fatalf("wrong usage %+v", u)
+	}
+
+	// place freed after closed.
+	c.Close()
+	srv.Close()
+	for i := 0; i < 100; i++ {
+		if u := la.accounts.Usage(); len(u) == 1 && u[0].Streams == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c, err = client.Dial("test", "three")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv = <-accepted
+	c.Close()
+	srv.Close()
+
+	// fabric gone, user can come again.
+	client.Close()
+	for i := 0; i < 100; i++ {
+		if len(la.accounts.Usage()) == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client, err = dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-pd.ch_err
+	client.Close()
+}
@@ -0,0 +1,506 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Rule matches targets with all conditions set, empty ones match anything.
+type Rule struct {
+	// shows in access log, index in Rules if empty.
+	Name string
+	// streams of users named, or in one of groups, checked in ACLs only.
+	// rules with them never match if user unknown, like in Allow.
+	Users  []string
+	Groups []string
+	// "tcp" or "udp", tcp4 and tcp6 count as tcp.
+	Network string
+	// ip of target in one of them.
+	Nets []*net.IPNet
+	// host asked for is one of them, or under it. targets asked by ip
+	// never match.
+	Domains []string
+	// port of target in [PortMin, PortMax], PortMax 0 means PortMin only.
+	PortMin int
+	PortMax int
+	// unix socket path of target is one of them, or under one ends with
+	// "/". Rules with Paths only match unix targets, and only they do.
+	Paths []string
+	Deny  bool
+	// conns to each destination matched, overrides Max of DestLimits.
+	// negative means no limit, so important ones can be exempted.
+	MaxPerDest int
+
+	hits uint64
+}
+
+// Hits returns how many targets matched it.
+func (r *Rule) Hits() uint64 {
+	return atomic.LoadUint64(&r.hits)
+}
+
+func (r *Rule) match(network, name string, ip net.IP, port int) bool {
+	if len(r.Paths) != 0 {
+		return false
+	}
+	if r.Network != "" && !strings.HasPrefix(network, r.Network) {
+		return false
+	}
+	if r.PortMin != 0 {
+		max := r.PortMax
+		if max == 0 {
+			max = r.PortMin
+		}
+		if port < r.PortMin || port > max {
+			return false
+		}
+	}
+	if len(r.Nets) != 0 && !containsIP(r.Nets, ip) {
+		return false
+	}
+	if len(r.Domains) != 0 && !underDomains(r.Domains, name) {
+		return false
+	}
+	return true
+}
+
+func (r *Rule) matchUser(who *UserInfo) bool {
+	if len(r.Users) == 0 && len(r.Groups) == 0 {
+		return true
+	}
+	if who == nil {
+		return false
+	}
+	for _, u := range r.Users {
+		if u == who.Username {
+			return true
+		}
+	}
+	for _, g := range r.Groups {
+		for _, g1 := range who.Groups {
+			if g == g1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchPath(path string) bool {
+	path = filepath.Clean(path)
+	for _, p := range r.Paths {
+		if strings.HasSuffix(p, "/") {
+			if strings.HasPrefix(path, p) {
+				return true
+			}
+		} else if path == filepath.Clean(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func underDomains(domains []string, name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return false
+	}
+	for _, d := range domains {
+		d = strings.ToLower(strings.Trim(d, "."))
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDRs parses nets for Rule.
+func ParseCIDRs(cidrs ...string) (nets []*net.IPNet, err error) {
+	for _, s := range cidrs {
+		var n *net.IPNet
+		_, n, err = net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+// ACL checks targets by Rules in order, first matched one decides.
+// Don't change it after given to Guard, make a new one.
+type ACL struct {
+	Rules []*Rule
+	// for targets matched nothing.
+	DefaultDeny bool
+
+	default_hits uint64
+}
+
+// DefaultHits returns how many targets matched no rule.
+func (acl *ACL) DefaultHits() uint64 {
+	return atomic.LoadUint64(&acl.default_hits)
+}
+
+// Allow tells if target can be dialed. name is the host asked for, empty
+// if asked by ip. Matched rule, nil for default, is counted. Rules of users
+// never match here.
+func (acl *ACL) Allow(network, name string, ip net.IP, port int) (r *Rule, ok bool) {
+	return acl.AllowUser(nil, network, name, ip, port)
+}
+
+// AllowUser works like Allow, for stream of who.
+func (acl *ACL) AllowUser(who *UserInfo, network, name string, ip net.IP, port int) (r *Rule, ok bool) {
+	i := acl.find(who, network, name, ip, port)
+	if i < 0 {
+		atomic.AddUint64(&acl.default_hits, 1)
+		return nil, !acl.DefaultDeny
+	}
+	r = acl.Rules[i]
+	atomic.AddUint64(&r.hits, 1)
+	return r, !r.Deny
+}
+
+// find returns index of the first rule matched, -1 if none. not counted.
+func (acl *ACL) find(who *UserInfo, network, name string, ip net.IP, port int) int {
+	for i, r := range acl.Rules {
+		if r.match(network, name, ip, port) && r.matchUser(who) {
+			return i
+		}
+	}
+	return -1
+}
+
+// AllowPath tells if unix socket at path can be dialed, by rules with Paths.
+// Paths matched nothing are denied, whatever DefaultDeny says.
+func (acl *ACL) AllowPath(path string) (r *Rule, ok bool) {
+	i := acl.findPath(nil, path)
+	if i < 0 {
+		atomic.AddUint64(&acl.default_hits, 1)
+		return nil, false
+	}
+	r = acl.Rules[i]
+	atomic.AddUint64(&r.hits, 1)
+	return r, !r.Deny
+}
+
+func (acl *ACL) findPath(who *UserInfo, path string) int {
+	for i, r := range acl.Rules {
+		if r.matchPath(path) && r.matchUser(who) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Verdict tells how ACLs decided a target, for access log. Zero if no ACL.
+type Verdict struct {
+	// ACLs checked in order, "user" before "global".
+	Order []string
+	// ACL decided, and the rule in it by Name, "#" and index in Rules if no
+	// name, or "default" if matched none.
+	ACL  string
+	Rule string
+	Deny bool
+}
+
+func (v Verdict) String() string {
+	if v.ACL == "" {
+		return ""
+	}
+	s := strings.Join(v.Order, ">") + " " + v.ACL + ":" + v.Rule
+	if v.Deny {
+		return s + " deny"
+	}
+	return s + " allow"
+}
+
+// policy checks targets of who by ACL of user first, then the global one.
+// rule matched in ACL of user decides, default of it only if DefaultDeny,
+// or no global one.
+type policy struct {
+	who    UserInfo
+	user   *ACL
+	global *ACL
+}
+
+func (p *policy) empty() bool {
+	return p.user == nil && p.global == nil
+}
+
+// decide counts and returns verdict by index of rule matched in acl, -1 for
+// default. final tells if default of it decides.
+func (p *policy) decide(v *Verdict, scope string, acl *ACL, i int, final bool, deny bool) bool {
+	v.Order = append(v.Order, scope)
+	if i < 0 && !final {
+		return false
+	}
+	v.ACL, v.Deny = scope, deny
+	if i < 0 {
+		atomic.AddUint64(&acl.default_hits, 1)
+		v.Rule = "default"
+		return true
+	}
+	r := acl.Rules[i]
+	atomic.AddUint64(&r.hits, 1)
+	v.Rule, v.Deny = r.Name, r.Deny
+	if v.Rule == "" {
+		v.Rule = "#" + strconv.Itoa(i)
+	}
+	return true
+}
+
+func (p *policy) allow(network, name string, ip net.IP, port int) (v Verdict) {
+	if p.user != nil {
+		i := p.user.find(&p.who, network, name, ip, port)
+		final := p.user.DefaultDeny || p.global == nil
+		if p.decide(&v, "user", p.user, i, final, p.user.DefaultDeny) {
+			return
+		}
+	}
+	if p.global != nil {
+		i := p.global.find(&p.who, network, name, ip, port)
+		p.decide(&v, "global", p.global, i, true, p.global.DefaultDeny)
+	}
+	return
+}
+
+// allowPath works like allow, paths matched nothing are denied.
+func (p *policy) allowPath(path string) (v Verdict) {
+	if p.user != nil {
+		i := p.user.findPath(&p.who, path)
+		if p.decide(&v, "user", p.user, i, p.global == nil, true) {
+			return
+		}
+	}
+	if p.global != nil {
+		p.decide(&v, "global", p.global, p.global.findPath(&p.who, path), true, true)
+	}
+	return
+}
+
+// destMax returns MaxPerDest of the first rule matched, in ACL of user
+// then global one, not counted in hits.
+func (p *policy) destMax(network, name string, ip net.IP, port int) int {
+	for _, acl := range []*ACL{p.user, p.global} {
+		if acl == nil {
+			continue
+		}
+		if i := acl.find(&p.who, network, name, ip, port); i >= 0 {
+			return acl.Rules[i].MaxPerDest
+		}
+	}
+	return 0
+}
+
+// Guard holds the ACL in use, it can be swapped when streams dialing.
+// Zero value allows everything.
+type Guard struct {
+	acl atomic.Pointer[ACL]
+}
+
+func NewGuard(acl *ACL) (g *Guard) {
+	g = &Guard{}
+	g.Set(acl)
+	return
+}
+
+// Set takes acl for dials after it, nil allows everything.
+func (g *Guard) Set(acl *ACL) {
+	g.acl.Store(acl)
+}
+
+func (g *Guard) Get() *ACL {
+	return g.acl.Load()
+}
+
+// Resolve checks target by ACL, returns address to dial. Names are resolved
+// here, so the ip checked is the one dialed. ErrDenied if not allowed.
+func (g *Guard) Resolve(ctx context.Context, network, address string) (dial string, err error) {
+	if g.Get() == nil {
+		return address, nil
+	}
+	addrs, err := g.ResolveAll(ctx, net.DefaultResolver, network, address)
+	if err != nil {
+		return
+	}
+	return addrs[0], nil
+}
+
+// ResolveAll works like Resolve, names resolved by r, all addresses allowed
+// returned in order of r. Names are resolved even if no ACL, nil Guard
+// allows everything.
+func (g *Guard) ResolveAll(ctx context.Context, r IPResolver, network, address string) (addrs []string, err error) {
+	p := policy{}
+	if g != nil {
+		p.global = g.Get()
+	}
+	addrs, _, err = p.resolve(ctx, r, network, address)
+	return
+}
+
+// resolve returns addresses allowed, and verdict of the first one, or of the
+// first denied if none.
+func (p *policy) resolve(ctx context.Context, r IPResolver, network, address string) (addrs []string, v Verdict, err error) {
+	host, sport, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	port, err := strconv.Atoi(sport)
+	if err != nil {
+		return
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if v = p.allow(network, "", ip, port); v.Deny {
+			return nil, v, ErrDenied
+		}
+		return []string{address}, v, nil
+	}
+
+	ipnet := "ip"
+	if strings.HasSuffix(network, "4") || strings.HasSuffix(network, "6") {
+		ipnet += network[len(network)-1:]
+	}
+	ips, err := r.LookupIP(ctx, ipnet, host)
+	if err != nil {
+		return
+	}
+	for i, ip := range ips {
+		v1 := p.allow(network, host, ip, port)
+		if i == 0 || len(addrs) == 0 && !v1.Deny {
+			v = v1
+		}
+		if !v1.Deny {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), sport))
+		}
+	}
+	switch {
+	case len(addrs) != 0:
+	case len(ips) != 0:
+		return nil, v, ErrDenied
+	default:
+		return nil, v, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return
+}
+
+// CheckPath returns ErrDenied if unix socket at path not allowed. No ACL
+// allows none, unlike ip targets.
+func (g *Guard) CheckPath(path string) error {
+	if g == nil || g.Get() == nil {
+		return ErrDenied
+	}
+	if _, ok := g.Get().AllowPath(path); !ok {
+		return ErrDenied
+	}
+	return nil
+}
+
+// policy returns ACLs of fabric in use now, so streams after a swap see the
+// new ones.
+func (fab *Fabric) policy() (p policy) {
+	p.who = UserInfo{Username: fab.Username, Groups: fab.Groups}
+	if fab.UserGuard != nil {
+		p.user = fab.UserGuard.Get()
+	}
+	if fab.Guard != nil {
+		p.global = fab.Guard.Get()
+	}
+	return
+}
+
+// checkPath returns ErrDenied if unix socket at path not allowed by ACLs of
+// fabric, none allows nothing.
+func (fab *Fabric) checkPath(path string) (v Verdict, err error) {
+	p := fab.policy()
+	if v = p.allowPath(path); v.ACL == "" || v.Deny {
+		return v, ErrDenied
+	}
+	return
+}
+
+// resolver returns Resolver of fabric, net.DefaultResolver if not set.
+func (fab *Fabric) resolver() IPResolver {
+	if fab.Resolver != nil {
+		return fab.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// isPrivate tells if ip is loopback, link-local, RFC 1918 or unspecified.
+func isPrivate(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified()
+}
+
+// ownIP tells if ip is where fabric connected to us, or Bind of it.
+func (fab *Fabric) ownIP(ip net.IP) bool {
+	if fab.Bind != nil && fab.Bind.Equal(ip) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(fab.Conn.LocalAddr().String())
+	if err != nil {
+		return false
+	}
+	return ip.Equal(net.ParseIP(host))
+}
+
+// resolveTarget resolves target by UserGuard and Guard of fabric, and
+// refuses all if one address is private when DenyPrivate. names resolved to
+// both are likely rebinding.
+func (fab *Fabric) resolveTarget(ctx context.Context, network, address string) (addrs []string, v Verdict, err error) {
+	err = fab.checkPort(network, address)
+	if err != nil {
+		return
+	}
+	p := fab.policy()
+	addrs, v, err = p.resolve(ctx, fab.resolver(), network, address)
+	if err != nil || !fab.DenyPrivate {
+		return
+	}
+	for _, addr := range addrs {
+		host, _, _ := net.SplitHostPort(addr)
+		ip := net.ParseIP(host)
+		if isPrivate(ip) || fab.ownIP(ip) {
+			logger.Noticef("%s %s:%s resolved to private %s, denied.",
+				fab.String(), network, address, host)
+			return nil, v, ErrDenied
+		}
+	}
+	return
+}
+
+// checkTarget returns where the stream should dial, by ports, ACLs and
+// DenyPrivate of fabric.
+func (fab *Fabric) checkTarget(network, address string) (dial string, v Verdict, err error) {
+	err = fab.checkPort(network, address)
+	if err != nil {
+		return
+	}
+	if p := fab.policy(); !fab.DenyPrivate && p.empty() {
+		return address, v, nil
+	}
+	ctx, cancel := context.WithTimeout(
+		context.Background(), DIAL_TIMEOUT*time.Millisecond)
+	defer cancel()
+	addrs, v, err := fab.resolveTarget(ctx, network, address)
+	if err == nil {
+		dial = addrs[0]
+	}
+	return
+}
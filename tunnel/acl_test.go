@@ -0,0 +1,310 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func mustCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	nets, err := ParseCIDRs(cidrs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
+
+func testACL(t *testing.T) *ACL {
+	return &ACL{
+		Rules: []*Rule{
+			{Nets: mustCIDRs(t, "127.0.0.0/8", "::1/128"), Deny: true},
+			{Network: "tcp", PortMin: 25, Deny: true},
+			{Domains: []string{".internal.test"}, Deny: true},
+			{Nets: mustCIDRs(t, "10.1.0.0/16")},
+			{Nets: mustCIDRs(t, "10.0.0.0/8", "192.168.0.0/16"), Deny: true},
+			{Network: "udp", PortMin: 5000, PortMax: 5999, Deny: true},
+		},
+	}
+}
+
+func TestACLAllow(t *testing.T) {
+	acl := testACL(t)
+	for _, c := range []struct {
+		network, name, ip string
+		port              int
+		rule              int
+		allow             bool
+	}{
+		{"tcp", "", "127.0.0.1", 80, 0, false},
+		{"tcp6", "", "::1", 80, 0, false},
+		{"tcp4", "", "8.8.8.8", 25, 1, false},
+		{"udp", "", "8.8.8.8", 25, -1, true},
+		{"tcp", "db.Internal.test.", "8.8.8.8", 443, 2, false},
+		{"tcp", "internal.test", "8.8.8.8", 443, 2, false},
+		{"tcp", "xinternal.test", "8.8.8.8", 443, -1, true},
+		{"tcp", "", "10.1.2.3", 22, 3, true},
+		{"tcp", "", "10.2.2.3", 22, 4, false},
+		{"udp", "", "8.8.8.8", 5500, 5, false},
+		{"udp", "", "8.8.8.8", 6000, -1, true},
+	} {
+		r, allow := acl.Allow(c.network, c.name, net.ParseIP(c.ip), c.port)
+		var expect *Rule
+		if c.rule >= 0 {
+			expect = acl.Rules[c.rule]
+		}
+		if r != expect || allow != c.allow {
+			t.Errorf("%+v: got rule %v, allow %v", c, r, allow)
+		}
+	}
+	if n := acl.Rules[0].Hits(); n != 2 {
+		t.Fatalf("expect 2 hits, got %d", n)
+	}
+	if n := acl.DefaultHits(); n != 3 {
+		t.Fatalf("expect 3 default hits, got %d", n)
+	}
+
+	acl.DefaultDeny = true
+	if _, allow := acl.Allow("tcp", "", net.ParseIP("8.8.8.8"), 80); allow {
+		t.Fatal("default deny not applied")
+	}
+}
+
+func TestGuardResolve(t *testing.T) {
+	ctx := context.Background()
+	g := &Guard{}
+	if dial, err := g.Resolve(ctx, "tcp", "localhost:80"); err != nil || dial != "localhost:80" {
+		t.Fatalf("empty guard should allow: %s %v", dial, err)
+	}
+
+	g.Set(testACL(t))
+	// names checked by where they go.
+	if _, err := g.Resolve(ctx, "tcp", "localhost:80"); err != ErrDenied {
+		t.Fatalf("expect denied, got %v", err)
+	}
+	if dial, err := g.Resolve(ctx, "tcp", "8.8.8.8:53"); err != nil || dial != "8.8.8.8:53" {
+		t.Fatalf("expect allowed, got %s %v", dial, err)
+	}
+
+	// swapped at runtime.
+	g.Set(&ACL{DefaultDeny: true})
+	if _, err := g.Resolve(ctx, "tcp", "8.8.8.8:53"); err != ErrDenied {
+		t.Fatalf("expect denied, got %v", err)
+	}
+}
+
+func TestGuardDenyDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	cli, srv := newConnPair(t)
+	g := &Guard{}
+	srv.fab.Guard = g
+	client := &Client{Fabric: cli.fab}
+
+	conn, err := client.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	acl := testACL(t)
+	g.Set(acl)
+	_, err = client.Dial("tcp", ln.Addr().String())
+	if !errors.Is(err, ErrDenied) {
+		t.Fatalf("expect denied, got %v", err)
+	}
+	if n := acl.Rules[0].Hits(); n != 1 {
+		t.Fatalf("expect 1 hit, got %d", n)
+	}
+}
+
+// rebindResolver gives a public address with loopback.
+type rebindResolver struct{}
+
+func (rebindResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	return []net.IP{net.ParseIP("93.184.216.34"), net.ParseIP("127.0.0.1")}, nil
+}
+
+func TestDenyPrivate(t *testing.T) {
+	echo := tcpEcho(t)
+	cli, srv := newConnPair(t)
+	srv.fab.DenyPrivate = true
+	srv.fab.Resolver = fakeResolver{"public.test": "93.184.216.34"}
+	client := &Client{Fabric: cli.fab}
+
+	for _, network := range []string{"tcp", "udp"} {
+		_, err := client.Dial(network, echo)
+		if !errors.Is(err, ErrDenied) {
+			t.Fatalf("%s: expect denied, got %v", network, err)
+		}
+	}
+
+	ctx := context.Background()
+	srv.fab.Bind = net.ParseIP("93.184.216.35")
+	for _, c := range []struct {
+		address string
+		ok      bool
+	}{
+		{"public.test:80", true},
+		{"8.8.8.8:53", true},
+		{"10.1.2.3:80", false},
+		{"169.254.169.254:80", false},
+		{"[::1]:80", false},
+		{"[fe80::1]:80", false},
+		{"0.0.0.0:80", false},
+		// bound to, ours.
+		{"93.184.216.35:80", false},
+	} {
+		_, _, err := srv.fab.resolveTarget(ctx, "tcp", c.address)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: wrong result %v", c.address, err)
+		}
+	}
+
+	// any private one refuses the name.
+	srv.fab.Resolver = rebindResolver{}
+	if _, _, err := srv.fab.resolveTarget(ctx, "tcp", "rebind.test:80"); err != ErrDenied {
+		t.Fatalf("expect denied, got %v", err)
+	}
+}
+
+func TestUserACL(t *testing.T) {
+	global := &ACL{
+		Rules: []*Rule{
+			{Name: "admins", Groups: []string{"admin"}},
+			{Name: "private", Nets: mustCIDRs(t, "10.0.0.0/8"), Deny: true},
+			{Nets: mustCIDRs(t, "1.1.1.0/24"), Deny: true},
+		},
+	}
+	// falls to global if matched nothing.
+	bob := &ACL{
+		Rules: []*Rule{
+			{Name: "no-dns", Nets: mustCIDRs(t, "8.8.8.8/32"), Deny: true},
+			{Nets: mustCIDRs(t, "1.1.1.0/24")},
+		},
+	}
+	contractor := &ACL{
+		Rules: []*Rule{
+			{Name: "web", Network: "tcp", PortMin: 80, PortMax: 443,
+				Domains: []string{"example.test"}},
+		},
+		DefaultDeny: true,
+	}
+	for _, c := range []struct {
+		who     UserInfo
+		user    *ACL
+		name    string
+		ip      string
+		port    int
+		verdict string
+	}{
+		// global allows, user denies, and the reverse.
+		{UserInfo{Username: "bob"}, bob, "", "8.8.8.8", 53, "user user:no-dns deny"},
+		{UserInfo{Username: "bob"}, bob, "", "1.1.1.1", 80, "user user:#1 allow"},
+		{UserInfo{Username: "bob"}, bob, "", "10.1.1.1", 80, "user>global global:private deny"},
+		{UserInfo{Username: "bob"}, bob, "", "9.9.9.9", 80, "user>global global:default allow"},
+		{UserInfo{Username: "eve"}, contractor, "www.example.test", "9.9.9.9", 443, "user user:web allow"},
+		{UserInfo{Username: "eve"}, contractor, "www.example.test", "9.9.9.9", 22, "user user:default deny"},
+		{UserInfo{Username: "eve"}, contractor, "", "9.9.9.9", 80, "user user:default deny"},
+		// rules by group.
+		{UserInfo{Username: "root", Groups: []string{"ops", "admin"}}, nil, "", "10.1.1.1", 80, "global global:admins allow"},
+		{UserInfo{Username: "carol", Groups: []string{"ops"}}, nil, "", "10.1.1.1", 80, "global global:private deny"},
+	} {
+		p := policy{who: c.who, user: c.user, global: global}
+		v := p.allow("tcp", c.name, net.ParseIP(c.ip), c.port)
+		if v.String() != c.verdict {
+			t.Errorf("%s %s %s:%d: got %q", c.who.Username, c.name, c.ip, c.port, v)
+		}
+	}
+
+	// rules by group never match without user.
+	if r, _ := global.Allow("tcp", "", net.ParseIP("10.1.1.1"), 80); r != global.Rules[1] {
+		t.Fatalf("rule of group matched without user: %+v", r)
+	}
+	// default of user decides, without global.
+	p := policy{who: UserInfo{Username: "bob"}, user: bob}
+	if v := p.allow("tcp", "", net.ParseIP("9.9.9.9"), 80); v.String() != "user user:default allow" {
+		t.Fatalf("got %q", v)
+	}
+	if n := global.Rules[1].Hits(); n != 3 {
+		t.Fatalf("expect 3 hits, got %d", n)
+	}
+}
+
+// aclAuth passes everyone in groups, rules by g.
+type aclAuth struct {
+	groups []string
+	g      *Guard
+}
+
+func (aa aclAuth) Auth(username, password string) (UserInfo, error) {
+	return UserInfo{Username: username, Groups: aa.groups}, nil
+}
+
+func (aa aclAuth) UserGuard(username string) *Guard {
+	return aa.g
+}
+
+func TestUserGuard(t *testing.T) {
+	SetLogging()
+	g := &Guard{}
+	as := newAuthServer(aclAuth{[]string{"ops"}, g}, 0)
+	dc := NewDialerCreator(as, "pipe", "pipe", "bob", "secret")
+	dc.Plaintext = true
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if info := <-as.ch; info.UserGuard != g || len(info.Groups) != 1 || info.Groups[0] != "ops" {
+		t.Fatalf("rules of user not given: %+v", info)
+	}
+
+	echo := tcpEcho(t)
+	cli, srv := newConnPair(t)
+	ch := make(chan AccessRecord, 4)
+	l := NewAccessLog(func(rec AccessRecord) { ch <- rec }, 0)
+	defer l.Close()
+	srv.fab.Username = "bob"
+	srv.fab.Guard = NewGuard(&ACL{})
+	srv.fab.UserGuard = g
+	srv.fab.AccessLog = l
+	tc := &Client{Fabric: cli.fab}
+
+	conn, err := tc.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// swapped for new streams only.
+	g.Set(&ACL{Rules: []*Rule{{Name: "no-loop", Nets: mustCIDRs(t, "127.0.0.0/8"), Deny: true}}})
+	if _, err = tc.Dial("tcp", echo); !errors.Is(err, ErrDenied) {
+		t.Fatalf("expect denied, got %v", err)
+	}
+	if err = pingConn(conn); err != nil {
+		t.Fatalf("stream alive should go on: %v", err)
+	}
+	rec := nextRecord(t, ch)
+	if rec.ACL.String() != "user user:no-loop deny" {
+		t.Fatalf("wrong acl in record: %+v", rec.ACL)
+	}
+	conn.Close()
+	rec = nextRecord(t, ch)
+	if rec.ACL.String() != "global global:default allow" {
+		t.Fatalf("wrong acl in record: %+v", rec.ACL)
+	}
+}
@@ -0,0 +1,326 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// Datagrams in udp associate streams are socks5 udp requests as is:
+// rsv(2), frag, atyp, addr, port, data. Server replies with the same
+// header, address of where it came from.
+const (
+	ATYP_IPV4   = 0x01
+	ATYP_DOMAIN = 0x03
+	ATYP_IPV6   = 0x04
+)
+
+// parseUdpHeader returns target and length of header.
+func parseUdpHeader(b []byte) (addr string, hlen int, err error) {
+	if len(b) < 4 || b[2] != 0 {
+		// fragments not supported.
+		return "", 0, ErrUdpHeader
+	}
+	var host string
+	switch b[3] {
+	case ATYP_IPV4:
+		hlen = 4 + net.IPv4len
+		if len(b) < hlen+2 {
+			return "", 0, ErrUdpHeader
+		}
+		host = net.IP(b[4:hlen]).String()
+	case ATYP_IPV6:
+		hlen = 4 + net.IPv6len
+		if len(b) < hlen+2 {
+			return "", 0, ErrUdpHeader
+		}
+		host = net.IP(b[4:hlen]).String()
+	case ATYP_DOMAIN:
+		if len(b) < 5 {
+			return "", 0, ErrUdpHeader
+		}
+		hlen = 5 + int(b[4])
+		if len(b) < hlen+2 {
+			return "", 0, ErrUdpHeader
+		}
+		host = string(b[5:hlen])
+	default:
+		return "", 0, ErrUdpHeader
+	}
+	port := binary.BigEndian.Uint16(b[hlen:])
+	hlen += 2
+	addr = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	return
+}
+
+func appendUdpHeader(b []byte, addr *net.UDPAddr) []byte {
+	b = append(b, 0, 0, 0)
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b = append(b, ATYP_IPV4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, ATYP_IPV6)
+		b = append(b, addr.IP.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(addr.Port))
+}
+
+// natEntry is one side of association, closed after idle.
+type natEntry struct {
+	net.Conn
+	last int64
+}
+
+func (e *natEntry) touch() {
+	atomic.StoreInt64(&e.last, time.Now().UnixNano())
+}
+
+func (e *natEntry) idle(now time.Time, timeout time.Duration) bool {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&e.last))) > timeout
+}
+
+// natTable keeps entries by key, swept every half timeout.
+type natTable struct {
+	lock    sync.Mutex
+	entries map[string]*natEntry
+	max     int
+	timeout time.Duration
+	closed  bool
+}
+
+func newNatTable(max int, timeout time.Duration) (t *natTable) {
+	if timeout == 0 {
+		timeout = UDP_IDLE_TIMEOUT * time.Millisecond
+	}
+	t = &natTable{
+		entries: make(map[string]*natEntry),
+		max:     max,
+		timeout: timeout,
+	}
+	go t.sweep()
+	return
+}
+
+// get returns entry of key, created by open if not there. nil if table
+// full or closed.
+func (t *natTable) get(key string, open func() (net.Conn, error)) (e *natEntry, created bool, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return nil, false, net.ErrClosed
+	}
+	if e = t.entries[key]; e != nil {
+		e.touch()
+		return
+	}
+	if len(t.entries) >= t.max {
+		return nil, false, ErrTooManyStreams
+	}
+	conn, err := open()
+	if err != nil {
+		return
+	}
+	e = &natEntry{Conn: conn}
+	e.touch()
+	t.entries[key] = e
+	return e, true, nil
+}
+
+// remove closes entry, if it is still on key.
+func (t *natTable) remove(key string, e *natEntry) {
+	t.lock.Lock()
+	if t.entries[key] == e {
+		delete(t.entries, key)
+	}
+	t.lock.Unlock()
+	e.Close()
+}
+
+func (t *natTable) sweep() {
+	ticker := time.NewTicker(t.timeout / 2)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		var idle []*natEntry
+		t.lock.Lock()
+		if t.closed {
+			t.lock.Unlock()
+			return
+		}
+		for key, e := range t.entries {
+			if e.idle(now, t.timeout) {
+				delete(t.entries, key)
+				idle = append(idle, e)
+			}
+		}
+		t.lock.Unlock()
+		for _, e := range idle {
+			e.Close()
+		}
+	}
+}
+
+func (t *natTable) Close() {
+	t.lock.Lock()
+	t.closed = true
+	entries := t.entries
+	t.entries = nil
+	t.lock.Unlock()
+	for _, e := range entries {
+		e.Close()
+	}
+}
+
+// UdpAssociate handles ASSOC_NETWORK syn, each target in stream gets a udp
+// socket of its own.
+type UdpAssociate struct {
+	// targets without datagram either way are closed, UDP_IDLE_TIMEOUT
+	// if 0.
+	IdleTimeout time.Duration
+	// targets of one stream at the same time, datagrams to more are
+	// dropped. ASSOC_MAX_TARGETS if 0.
+	MaxTargets int
+}
+
+func (p *UdpAssociate) Handle(fabconn net.Conn) (err error) {
+	c, ok := fabconn.(*Conn)
+	if !ok {
+		panic("proxy with no fab conn.")
+	}
+	err = c.Accept()
+	if err != nil {
+		return
+	}
+	go p.serve(NewDgramConn(c))
+	return
+}
+
+func (p *UdpAssociate) serve(d *DgramConn) {
+	max := p.MaxTargets
+	if max == 0 {
+		max = ASSOC_MAX_TARGETS
+	}
+	targets := newNatTable(max, p.IdleTimeout)
+	defer d.Close()
+	defer targets.Close()
+	buf := make([]byte, MAX_DGRAM)
+	for {
+		n, err := d.ReadMsg(buf)
+		if err != nil {
+			return
+		}
+		addr, hlen, err := parseUdpHeader(buf[:n])
+		if err != nil {
+			logger.Info(err.Error())
+			continue
+		}
+		e, created, err := targets.get(addr, func() (net.Conn, error) {
+			c := d.Conn.(*Conn)
+			dial, _, err := c.fab.checkTarget("udp", addr)
+			if err != nil {
+				return nil, err
+			}
+			return dialFrom(c.fab.bindIP(c), "udp", dial, DIAL_TIMEOUT*time.Millisecond)
+		})
+		if err != nil {
+			logger.Infof("%s drop datagram to %s: %s",
+				d.Conn.(*Conn).String(), addr, err.Error())
+			continue
+		}
+		if created {
+			go p.reply(d, targets, addr, e)
+		}
+		e.Write(buf[hlen:n])
+	}
+}
+
+// reply sends datagrams from target back, with address of it.
+func (p *UdpAssociate) reply(d *DgramConn, targets *natTable, addr string, e *natEntry) {
+	defer targets.remove(addr, e)
+	// header kept in front of buf, datagram read after it.
+	buf := appendUdpHeader(make([]byte, 0, MAX_DGRAM), e.RemoteAddr().(*net.UDPAddr))
+	hlen := len(buf)
+	buf = buf[:MAX_DGRAM]
+	for {
+		n, err := e.Read(buf[hlen:])
+		if err != nil {
+			return
+		}
+		e.touch()
+		_, err = d.WriteMsg(buf[:hlen+n])
+		if err != nil {
+			return
+		}
+	}
+}
+
+// UdpRelay takes socks5 udp requests on Conn, and sends them over streams
+// from Dialer, one stream each source.
+type UdpRelay struct {
+	Dialer netutil.Dialer
+	Conn   net.PacketConn
+	// sources without datagram either way are closed, UDP_IDLE_TIMEOUT
+	// if 0.
+	IdleTimeout time.Duration
+	// sources at the same time, ASSOC_MAX_SOURCES if 0.
+	MaxSources int
+}
+
+// Serve relays until Conn closed.
+func (r *UdpRelay) Serve() (err error) {
+	max := r.MaxSources
+	if max == 0 {
+		max = ASSOC_MAX_SOURCES
+	}
+	sources := newNatTable(max, r.IdleTimeout)
+	defer sources.Close()
+
+	buf := make([]byte, MAX_DGRAM)
+	for {
+		n, src, err := r.Conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if _, _, err = parseUdpHeader(buf[:n]); err != nil {
+			logger.Info(err.Error())
+			continue
+		}
+		key := src.String()
+		e, created, err := sources.get(key, func() (net.Conn, error) {
+			conn, err := r.Dialer.Dial(ASSOC_NETWORK, "")
+			if err != nil {
+				return nil, err
+			}
+			return NewDgramConn(conn), nil
+		})
+		if err != nil {
+			logger.Infof("drop datagram from %s: %s", key, err.Error())
+			continue
+		}
+		if created {
+			go r.reply(sources, src, e)
+		}
+		e.Write(buf[:n])
+	}
+}
+
+// reply sends datagrams from stream back to source, header is from server.
+func (r *UdpRelay) reply(sources *natTable, src net.Addr, e *natEntry) {
+	defer sources.remove(src.String(), e)
+	buf := make([]byte, MAX_DGRAM)
+	for {
+		n, err := e.Read(buf)
+		if err != nil {
+			return
+		}
+		e.touch()
+		_, err = r.Conn.WriteTo(buf[:n], src)
+		if err != nil {
+			return
+		}
+	}
+}
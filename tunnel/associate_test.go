@@ -0,0 +1,117 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func udpRequest(t *testing.T, addr string, data string) []byte {
+	uaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(appendUdpHeader(nil, uaddr), data...)
+}
+
+// assocDialer serves streams it dialed with p.
+type assocDialer struct {
+	*Client
+	p *UdpAssociate
+}
+
+func (d *assocDialer) Dial(network, address string) (conn net.Conn, err error) {
+	conn, err = d.Client.Dial("test", "pair")
+	if err != nil {
+		return
+	}
+	go d.p.serve(NewDgramConn(<-accepted))
+	return
+}
+
+// newUdpRelay starts a relay over a fabric pair to p, returns app socket
+// and address of relay.
+func newUdpRelay(t *testing.T, p *UdpAssociate) (app net.PacketConn, relay net.Addr) {
+	cli, _ := newConnPair(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	r := &UdpRelay{
+		Dialer: &assocDialer{&Client{Fabric: cli.fab}, p},
+		Conn:   pc,
+	}
+	go r.Serve()
+
+	app, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { app.Close() })
+	return app, pc.LocalAddr()
+}
+
+func TestUdpHeader(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:53", "[::1]:443"} {
+		b := udpRequest(t, addr, "x")
+		got, hlen, err := parseUdpHeader(b)
+		if err != nil || got != addr || string(b[hlen:]) != "x" {
+			t.Fatalf("parse %s: %s %d %v", addr, got, hlen, err)
+		}
+	}
+	b := append([]byte{0, 0, 0, ATYP_DOMAIN, 11}, "example.com"...)
+	b = append(b, 0, 80)
+	if got, hlen, err := parseUdpHeader(b); err != nil || got != "example.com:80" || hlen != len(b) {
+		t.Fatalf("parse domain: %s %d %v", got, hlen, err)
+	}
+	for _, bad := range [][]byte{{0, 0, 1, ATYP_IPV4, 1, 2, 3, 4, 0, 1}, {0, 0, 0, ATYP_IPV4, 1}, {0, 0, 0, 9}} {
+		if _, _, err := parseUdpHeader(bad); err != ErrUdpHeader {
+			t.Fatalf("expect bad header for %v, got %v", bad, err)
+		}
+	}
+}
+
+func TestUdpAssociate(t *testing.T) {
+	app, relay := newUdpRelay(t, &UdpAssociate{})
+	echos := []string{udpEcho(t), udpEcho(t)}
+
+	buf := make([]byte, MAX_DGRAM)
+	for i := 0; i < 2; i++ {
+		for _, echo := range echos {
+			msg := "to " + echo
+			if _, err := app.WriteTo(udpRequest(t, echo, msg), relay); err != nil {
+				t.Fatal(err)
+			}
+			app.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := app.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// reply comes with address of target.
+			from, hlen, err := parseUdpHeader(buf[:n])
+			if err != nil || from != echo || string(buf[hlen:n]) != msg {
+				t.Fatalf("expect %q from %s, got %q from %s %v", msg, echo, buf[hlen:n], from, err)
+			}
+		}
+	}
+}
+
+func TestUdpAssociateLimit(t *testing.T) {
+	app, relay := newUdpRelay(t, &UdpAssociate{MaxTargets: 1})
+	echos := []string{udpEcho(t), udpEcho(t)}
+
+	buf := make([]byte, MAX_DGRAM)
+	app.WriteTo(udpRequest(t, echos[0], "a"), relay)
+	app.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := app.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// second target over limit, dropped.
+	app.WriteTo(udpRequest(t, echos[1], "b"), relay)
+	app.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := app.ReadFrom(buf); !isTimeout(err) {
+		t.Fatalf("expect dropped, got %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// UserInfo is what auth backend tells of user passed.
+type UserInfo struct {
+	// user fabric runs as, the one client gave if empty.
+	Username string
+	// for rules by group in ACLs.
+	Groups []string
+	// ports user can dial, nil means Ports of server. backend may swap set
+	// in it for new streams.
+	Ports *PortFilter
+}
+
+// Authenticator checks credentials in MSG_AUTH, client refused with
+// ERR_AUTH if error returned. It can be a KeyAuthenticator and a
+// LimitAuthenticator too.
+type Authenticator interface {
+	Auth(username, password string) (UserInfo, error)
+}
+
+// MapAuthenticator checks password by username, users not in it refused.
+type MapAuthenticator map[string]string
+
+func (m MapAuthenticator) Auth(username, password string) (info UserInfo, err error) {
+	password1, ok := m[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(password1), []byte(password)) != 1 {
+		return info, ErrAuthFailed
+	}
+	info.Username = username
+	return
+}
+
+// AuthFunc makes a function Authenticator, for backends like ldap or an
+// api of users.
+type AuthFunc func(username, password string) (UserInfo, error)
+
+func (f AuthFunc) Auth(username, password string) (UserInfo, error) {
+	return f(username, password)
+}
+
+// passwordAuth adapts PasswordAuthenticator, optional interfaces are
+// looked up in it.
+type passwordAuth struct {
+	PasswordAuthenticator
+}
+
+func (pa passwordAuth) Auth(username, password string) (info UserInfo, err error) {
+	if !pa.AuthPass(username, password) {
+		return info, ErrAuthFailed
+	}
+	info.Username = username
+	return
+}
+
+// backend returns what author adapts, or author itself.
+func backend(author Authenticator) interface{} {
+	if pa, ok := author.(passwordAuth); ok {
+		return pa.PasswordAuthenticator
+	}
+	return author
+}
+
+// ChallengeAuthenticator keeps keys by DeriveKey, not passwords. Server
+// agrees CAP_CHALLENGE if authenticator is one, clients prove they know
+// the key on a nonce from us, password never sent.
+type ChallengeAuthenticator interface {
+	Authenticator
+	UserKey(username string) ([]byte, error)
+}
+
+// PlaintextAuthenticator tells if password in MSG_AUTH accepted when
+// CAP_CHALLENGE agreed, for fabrics on tls. Encrypted fabrics always can.
+type PlaintextAuthenticator interface {
+	AllowPlaintext() bool
+}
+
+// GuestAuthenticator lets clients without credentials in as user it
+// returns, if ok. Clients ask by Anonymous in auth, or send syn instead of
+// auth. Guests go through limits and ACLs of that user like any other.
+type GuestAuthenticator interface {
+	GuestUser() (info UserInfo, ok bool)
+}
+
+// FailAuthenticator is told of each client failed in auth, for counting
+// or banning.
+type FailAuthenticator interface {
+	AuthFailed(username string, addr net.Addr)
+}
+
+// DeriveKey is what ChallengeAuthenticator keeps for user, PBKDF2 of
+// password with HMAC-SHA256, salted by username.
+func DeriveKey(username, password string) []byte {
+	return pbkdf2([]byte(password), []byte("goproxy:"+username), AUTH_KDF_ROUNDS)
+}
+
+// pbkdf2 of RFC 8018 with HMAC-SHA256, one block of key.
+func pbkdf2(password, salt []byte, rounds int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < rounds; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// authProof is what client sends for nonce of server and its own, and
+// its time in unix ms if not 0.
+func authProof(key, nonce, cnonce []byte, ms int64) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(nonce)
+	mac.Write(cnonce)
+	if ms != 0 {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(ms))
+		mac.Write(b[:])
+	}
+	return mac.Sum(nil)
+}
+
+func newNonce() (nonce []byte, err error) {
+	nonce = make([]byte, AUTH_NONCE_SIZE)
+	_, err = rand.Read(nonce)
+	return
+}
+
+var (
+	dummy_key_once sync.Once
+	dummy_key      []byte
+)
+
+// dummyKey is what proofs of users not known checked against, so they
+// take as long as wrong passwords.
+func dummyKey() []byte {
+	dummy_key_once.Do(func() {
+		dummy_key = make([]byte, sha256.Size)
+		rand.Read(dummy_key)
+	})
+	return dummy_key
+}
+
+// checkProof verifies proof in auth on nonce we sent at issued, with time
+// of client if CAP_TIMESTAMP in caps. Nonce lives on its conn, checked
+// once in AUTH_NONCE_TTL after issued. Users not known and replays
+// refused after proof checked, so they take as long as wrong passwords.
+func checkProof(ca ChallengeAuthenticator, rc *ReplayCache, auth *Auth, nonce []byte, issued time.Time, caps uint32) (info UserInfo, err error) {
+	if len(auth.Nonce) != AUTH_NONCE_SIZE {
+		return info, ErrAuthFailed
+	}
+	key, err := ca.UserKey(auth.Username)
+	if err != nil {
+		key = dummyKey()
+	}
+	fresh := time.Since(issued) < AUTH_NONCE_TTL*time.Millisecond
+	var ms int64
+	if caps&CAP_TIMESTAMP != 0 {
+		ms = auth.Time
+		fresh = fresh && rc.checkTime(ms)
+	}
+	if !hmac.Equal(auth.Proof, authProof(key, nonce, auth.Nonce, ms)) || err != nil {
+		if err == nil {
+			err = ErrAuthFailed
+		}
+		return info, err
+	}
+	if !fresh {
+		rc.replayed(auth.Username)
+		return info, ErrReplayed
+	}
+	info.Username = auth.Username
+	return
+}
+
+// UserKey derives key for users not known too, so they take as long as
+// those known.
+func (m MapAuthenticator) UserKey(username string) ([]byte, error) {
+	password, ok := m[username]
+	key := DeriveKey(username, password)
+	if !ok {
+		return nil, ErrAuthFailed
+	}
+	return key, nil
+}
+
+// KeyMapAuthenticator keeps keys by DeriveKey, by username. Passwords in
+// plaintext checked against them too.
+type KeyMapAuthenticator map[string][]byte
+
+func (m KeyMapAuthenticator) Auth(username, password string) (info UserInfo, err error) {
+	key, ok := m[username]
+	derived := DeriveKey(username, password)
+	if !ok || !hmac.Equal(key, derived) {
+		return info, ErrAuthFailed
+	}
+	info.Username = username
+	return
+}
+
+func (m KeyMapAuthenticator) UserKey(username string) ([]byte, error) {
+	key, ok := m[username]
+	if !ok {
+		return nil, ErrAuthFailed
+	}
+	return key, nil
+}
@@ -0,0 +1,563 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// authServer runs auth by author for each dial, tells info in ch.
+type authServer struct {
+	author  Authenticator
+	timeout time.Duration
+	ch      chan AuthInfo
+	ch_err  chan error
+}
+
+func newAuthServer(author Authenticator, timeout time.Duration) *authServer {
+	return &authServer{
+		author:  author,
+		timeout: timeout,
+		ch:      make(chan AuthInfo, 1),
+		ch_err:  make(chan error, 1),
+	}
+}
+
+func (as *authServer) Dial(network, address string) (net.Conn, error) {
+	p1, p2 := net.Pipe()
+	go func() {
+		info, err := AuthConnWith(as.author, p2, as.timeout)
+		p2.Close()
+		if err != nil {
+			as.ch_err <- err
+			return
+		}
+		as.ch <- info
+	}()
+	return p1, nil
+}
+
+func TestMapAuthenticator(t *testing.T) {
+	SetLogging()
+	as := newAuthServer(MapAuthenticator{"alice": "secret"}, 0)
+	dc := NewDialerCreator(as, "pipe", "pipe", "alice", "secret")
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if info := <-as.ch; info.Username != "alice" {
+		t.Fatalf("wrong user: %+v", info)
+	}
+
+	for _, user := range [][2]string{{"alice", "wrong"}, {"bob", "secret"}, {"", ""}} {
+		dc = NewDialerCreator(as, "pipe", "pipe", user[0], user[1])
+		_, err = dc.Create()
+		if !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("%v: expect auth failed, got %v", user, err)
+		}
+		err = <-as.ch_err
+		if user[1] != "" && strings.Contains(err.Error(), user[1]) {
+			t.Fatalf("password in error: %v", err)
+		}
+	}
+}
+
+func TestAuthFunc(t *testing.T) {
+	SetLogging()
+	as := newAuthServer(AuthFunc(func(username, password string) (UserInfo, error) {
+		if password != "token" {
+			return UserInfo{}, ErrAuthFailed
+		}
+		return UserInfo{Username: strings.ToLower(username)}, nil
+	}), 0)
+	dc := NewDialerCreator(as, "pipe", "pipe", "Alice", "token")
+	_, err := dc.Create()
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("password sent to server can't challenge: %v", err)
+	}
+	<-as.ch_err
+
+	dc.Plaintext = true
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if info := <-as.ch; info.Username != "alice" {
+		t.Fatalf("user should be the one backend told: %+v", info)
+	}
+}
+
+func TestSynBeforeAuth(t *testing.T) {
+	SetLogging()
+	as := newAuthServer(MapAuthenticator{}, 0)
+	conn, _ := as.Dial("pipe", "pipe")
+	defer conn.Close()
+	err := WriteFrame(conn, MSG_HELLO, 0, &Hello{Version: PROTO_VERSION})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadFrame(conn, nil); err != nil {
+		t.Fatal(err)
+	}
+	err = WriteFrame(conn, MSG_SYN, 1, &Syn{Network: "tcp", Address: "127.0.0.1:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var errno Result
+	f, err := ReadFrame(conn, &errno)
+	if err != nil || f.Header.Type != MSG_RESULT || errno != ERR_AUTH {
+		t.Fatalf("syn should be refused, got %v: %v", f, err)
+	}
+	if err = <-as.ch_err; err != ErrUnexpectedPkg {
+		t.Fatalf("expect unexpected package, got %v", err)
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	SetLogging()
+	as := newAuthServer(MapAuthenticator{}, 50*time.Millisecond)
+	conn, _ := as.Dial("pipe", "pipe")
+	defer conn.Close()
+
+	// silent client dropped.
+	start := time.Now()
+	select {
+	case err := <-as.ch_err:
+		if !errors.Is(err, ErrAuthTimeout) {
+			t.Fatalf("expect auth timeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("silent conn not dropped")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("dropped after %s", d)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("conn still open")
+	}
+}
+
+// closedIn tells if conn closed by peer in d.
+func closedIn(conn net.Conn, d time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(d))
+	_, err := io.Copy(io.Discard, conn)
+	return !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func TestServeAuthTimeout(t *testing.T) {
+	SetLogging()
+	srvcfg, clicfg := tlsConfigs(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ts := &tlsServer{author: MapAuthenticator{"alice": "secret"}, ch: make(chan *TunnelServer, 1)}
+	server := &Server{Handler: ts, TLSConfig: srvcfg, AuthTimeout: 200 * time.Millisecond}
+	go server.Serve(ln)
+	addr := ln.Addr().String()
+
+	// silent, in tls.
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !closedIn(conn, time.Second) {
+		t.Fatal("silent conn not dropped")
+	}
+
+	// bytes dribbled never extend it.
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	go func() {
+		// header of a hello record, body never done.
+		dribble := append([]byte{0x16, 0x03, 0x01, 0x02, 0x00}, make([]byte, 20)...)
+		for _, b := range dribble {
+			time.Sleep(20 * time.Millisecond)
+			if _, err := conn.Write([]byte{b}); err != nil {
+				return
+			}
+		}
+	}()
+	if !closedIn(conn, time.Second) || time.Since(start) > 350*time.Millisecond {
+		t.Fatalf("dribbling conn dropped after %s", time.Since(start))
+	}
+
+	// tls done, never authed. tls and auth share the time.
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	cfg := clicfg.Clone()
+	cfg.ServerName = "localhost"
+	tc := tls.Client(raw, cfg)
+	defer tc.Close()
+	if err = tc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if !closedIn(tc, time.Second) || time.Since(start) > 350*time.Millisecond {
+		t.Fatalf("conn not authed dropped after %s", time.Since(start))
+	}
+	for i := 0; server.AuthTimeouts() != 3; i++ {
+		if i > 100 {
+			t.Fatalf("expect 3 timeouts, got %d", server.AuthTimeouts())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// cleared for fabric.
+	_, port, _ := net.SplitHostPort(addr)
+	dc := NewDialerCreator(netutil.DefaultTcpDialer, "tcp", net.JoinHostPort("localhost", port), "alice", "secret")
+	dc.TLSConfig = clicfg
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go client.Loop()
+	<-ts.ch
+	time.Sleep(300 * time.Millisecond)
+	c, err := client.Dial("tcp", tcpEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = pingConn(c); err != nil {
+		t.Fatalf("fabric broken after auth timeout: %v", err)
+	}
+}
+
+// sniffDialer keeps bytes client wrote in the last conn.
+type sniffDialer struct {
+	netutil.Dialer
+	sniff *sniffConn
+}
+
+func (sd *sniffDialer) Dial(network, address string) (net.Conn, error) {
+	conn, err := sd.Dialer.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	sd.sniff = &sniffConn{Conn: conn}
+	return sd.sniff, nil
+}
+
+// failCounter counts failures told.
+type failCounter struct {
+	KeyMapAuthenticator
+	plaintext bool
+	failed    int32
+}
+
+func (fc *failCounter) AllowPlaintext() bool { return fc.plaintext }
+
+func (fc *failCounter) AuthFailed(username string, addr net.Addr) {
+	atomic.AddInt32(&fc.failed, 1)
+}
+
+// rawAuth talks hello with caps, and auth made on nonce from server.
+func rawAuth(t *testing.T, conn net.Conn, caps uint32, auth func(nonce []byte) Auth) Result {
+	defer conn.Close()
+	err := WriteFrame(conn, MSG_HELLO, 0, &Hello{Version: PROTO_VERSION, Caps: caps})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hello Hello
+	if _, err = ReadFrame(conn, &hello); err != nil {
+		t.Fatal(err)
+	}
+	if caps&CAP_CHALLENGE != 0 && (hello.Caps&CAP_CHALLENGE == 0 || len(hello.Nonce) != AUTH_NONCE_SIZE) {
+		t.Fatalf("no challenge: %+v", hello)
+	}
+	a := auth(hello.Nonce)
+	if err = WriteFrame(conn, MSG_AUTH, 0, &a); err != nil {
+		t.Fatal(err)
+	}
+	var errno Result
+	if _, err = ReadFrame(conn, &errno); err != nil {
+		t.Fatal(err)
+	}
+	return errno
+}
+
+func TestChallenge(t *testing.T) {
+	SetLogging()
+	fc := &failCounter{KeyMapAuthenticator: KeyMapAuthenticator{
+		"alice": DeriveKey("alice", "secret"),
+	}}
+	as := newAuthServer(fc, 0)
+	sd := &sniffDialer{Dialer: as}
+	dc := NewDialerCreator(sd, "pipe", "pipe", "alice", "secret")
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if info := <-as.ch; info.Username != "alice" {
+		t.Fatalf("wrong user: %+v", info)
+	}
+	if bytes.Contains(sd.sniff.buf.Bytes(), []byte("secret")) {
+		t.Fatal("password on the wire")
+	}
+
+	// wrong password, and users unknown.
+	for _, user := range [][2]string{{"alice", "wrong"}, {"bob", "secret"}} {
+		dc = NewDialerCreator(as, "pipe", "pipe", user[0], user[1])
+		if _, err = dc.Create(); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("%v: expect auth failed, got %v", user, err)
+		}
+		<-as.ch_err
+	}
+	if n := atomic.LoadInt32(&fc.failed); n != 2 {
+		t.Fatalf("expect 2 failures told, got %d", n)
+	}
+}
+
+func TestChallengeReplay(t *testing.T) {
+	SetLogging()
+	key := DeriveKey("alice", "secret")
+	as := newAuthServer(&failCounter{KeyMapAuthenticator: KeyMapAuthenticator{"alice": key}}, 0)
+	cnonce := bytes.Repeat([]byte{1}, AUTH_NONCE_SIZE)
+
+	var seen Auth
+	var first []byte
+	conn, _ := as.Dial("pipe", "pipe")
+	errno := rawAuth(t, conn, CAP_CHALLENGE, func(nonce []byte) Auth {
+		first = nonce
+		seen = Auth{Username: "alice", Nonce: cnonce, Proof: authProof(key, nonce, cnonce, 0)}
+		return seen
+	})
+	if errno != ERR_NONE {
+		t.Fatalf("expect passed, got %d", errno)
+	}
+	<-as.ch
+
+	// proof for nonce of another conn.
+	conn, _ = as.Dial("pipe", "pipe")
+	errno = rawAuth(t, conn, CAP_CHALLENGE, func(nonce []byte) Auth {
+		if bytes.Equal(nonce, first) {
+			t.Fatal("nonce reused")
+		}
+		return seen
+	})
+	if errno != ERR_AUTH {
+		t.Fatalf("replay should be refused, got %d", errno)
+	}
+	<-as.ch_err
+
+	// short nonce of client.
+	conn, _ = as.Dial("pipe", "pipe")
+	errno = rawAuth(t, conn, CAP_CHALLENGE, func(nonce []byte) Auth {
+		return Auth{Username: "alice", Proof: authProof(key, nonce, nil, 0)}
+	})
+	if errno != ERR_AUTH {
+		t.Fatalf("proof without nonce should be refused, got %d", errno)
+	}
+	<-as.ch_err
+}
+
+// keyCounter tells which users UserKey asked for, unknown ones too.
+type keyCounter struct {
+	MapAuthenticator
+	asked []string
+}
+
+func (kc *keyCounter) UserKey(username string) ([]byte, error) {
+	kc.asked = append(kc.asked, username)
+	return kc.MapAuthenticator.UserKey(username)
+}
+
+func TestChallengeUnknownUser(t *testing.T) {
+	SetLogging()
+	kc := &keyCounter{MapAuthenticator: MapAuthenticator{"alice": "secret"}}
+	rc := &ReplayCache{}
+	nonce := bytes.Repeat([]byte{1}, AUTH_NONCE_SIZE)
+	cnonce := bytes.Repeat([]byte{2}, AUTH_NONCE_SIZE)
+	proof := func(username string, key []byte) (time.Duration, error) {
+		auth := &Auth{Username: username, Nonce: cnonce, Proof: authProof(key, nonce, cnonce, 0)}
+		start := time.Now()
+		_, err := checkProof(kc, rc, auth, nonce, time.Now(), 0)
+		return time.Since(start), err
+	}
+
+	// proof on dummy key never passes for users not known.
+	if _, err := proof("bob", dummyKey()); err != ErrAuthFailed {
+		t.Fatalf("expect auth failed, got %v", err)
+	}
+	var known, unknown time.Duration
+	for i := 0; i < 10; i++ {
+		d, _ := proof("alice", DeriveKey("alice", "wrong"))
+		known += d
+		d, _ = proof("bob", DeriveKey("bob", "wrong"))
+		unknown += d
+	}
+	if len(kc.asked) != 21 {
+		t.Fatalf("expect key asked for every user, got %d", len(kc.asked))
+	}
+	// key derived for both, so they can't be told apart by time.
+	if unknown < known/4 {
+		t.Fatalf("users not known refused in %s, known in %s", unknown, known)
+	}
+}
+
+func TestChallengePlaintext(t *testing.T) {
+	SetLogging()
+	fc := &failCounter{KeyMapAuthenticator: KeyMapAuthenticator{
+		"alice": DeriveKey("alice", "secret"),
+	}}
+	as := newAuthServer(fc, 0)
+	plain := func([]byte) Auth { return Auth{Username: "alice", Password: "secret"} }
+
+	// client before challenge, or one fooled.
+	for _, caps := range []uint32{0, CAP_CHALLENGE} {
+		conn, _ := as.Dial("pipe", "pipe")
+		if errno := rawAuth(t, conn, caps, plain); errno != ERR_AUTH {
+			t.Fatalf("plaintext should be refused, got %d", errno)
+		}
+		<-as.ch_err
+	}
+
+	fc.plaintext = true
+	conn, _ := as.Dial("pipe", "pipe")
+	if errno := rawAuth(t, conn, 0, plain); errno != ERR_NONE {
+		t.Fatalf("plaintext allowed, got %d", errno)
+	}
+	<-as.ch
+}
+
+func TestDeriveKey(t *testing.T) {
+	// known answer of PBKDF2-HMAC-SHA256, 4096 rounds.
+	want, _ := hex.DecodeString("c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a")
+	if k := pbkdf2([]byte("password"), []byte("salt"), 4096); !bytes.Equal(k, want) {
+		t.Fatalf("wrong pbkdf2: %x", k)
+	}
+	k1, k2 := DeriveKey("alice", "secret"), DeriveKey("bob", "secret")
+	if len(k1) != sha256.Size || bytes.Equal(k1, k2) {
+		t.Fatal("keys should be salted by username")
+	}
+	if !bytes.Equal(k1, DeriveKey("alice", "secret")) {
+		t.Fatal("key not stable")
+	}
+}
+
+type guestAuth struct {
+	MapAuthenticator
+	ok bool
+}
+
+func (ga guestAuth) GuestUser() (UserInfo, bool) {
+	return UserInfo{}, ga.ok
+}
+
+func TestGuest(t *testing.T) {
+	SetLogging()
+	as := newAuthServer(guestAuth{MapAuthenticator{"alice": "secret"}, true}, 0)
+	dc := NewDialerCreator(as, "pipe", "pipe", "", "")
+	dc.Anonymous = true
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if info := <-as.ch; !info.Guest || info.Username != GUEST_USER || info.Method != "guest" || info.Syn != nil {
+		t.Fatalf("wrong guest: %+v", info)
+	}
+
+	dc = NewDialerCreator(as, "pipe", "pipe", "alice", "secret")
+	client, err = dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if info := <-as.ch; info.Guest || info.Username != "alice" {
+		t.Fatalf("user should not be guest: %+v", info)
+	}
+
+	as = newAuthServer(guestAuth{MapAuthenticator{"alice": "secret"}, false}, 0)
+	dc = NewDialerCreator(as, "pipe", "pipe", "", "")
+	dc.Anonymous = true
+	if _, err = dc.Create(); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("guest should be refused, got %v", err)
+	}
+	<-as.ch_err
+}
+
+func TestGuestSyn(t *testing.T) {
+	SetLogging()
+	echo := tcpEcho(t)
+	ch := make(chan AccessRecord, 1)
+	l := NewAccessLog(func(rec AccessRecord) { ch <- rec }, 0)
+	defer l.Close()
+
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	go func() {
+		defer p2.Close()
+		info, err := AuthConnWith(guestAuth{ok: true}, p2, 0)
+		if err != nil || info.Syn == nil {
+			t.Errorf("guest without auth refused: %+v %v", info, err)
+			return
+		}
+		tun := NewTunnelServer(info.Conn)
+		tun.SetCaps(info.Caps)
+		tun.Username, tun.Guest = info.Username, info.Guest
+		tun.AccessLog = l
+		tun.Replay(info.Syn)
+		tun.Loop()
+	}()
+
+	err := WriteFrame(p1, MSG_HELLO, 0, &Hello{Version: PROTO_VERSION})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadFrame(p1, nil); err != nil {
+		t.Fatal(err)
+	}
+	err = WriteFrame(p1, MSG_SYN, 1, &Syn{Network: "tcp", Address: echo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		f, err := ReadFrame(p1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Header.Type != MSG_RESULT {
+			continue
+		}
+		result, err := f.unmarshalResult()
+		if err != nil || f.Header.Streamid != 1 || result.Errno != ERR_NONE {
+			t.Fatalf("syn of guest should go, got %+v %v", result, err)
+		}
+		break
+	}
+	p1.Close()
+
+	select {
+	case rec := <-ch:
+		if !rec.Guest || rec.Username != GUEST_USER {
+			t.Fatalf("guest not marked: %+v", rec)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no access record")
+	}
+}
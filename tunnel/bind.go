@@ -0,0 +1,323 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// BindRequest asks peer to listen on Address, conns accepted there come
+// back as streams with Bind of Id in syn. Close stops it, no answer for it.
+type BindRequest struct {
+	Id      uint32
+	Network string `json:",omitempty"`
+	Address string `json:",omitempty"`
+	Close   bool   `json:",omitempty"`
+}
+
+// BindAnswer answers BindRequest of Id. Sent again with ERR_CLOSED if peer
+// stopped listening by itself, listener of Id closed then.
+type BindAnswer struct {
+	Id uint32
+	// address peer listening on, empty if failed.
+	Address string `json:",omitempty"`
+	Errno   uint32 `json:",omitempty"`
+}
+
+// BindRemote asks peer to listen on address, like ssh -R. Streams for conns
+// peer accepted there go to the listener returned, Target of them is the
+// address conn came from. CAP_BIND should be agreed.
+func (fab *Fabric) BindRemote(ctx context.Context, network, address string) (l *Listener, err error) {
+	if !fab.reverse {
+		return nil, ErrNoBind
+	}
+	// streams may come before answer handled.
+	bl := newListener(fab, LISTEN_BACKLOG)
+	ch := make(chan *BindAnswer, 1)
+	fab.block.Lock()
+	if fab.b_closed {
+		fab.block.Unlock()
+		return nil, net.ErrClosed
+	}
+	fab.next_bind++
+	bl.id = fab.next_bind
+	fab.bind_waits[bl.id] = ch
+	fab.bound[bl.id] = bl
+	fab.block.Unlock()
+
+	defer func() {
+		fab.block.Lock()
+		delete(fab.bind_waits, bl.id)
+		if err != nil {
+			delete(fab.bound, bl.id)
+		}
+		fab.block.Unlock()
+	}()
+
+	err = SendFrame(fab, MSG_BIND, 0, &BindRequest{Id: bl.id, Network: network, Address: address})
+	if err != nil {
+		return nil, err
+	}
+
+	var answer *BindAnswer
+	select {
+	case answer = <-ch:
+	case <-ctx.Done():
+		// peer may listen later, tell it to stop.
+		bl.Close()
+		return nil, ctx.Err()
+	}
+	if answer == nil {
+		return nil, net.ErrClosed
+	}
+	if answer.Errno != ERR_NONE {
+		return nil, errnoErr(answer.Errno)
+	}
+	bl.addr, err = net.ResolveTCPAddr("tcp", answer.Address)
+	if err != nil {
+		bl.Close()
+		return nil, err
+	}
+	logger.Noticef("%s peer listening on %s for %d.", fab.String(), answer.Address, bl.id)
+	return bl, nil
+}
+
+// unbind unregisters listener of id, and tells peer to stop.
+func (fab *Fabric) unbind(id uint32) {
+	fab.block.Lock()
+	delete(fab.bound, id)
+	closed := fab.b_closed
+	fab.block.Unlock()
+	if closed {
+		return
+	}
+	err := SendFrame(fab, MSG_BIND, 0, &BindRequest{Id: id, Close: true})
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+// boundListener returns listener for streams with bind of id, nil if gone.
+func (fab *Fabric) boundListener(id uint32) *Listener {
+	fab.block.Lock()
+	defer fab.block.Unlock()
+	return fab.bound[id]
+}
+
+// closeBinds stops listeners both side, after fabric closed.
+func (fab *Fabric) closeBinds() {
+	fab.block.Lock()
+	defer fab.block.Unlock()
+	fab.b_closed = true
+	for id, ch := range fab.bind_waits {
+		close(ch)
+		delete(fab.bind_waits, id)
+	}
+	for id, l := range fab.bound {
+		go l.shut()
+		delete(fab.bound, id)
+	}
+	for id, ln := range fab.binds {
+		ln.Close()
+		delete(fab.binds, id)
+	}
+}
+
+func (fab *Fabric) onBindAnswer(f *Frame) {
+	var answer BindAnswer
+	err := f.Unmarshal(&answer)
+	if err != nil {
+		return
+	}
+	fab.block.Lock()
+	ch, ok := fab.bind_waits[answer.Id]
+	delete(fab.bind_waits, answer.Id)
+	var l *Listener
+	if !ok && answer.Errno == ERR_CLOSED {
+		// peer stopped listening.
+		l = fab.bound[answer.Id]
+		delete(fab.bound, answer.Id)
+	}
+	fab.block.Unlock()
+	if l != nil {
+		logger.Noticef("%s peer stopped listening for %d.", fab.String(), answer.Id)
+		l.shut()
+		return
+	}
+	if !ok {
+		logger.Debugf("%s bind answer for %d dropped.", fab.String(), answer.Id)
+		return
+	}
+	ch <- &answer
+}
+
+func (fab *Fabric) onBind(f *Frame) {
+	var req BindRequest
+	err := f.Unmarshal(&req)
+	if err != nil {
+		return
+	}
+	if req.Close {
+		fab.block.Lock()
+		ln, ok := fab.binds[req.Id]
+		delete(fab.binds, req.Id)
+		fab.block.Unlock()
+		if ok {
+			logger.Noticef("%s stop listening on %s.", fab.String(), ln.Addr())
+			ln.Close()
+		}
+		return
+	}
+
+	answer := &BindAnswer{Id: req.Id}
+	ln, errno := fab.listenFor(&req)
+	if errno != ERR_NONE {
+		answer.Errno = errno
+	} else {
+		answer.Address = ln.Addr().String()
+		logger.Noticef("%s listening on %s for peer.", fab.String(), answer.Address)
+		go fab.serveBind(req.Id, ln)
+	}
+	err = SendFrame(fab, MSG_BINDANSWER, 0, answer)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+// listenFor listens as peer asked, if MaxBinds and port range allow.
+func (fab *Fabric) listenFor(req *BindRequest) (ln net.Listener, errno uint32) {
+	if !fab.reverse {
+		logger.Warningf("%s bind without CAP_BIND, refused.", fab.String())
+		return nil, ERR_DENIED
+	}
+	switch req.Network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, ERR_UNKNOWN_PROTOCOL
+	}
+	_, p, err := net.SplitHostPort(req.Address)
+	if err != nil {
+		return nil, ERR_BIND
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return nil, ERR_BIND
+	}
+	if !fab.bindAllowed(port) {
+		logger.Noticef("%s bind %s denied.", fab.String(), req.Address)
+		return nil, ERR_DENIED
+	}
+
+	fab.block.Lock()
+	defer fab.block.Unlock()
+	switch {
+	case fab.b_closed:
+		return nil, ERR_CLOSED
+	case len(fab.binds) >= fab.MaxBinds:
+		return nil, ERR_TOOMANYBINDS
+	}
+	if _, ok := fab.binds[req.Id]; ok {
+		return nil, ERR_IDEXIST
+	}
+	ln, err = net.Listen(req.Network, req.Address)
+	if err != nil {
+		logger.Errorf("%s %s", fab.String(), err.Error())
+		return nil, ERR_BIND
+	}
+	fab.binds[req.Id] = ln
+	return ln, ERR_NONE
+}
+
+// bindAllowed tells if peer can listen on port. port 0 only allowed if no
+// range, or we can't tell where it goes.
+func (fab *Fabric) bindAllowed(port int) bool {
+	if fab.MaxBinds <= 0 {
+		return false
+	}
+	if fab.BindPortMin == 0 && fab.BindPortMax == 0 {
+		return true
+	}
+	if port == 0 || port < fab.BindPortMin {
+		return false
+	}
+	return fab.BindPortMax == 0 || port <= fab.BindPortMax
+}
+
+// serveBind opens a stream to peer for each conn accepted in ln. Accept
+// retried after temporary errors. Peer told if ln quit by itself.
+func (fab *Fabric) serveBind(id uint32, ln net.Listener) {
+	defer fab.unlisten(id, ln)
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil && isTemporary(err) {
+			delay *= 2
+			if delay == 0 {
+				delay = BIND_RETRY_MIN * time.Millisecond
+			}
+			if delay > BIND_RETRY_MAX*time.Millisecond {
+				delay = BIND_RETRY_MAX * time.Millisecond
+			}
+			logger.Warningf("%s listener %d accept: %s, retry in %s.",
+				fab.String(), id, err.Error(), delay)
+			time.Sleep(delay)
+			continue
+		}
+		if err != nil {
+			logger.Infof("%s listener %d quit: %s", fab.String(), id, err.Error())
+			return
+		}
+		delay = 0
+		go fab.dialBind(id, conn)
+	}
+}
+
+// isTemporary tells if accept may pass later, like out of fds.
+func isTemporary(err error) bool {
+	for _, e := range []error{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS,
+		syscall.ENOMEM, syscall.ECONNABORTED, syscall.ECONNRESET} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// unlisten closes ln of id, removed from binds and peer told if it's
+// still there, not closed by peer or fabric.
+func (fab *Fabric) unlisten(id uint32, ln net.Listener) {
+	ln.Close()
+	fab.block.Lock()
+	cur, ok := fab.binds[id]
+	tell := ok && cur == ln && !fab.b_closed
+	if tell {
+		delete(fab.binds, id)
+	}
+	fab.block.Unlock()
+	if !tell {
+		return
+	}
+	err := SendFrame(fab, MSG_BINDANSWER, 0, &BindAnswer{Id: id, Errno: ERR_CLOSED})
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+func (fab *Fabric) dialBind(id uint32, conn net.Conn) {
+	c := NewConn(fab)
+	c.bind_id = id
+	ctx, cancel := context.WithTimeout(context.Background(), c.dial_timeout)
+	defer cancel()
+	_, err := fab.dial(ctx, c, conn.RemoteAddr().Network(), conn.RemoteAddr().String())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	c.setDialed(conn)
+	netutil.CopyLink(conn, c)
+}
@@ -0,0 +1,211 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newBindPair(t *testing.T, caps uint32) (cli, srv *Fabric, stop func()) {
+	SetLogging()
+	c1, c2, stop, err := makePipeCaps(caps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+	return c1.(*Conn).fab, c2.(*Conn).fab, stop
+}
+
+// waitRefused dials addr until refused, as listener closed.
+func waitRefused(t *testing.T, addr string) {
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s still listening", addr)
+}
+
+func TestBindRemote(t *testing.T) {
+	ctx := context.Background()
+	cli, srv, _ := newBindPair(t, CAP_BIND)
+
+	// disabled by default.
+	_, err := cli.BindRemote(ctx, "tcp", "127.0.0.1:0")
+	if !errors.Is(err, ErrDenied) {
+		t.Fatalf("expect denied, got %v", err)
+	}
+
+	srv.MaxBinds = 1
+	l, err := cli.BindRemote(ctx, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	if l.Addr().(*net.TCPAddr).Port == 0 {
+		t.Fatalf("no port bound: %s", addr)
+	}
+	_, err = cli.BindRemote(ctx, "tcp", "127.0.0.1:0")
+	if !errors.Is(err, ErrTooManyBinds) {
+		t.Fatalf("expect too many binds, got %v", err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	c, err := l.AcceptConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network, address := c.Target(); network != "tcp" || address != conn.LocalAddr().String() {
+		t.Fatalf("wrong target %s:%s", network, address)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("wrong data %q: %v", buf, err)
+	}
+	c.Write([]byte("pong"))
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("wrong data %q: %v", buf, err)
+	}
+	c.Close()
+
+	// peer stops listening, place freed.
+	l.Close()
+	waitRefused(t, addr)
+	l, err = cli.BindRemote(ctx, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
+
+func TestBindLimits(t *testing.T) {
+	ctx := context.Background()
+	cli, srv, _ := newBindPair(t, 0)
+	if _, err := cli.BindRemote(ctx, "tcp", "127.0.0.1:0"); err != ErrNoBind {
+		t.Fatalf("expect no bind, got %v", err)
+	}
+
+	cli, srv, _ = newBindPair(t, CAP_BIND)
+	srv.MaxBinds = 4
+	srv.BindPortMin, srv.BindPortMax = 20000, 20010
+	for _, c := range []struct {
+		network, address string
+		err              error
+	}{
+		{"tcp", "127.0.0.1:0", ErrDenied},
+		{"tcp", "127.0.0.1:19999", ErrDenied},
+		{"tcp", "127.0.0.1:20011", ErrDenied},
+		{"udp", "127.0.0.1:20000", ErrUnknownNetwork},
+		{"tcp", "127.0.0.1", ErrBind},
+	} {
+		_, err := cli.BindRemote(ctx, c.network, c.address)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s:%s: expect %v, got %v", c.network, c.address, c.err, err)
+		}
+	}
+}
+
+func TestBindFabricClose(t *testing.T) {
+	cli, srv, stop := newBindPair(t, CAP_BIND)
+	srv.MaxBinds = 1
+	l, err := cli.BindRemote(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// listeners both side gone with fabric.
+	stop()
+	if _, err = l.Accept(); err != net.ErrClosed {
+		t.Fatalf("expect closed, got %v", err)
+	}
+	waitRefused(t, l.Addr().String())
+
+	// bound listener only takes streams of its own.
+	cli, srv, _ = newBindPair(t, CAP_BIND)
+	c := NewConn(srv)
+	c.bind_id = 1
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err = srv.dial(ctx, c, "tcp", "127.0.0.1:1"); !errors.Is(err, ErrBrokenPipe) {
+		t.Fatalf("expect refused, got %v", err)
+	}
+}
+
+// flakyListener fails accept with EMFILE fails times first.
+type flakyListener struct {
+	net.Listener
+	fails   int32
+	accepts int32
+}
+
+func (fl *flakyListener) Accept() (net.Conn, error) {
+	atomic.AddInt32(&fl.accepts, 1)
+	if atomic.AddInt32(&fl.fails, -1) >= 0 {
+		return nil, &net.OpError{Op: "accept", Net: "tcp",
+			Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+	return fl.Listener.Accept()
+}
+
+func TestBindAcceptRetry(t *testing.T) {
+	cli, srv, _ := newBindPair(t, CAP_BIND)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fl := &flakyListener{Listener: ln, fails: 3}
+	const id = 100
+	l := newListener(cli, LISTEN_BACKLOG)
+	l.id = id
+	cli.block.Lock()
+	cli.bound[id] = l
+	cli.block.Unlock()
+	srv.block.Lock()
+	srv.binds[id] = fl
+	srv.block.Unlock()
+	go srv.serveBind(id, fl)
+
+	// accepted after out of fds for a while.
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c, err := l.AcceptConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if n := atomic.LoadInt32(&fl.accepts); n < 4 {
+		t.Fatalf("expect accept retried, got %d", n)
+	}
+
+	// quit by itself, peer told and place freed.
+	ln.Close()
+	if _, err = l.Accept(); err != net.ErrClosed {
+		t.Fatalf("expect closed, got %v", err)
+	}
+	srv.block.Lock()
+	n := len(srv.binds)
+	srv.block.Unlock()
+	if n != 0 {
+		t.Fatalf("expect binds freed, got %d", n)
+	}
+	if cli.boundListener(id) != nil {
+		t.Fatal("bound listener should be removed")
+	}
+}
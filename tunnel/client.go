@@ -1,6 +1,7 @@
 package tunnel
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"time"
@@ -14,6 +15,30 @@ type DialerCreator struct {
 	serveraddr string
 	username   string
 	password   string
+	// ask for CAP_CHECKSUM in hello, for links may corrupt data silently.
+	Checksum bool
+	// ask for CAP_COMPRESS in hello, for slow links.
+	Compress bool
+	// ask for CAP_PADDING in hello, and pad with it if agreed.
+	Padding PaddingPolicy
+	// pre-shared key, ask for CAP_ENCRYPT with it. server must have the
+	// same key, and must agree.
+	Key []byte
+	// send password as is if server can't challenge. fabrics encrypted or
+	// on tls always can.
+	Plaintext bool
+	// fabric on tls by it, handshake done before hello. ServerName is
+	// host of server address if empty.
+	TLSConfig *tls.Config
+	// fetches bearer token sent in auth instead of password, and again to
+	// renew it before expired. never sent in plaintext unless Plaintext.
+	Token func() (string, error)
+	// auth as guest, username and password not sent. server must let
+	// guests in.
+	Anonymous bool
+	// given to fabric, see RekeyBytes and RekeyInterval of Fabric.
+	RekeyBytes    uint64
+	RekeyInterval time.Duration
 }
 
 func NewDialerCreator(raw netutil.Dialer, network, serveraddr, username, password string) (dc *DialerCreator) {
@@ -34,21 +59,133 @@ func (dc *DialerCreator) Create() (client *Client, err error) {
 		return
 	}
 
+	if dc.TLSConfig != nil {
+		// server can't change its identity by renegotiation.
+		cfg := dc.TLSConfig.Clone()
+		cfg.Renegotiation = tls.RenegotiateNever
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(dc.serveraddr)
+		}
+		tc := tls.Client(conn, cfg)
+		err = tlsHandshake(tc, AUTH_TIMEOUT*time.Millisecond)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		conn = tc
+	}
+
+	// conn may be replaced by encrypted one.
+	raw := conn
 	ti := time.AfterFunc(AUTH_TIMEOUT*time.Millisecond, func() {
-		logger.Errorf("auth timeout %s.", conn.RemoteAddr())
-		conn.Close()
+		logger.Errorf("auth timeout %s.", raw.RemoteAddr())
+		raw.Close()
 	})
 	defer ti.Stop()
 
-	if dc.username != "" || dc.password != "" {
-		logger.Noticef("auth with username: %s, password: %s.",
-			dc.username, dc.password)
+	// resolving and listening by server cost nothing if unused.
+	hello := Hello{Version: PROTO_VERSION, Caps: CAP_DNS | CAP_BIND | CAP_ADDRS | CAP_EARLY | CAP_CHALLENGE | CAP_TIMESTAMP}
+	if dc.Checksum {
+		hello.Caps |= CAP_CHECKSUM
+	}
+	if dc.Compress {
+		hello.Caps |= CAP_COMPRESS
+	}
+	if dc.Padding != nil {
+		hello.Caps |= CAP_PADDING
+	}
+	if dc.Token != nil {
+		hello.Caps |= CAP_TOKEN
+	}
+	var kx *keyExchange
+	if len(dc.Key) != 0 {
+		kx, err = newKeyExchange()
+		if err != nil {
+			conn.Close()
+			return
+		}
+		hello.Caps |= CAP_ENCRYPT | CAP_REKEY
+		hello.Key = kx.Public()
+	}
+	err = WriteFrame(conn, MSG_HELLO, 0, &hello)
+	if err != nil {
+		return
 	}
 
-	auth := Auth{
-		Username: dc.username,
-		Password: dc.password,
+	fhello, err := ReadFrame(conn, nil)
+	if err != nil {
+		if dc.TLSConfig != nil && tlsAlert(err) {
+			err = fmt.Errorf("%w: %w", ErrTLSHandshake, err)
+		}
+		conn.Close()
+		return
+	}
+	if fhello.Header.Type != MSG_HELLO {
+		conn.Close()
+		return nil, fmt.Errorf("%w: no hello from server.", ErrVersion)
 	}
+	var peer Hello
+	err = fhello.Unmarshal(&peer)
+	if err != nil {
+		return
+	}
+	err = checkVersion(peer.Version)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if kx != nil {
+		// never fall back to plain text, hello may be changed on the wire.
+		if peer.Caps&CAP_ENCRYPT == 0 {
+			conn.Close()
+			return nil, fmt.Errorf("%w: server not agreed.", ErrEncrypt)
+		}
+		var ac *aeadConn
+		ac, err = kx.wrap(conn, dc.Key, peer.Key, true, peer.Caps)
+		if err != nil {
+			conn.Close()
+			return
+		}
+		conn = ac
+	}
+
+	auth := Auth{Username: dc.username}
+	// password never logged.
+	method := "password"
+	switch {
+	case dc.Anonymous:
+		auth = Auth{Anonymous: true}
+		method = "guest"
+	case dc.Token != nil:
+		method = "token"
+		if !dc.Plaintext && kx == nil && dc.TLSConfig == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%w: token not sent in plaintext.", ErrAuthFailed)
+		}
+		auth.Token, err = dc.Token()
+		if err != nil {
+			conn.Close()
+			return
+		}
+	case peer.Caps&CAP_CHALLENGE != 0:
+		method = "challenge"
+		auth.Nonce, err = newNonce()
+		if err != nil {
+			conn.Close()
+			return
+		}
+		if peer.Caps&CAP_TIMESTAMP != 0 {
+			auth.Time = time.Now().UnixMilli()
+		}
+		auth.Proof = authProof(DeriveKey(dc.username, dc.password), peer.Nonce, auth.Nonce, auth.Time)
+	case dc.Plaintext || kx != nil || dc.TLSConfig != nil || dc.password == "":
+		auth.Password = dc.password
+	default:
+		// hello may be changed on the wire to steal password.
+		conn.Close()
+		return nil, fmt.Errorf("%w: server can't challenge, password not sent.", ErrAuthFailed)
+	}
+	logger.Noticef("auth with username: %s, method: %s.", auth.Username, method)
 	err = WriteFrame(conn, MSG_AUTH, 0, &auth)
 	if err != nil {
 		return
@@ -65,45 +202,54 @@ func (dc *DialerCreator) Create() (client *Client, err error) {
 	}
 	if errno != ERR_NONE {
 		conn.Close()
-		return nil, fmt.Errorf("create connection failed with code: %d.", errno)
+		return nil, fmt.Errorf("create connection failed with code %d: %w",
+			errno, errnoErr(uint32(errno)))
 	}
 
-	logger.Notice("auth passed.")
+	logger.Noticef("auth passed, caps: %d.", peer.Caps)
 	client = NewClient(conn)
+	// server never agrees what we didn't ask.
+	client.SetCaps(peer.Caps & hello.Caps)
+	client.Padding = dc.Padding
+	client.TokenSource = dc.Token
+	client.RekeyBytes, client.RekeyInterval = dc.RekeyBytes, dc.RekeyInterval
 	return
 }
 
 type Client struct {
 	*Fabric
+	// accept streams dialed by server, with ProtocolHandlers.
+	Reverse bool
 }
 
+// NewClient takes odd stream ids, as initiator of the connection.
 func NewClient(conn net.Conn) (client *Client) {
 	client = &Client{
-		Fabric: NewFabric(conn, 0),
+		Fabric: NewFabric(conn, 1),
 	}
 	client.dft_fiber = client
 	return
 }
 
-func (client *Client) Dial(network, address string) (conn net.Conn, err error) {
-	c := NewConn(client.Fabric)
-	c.streamid, err = client.Fabric.PutIntoNextId(c)
-	if err != nil {
-		return
-	}
-
-	logger.Debugf("%s try to dial %s:%s.", client.String(), network, address)
-
-	err = c.Connect(network, address)
-	if err != nil {
-		logger.Error(err.Error())
-	}
-	logger.Infof("%s connected.", c.String())
-	conn = c
-	return
-}
-
 func (client *Client) SendFrame(f *Frame) (err error) {
+	switch f.Header.Type {
+	case MSG_RESULT:
+		return client.onResult(f)
+	case MSG_SYN:
+		var syn Syn
+		err = f.Unmarshal(&syn)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		// streams for our binds always taken.
+		if !client.Reverse && syn.Bind == 0 {
+			logger.Errorf("%s reverse stream not allowed.", client.String())
+			return SendFrame(
+				client.Fabric, MSG_RESULT, f.Header.Streamid, ERR_UNKNOWN_PROTOCOL)
+		}
+		return client.onSyn(f.Header.Streamid, &syn)
+	}
 	logger.Errorf("client should never recv unmapped frame: %s.", f.Debug())
 	return
 }
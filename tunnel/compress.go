@@ -0,0 +1,156 @@
+package tunnel
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+var errNoGain = errors.New("compress no gain")
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+var flateReaders = sync.Pool{
+	New: func() interface{} {
+		return flate.NewReader(nil)
+	},
+}
+
+// limitBuffer fails writes past its cap, so compressing stops as soon as
+// it can't save enough.
+type limitBuffer struct {
+	b   []byte
+	max int
+}
+
+func (lb *limitBuffer) Write(p []byte) (n int, err error) {
+	if len(lb.b)+len(p) > lb.max {
+		return 0, errNoGain
+	}
+	lb.b = append(lb.b, p...)
+	return len(p), nil
+}
+
+// compressData compresses src into dst, returns errNoGain if it can't
+// save 1/8 of src.
+func compressData(dst, src []byte) (b []byte, err error) {
+	lb := &limitBuffer{b: dst[:0], max: len(src) - len(src)/8}
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(lb)
+	_, err = w.Write(src)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return
+	}
+	return lb.b, nil
+}
+
+// decompressData decompresses src, no more than max bytes. the result
+// came from getData if small enough.
+func decompressData(src []byte, max int, scratch []byte) (b []byte, err error) {
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+	r.(flate.Resetter).Reset(bytes.NewReader(src), nil)
+
+	// not ReadFull, truncated stream gives ErrUnexpectedEOF too.
+	var n, m int
+	for err == nil {
+		if n > max {
+			return nil, fmt.Errorf("%w: decompressed > %d", ErrFrameTooLarge, max)
+		}
+		m, err = r.Read(scratch[n : max+1])
+		n += m
+	}
+	if err != io.EOF {
+		return nil, fmt.Errorf("%w: %w", ErrCompress, err)
+	}
+	err = nil
+
+	if n <= netutil.BUFFERSIZE {
+		b = getData(n)
+	} else {
+		b = make([]byte, n)
+	}
+	copy(b, scratch[:n])
+	return
+}
+
+// SetCompress turns compression of data we send on or off, only works
+// when CAP_COMPRESS agreed. Received frames are always decompressed.
+func (fab *Fabric) SetCompress(on bool) {
+	var v int32
+	if on && fab.compress {
+		v = 1
+	}
+	atomic.StoreInt32(&fab.compress_on, v)
+}
+
+func (fab *Fabric) compressing() bool {
+	return atomic.LoadInt32(&fab.compress_on) != 0
+}
+
+// zipData compresses payload of data frame if worth it. ok is false when
+// data should be sent as it is. Streams stop trying for a while after data
+// not compressible.
+func (c *Conn) zipData(data []byte) (b []byte, ok bool) {
+	if len(data) < COMPRESS_MIN || !c.fab.compressing() {
+		return
+	}
+	c.lock.Lock()
+	if c.zip_skip > 0 {
+		c.zip_skip--
+		c.lock.Unlock()
+		return
+	}
+	c.lock.Unlock()
+
+	var buf []byte
+	if len(data) <= netutil.BUFFERSIZE {
+		buf = getData(len(data))
+	} else {
+		buf = make([]byte, len(data))
+	}
+	b, err := compressData(buf, data)
+	if err != nil {
+		putData(buf)
+		c.lock.Lock()
+		c.zip_skip = COMPRESS_SKIP
+		c.lock.Unlock()
+		return nil, false
+	}
+	return b, true
+}
+
+// unzipData replaces payload of compressed data frame by decompressed.
+func (fab *Fabric) unzipData(f *Frame) (err error) {
+	if !fab.compress {
+		return fmt.Errorf("%w: compressed data not agreed.", ErrCompress)
+	}
+	if fab.rzip == nil {
+		fab.rzip = make([]byte, fab.MaxReadSize+1)
+	}
+	data, err := decompressData(f.Data, fab.MaxReadSize, fab.rzip)
+	putData(f.Data)
+	f.Data = nil
+	if err != nil {
+		return
+	}
+	f.Data = data
+	f.Header.Length = uint16(len(data))
+	f.Header.Flags &^= FLAG_COMPRESSED
+	return
+}
@@ -0,0 +1,153 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+	"time"
+)
+
+func textData(size int) []byte {
+	line := []byte(`{"id": 1234, "name": "goproxy", "tags": ["tunnel", "proxy"]}` + "\n")
+	return bytes.Repeat(line, size/len(line)+1)[:size]
+}
+
+func randomData(size int) []byte {
+	b := make([]byte, size)
+	rand.Read(b)
+	return b
+}
+
+func pipeCopy(t *testing.T, caps uint32, data []byte) (cli, srv *Conn) {
+	SetLogging()
+	c1, c2, stop, err := makePipeCaps(caps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+	cli, srv = c1.(*Conn), c2.(*Conn)
+
+	go cli.Write(data)
+	got := make([]byte, len(data))
+	_, err = io.ReadFull(srv, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data mismatch")
+	}
+	return
+}
+
+func TestCompress(t *testing.T) {
+	data := textData(100000)
+	cli, srv := pipeCopy(t, CAP_COMPRESS|CAP_CHECKSUM, data)
+	st := cli.fab.Stats()
+	if st.BytesOut > uint64(len(data)/4) {
+		t.Fatalf("data not compressed: %d", st.BytesOut)
+	}
+	// window counted in uncompressed bytes.
+	if st := cli.Status(); st.Sent != uint64(len(data)) {
+		t.Fatalf("wrong sent: %+v", st)
+	}
+	if st := srv.Status(); st.Recved != uint64(len(data)) {
+		t.Fatalf("wrong recved: %+v", st)
+	}
+
+	// turned off in the middle.
+	before := cli.fab.Stats()
+	cli.fab.SetCompress(false)
+	go cli.Write(data)
+	_, err := io.ReadFull(srv, make([]byte, len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if out := cli.fab.Stats().Sub(before); out.BytesOut < uint64(len(data)) {
+		t.Fatalf("data compressed after turned off: %d", out.BytesOut)
+	}
+}
+
+func TestCompressRandom(t *testing.T) {
+	data := randomData(100000)
+	cli, _ := pipeCopy(t, CAP_COMPRESS, data)
+	// last frame may still counting.
+	time.Sleep(50 * time.Millisecond)
+	if st := cli.fab.Stats(); st.BytesOut < uint64(len(data)) {
+		t.Fatalf("random data shrinks: %d", st.BytesOut)
+	}
+	cli.lock.Lock()
+	skip := cli.zip_skip
+	cli.lock.Unlock()
+	if skip == 0 {
+		t.Fatal("still trying after incompressible data")
+	}
+}
+
+func TestCompressNotAgreed(t *testing.T) {
+	data := textData(10000)
+	cli, _ := pipeCopy(t, 0, data)
+	cli.fab.SetCompress(true)
+	if cli.fab.compressing() {
+		t.Fatal("compress on without cap")
+	}
+
+	// peer sent compressed frame without cap.
+	c, _ := newRawConn(t)
+	zipped, err := compressData(make([]byte, len(data)), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.fab.unzipData(&Frame{
+		Header: Header{Type: MSG_DATA, Flags: FLAG_COMPRESSED},
+		Data:   zipped,
+	})
+	if err == nil {
+		t.Fatal("compressed data accepted without cap")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	data := textData(MAX_FRAME_SIZE + 100)
+	zipped, err := compressData(make([]byte, len(data)), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = decompressData(zipped, MAX_FRAME_SIZE, make([]byte, MAX_FRAME_SIZE+1))
+	if err == nil {
+		t.Fatal("decompressed over limit")
+	}
+	_, err = decompressData([]byte("not deflate"), MAX_FRAME_SIZE, make([]byte, MAX_FRAME_SIZE+1))
+	if err == nil {
+		t.Fatal("bad data decompressed")
+	}
+}
+
+func benchmarkCompress(b *testing.B, caps uint32, data []byte) {
+	SetLogging()
+	c1, c2, stop, err := makePipeCaps(caps)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer stop()
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			c1.Write(data)
+		}
+	}()
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = io.CopyN(io.Discard, c2, int64(len(data)))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompressText(b *testing.B)   { benchmarkCompress(b, CAP_COMPRESS, textData(64*1024)) }
+func BenchmarkCompressRandom(b *testing.B) { benchmarkCompress(b, CAP_COMPRESS, randomData(64*1024)) }
+func BenchmarkPlainText(b *testing.B)      { benchmarkCompress(b, 0, textData(64*1024)) }
@@ -1,22 +1,48 @@
 package tunnel
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/shell909090/goproxy/netutil"
 )
 
+// Addr is the fabric's endpoint with streamid. RemoteAddr of a dialed conn
+// also carries where the stream goes.
 type Addr struct {
 	net.Addr
 	streamid uint16
+	network  string
+	address  string
+}
+
+func (a *Addr) Network() string {
+	return "tunnel"
 }
 
 func (a *Addr) String() (s string) {
-	return fmt.Sprintf("%s(%d)", a.Addr.String(), a.streamid)
+	if a.address == "" {
+		return fmt.Sprintf("%s(%d)", a.Addr.String(), a.streamid)
+	}
+	return fmt.Sprintf("%s(%d)->%s:%s",
+		a.Addr.String(), a.streamid, a.network, a.address)
+}
+
+func (a *Addr) StreamID() uint16 {
+	return a.streamid
+}
+
+// Target returns network and address of the stream, empty if unknown.
+func (a *Addr) Target() (network, address string) {
+	return a.network, a.address
 }
 
 func RecvWithTimeout(ch chan uint32, t time.Duration) (errno uint32) {
@@ -33,8 +59,11 @@ func RecvWithTimeout(ch chan uint32, t time.Duration) (errno uint32) {
 	return
 }
 
-// use lock to protect: status, window.
+// use lock to protect: status, window, deadlines.
+// wev waits on lock, so window changes must signal with lock held.
 // SendFrame are not included.
+// lock order: fabric calls conn without plock held, and conn never calls
+// fabric with lock held. decide under lock, act after unlock.
 type Conn struct {
 	fab       *Fabric
 	lock      sync.Mutex
@@ -42,27 +71,149 @@ type Conn struct {
 	streamid  uint16
 	ch_syn    chan uint32
 	t_closing *time.Timer
-
-	r_rest []byte
-	rqueue *Queue
-	window int32
-	wev    *sync.Cond
+	closed    bool
+	rlock     sync.Mutex
+	wlock     sync.Mutex
+
+	r_rest      []byte
+	r_buf       []byte
+	rqueue      *Queue
+	rdeadline   time.Time
+	window      int32
+	wnd_base    int32
+	wev         *sync.Cond
+	wdeadline   time.Time
+	t_wdeadline *time.Timer
+
+	unacked     uint32
+	t_wnd       *time.Timer
+	buffered    int
+	pending     int
+	max_pending int
+	sent        uint64
+	recved      uint64
+	created     time.Time
+	active      time.Time
+
+	dial_timeout time.Duration
+	linger       time.Duration
+	writers      int
+	data_size    int
+	read_limit   int
+	send_rate    tokenBucket
+	recv_rate    tokenBucket
+	// frames sent as is before trying compress again.
+	zip_skip int
+	// set when peer reset us.
+	rst_err *ResetError
+	// place in dialing of fabric, protected by fab.dlock.
+	dial_state uint8
+	// addresses of conn handler dialed for target.
+	outbound  net.Addr
+	dialed_at net.Addr
+	// bind of peer's listener this stream came from.
+	bind_id uint32
+	// early data in syn from peer, not taken by handler yet.
+	early []byte
+	// counted in it, from fabric.
+	account *Account
+	// data both ways counted in it, for streams from peer.
+	quota *userQuota
+	// target in syn if Address rewritten.
+	asked string
+	// how ACLs decided target, for access log.
+	verdict Verdict
+	// how the stream ended, the first one counts.
+	end      EndReason
+	end_code uint32
 
 	Network string
 	Address string
+	dialed  bool
 }
 
-func NewConn(fab *Fabric) (c *Conn) {
+type ConnOption func(c *Conn)
+
+// WithWindow sets initial send window, peer should be able to buffer it.
+func WithWindow(n int32) ConnOption {
+	return func(c *Conn) {
+		if n > MAX_WINDOW {
+			n = MAX_WINDOW
+		}
+		c.window = n
+	}
+}
+
+// WithDialTimeout sets how long Connect waits for result.
+func WithDialTimeout(d time.Duration) ConnOption {
+	return func(c *Conn) {
+		c.dial_timeout = d
+	}
+}
+
+// WithMaxFrameSize sets max payload of data frame, overrides the fabric's.
+func WithMaxFrameSize(n int) ConnOption {
+	return func(c *Conn) {
+		if n > MAX_FRAME_SIZE {
+			n = MAX_FRAME_SIZE
+		}
+		c.data_size = n
+	}
+}
+
+// WithReadQueueLimit resets the stream when more than n bytes received
+// but not read yet, 0 means no limit.
+func WithReadQueueLimit(n int) ConnOption {
+	return func(c *Conn) {
+		c.read_limit = n
+	}
+}
+
+func NewConn(fab *Fabric, opts ...ConnOption) (c *Conn) {
+	window := fab.peerWindow()
 	c = &Conn{
-		status: ST_UNKNOWN,
-		fab:    fab,
-		rqueue: NewQueue(),
-		window: WINDOWSIZE,
+		status:   ST_UNKNOWN,
+		fab:      fab,
+		rqueue:   NewQueue(),
+		window:   window,
+		wnd_base: window,
+
+		dial_timeout: fab.DialTimeout,
+		linger:       CLOSE_TIMEOUT * time.Millisecond,
 	}
+	c.created = time.Now()
+	c.active = c.created
 	c.wev = sync.NewCond(&c.lock)
+	for _, opt := range fab.ConnOptions {
+		opt(c)
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
 	return
 }
 
+// frameSize returns max payload of data frame, no more than peer accepts.
+func (c *Conn) frameSize() int {
+	size := c.fab.data_size
+	if c.data_size > 0 {
+		size = c.data_size
+	}
+	if peer := c.fab.peerFrameSize(); size > peer {
+		return peer
+	}
+	return size
+}
+
+// applyWindow moves send window as the initial window of peer changed.
+func (c *Conn) applyWindow(base int32) {
+	c.lock.Lock()
+	c.window += base - c.wnd_base
+	c.wnd_base = base
+	c.wev.Broadcast()
+	c.lock.Unlock()
+}
+
 func (c *Conn) String() (s string) {
 	return fmt.Sprintf("%s(%d)", c.fab.String(), c.streamid)
 }
@@ -84,28 +235,111 @@ func (c *Conn) GetStatusString() (st string) {
 	return
 }
 
+type ConnStatus struct {
+	State    State
+	Streamid uint16
+	Window   int32
+	Buffered int
+	Pending  int
+	Sent     uint64
+	Recved   uint64
+	Network  string
+	Address  string
+	Created  time.Time
+}
+
+// Status returns a consistent snapshot of conn.
+func (c *Conn) Status() (st ConnStatus) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return ConnStatus{
+		State:    State(c.status),
+		Streamid: c.streamid,
+		Window:   c.window,
+		Buffered: c.buffered,
+		Pending:  c.pending,
+		Sent:     c.sent,
+		Recved:   c.recved,
+		Network:  c.Network,
+		Address:  c.Address,
+		Created:  c.created,
+	}
+}
+
 func (c *Conn) GetTarget() (s string) {
 	// used by manager
 	return fmt.Sprintf("%s:%s", c.Network, c.Address)
 }
 
 func (c *Conn) Connect(network, address string) (err error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), c.dial_timeout)
+	defer cancel()
+	return c.ConnectContext(ctx, network, address)
+}
+
+// ConnectContext works like Connect, stop waiting for result when ctx done.
+// The half opened stream will be reset, so server can drop it.
+func (c *Conn) ConnectContext(ctx context.Context, network, address string) (err error) {
+	return c.connect(ctx, network, address, nil)
+}
+
+// ConnectWithData works like Connect, data sent as the first bytes of
+// stream. Up to EARLY_DATA_MAX of it goes in syn if CAP_EARLY agreed, so
+// server can write it to target before result, one round trip saved. The
+// rest, or all without CAP_EARLY, is written after established.
+func (c *Conn) ConnectWithData(network, address string, data []byte) (err error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), c.dial_timeout)
+	defer cancel()
+	return c.connect(ctx, network, address, data)
+}
+
+func (c *Conn) connect(ctx context.Context, network, address string, data []byte) (err error) {
+	defer func() { err = c.wrapErr("dial", err) }()
+	// ch_syn is protected by lock, result may come after we quit.
+	c.lock.Lock()
+	if c.status != ST_UNKNOWN {
+		c.lock.Unlock()
+		err = ErrState
+		logger.Error(err.Error())
+		return
+	}
 	c.Network = network
 	c.Address = address
+	c.status = ST_SYN_SENT
+	c.dialed = true
+	ch_syn := make(chan uint32, 1)
+	c.ch_syn = ch_syn
+	// early data takes window, like it's sent in data frames.
+	var early []byte
+	if c.fab.early {
+		n := len(data)
+		if n > EARLY_DATA_MAX {
+			n = EARLY_DATA_MAX
+		}
+		if n > int(c.window) {
+			n = int(c.window)
+		}
+		if n > 0 {
+			early, data = data[:n], data[n:]
+			c.window -= int32(n)
+			c.sent += uint64(n)
+		}
+	}
+	c.lock.Unlock()
 
-	c.ch_syn = make(chan uint32, 0)
 	defer func() {
+		c.lock.Lock()
 		c.ch_syn = nil
+		c.lock.Unlock()
 	}()
 
-	err = c.CheckAndSetStatus(ST_UNKNOWN, ST_SYN_SENT)
-	if err != nil {
-		return
-	}
-
 	syn := Syn{
 		Network: network,
 		Address: address,
+		Bind:    c.bind_id,
+		Data:    early,
 	}
 	err = SendFrame(c.fab, MSG_SYN, c.streamid, &syn)
 	if err != nil {
@@ -114,20 +348,59 @@ func (c *Conn) Connect(network, address string) (err error) {
 		return
 	}
 
-	errno := RecvWithTimeout(c.ch_syn, DIAL_TIMEOUT*time.Millisecond)
-
-	if errno != ERR_NONE {
-		errtxt, ok := ErrnoText[errno]
+	var errno uint32
+	var ok bool
+	select {
+	case errno, ok = <-ch_syn:
 		if !ok {
-			errtxt = "unknown"
+			errno = ERR_CLOSED
 		}
+	case <-ctx.Done():
+		err = ctx.Err()
+		logger.Errorf("%s connect %s:%s aborted: %s.",
+			c.String(), network, address, err.Error())
+		if err == context.DeadlineExceeded {
+			c.ResetWith(ERR_TIMEOUT)
+			err = fmt.Errorf("%w: %w", ErrDialTimeout, err)
+		} else {
+			c.ResetWith(ERR_ABORT)
+		}
+		return
+	}
+
+	if errno != ERR_NONE {
+		err = errnoErr(errno)
 		logger.Errorf(
 			"%s connect %s:%s failed for %s",
-			c.String(), network, address, errtxt)
+			c.String(), network, address, err.Error())
+		c.lock.Lock()
+		c.status = ST_UNKNOWN
+		c.lock.Unlock()
 		c.Final()
 		return
 	}
 	err = c.CheckAndSetStatus(ST_SYN_SENT, ST_EST)
+	if err != nil || len(data) == 0 {
+		return
+	}
+	_, err = c.Write(data)
+	return
+}
+
+// writeEarly writes early data from peer to w, before Accept. window of it
+// given back after result.
+func (c *Conn) writeEarly(w io.Writer) (err error) {
+	c.lock.Lock()
+	data := c.early
+	c.early = nil
+	c.lock.Unlock()
+	if len(data) == 0 {
+		return
+	}
+	_, err = w.Write(data)
+	c.lock.Lock()
+	c.unacked += uint32(len(data))
+	c.lock.Unlock()
 	return
 }
 
@@ -137,20 +410,45 @@ func (c *Conn) Accept() (err error) {
 		logger.Error(err.Error())
 		return
 	}
+	c.fab.dialDone(c)
 
-	err = SendFrame(
-		c.fab, MSG_RESULT, c.streamid, ERR_NONE)
+	var result interface{} = uint32(ERR_NONE)
+	c.lock.Lock()
+	if c.fab.addrs && c.dialed_at != nil {
+		dr := &DialResult{Errno: ERR_NONE, Remote: c.dialed_at.String()}
+		if c.outbound != nil {
+			dr.Local = c.outbound.String()
+		}
+		result = dr
+	}
+	// handler didn't take early data, user reads it first. queued before
+	// result, data frames after it come behind.
+	early := c.early
+	c.early = nil
+	c.buffered += len(early)
+	c.lock.Unlock()
+	if len(early) != 0 {
+		c.rqueue.Push(early)
+	}
+	err = SendFrame(c.fab, MSG_RESULT, c.streamid, result)
 	if err != nil {
 		logger.Error(err.Error())
 		return
 	}
-	return
+	return c.flushWindow()
 }
 
 func (c *Conn) Deny() (err error) {
+	return c.DenyWith(ERR_CONNFAILED)
+}
+
+func (c *Conn) DenyWith(errno uint32) (err error) {
+	c.lock.Lock()
+	c.setEnd(END_ERROR, errno)
+	c.lock.Unlock()
 	defer c.Final()
 	err = SendFrame(
-		c.fab, MSG_RESULT, c.streamid, ERR_CONNFAILED)
+		c.fab, MSG_RESULT, c.streamid, errno)
 	if err != nil {
 		logger.Error(err.Error())
 		return
@@ -170,50 +468,181 @@ func (c *Conn) CheckAndSetStatus(old uint8, new uint8) (err error) {
 	return
 }
 
+// next returns data should be read next, nil if nothing and not block.
+// call with rlock held.
+func (c *Conn) next(block bool) (b []byte, err error) {
+	for c.r_rest == nil {
+		var v interface{}
+		// when data isn't empty, reader should return.
+		// when it is empty, reader should be blocked in here.
+		v, err = c.rqueue.PopTimeout(block, c.readDeadline())
+		switch err {
+		case ErrQueueTimeout:
+			return nil, ErrDeadline
+		case ErrQueueWakeup:
+			// read deadline moved.
+			continue
+		}
+		if err == io.EOF && c.isClosed() {
+			return nil, net.ErrClosed
+		}
+		if err == io.EOF {
+			if rerr := c.resetErr(); rerr != nil {
+				return nil, rerr
+			}
+		}
+		if err != nil {
+			return
+		}
+
+		if v == nil {
+			// when rqueue not blocked
+			// it will return v=nil, err=nil
+			return
+		}
+		c.r_rest = v.([]byte)
+		c.r_buf = c.r_rest
+	}
+	return c.r_rest, nil
+}
+
+// skip drops size bytes from the head of rest. call with rlock held.
+func (c *Conn) skip(size int) {
+	if len(c.r_rest) > size {
+		c.r_rest = c.r_rest[size:]
+	} else {
+		// take all data in rest, buffer goes back to pool.
+		c.r_rest = nil
+		putData(c.r_buf)
+		c.r_buf = nil
+	}
+}
+
 func (c *Conn) Read(data []byte) (n int, err error) {
-	var v interface{}
+	defer func() { err = c.wrapErr("read", err) }()
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	if c.readExpired() {
+		return 0, ErrDeadline
+	}
+
+	var b []byte
 	target := data[:]
 	for len(target) > 0 {
-		if c.r_rest == nil {
-			// when data isn't empty, reader should return.
-			// when it is empty, reader should be blocked in here.
-			v, err = c.rqueue.Pop(n == 0)
-			if err != nil {
+		b, err = c.next(n == 0)
+		if err != nil {
+			if n == 0 {
 				return
 			}
-
-			if v == nil {
-				// when rqueue not blocked
-				// it will return v=nil, err=nil
-				break
-			}
-			c.r_rest = v.([]byte)
+			// return data first, error in next read.
+			err = nil
+			break
+		}
+		if b == nil {
+			break
 		}
 
-		size := copy(target, c.r_rest)
+		size := copy(target, b)
 		target = target[size:]
 		n += size
+		c.skip(size)
+	}
 
-		if len(c.r_rest) > size {
-			c.r_rest = c.r_rest[size:]
-		} else {
-			// take all data in rest
-			c.r_rest = nil
+	logger.Debugf("%s readed %d bytes.", c.String(), n)
+	err = c.readed(n)
+	return
+}
+
+// WriteTo writes queued data to w directly, without copy to a buffer.
+func (c *Conn) WriteTo(w io.Writer) (n int64, err error) {
+	defer func() { err = c.wrapErr("read", err) }()
+	c.rlock.Lock()
+	defer c.rlock.Unlock()
+
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	if c.readExpired() {
+		return 0, ErrDeadline
+	}
+
+	var b []byte
+	var nw int
+	for {
+		b, err = c.next(true)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return
+		}
+
+		nw, err = w.Write(b)
+		n += int64(nw)
+		c.skip(nw)
+		if e := c.readed(nw); err == nil {
+			err = e
+		}
+		if err != nil {
+			return
 		}
 	}
+}
 
-	logger.Debugf("%s readed %d bytes.", c.String(), n)
+// readed accounts n bytes read by user, and renews window when needed.
+func (c *Conn) readed(n int) (err error) {
+	if n == 0 {
+		return
+	}
+	c.recv_rate.wait(n, time.Time{})
+	c.fab.recv_rate.wait(n, time.Time{})
 
 	c.lock.Lock()
-	defer c.lock.Unlock()
+	c.buffered -= n
+	c.unacked += uint32(n)
+	c.active = time.Now()
+	if c.unacked < c.fab.WindowThreshold {
+		if c.t_wnd == nil {
+			c.t_wnd = time.AfterFunc(WINDOW_DELAY*time.Millisecond, func() {
+				c.flushWindow()
+			})
+		}
+		c.lock.Unlock()
+		return
+	}
+	c.lock.Unlock()
 
-	// send wnd renew after fin will cause unmapped frame.
-	switch c.status {
-	case ST_FIN_SENT, ST_UNKNOWN:
+	return c.flushWindow()
+}
+
+// flushWindow sends all read bytes to peer in one window renew.
+func (c *Conn) flushWindow() (err error) {
+	c.lock.Lock()
+	window := c.unacked
+	c.unacked = 0
+	if c.t_wnd != nil {
+		c.t_wnd.Stop()
+		c.t_wnd = nil
+	}
+	status := c.status
+	c.lock.Unlock()
+
+	// peer may still writing after our fin, keep window moving.
+	// after peer's fin, nobody needs window any more.
+	switch status {
+	case ST_EST, ST_FIN_SENT:
+	default:
+		return
+	}
+	if window == 0 {
 		return
 	}
 
-	err = SendFrame(c.fab, MSG_WND, c.streamid, uint32(n))
+	err = SendFrame(c.fab, MSG_WND, c.streamid, window)
 	if err != nil {
 		logger.Error(err.Error())
 		return
@@ -221,92 +650,405 @@ func (c *Conn) Read(data []byte) (n int, err error) {
 	return
 }
 
+// ReadFrom reads r into frame sized buffer, and sends them directly.
+func (c *Conn) ReadFrom(r io.Reader) (n int64, err error) {
+	defer func() { err = c.wrapErr("write", err) }()
+
+	var buf []byte
+	size := c.frameSize()
+	if size <= netutil.BUFFERSIZE {
+		buf = netutil.BufferPool.Get().([]byte)
+		defer netutil.BufferPool.Put(buf)
+	} else {
+		buf = make([]byte, size)
+	}
+
+	var nr int
+	for {
+		// peer settings may come in the middle.
+		nr, err = r.Read(buf[:c.fab.chunkSize(c.frameSize(), len(buf))])
+		if nr > 0 {
+			e := c.beginWrite()
+			if e != nil {
+				return n, e
+			}
+			// frame will be packed in SendFrame, so buf can be reused.
+			// wlock never held in reading, or close waits for source.
+			c.wlock.Lock()
+			e = c.writeSlice(buf[:nr])
+			c.wlock.Unlock()
+			c.endWrite()
+			if e != nil {
+				return n, e
+			}
+			n += int64(nr)
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Write returns bytes of frames fully sent. Errors are *StreamError wraps:
+// net.ErrClosed after Close, ErrBrokenPipe when stream can't be written,
+// ErrDeadline when write deadline exceeded, or ErrFabricWrite.
 func (c *Conn) Write(data []byte) (n int, err error) {
+	defer func() { err = c.wrapErr("write", err) }()
+	err = c.beginWrite()
+	if err != nil {
+		return
+	}
+	defer c.endWrite()
+
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
 	for len(data) > 0 {
-		size := uint16(len(data))
-		if size > uint16(netutil.BUFFERSIZE) {
-			size = uint16(netutil.BUFFERSIZE)
-			// random size
-			// size = uint16(16*1024 + rand.Intn(16*1024))
-		}
+		size := c.fab.chunkSize(c.frameSize(), len(data))
 
 		err = c.writeSlice(data[:size])
-		switch err {
+		switch {
+		case err == nil:
+		case err == ErrDeadline || errors.Is(err, ErrBrokenPipe) || err == net.ErrClosed:
+			logger.Infof("%s write failed: %s.", c.String(), err.Error())
+			return
 		default:
 			logger.Error(err.Error())
 			return
-		case io.EOF:
-			logger.Infof("%s connection closed.")
-			return
-		case nil:
 		}
 		logger.Debugf("%s send chunk [%d:%d+%d].", c.String(), n, n, size)
 
 		data = data[size:]
-		n += int(size)
+		n += size
 	}
 	logger.Debugf("%s sent %d bytes.", c.String(), n)
 	return
 }
 
-func (c *Conn) writeSlice(data []byte) (err error) {
+// beginWrite counts a write Close should wait for, fails after Close.
+func (c *Conn) beginWrite() (err error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	if c.status != ST_EST {
-		return io.ErrClosedPipe
+	if c.closed {
+		return net.ErrClosed
 	}
+	c.writers++
+	return
+}
 
-	fdata := NewFrame(MSG_DATA, c.streamid)
-	fdata.Data = data
-	fdata.Header.Length = uint16(len(data))
+func (c *Conn) endWrite() {
+	c.lock.Lock()
+	c.writers--
+	c.wev.Broadcast()
+	c.lock.Unlock()
+}
 
-	logger.Debugf("write data len: %d, window: %d", len(data), c.window)
-	for c.window-int32(len(data)) < 0 {
-		// just one goroutine could wait here.
+// SetLinger sets how long Close waits for writes running to be sent.
+// After that, stream will be reset and unsent data dropped.
+// Negative means wait forever, zero means never wait.
+// CLOSE_TIMEOUT by default.
+func (c *Conn) SetLinger(d time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.linger = d
+	return nil
+}
+
+// drain waits for all writes accepted before Close, false if linger
+// timeout. call after closed set.
+func (c *Conn) drain() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.writers == 0 || c.linger == 0 {
+		return c.writers == 0
+	}
+	expired := false
+	if c.linger > 0 {
+		t := time.AfterFunc(c.linger, func() {
+			c.lock.Lock()
+			expired = true
+			c.wev.Broadcast()
+			c.lock.Unlock()
+		})
+		defer t.Stop()
+	}
+	for c.writers > 0 && !expired {
 		c.wev.Wait()
 	}
+	return c.writers == 0
+}
 
-	err = c.fab.SendFrame(fdata)
+// wrapErr adds stream info to err, io.EOF is left as it is.
+func (c *Conn) wrapErr(op string, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	if _, ok := err.(*StreamError); ok {
+		return err
+	}
+	return &StreamError{
+		Fabric:   c.fab.String(),
+		Streamid: c.streamid,
+		Op:       op,
+		Err:      err,
+	}
+}
+
+// call with lock held.
+func (c *Conn) writable() bool {
+	return c.status == ST_EST || c.status == ST_FIN_RECV
+}
+
+// call with lock held.
+func (c *Conn) writeErr() error {
+	if c.closed {
+		return net.ErrClosed
+	}
+	if c.rst_err != nil {
+		return c.rst_err
+	}
+	return ErrBrokenPipe
+}
+
+// resetErr returns why peer reset us, nil if not.
+func (c *Conn) resetErr() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.rst_err == nil {
+		return nil
+	}
+	return c.rst_err
+}
+
+func (c *Conn) writeSlice(data []byte) (err error) {
+	c.lock.Lock()
+	if !c.writable() {
+		err = c.writeErr()
+		c.lock.Unlock()
+		return
+	}
+	deadline := c.wdeadline
+	c.lock.Unlock()
+
+	// pace before taking window, window not held while sleeping.
+	err = c.send_rate.wait(len(data), deadline)
 	if err != nil {
 		return
 	}
 
+	c.lock.Lock()
+
+	logger.Debugf("write data len: %d, window: %d", len(data), c.window)
+	for c.window-int32(len(data)) < 0 || c.overPending(len(data)) {
+		if c.writeExpired() {
+			c.lock.Unlock()
+			return ErrDeadline
+		}
+		c.wev.Wait()
+		if !c.writable() {
+			err = c.writeErr()
+			c.lock.Unlock()
+			return
+		}
+	}
+	if c.writeExpired() {
+		c.lock.Unlock()
+		return ErrDeadline
+	}
+
+	// take window before unlock, give it back if frame not sent.
+	// never send frame with lock held, peer may need it to process frames.
 	c.window -= int32(len(data))
+	c.sent += uint64(len(data))
+	c.pending += len(data)
+	deadline = c.wdeadline
+	c.lock.Unlock()
+
+	fdata := framePool.Get().(*Frame)
+	fdata.Header = Header{
+		Type:     MSG_DATA,
+		Length:   uint16(len(data)),
+		Streamid: c.streamid,
+	}
+	fdata.Data = data
+	zipped, ok := c.zipData(data)
+	if ok {
+		fdata.Header.Flags = FLAG_COMPRESSED
+		fdata.Data = zipped
+	}
+	padded, pok := c.fab.padData(fdata.Data)
+	if pok {
+		fdata.Header.Flags |= FLAG_PADDED
+		fdata.Data = padded
+	}
+	fdata.Header.Length = uint16(len(fdata.Data))
+
+	err = c.fab.SendFrameDeadline(fdata, deadline)
+	fdata.Data = nil
+	framePool.Put(fdata)
+	if ok {
+		putData(zipped)
+	}
+	if pok {
+		putData(padded)
+	}
+	if err != nil && err != ErrDeadline {
+		err = fmt.Errorf("%w: %w", ErrFabricWrite, err)
+	}
+
+	c.lock.Lock()
+	c.pending -= len(data)
+	if err != nil {
+		c.window += int32(len(data))
+		c.sent -= uint64(len(data))
+	} else {
+		c.active = time.Now()
+		c.quota.count(len(data))
+	}
+	c.wev.Broadcast()
+	c.lock.Unlock()
 	return
 }
 
+// overPending tells if size more bytes will exceed max_pending.
+// a frame larger then limit can go when nothing pending.
+// call with lock held.
+func (c *Conn) overPending(size int) bool {
+	if c.max_pending == 0 || c.pending == 0 {
+		return false
+	}
+	return c.pending+size > c.max_pending
+}
+
+// SetMaxPending limits bytes handed to fabric but not written out yet,
+// whatever window peer gives. Zero means no limit.
+func (c *Conn) SetMaxPending(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.max_pending = n
+	c.wev.Broadcast()
+}
+
+// SetRateLimit limits bytes written to stream per second, writers wait.
+// 0 means no limit, can be changed any time.
+func (c *Conn) SetRateLimit(rate int) {
+	c.send_rate.set(rate, 0)
+}
+
+// SetReadRateLimit limits bytes read from stream per second. Window renew
+// delayed with it, so peer slowed down. 0 means no limit.
+func (c *Conn) SetReadRateLimit(rate int) {
+	c.recv_rate.set(rate, 0)
+}
+
+func (c *Conn) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+// Close shutdown both side of conn locally. Peer will get a fin.
 func (c *Conn) Close() (err error) {
-	return c.closeWrite()
+	defer func() { err = c.wrapErr("close", err) }()
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return
+	}
+	c.closed = true
+	c.lock.Unlock()
+
+	// fin should go after data already written.
+	if !c.drain() {
+		logger.Warningf("%s linger timeout, reset.", c.String())
+		c.ResetWith(ERR_TIMEOUT)
+		return ErrLinger
+	}
+	err = c.CloseWrite()
+	c.rqueue.Close()
+	return
 }
 
+// Reset kills the stream at once, and tells peer with rst of ERR_ABORT.
 func (c *Conn) Reset() {
+	c.ResetWith(ERR_ABORT)
+}
+
+// ResetWith works like Reset, tells peer why by code in ERR_*.
+func (c *Conn) ResetWith(code uint32) {
+	c.reset(true, code)
+}
+
+// Abort closes the conn without fin handshake, data not sent or not read yet
+// will be dropped.
+func (c *Conn) Abort() (err error) {
+	logger.Debugf("%s abort.", c.String())
 	c.lock.Lock()
+	c.closed = true
+	c.lock.Unlock()
+	c.Reset()
+	return
+}
+
+// reset tears down the stream. notify should be false if peer already knows,
+// like a rst from peer, or the fabric is gone. code only sent with notify.
+func (c *Conn) reset(notify bool, code uint32) {
+	c.lock.Lock()
+	status := c.status
 	c.status = ST_UNKNOWN
+	switch {
+	case code == ERR_IDLE || code == ERR_TIMEOUT:
+		c.setEnd(END_TIMEOUT, code)
+	case notify || c.rst_err != nil:
+		c.setEnd(END_RST, code)
+	default:
+		// fabric gone.
+		c.setEnd(END_ERROR, code)
+	}
+	if c.t_closing != nil {
+		c.t_closing.Stop()
+		c.t_closing = nil
+	}
+	c.wev.Broadcast()
 	c.lock.Unlock()
+
+	if notify && status != ST_UNKNOWN {
+		err := c.fab.sendReset(c.streamid, code)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}
 	c.Final()
-	err := c.rqueue.Close()
-	if err != nil {
-		panic(err.Error())
+	c.rqueue.Close()
+}
+
+// setEnd records how stream ended, if not yet. call with lock held.
+func (c *Conn) setEnd(end EndReason, code uint32) {
+	if c.end == END_NONE {
+		c.end, c.end_code = end, code
 	}
 }
 
+// Final removes conn from fabric, can be called any times. the id may be
+// taken by another stream already, which is left as it is.
 func (c *Conn) Final() {
-	err := c.fab.CloseFiber(c.streamid)
-	if err != nil {
-		logger.Error(err.Error())
+	if !c.fab.removeFiber(c.streamid, c) {
 		return
 	}
-
 	logger.Noticef("%s final.", c.String())
 	return
 }
 
-func (c *Conn) closeWrite() (err error) {
+// CloseWrite shutdown the writing side, just like TCPConn. Reads still
+// work until peer's fin.
+func (c *Conn) CloseWrite() (err error) {
 	// When sbd trying to close a conn, there should always have a daedline which
 	// the connection can surely been closed.
+	var final bool
 	c.lock.Lock()
-	defer c.lock.Unlock()
-
 	switch c.status {
 	case ST_EST:
 		c.status = ST_FIN_SENT
@@ -315,15 +1057,28 @@ func (c *Conn) closeWrite() (err error) {
 		c.status = ST_UNKNOWN
 		c.t_closing.Stop()
 		c.t_closing = nil
-		c.Final()
-	case ST_UNKNOWN:
+		c.setEnd(END_FIN, ERR_NONE)
+		final = true
+	case ST_FIN_SENT, ST_UNKNOWN:
+		// already half closed, fin sent once.
+		c.lock.Unlock()
 		return
 	default:
+		c.lock.Unlock()
 		return ErrState
 	}
+	// writers waiting for window should quit now.
+	c.wev.Broadcast()
+	c.lock.Unlock()
+	if final {
+		c.Final()
+	}
 
 	logger.Debugf("%s write close.", c.String())
 
+	// wait for the running write, so fin always comes after data.
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
 	err = SendFrame(c.fab, MSG_FIN, c.streamid, nil)
 	if err != nil {
 		logger.Info(err.Error())
@@ -333,10 +1088,18 @@ func (c *Conn) closeWrite() (err error) {
 	return
 }
 
-func (c *Conn) closeRead() (err error) {
+// CloseRead shutdown the reading side locally. Data queued can still be
+// read, after that Read returns io.EOF.
+func (c *Conn) CloseRead() (err error) {
+	logger.Debugf("%s close read.", c.String())
+	return c.rqueue.Close()
+}
+
+// onFin closes the reading side when peer sent fin.
+func (c *Conn) onFin() (err error) {
 	logger.Debugf("%s read close.", c.String())
+	var final bool
 	c.lock.Lock()
-	defer c.lock.Unlock()
 	switch c.status {
 	case ST_EST:
 		c.status = ST_FIN_RECV
@@ -345,40 +1108,170 @@ func (c *Conn) closeRead() (err error) {
 		c.status = ST_UNKNOWN
 		c.t_closing.Stop()
 		c.t_closing = nil
-		c.Final()
+		c.wev.Broadcast()
+		c.setEnd(END_FIN, ERR_NONE)
+		final = true
 	case ST_UNKNOWN:
+		c.lock.Unlock()
 		return
 	default:
+		c.lock.Unlock()
 		return ErrState
 	}
+	c.lock.Unlock()
 
+	if final {
+		c.Final()
+	}
 	c.rqueue.Close()
 	return
 }
 
 func (c *Conn) LocalAddr() net.Addr {
 	return &Addr{
-		c.fab.LocalAddr(),
-		c.streamid,
+		Addr:     c.fab.LocalAddr(),
+		streamid: c.streamid,
 	}
 }
 
+// Target returns network and address the stream asked for, by us or peer.
+func (c *Conn) Target() (network, address string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Network, c.Address
+}
+
+// OutboundAddr returns local address handler dialed target from, nil if not
+// dialed, or not told by server.
+func (c *Conn) OutboundAddr() net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.outbound
+}
+
+// DialedAddr returns address of target handler connected to, names resolved.
+// nil if not dialed, or not told by server.
+func (c *Conn) DialedAddr() net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.dialed_at
+}
+
+// parseAddr makes addr of ip and port, or socket path, in network. nil if
+// not one.
+func parseAddr(network, s string) net.Addr {
+	if strings.HasPrefix(network, "unix") {
+		if s == "" {
+			return nil
+		}
+		return &net.UnixAddr{Name: s, Net: network}
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil
+	}
+	ap := netip.AddrPortFrom(ip, uint16(n))
+	if strings.HasPrefix(network, "udp") {
+		return net.UDPAddrFromAddrPort(ap)
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+func (c *Conn) setVerdict(v Verdict) {
+	c.lock.Lock()
+	c.verdict = v
+	c.lock.Unlock()
+}
+
+func (c *Conn) setDialed(conn net.Conn) {
+	c.lock.Lock()
+	c.outbound, c.dialed_at = conn.LocalAddr(), conn.RemoteAddr()
+	c.lock.Unlock()
+}
+
+// RemoteAddr returns address of target server connected to, if told in
+// result. Or Addr with fabric and stream.
 func (c *Conn) RemoteAddr() net.Addr {
-	return &Addr{
-		c.fab.RemoteAddr(),
-		c.streamid,
+	c.lock.Lock()
+	target := c.dialed_at
+	if !c.dialed {
+		target = nil
 	}
+	c.lock.Unlock()
+	if target != nil {
+		return target
+	}
+	addr := &Addr{
+		Addr:     c.fab.RemoteAddr(),
+		streamid: c.streamid,
+	}
+	c.lock.Lock()
+	if c.dialed {
+		addr.network, addr.address = c.Network, c.Address
+	}
+	c.lock.Unlock()
+	return addr
 }
 
-func (c *Conn) SetDeadline(t time.Time) error {
-	return nil
+func (c *Conn) readDeadline() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.rdeadline
+}
+
+func (c *Conn) readExpired() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return !c.rdeadline.IsZero() && !time.Now().Before(c.rdeadline)
+}
+
+func (c *Conn) SetDeadline(t time.Time) (err error) {
+	err = c.SetReadDeadline(t)
+	if err != nil {
+		return
+	}
+	return c.SetWriteDeadline(t)
 }
 
 func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.rdeadline = t
+	c.lock.Unlock()
+	// blocked reader should wait for the new deadline.
+	c.rqueue.Wakeup()
 	return nil
 }
 
+// call with lock held.
+func (c *Conn) writeExpired() bool {
+	return !c.wdeadline.IsZero() && !time.Now().Before(c.wdeadline)
+}
+
+func (c *Conn) wakeWriter() {
+	c.lock.Lock()
+	c.wev.Broadcast()
+	c.lock.Unlock()
+}
+
 func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.wdeadline = t
+	if c.t_wdeadline != nil {
+		c.t_wdeadline.Stop()
+		c.t_wdeadline = nil
+	}
+	if !t.IsZero() {
+		c.t_wdeadline = time.AfterFunc(time.Until(t), c.wakeWriter)
+	}
 	return nil
 }
 
@@ -387,38 +1280,66 @@ func (c *Conn) SendFrame(f *Frame) (err error) {
 	default:
 		err = ErrUnexpectedPkg
 		logger.Error(err.Error())
-		c.Reset()
+		c.ResetWith(ERR_PROTOCOL)
 
 	case MSG_RESULT:
-		c.lock.Lock()
-		if c.status != ST_SYN_SENT {
-			c.lock.Unlock()
-			err = ErrState
+		var result DialResult
+		result, err = f.unmarshalResult()
+		if err != nil {
 			logger.Error(err.Error())
 			return
 		}
-		c.lock.Unlock()
 
-		var errno uint32
-		err = f.Unmarshal(&errno)
-		if err != nil {
-			logger.Error(err.Error())
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		if c.status != ST_SYN_SENT || c.ch_syn == nil {
+			// connect aborted, and rst already sent.
+			logger.Warningf("%s drop result in status %s.",
+				c.String(), State(c.status))
 			return
 		}
 
+		if result.Errno == ERR_NONE && result.Remote != "" {
+			c.dialed_at = parseAddr(c.Network, result.Remote)
+			c.outbound = parseAddr(c.Network, result.Local)
+		}
 		select {
-		case c.ch_syn <- errno:
+		case c.ch_syn <- result.Errno:
 		default:
 		}
 
 	case MSG_DATA:
+		c.lock.Lock()
+		if c.read_limit > 0 && c.buffered+len(f.Data) > c.read_limit {
+			buffered := c.buffered
+			c.lock.Unlock()
+			logger.Warningf("%s read queue overflow: %d + %d, reset.",
+				c.String(), buffered, len(f.Data))
+			putData(f.Data)
+			c.ResetWith(ERR_OVERFLOW)
+			return
+		}
+		c.buffered += len(f.Data)
+		c.recved += uint64(len(f.Data))
+		c.active = time.Now()
+		c.quota.count(len(f.Data))
+		c.lock.Unlock()
+
 		err = c.rqueue.Push(f.Data)
+		if err != nil {
+			c.lock.Lock()
+			c.buffered -= len(f.Data)
+			c.lock.Unlock()
+			putData(f.Data)
+		}
 		switch err {
 		default:
 			return
 		case io.ErrClosedPipe:
-			// Drop data here
-			err = nil
+			// nobody will read it, tell peer to stop sending.
+			logger.Infof("%s data after read closed, reset.", c.String())
+			c.ResetWith(ERR_CLOSED)
+			return nil
 		case nil:
 		}
 		logger.Debugf("%s recved %d bytes.", c.String(), len(f.Data))
@@ -431,24 +1352,60 @@ func (c *Conn) SendFrame(f *Frame) (err error) {
 		}
 
 		c.lock.Lock()
+		if int64(c.window)+int64(window) > MAX_WINDOW {
+			current := c.window
+			c.lock.Unlock()
+			logger.Warningf("%s window overflow: %d + %d, reset.",
+				c.String(), current, window)
+			c.ResetWith(ERR_PROTOCOL)
+			return
+		}
 		c.window += int32(window)
-		c.wev.Signal()
+		current := c.window
+		c.wev.Broadcast()
 		c.lock.Unlock()
-		logger.Debugf("%s window + %d = %d.", c.String(), window, c.window)
+		logger.Debugf("%s window + %d = %d.", c.String(), window, current)
 
 	case MSG_FIN:
-		logger.Debugf("%s read close.", c.String())
-		c.closeRead()
+		c.onFin()
 
 	case MSG_RST:
-		logger.Debugf("%s reset.", c.String())
-		c.Reset()
+		// old peers send no reason.
+		var code uint32
+		if len(f.Data) != 0 {
+			err = f.Unmarshal(&code)
+			if err != nil {
+				code = ERR_NONE
+			}
+		}
+		rerr := &ResetError{Code: code}
+		logger.Debugf("%s %s", c.String(), rerr.Error())
+		c.lock.Lock()
+		c.rst_err = rerr
+		c.lock.Unlock()
+		c.reset(false, code)
+		return nil
 	}
 	return
 }
 
+// reapIdle resets conn if nothing read or written for timeout.
+func (c *Conn) reapIdle(now time.Time, timeout time.Duration) {
+	c.lock.Lock()
+	idle := now.Sub(c.active)
+	age := now.Sub(c.created)
+	sent, recved := c.sent, c.recved
+	c.lock.Unlock()
+	if idle < timeout {
+		return
+	}
+	logger.Noticef("%s idle for %s, age %s, sent %d, recved %d, reset.",
+		c.String(), idle, age, sent, recved)
+	c.ResetWith(ERR_IDLE)
+}
+
 func (c *Conn) CloseFiber(streamid uint16) (err error) {
 	// Mostly Fabric closed.
-	c.Reset()
+	c.reset(false, ERR_NONE)
 	return
 }
@@ -0,0 +1,2625 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+	"golang.org/x/net/nettest"
+)
+
+type chanHandler chan *Conn
+
+func (h chanHandler) Handle(fabconn net.Conn) (err error) {
+	c := fabconn.(*Conn)
+	err = c.Accept()
+	if err != nil {
+		return
+	}
+	h <- c
+	return
+}
+
+var accepted = make(chanHandler, 16)
+
+func init() {
+	RegisterNetwork("test", accepted)
+}
+
+func makePipe() (c1, c2 net.Conn, stop func(), err error) {
+	return makePipeCaps(0)
+}
+
+// makePipeCaps works like makePipe, with caps agreed on both side.
+func makePipeCaps(caps uint32) (c1, c2 net.Conn, stop func(), err error) {
+	p1, p2 := net.Pipe()
+	client := NewClient(p1)
+	server := NewTunnelServer(p2)
+	client.SetCaps(caps)
+	server.SetCaps(caps)
+	go client.Loop()
+	go server.Loop()
+	stop = func() {
+		client.Close()
+		server.Close()
+	}
+
+	c1, err = client.Dial("test", "pair")
+	if err != nil {
+		stop()
+		return
+	}
+
+	select {
+	case c2 = <-accepted:
+	case <-time.After(time.Second):
+		stop()
+		err = ErrDeadline
+	}
+	return
+}
+
+// newConnPair links a client and a server fabric over net.Pipe, and
+// returns the established conns on both side.
+func newConnPair(t *testing.T) (cli, srv *Conn) {
+	SetLogging()
+	c1, c2, stop, err := makePipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+	return c1.(*Conn), c2.(*Conn)
+}
+
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+func TestReadDeadline(t *testing.T) {
+	cli, srv := newConnPair(t)
+	var buf [16]byte
+
+	cli.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	_, err := cli.Read(buf[:])
+	if !isTimeout(err) {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("read returned before deadline")
+	}
+
+	// past deadline fails at once, even with data in queue.
+	_, err = srv.Write([]byte(PAYLOAD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.SetReadDeadline(time.Now().Add(-time.Second))
+	_, err = cli.Read(buf[:])
+	if !isTimeout(err) {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+
+	// move deadline forward, read works again.
+	cli.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := cli.Read(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != PAYLOAD {
+		t.Fatal("data not match")
+	}
+
+	cli.SetReadDeadline(time.Time{})
+}
+
+func TestWriteDeadline(t *testing.T) {
+	cli, srv := newConnPair(t)
+
+	// peer holds window updates until it reads.
+	cli.lock.Lock()
+	cli.window = int32(netutil.BUFFERSIZE)
+	cli.lock.Unlock()
+
+	data := make([]byte, 2*netutil.BUFFERSIZE)
+	cli.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := cli.Write(data)
+	if !isTimeout(err) {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+	if n != netutil.BUFFERSIZE {
+		t.Fatalf("expect %d bytes sent, got %d", netutil.BUFFERSIZE, n)
+	}
+
+	cli.lock.Lock()
+	window := cli.window
+	cli.lock.Unlock()
+	if window != 0 {
+		t.Fatalf("window should be 0, got %d", window)
+	}
+
+	buf := make([]byte, 2*netutil.BUFFERSIZE)
+	_, err = io.ReadFull(srv, buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cli.SetWriteDeadline(time.Time{})
+	n, err = cli.Write(data[n:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadFull(srv, buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNetConn(t *testing.T) {
+	SetLogging()
+	nettest.TestConn(t, makePipe)
+}
+
+func TestWindowWait(t *testing.T) {
+	cli, srv := newConnPair(t)
+
+	cli.lock.Lock()
+	cli.window = 0
+	cli.lock.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cli.Write([]byte(PAYLOAD))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("write should block on zero window, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	err := SendFrame(srv.fab, MSG_WND, srv.streamid, uint32(len(PAYLOAD)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write not released by window update")
+	}
+
+	var buf [16]byte
+	n, err := srv.Read(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != PAYLOAD {
+		t.Fatal("data not match")
+	}
+}
+
+func TestResetWakeWriter(t *testing.T) {
+	cli, _ := newConnPair(t)
+
+	cli.lock.Lock()
+	cli.window = 0
+	cli.lock.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cli.Write([]byte(PAYLOAD))
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	go cli.Reset()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrBrokenPipe) {
+			t.Fatalf("expect broken pipe, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("writer not woken by reset")
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	cli, srv := newConnPair(t)
+
+	var _ interface{ CloseWrite() error } = cli
+
+	err := cli.CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf [16]byte
+	_, err = srv.Read(buf[:])
+	if err != io.EOF {
+		t.Fatalf("expect eof, got %v", err)
+	}
+
+	// after our fin, peer's data still comes.
+	_, err = srv.Write([]byte(PAYLOAD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := cli.Read(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != PAYLOAD {
+		t.Fatal("data not match")
+	}
+
+	err = srv.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cli.Read(buf[:])
+	if err != io.EOF {
+		t.Fatalf("expect eof, got %v", err)
+	}
+}
+
+func TestCloseWriteThenClose(t *testing.T) {
+	cli, srv := newConnPair(t)
+
+	// relays half close first, then close when the other way done.
+	if err := cli.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.CloseWrite(); err != nil {
+		t.Fatalf("second half close should be no-op, got %v", err)
+	}
+	if err := cli.Close(); err != nil {
+		t.Fatalf("close after half close, got %v", err)
+	}
+	var buf [16]byte
+	_, err := srv.Read(buf[:])
+	if err != io.EOF {
+		t.Fatalf("expect eof, got %v", err)
+	}
+}
+
+// closeRecorder keeps errors of Close, CloseWrite of Conn passed.
+type closeRecorder struct {
+	*Conn
+	lock sync.Mutex
+	errs []error
+}
+
+func (cr *closeRecorder) Close() (err error) {
+	err = cr.Conn.Close()
+	cr.lock.Lock()
+	cr.errs = append(cr.errs, err)
+	cr.lock.Unlock()
+	return
+}
+
+func (cr *closeRecorder) check(t *testing.T) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if len(cr.errs) == 0 {
+		t.Fatal("tunnel side never closed")
+	}
+	for _, err := range cr.errs {
+		if err != nil {
+			t.Fatalf("close after half close failed: %v", err)
+		}
+	}
+}
+
+func TestCopyHalf(t *testing.T) {
+	cli, srv := newConnPair(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// backend answers after the whole request, like http/1.0.
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, _ := io.ReadAll(conn)
+		conn.Write(append(req, PAYLOAD...))
+	}()
+	backend, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr := &closeRecorder{Conn: srv}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		netutil.CopyHalf(cr, backend)
+	}()
+
+	cli.Write([]byte(PAYLOAD))
+	if err = cli.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	cli.SetReadDeadline(time.Now().Add(time.Second))
+	resp, err := io.ReadAll(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != PAYLOAD+PAYLOAD {
+		t.Fatalf("reply after half close lost: %q", resp)
+	}
+	<-done
+	cr.check(t)
+
+	// backend gone after reply, tunnel closed while half closed.
+	cli, srv = newConnPair(t)
+	cr = &closeRecorder{Conn: srv}
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		netutil.CopyHalf(cr, &goneBackend{Reader: strings.NewReader(PAYLOAD)})
+	}()
+	cli.SetReadDeadline(time.Now().Add(time.Second))
+	resp, err = io.ReadAll(cli)
+	if err != nil || string(resp) != PAYLOAD {
+		t.Fatalf("reply lost: %q, %v", resp, err)
+	}
+	cli.Write([]byte(PAYLOAD))
+	<-done
+	cr.check(t)
+}
+
+// goneBackend replies, then refuses anything written, like peer reset.
+type goneBackend struct {
+	io.Reader
+}
+
+func (gb *goneBackend) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (gb *goneBackend) Close() error                { return nil }
+
+func TestStatus(t *testing.T) {
+	cli, srv := newConnPair(t)
+
+	_, err := cli.Write([]byte(PAYLOAD))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := cli.Status()
+	if st.State != ST_EST || st.Sent != uint64(len(PAYLOAD)) {
+		t.Fatalf("wrong status: %+v", st)
+	}
+	if st.State.String() != "ESTAB" {
+		t.Fatalf("wrong state string: %s", st.State)
+	}
+
+	var buf [16]byte
+	_, err = srv.Read(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	st = srv.Status()
+	if st.Recved != uint64(len(PAYLOAD)) || st.Buffered != 0 {
+		t.Fatalf("wrong status: %+v", st)
+	}
+
+	sts := cli.fab.Streams()
+	if len(sts) != 1 || sts[0].Streamid != cli.streamid {
+		t.Fatalf("wrong statuses: %+v", sts)
+	}
+	if sts[0].Network != "test" || sts[0].Address != "pair" || sts[0].Created.IsZero() {
+		t.Fatalf("wrong statuses: %+v", sts)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	cli, _ := newConnPair(t)
+	client := &Client{Fabric: cli.fab}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			client.Streams()
+			client.NumStreams()
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		_, err := client.Dial("test", "pair")
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-accepted
+	}
+	<-done
+
+	if n := client.NumStreams(); n != 11 {
+		t.Fatalf("expect 11 streams, got %d", n)
+	}
+	sts := client.Streams()
+	for i := 1; i < len(sts); i++ {
+		if sts[i-1].Streamid >= sts[i].Streamid {
+			t.Fatal("streams not sorted")
+		}
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	client := NewClient(p1)
+	go client.Loop()
+	defer client.Close()
+
+	// peer never answer syn.
+	go func() {
+		for {
+			_, err := ReadFrame(p2, nil)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	client.DialTimeout = 50 * time.Millisecond
+	_, err := client.Dial("test", "pair")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err = client.DialContext(ctx, "test", "pair")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect canceled, got %v", err)
+	}
+	if client.GetSize() != 0 {
+		t.Fatal("stream not removed after abort")
+	}
+}
+
+func TestLateResult(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	client := NewClient(p1)
+	go client.Loop()
+	defer client.Close()
+	client.DialTimeout = 50 * time.Millisecond
+
+	ch_frame := make(chan *Frame, 4)
+	go func() {
+		for {
+			f, err := readPeer(p2, nil)
+			if err != nil {
+				return
+			}
+			ch_frame <- f
+		}
+	}()
+
+	_, err := client.Dial("test", "late")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+
+	fsyn := <-ch_frame
+	if fsyn.Header.Type != MSG_SYN {
+		t.Fatalf("expect syn, got %s", fsyn.Debug())
+	}
+	frst := <-ch_frame
+	if frst.Header.Type != MSG_RST {
+		t.Fatalf("expect rst, got %s", frst.Debug())
+	}
+
+	// positive result after timeout, should be reset again.
+	err = WriteFrame(p2, MSG_RESULT, fsyn.Header.Streamid, ERR_NONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case frst = <-ch_frame:
+		if frst.Header.Type != MSG_RST || frst.Header.Streamid != fsyn.Header.Streamid {
+			t.Fatalf("expect rst, got %s", frst.Debug())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("late result not reset")
+	}
+}
+
+// readPeer reads frames sent by a looping fabric, settings skipped.
+func readPeer(r io.Reader, v interface{}) (f *Frame, err error) {
+	for {
+		f, err = ReadFrame(r, nil)
+		if err != nil || f.Header.Type != MSG_SETTINGS {
+			break
+		}
+	}
+	if err == nil && v != nil {
+		err = f.Unmarshal(v)
+	}
+	return
+}
+
+// newRawConn returns an established conn on a fabric, frames sent by it are
+// counted in the returned channel.
+func newRawConn(t *testing.T) (c *Conn, ch_frame chan *Frame) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	fab := NewFabric(p1, 0)
+	t.Cleanup(func() { fab.Close() })
+
+	ch_frame = make(chan *Frame, 16)
+	go func() {
+		for {
+			f, err := ReadFrame(p2, nil)
+			if err != nil {
+				return
+			}
+			ch_frame <- f
+		}
+	}()
+
+	c = NewConn(fab)
+	var err error
+	c.streamid, err = fab.PutIntoNextId(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.status = ST_EST
+	return
+}
+
+func dataFrame(streamid uint16, data string) (f *Frame) {
+	f = NewFrame(MSG_DATA, streamid)
+	f.Data = []byte(data)
+	f.Header.Length = uint16(len(f.Data))
+	return
+}
+
+func TestNoWindowAfterEOF(t *testing.T) {
+	c, ch_frame := newRawConn(t)
+	var buf [16]byte
+
+	c.SendFrame(dataFrame(c.streamid, PAYLOAD))
+	_, err := c.Read(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := <-ch_frame
+	if f.Header.Type != MSG_WND {
+		t.Fatalf("expect wnd, got %s", f.Debug())
+	}
+
+	// zero read, no window renew.
+	_, err = c.Read(buf[:0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SendFrame(dataFrame(c.streamid, PAYLOAD))
+	c.SendFrame(NewFrame(MSG_FIN, c.streamid))
+	for i := 0; i < 3; i++ {
+		_, err = c.Read(buf[:])
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err != io.EOF {
+		t.Fatalf("expect eof, got %v", err)
+	}
+
+	select {
+	case f = <-ch_frame:
+		t.Fatalf("unexpected frame: %s", f.Debug())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWindowCoalesce(t *testing.T) {
+	cli, srv := newConnPair(t)
+
+	// threshold never reached, renew must come by timer.
+	srv.fab.WindowThreshold = 2 * WINDOWSIZE
+	cli.lock.Lock()
+	cli.window = int32(netutil.BUFFERSIZE)
+	cli.lock.Unlock()
+
+	data := make([]byte, 4*netutil.BUFFERSIZE)
+	done := make(chan error, 1)
+	go func() {
+		_, err := cli.Write(data)
+		done <- err
+	}()
+
+	_, err := io.ReadFull(srv, make([]byte, len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("writer blocked by withheld window")
+	}
+}
+
+type countConn struct {
+	net.Conn
+	frames int64
+}
+
+func (cc *countConn) Write(b []byte) (n int, err error) {
+	atomic.AddInt64(&cc.frames, 1)
+	return cc.Conn.Write(b)
+}
+
+func benchmarkWindow(b *testing.B, threshold uint32) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	cc := &countConn{Conn: p2}
+	client := NewClient(p1)
+	server := NewTunnelServer(cc)
+	server.WindowThreshold = threshold
+	go client.Loop()
+	go server.Loop()
+	defer client.Close()
+	defer server.Close()
+
+	conn, err := client.Dial("test", "bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	srv := <-accepted
+
+	chunk := make([]byte, 4096)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			conn.Write(chunk)
+		}
+	}()
+
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	start := atomic.LoadInt64(&cc.frames)
+	for i := 0; i < b.N; i++ {
+		_, err = io.ReadFull(srv, chunk)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&cc.frames)-start)/float64(b.N), "wnd/op")
+}
+
+func BenchmarkWindowEveryRead(b *testing.B) { benchmarkWindow(b, 0) }
+func BenchmarkWindowCoalesce(b *testing.B)  { benchmarkWindow(b, WINDOWSIZE/2) }
+
+func TestReadFromWriteTo(t *testing.T) {
+	cli, srv := newConnPair(t)
+
+	data := make([]byte, 100*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	go func() {
+		_, err := io.Copy(cli, bytes.NewReader(data))
+		if err != nil {
+			t.Error(err)
+		}
+		cli.CloseWrite()
+	}()
+
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("data not match")
+	}
+}
+
+func TestReadFromClose(t *testing.T) {
+	cli, srv := newConnPair(t)
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	ch_err := make(chan error, 1)
+	go func() {
+		_, err := cli.ReadFrom(pr)
+		ch_err <- err
+	}()
+	pw.Write([]byte(PAYLOAD))
+	var buf [16]byte
+	n, err := srv.Read(buf[:])
+	if err != nil || string(buf[:n]) != PAYLOAD {
+		t.Fatalf("data not match: %v", err)
+	}
+
+	// source quiet, close never waits for it.
+	ch_closed := make(chan error, 1)
+	go func() { ch_closed <- cli.Close() }()
+	select {
+	case err = <-ch_closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close blocked by ReadFrom on quiet source")
+	}
+	_, err = srv.Read(buf[:])
+	if err != io.EOF {
+		t.Fatalf("expect eof, got %v", err)
+	}
+
+	// source wakes up later, ReadFrom quits.
+	pw.Write([]byte(PAYLOAD))
+	if err = <-ch_err; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expect closed, got %v", err)
+	}
+}
+
+// hide ReadFrom and WriteTo from io.Copy.
+type onlyWriter struct{ io.Writer }
+type onlyReader struct{ io.Reader }
+
+func benchmarkCopy(b *testing.B, direct bool, caps uint32) {
+	SetLogging()
+	c1, c2, stop, err := makePipeCaps(caps)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer stop()
+
+	const size = 64 * 1024
+	src := bytes.NewReader(make([]byte, size))
+	go func() {
+		for i := 0; i < b.N; i++ {
+			src.Seek(0, io.SeekStart)
+			if direct {
+				io.Copy(c1, src)
+			} else {
+				io.Copy(onlyWriter{c1}, onlyReader{src})
+			}
+		}
+	}()
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if direct {
+			_, err = io.CopyN(io.Discard, c2, size)
+		} else {
+			_, err = io.CopyN(onlyWriter{io.Discard}, onlyReader{c2}, size)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopyBuffer(b *testing.B)   { benchmarkCopy(b, false, 0) }
+func BenchmarkCopyDirect(b *testing.B)   { benchmarkCopy(b, true, 0) }
+func BenchmarkCopyChecksum(b *testing.B) { benchmarkCopy(b, true, CAP_CHECKSUM) }
+
+type failConn struct {
+	net.Conn
+	left int32
+}
+
+func (fc *failConn) Write(b []byte) (n int, err error) {
+	if atomic.AddInt32(&fc.left, -1) < 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return fc.Conn.Write(b)
+}
+
+func TestPartialWrite(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	fab := NewFabric(&failConn{Conn: p1, left: 2}, 0)
+	defer fab.Close()
+	go io.Copy(io.Discard, p2)
+
+	c := NewConn(fab)
+	c.streamid, _ = fab.PutIntoNextId(c)
+	c.status = ST_EST
+
+	n, err := c.Write(make([]byte, 3*netutil.BUFFERSIZE))
+	if !errors.Is(err, ErrFabricWrite) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expect fabric write error, got %v", err)
+	}
+	if n != 2*netutil.BUFFERSIZE {
+		t.Fatalf("expect %d bytes sent, got %d", 2*netutil.BUFFERSIZE, n)
+	}
+	if c.Status().Sent != uint64(n) {
+		t.Fatal("sent counter not match")
+	}
+
+	c.Reset()
+	_, err = c.Write([]byte(PAYLOAD))
+	if !errors.Is(err, ErrBrokenPipe) {
+		t.Fatalf("expect broken pipe, got %v", err)
+	}
+}
+
+func TestDataFrameSize(t *testing.T) {
+	c, ch_frame := newRawConn(t)
+
+	if c.fab.SetDataFrameSize(MAX_FRAME_SIZE+1, false) != ErrFrameOverFlow {
+		t.Fatal("oversize should be refused")
+	}
+
+	err := c.fab.SetDataFrameSize(100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Write(make([]byte, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		f := <-ch_frame
+		if f.Header.Length != 100 {
+			t.Fatalf("expect length 100, got %d", f.Header.Length)
+		}
+	}
+
+	err = c.fab.SetDataFrameSize(100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Write(make([]byte, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for total := 0; total < 1000; {
+		f := <-ch_frame
+		total += int(f.Header.Length)
+		if f.Header.Length > 100 || (total < 1000 && f.Header.Length < 50) {
+			t.Fatalf("random length out of range: %d", f.Header.Length)
+		}
+	}
+}
+
+func TestPending(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	fab := NewFabric(p1, 0)
+	defer fab.Close()
+
+	c := NewConn(fab)
+	c.streamid, _ = fab.PutIntoNextId(c)
+	c.status = ST_EST
+	c.SetMaxPending(netutil.BUFFERSIZE)
+
+	// nobody reads the pipe, so frame stay pending in fabric.
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Write([]byte(PAYLOAD))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if st := c.Status(); st.Pending != len(PAYLOAD) {
+		t.Fatalf("expect %d pending, got %d", len(PAYLOAD), st.Pending)
+	}
+
+	go io.Copy(io.Discard, p2)
+	err := <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := c.Status(); st.Pending != 0 {
+		t.Fatalf("expect nothing pending, got %d", st.Pending)
+	}
+}
+
+func wndFrame(streamid uint16, window uint32) (f *Frame) {
+	f = NewFrame(MSG_WND, streamid)
+	f.Marshal(window)
+	return
+}
+
+func TestWindowOverflow(t *testing.T) {
+	c, ch_frame := newRawConn(t)
+
+	err := c.SendFrame(wndFrame(c.streamid, 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := c.Status(); st.Window != WINDOWSIZE+1024 || st.State != ST_EST {
+		t.Fatalf("wrong status: %+v", st)
+	}
+
+	var hostile = []uint32{0xffffffff, 1 << 31, MAX_WINDOW}
+	for _, w := range hostile {
+		c, ch_frame = newRawConn(t)
+		err = c.SendFrame(wndFrame(c.streamid, w))
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := c.Status()
+		if st.State != ST_UNKNOWN || st.Window != WINDOWSIZE {
+			t.Fatalf("window %d should reset stream: %+v", w, st)
+		}
+		f := <-ch_frame
+		if f.Header.Type != MSG_RST {
+			t.Fatalf("expect rst, got %s", f.Debug())
+		}
+	}
+}
+
+func expectOneRst(t *testing.T, ch_frame chan *Frame, streamid uint16) (f *Frame) {
+	select {
+	case f = <-ch_frame:
+		if f.Header.Type != MSG_RST || f.Header.Streamid != streamid {
+			t.Fatalf("expect rst, got %s", f.Debug())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no rst sent")
+	}
+	select {
+	case f := <-ch_frame:
+		t.Fatalf("unexpected frame %s", f.Debug())
+	case <-time.After(50 * time.Millisecond):
+	}
+	return
+}
+
+func TestDataBeforeFin(t *testing.T) {
+	c, _ := newRawConn(t)
+
+	// all queued before read, data drained first, then eof.
+	for i := 0; i < 3; i++ {
+		c.SendFrame(dataFrame(c.streamid, PAYLOAD))
+	}
+	c.SendFrame(NewFrame(MSG_FIN, c.streamid))
+	data, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != strings.Repeat(PAYLOAD, 3) {
+		t.Fatalf("data lost before fin: %q", data)
+	}
+	if st := c.Status(); st.State != ST_FIN_RECV {
+		t.Fatalf("stream should be half closed: %+v", st)
+	}
+}
+
+func TestDataAfterFin(t *testing.T) {
+	c, ch_frame := newRawConn(t)
+
+	c.SendFrame(NewFrame(MSG_FIN, c.streamid))
+	for i := 0; i < 3; i++ {
+		err := c.SendFrame(dataFrame(c.streamid, PAYLOAD))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectOneRst(t, ch_frame, c.streamid)
+	if st := c.Status(); st.State != ST_UNKNOWN {
+		t.Fatalf("stream should be reset: %+v", st)
+	}
+}
+
+func TestDataToDeadStream(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	fab := NewFabric(p1, 0)
+	t.Cleanup(func() { fab.Close() })
+	go fab.Loop()
+
+	ch_frame := make(chan *Frame, 16)
+	go func() {
+		for {
+			f, err := readPeer(p2, nil)
+			if err != nil {
+				return
+			}
+			ch_frame <- f
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		err := dataFrame(7, PAYLOAD).WriteTo(p2)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectOneRst(t, ch_frame, 7)
+
+	// reused id should be reset again.
+	c := NewConn(fab)
+	err := fab.PutIntoId(7, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fab.CloseFiber(7)
+	err = dataFrame(7, PAYLOAD).WriteTo(p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectOneRst(t, ch_frame, 7)
+}
+
+func TestAbort(t *testing.T) {
+	cli, srv := newConnPair(t)
+	var buf [16]byte
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := cli.Read(buf[:])
+		done <- err
+	}()
+
+	err := srv.Abort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = srv.Read(buf[:])
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expect closed, got %v", err)
+	}
+
+	select {
+	case err = <-done:
+		if !errors.Is(err, ErrReset) || !errors.Is(err, ErrAborted) {
+			t.Fatalf("expect reset by abort, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("peer not reset")
+	}
+	if st := cli.Status(); st.State != ST_UNKNOWN {
+		t.Fatalf("peer should be reset: %+v", st)
+	}
+}
+
+func TestResetNotify(t *testing.T) {
+	c, ch_frame := newRawConn(t)
+	c.Reset()
+	expectOneRst(t, ch_frame, c.streamid)
+
+	// rst from peer should not be answered.
+	c, ch_frame = newRawConn(t)
+	err := c.SendFrame(NewFrame(MSG_RST, c.streamid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := c.Status(); st.State != ST_UNKNOWN {
+		t.Fatalf("stream should be reset: %+v", st)
+	}
+	select {
+	case f := <-ch_frame:
+		t.Fatalf("unexpected frame %s", f.Debug())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestResetReason(t *testing.T) {
+	c, ch_frame := newRawConn(t)
+	c.Reset()
+	var code uint32
+	f := expectOneRst(t, ch_frame, c.streamid)
+	if err := f.Unmarshal(&code); err != nil || code != ERR_ABORT {
+		t.Fatalf("expect abort in rst, got %d, %v", code, err)
+	}
+
+	c, _ = newRawConn(t)
+	f = NewFrame(MSG_RST, c.streamid)
+	f.Marshal(uint32(ERR_DENIED))
+	err := c.SendFrame(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Write([]byte("x"))
+	if !errors.Is(err, ErrDenied) || !errors.Is(err, ErrReset) || !errors.Is(err, ErrBrokenPipe) {
+		t.Fatalf("write after rst: %v", err)
+	}
+	_, err = c.Read(make([]byte, 1))
+	if !errors.Is(err, ErrDenied) {
+		t.Fatalf("read after rst: %v", err)
+	}
+
+	// rst from old peer has no reason.
+	c, _ = newRawConn(t)
+	err = c.SendFrame(NewFrame(MSG_RST, c.streamid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Read(make([]byte, 1))
+	var rerr *ResetError
+	if !errors.As(err, &rerr) || rerr.Code != ERR_NONE || errors.Is(err, ErrDenied) {
+		t.Fatalf("expect unspecified reset, got %v", err)
+	}
+}
+
+func TestTeardownRace(t *testing.T) {
+	SetLogging()
+	c1, c2, stop, err := makePipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	cli, srv := c1.(*Conn), c2.(*Conn)
+	fab := cli.fab
+
+	for i := 0; i < 50; i++ {
+		if i > 0 {
+			c, err := fab.Dial("test", "pair")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cli, srv = c.(*Conn), <-accepted
+		}
+		go cli.Write(make([]byte, 1000))
+		var wg sync.WaitGroup
+		for _, fn := range []func(){
+			func() { cli.Close() },
+			func() { cli.Reset() },
+			func() { cli.Final() },
+			func() { srv.Reset() },
+			func() { srv.Abort() },
+			func() { srv.Close() },
+			func() { srv.CloseFiber(srv.streamid) },
+		} {
+			wg.Add(1)
+			go func(fn func()) {
+				defer wg.Done()
+				fn()
+			}(fn)
+		}
+		wg.Wait()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if n := fab.NumStreams(); n != 0 {
+		t.Fatalf("streams left: %d", n)
+	}
+	// missing id is fine.
+	if err := fab.CloseFiber(12345); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseCallback(t *testing.T) {
+	cli, srv := newConnPair(t)
+	ch_closed := make(chan *Conn, 2)
+	// calls back into conn, deadlock if fabric called with lock held.
+	onClose := func(c *Conn) {
+		c.Status()
+		c.Reset()
+		ch_closed <- c
+	}
+	cli.fab.OnClose = onClose
+	srv.fab.OnClose = onClose
+
+	go cli.Close()
+	go func() {
+		io.Copy(io.Discard, srv)
+		srv.Close()
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-ch_closed:
+		case <-time.After(time.Second):
+			t.Fatal("close deadlocked")
+		}
+	}
+}
+
+func TestAddr(t *testing.T) {
+	cli, srv := newConnPair(t)
+
+	addr := cli.RemoteAddr().(*Addr)
+	if addr.Network() != "tunnel" || addr.StreamID() != cli.streamid {
+		t.Fatalf("wrong addr: %s %d", addr.Network(), addr.StreamID())
+	}
+	network, address := addr.Target()
+	if network != "test" || address != "pair" {
+		t.Fatalf("wrong target: %s %s", network, address)
+	}
+	if !strings.HasSuffix(addr.String(), "->test:pair") {
+		t.Fatalf("wrong addr string: %s", addr.String())
+	}
+
+	// accepted side only knows the fabric.
+	addr = srv.RemoteAddr().(*Addr)
+	if network, _ = addr.Target(); network != "" {
+		t.Fatalf("accepted conn should not have target: %s", addr.String())
+	}
+	if addr.StreamID() != srv.streamid || addr.Addr.Network() != "pipe" {
+		t.Fatalf("wrong addr: %s", addr.String())
+	}
+}
+
+func TestConnOptions(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	client := NewClient(p1)
+	go client.Loop()
+	defer client.Close()
+	go func() {
+		for {
+			_, err := ReadFrame(p2, nil)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	client.ConnOptions = []ConnOption{
+		WithWindow(1000), WithMaxFrameSize(100), WithDialTimeout(time.Hour)}
+	c := NewConn(client.Fabric, WithWindow(2000), WithReadQueueLimit(10))
+	if c.window != 2000 || c.frameSize() != 100 || c.read_limit != 10 {
+		t.Fatalf("options not applied: %d %d %d",
+			c.window, c.frameSize(), c.read_limit)
+	}
+	if c = NewConn(client.Fabric, WithWindow(MAX_WINDOW+1)); c.window != MAX_WINDOW {
+		t.Fatal("window should be capped")
+	}
+
+	// dial options override fabric's.
+	start := time.Now()
+	_, err := client.DialOptions(
+		"test", "pair", WithDialTimeout(50*time.Millisecond))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("dial timeout not applied")
+	}
+}
+
+func TestStalledStream(t *testing.T) {
+	cli, srv := newConnPair(t)
+
+	// nobody reads srv, cli writes until window runs out.
+	go cli.Write(make([]byte, 2*WINDOWSIZE))
+	time.Sleep(100 * time.Millisecond)
+	if st := srv.Status(); st.Buffered == 0 {
+		t.Fatalf("data should be queued in stalled stream: %+v", st)
+	}
+
+	// loop keeps going for others.
+	c, err := cli.fab.Dial("test", "pair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	other := <-accepted
+	defer other.Close()
+	_, err = c.Write([]byte(PAYLOAD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.SetReadDeadline(time.Now().Add(time.Second))
+	var buf [16]byte
+	n, err := other.Read(buf[:])
+	if err != nil || string(buf[:n]) != PAYLOAD {
+		t.Fatalf("sibling of stalled stream blocked: %v", err)
+	}
+}
+
+func TestReadQueueLimit(t *testing.T) {
+	c, ch_frame := newRawConn(t)
+	WithReadQueueLimit(10)(c)
+
+	err := c.SendFrame(dataFrame(c.streamid, "12345678"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := c.Status(); st.State != ST_EST || st.Buffered != 8 {
+		t.Fatalf("wrong status: %+v", st)
+	}
+
+	err = c.SendFrame(dataFrame(c.streamid, "12345678"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := c.Status(); st.State != ST_UNKNOWN {
+		t.Fatalf("overflow should reset stream: %+v", st)
+	}
+	expectOneRst(t, ch_frame, c.streamid)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	client := NewClient(p1)
+	client.IdleTimeout = 100 * time.Millisecond
+	server := NewTunnelServer(p2)
+	go client.Loop()
+	go server.Loop()
+	defer client.Close()
+	defer server.Close()
+
+	conn, err := client.Dial("test", "pair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := conn.(*Conn)
+	srv := <-accepted
+	go io.Copy(io.Discard, srv)
+
+	// activity keeps stream alive.
+	for i := 0; i < 6; i++ {
+		_, err = cli.Write([]byte(PAYLOAD))
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(40 * time.Millisecond)
+	}
+	if st := cli.Status(); st.State != ST_EST {
+		t.Fatalf("active stream reaped: %+v", st)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if st := cli.Status(); st.State != ST_UNKNOWN {
+		t.Fatalf("idle stream not reaped: %+v", st)
+	}
+	if st := srv.Status(); st.State != ST_UNKNOWN {
+		t.Fatalf("peer not reset: %+v", st)
+	}
+}
+
+func TestCloseLinger(t *testing.T) {
+	cli, srv := newConnPair(t)
+
+	cli.lock.Lock()
+	cli.window = 64 * 1024
+	cli.lock.Unlock()
+
+	data := make([]byte, 1024*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	ch_write := make(chan error, 1)
+	go func() {
+		_, err := cli.Write(data)
+		ch_write <- err
+	}()
+	ch_read := make(chan []byte, 1)
+	go func() {
+		// let Close wait for the blocked writer.
+		time.Sleep(100 * time.Millisecond)
+		b, err := io.ReadAll(srv)
+		if err != nil {
+			t.Error(err)
+		}
+		ch_read <- b
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	err := cli.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-ch_write; err != nil {
+		t.Fatalf("write before close failed: %v", err)
+	}
+	if _, err = cli.Write([]byte(PAYLOAD)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expect closed, got %v", err)
+	}
+	if b := <-ch_read; !bytes.Equal(b, data) {
+		t.Fatalf("peer got %d bytes, expect %d", len(b), len(data))
+	}
+}
+
+func TestCloseLingerTimeout(t *testing.T) {
+	cli, _ := newConnPair(t)
+
+	cli.lock.Lock()
+	cli.window = 0
+	cli.lock.Unlock()
+	cli.SetLinger(50 * time.Millisecond)
+
+	ch_write := make(chan error, 1)
+	go func() {
+		_, err := cli.Write([]byte(PAYLOAD))
+		ch_write <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	err := cli.Close()
+	if !errors.Is(err, ErrLinger) {
+		t.Fatalf("expect linger timeout, got %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("close returned before linger")
+	}
+	if err = <-ch_write; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expect closed, got %v", err)
+	}
+	if st := cli.Status(); st.State != ST_UNKNOWN {
+		t.Fatalf("stream should be reset: %+v", st)
+	}
+}
+
+type denyHandler struct{}
+
+func (denyHandler) Handle(fabconn net.Conn) (err error) {
+	return fabconn.(*Conn).Deny()
+}
+
+func TestStreamError(t *testing.T) {
+	RegisterNetwork("deny", denyHandler{})
+	cli, srv := newConnPair(t)
+	client := &Client{Fabric: cli.fab}
+
+	_, err := client.Dial("deny", "pair")
+	var serr *StreamError
+	if !errors.As(err, &serr) || serr.Op != "dial" || !errors.Is(err, ErrDialFailed) {
+		t.Fatalf("expect dial failed, got %v", err)
+	}
+	if serr.Fabric != cli.fab.String() {
+		t.Fatalf("wrong fabric in error: %s", serr.Fabric)
+	}
+
+	_, err = client.Dial("nosuch", "pair")
+	if !errors.Is(err, ErrUnknownNetwork) {
+		t.Fatalf("expect unknown network, got %v", err)
+	}
+
+	srv.Reset()
+	time.Sleep(50 * time.Millisecond)
+	_, err = cli.Write([]byte(PAYLOAD))
+	if !errors.As(err, &serr) || serr.Streamid != cli.streamid || serr.Op != "write" {
+		t.Fatalf("expect stream error, got %v", err)
+	}
+	if !errors.Is(err, ErrBrokenPipe) || isTimeout(err) {
+		t.Fatalf("expect broken pipe, got %v", err)
+	}
+
+	cli.SetReadDeadline(time.Now())
+	_, err = cli.Read(make([]byte, 16))
+	if !isTimeout(err) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	client := NewClient(p1)
+	server := NewTunnelServer(p2)
+	go client.Loop()
+	go server.Loop()
+	defer client.Close()
+
+	conn, err := client.Dial("test", "pair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := conn.(*Conn)
+	srv := <-accepted
+
+	ch_done := make(chan error, 1)
+	go func() {
+		ch_done <- server.Shutdown(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if !client.GoingAway() {
+		t.Fatal("client not told by goaway")
+	}
+	_, err = client.Dial("test", "pair")
+	if !errors.Is(err, ErrGoaway) {
+		t.Fatalf("expect goaway, got %v", err)
+	}
+	// peer ignoring goaway still got refused.
+	c := NewConn(client.Fabric)
+	c.streamid, err = client.PutIntoNextId(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Connect("test", "pair")
+	if !errors.Is(err, ErrGoaway) {
+		t.Fatalf("expect goaway, got %v", err)
+	}
+
+	// existing stream still works.
+	go func() {
+		io.Copy(srv, srv)
+		srv.Close()
+	}()
+	_, err = cli.Write([]byte(PAYLOAD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf [16]byte
+	n, err := io.ReadFull(cli, buf[:len(PAYLOAD)])
+	if err != nil || string(buf[:n]) != PAYLOAD {
+		t.Fatalf("echo failed: %v", err)
+	}
+	select {
+	case err = <-ch_done:
+		t.Fatalf("shutdown returned before drained: %v", err)
+	default:
+	}
+
+	cli.Close()
+	select {
+	case err = <-ch_done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("shutdown not finished after drained")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	client := NewClient(p1)
+	server := NewTunnelServer(p2)
+	go client.Loop()
+	go server.Loop()
+	defer client.Close()
+
+	conn, err := client.Dial("test", "pair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-accepted
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if st := conn.(*Conn).Status(); st.State != ST_UNKNOWN {
+		t.Fatalf("stream not reset after shutdown: %+v", st)
+	}
+}
+
+func TestBothDial(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	client := NewClient(p1)
+	client.Reverse = true
+	server := NewTunnelServer(p2)
+	go client.Loop()
+	go server.Loop()
+	defer client.Close()
+	defer server.Close()
+
+	const N = 10
+	type result struct {
+		c   net.Conn
+		err error
+		odd bool
+	}
+	ch_result := make(chan result, 2*N)
+	for i := 0; i < N; i++ {
+		go func() {
+			c, err := client.Dial("test", "pair")
+			ch_result <- result{c, err, true}
+		}()
+		go func() {
+			c, err := server.Dial("test", "pair")
+			ch_result <- result{c, err, false}
+		}()
+	}
+
+	ids := make(map[uint16]bool)
+	for i := 0; i < 2*N; i++ {
+		r := <-ch_result
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		id := r.c.(*Conn).Status().Streamid
+		if (id%2 == 1) != r.odd || id == 0 {
+			t.Fatalf("stream id %d from wrong half", id)
+		}
+		if ids[id] {
+			t.Fatalf("stream id %d dialed twice", id)
+		}
+		ids[id] = true
+	}
+	for i := 0; i < 2*N; i++ {
+		<-accepted
+	}
+	if client.NumStreams() != 2*N || server.NumStreams() != 2*N {
+		t.Fatalf("expect %d streams, got %d %d",
+			2*N, client.NumStreams(), server.NumStreams())
+	}
+}
+
+func TestSynWrongHalf(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	server := NewTunnelServer(p2)
+	done := make(chan struct{})
+	go func() {
+		server.Loop()
+		close(done)
+	}()
+	defer server.Close()
+
+	// even ids belong to server.
+	err := WriteFrame(p1, MSG_SYN, 4, &Syn{Network: "test", Address: "pair"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("fabric should be closed for syn from wrong half")
+	}
+
+	// reverse stream refused by default.
+	p1, p2 = net.Pipe()
+	client := NewClient(p1)
+	go client.Loop()
+	defer client.Close()
+	go WriteFrame(p2, MSG_SYN, 4, &Syn{Network: "test", Address: "pair"})
+	var errno uint32
+	f, err := readPeer(p2, &errno)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Header.Type != MSG_RESULT || errno != ERR_UNKNOWN_PROTOCOL {
+		t.Fatalf("expect refused, got %s %d", f.Debug(), errno)
+	}
+}
+
+func TestDupSyn(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	server := NewTunnelServer(p2)
+	go server.Loop()
+	defer server.Close()
+	defer p1.Close()
+
+	syn := &Syn{Network: "test", Address: "pair"}
+	go WriteFrame(p1, MSG_SYN, 1, syn)
+	var errno uint32
+	f, err := readPeer(p1, &errno)
+	if err != nil || f.Header.Type != MSG_RESULT || errno != ERR_NONE {
+		t.Fatalf("expect accepted, got %v", err)
+	}
+	peer := <-accepted
+
+	// peer's stream reset as protocol error.
+	go WriteFrame(p1, MSG_SYN, 1, syn)
+	var code uint32
+	f, err = readPeer(p1, &code)
+	if err != nil || f.Header.Type != MSG_RST || f.Header.Streamid != 1 || code != ERR_PROTOCOL {
+		t.Fatalf("expect rst of protocol error, got %v", err)
+	}
+	if st := peer.Status(); st.State != ST_UNKNOWN {
+		t.Fatalf("stream of peer should be reset: %+v", st)
+	}
+
+	// ours kept.
+	ch_conn := make(chan net.Conn, 1)
+	go func() {
+		c, err := server.Dial("tcp", "example.com:80")
+		if err != nil {
+			t.Error(err)
+		}
+		ch_conn <- c
+	}()
+	f, err = readPeer(p1, nil)
+	if err != nil || f.Header.Type != MSG_SYN {
+		t.Fatalf("expect syn, got %v", err)
+	}
+	id := f.Header.Streamid
+	go WriteFrame(p1, MSG_RESULT, id, ERR_NONE)
+	ours := (<-ch_conn).(*Conn)
+
+	go WriteFrame(p1, MSG_SYN, id, syn)
+	f, err = readPeer(p1, &code)
+	if err != nil || f.Header.Type != MSG_RST || f.Header.Streamid != id || code != ERR_PROTOCOL {
+		t.Fatalf("expect rst of protocol error, got %v", err)
+	}
+	if st := ours.Status(); st.State != ST_EST {
+		t.Fatalf("our stream should be kept: %+v", st)
+	}
+	if n := server.Stats().DupSyns; n != 2 {
+		t.Fatalf("expect 2 dup syns, got %d", n)
+	}
+}
+
+type nopFiber struct{}
+
+func (nopFiber) SendFrame(*Frame) error  { return nil }
+func (nopFiber) CloseFiber(uint16) error { return nil }
+
+func TestStreamIdQuarantine(t *testing.T) {
+	SetLogging()
+	p1, _ := net.Pipe()
+	fab := NewFabric(p1, 1)
+	defer fab.Close()
+
+	id, err := fab.PutIntoNextId(nopFiber{})
+	if err != nil || id != 1 {
+		t.Fatalf("expect id 1, got %d %v", id, err)
+	}
+	fab.CloseFiber(id)
+
+	// wrap around, freed id should be skipped.
+	fab.next_id = 1
+	id, err = fab.PutIntoNextId(nopFiber{})
+	if err != nil || id != 3 {
+		t.Fatalf("expect id 3, got %d %v", id, err)
+	}
+
+	// fill all odd ids but the quarantined one.
+	for i := 5; i < 1<<16; i += 2 {
+		fab.weaves[uint16(i)] = nopFiber{}
+	}
+	id, err = fab.PutIntoNextId(nopFiber{})
+	if err != nil || id != 1 {
+		t.Fatalf("expect quarantined id 1 at last, got %d %v", id, err)
+	}
+
+	_, err = fab.PutIntoNextId(nopFiber{})
+	if err != ErrStreamOutOfID {
+		t.Fatalf("expect out of id, got %v", err)
+	}
+}
+
+// gateConn blocks the first write until gate closed.
+type gateConn struct {
+	net.Conn
+	once sync.Once
+	gate chan struct{}
+}
+
+func (c *gateConn) Write(b []byte) (int, error) {
+	c.once.Do(func() { <-c.gate })
+	return c.Conn.Write(b)
+}
+
+func TestControlFirst(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	gc := &gateConn{Conn: p1, gate: make(chan struct{})}
+	fab := NewFabric(gc, 1)
+	defer fab.Close()
+
+	ch_frame := make(chan *Frame, 16)
+	go func() {
+		for {
+			f, err := ReadFrame(p2, nil)
+			if err != nil {
+				return
+			}
+			ch_frame <- f
+		}
+	}()
+
+	// first data frame takes the fabric, others wait.
+	for i := 0; i < 4; i++ {
+		go fab.SendFrame(dataFrame(uint16(2*i+1), PAYLOAD))
+		time.Sleep(10 * time.Millisecond)
+	}
+	go fab.SendFrame(wndFrame(9, 1024))
+	time.Sleep(10 * time.Millisecond)
+	close(gc.gate)
+
+	types := make([]uint8, 0, 5)
+	for i := 0; i < 5; i++ {
+		types = append(types, (<-ch_frame).Header.Type)
+	}
+	if types[0] != MSG_DATA || types[1] != MSG_WND {
+		t.Fatalf("window renew not sent first: %v", types)
+	}
+}
+
+func BenchmarkControlLatency(b *testing.B) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	fab := NewFabric(p1, 1)
+	defer fab.Close()
+	go io.Copy(io.Discard, p2)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	data := make([]byte, 16*1024)
+	for i := 0; i < 8; i++ {
+		go func(streamid uint16) {
+			f := NewFrame(MSG_DATA, streamid)
+			f.Data = data
+			f.Header.Length = uint16(len(data))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				fab.SendFrame(f)
+			}
+		}(uint16(2*i + 1))
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fab.SendFrame(wndFrame(99, 1024))
+	}
+}
+
+func TestFlushDelay(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	cc := &countConn{Conn: p1}
+	fab := NewFabric(cc, 1)
+	fab.FlushDelay = 20 * time.Millisecond
+	defer fab.Close()
+
+	ch_frame := make(chan *Frame, 16)
+	go func() {
+		for {
+			f, err := ReadFrame(p2, nil)
+			if err != nil {
+				return
+			}
+			ch_frame <- f
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		err := fab.SendFrame(dataFrame(1, PAYLOAD))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-ch_frame:
+		case <-time.After(time.Second):
+			t.Fatal("delayed frames not flushed")
+		}
+	}
+	if n := atomic.LoadInt64(&cc.frames); n != 1 {
+		t.Fatalf("expect frames batched in 1 write, got %d", n)
+	}
+
+	// control frames never wait.
+	err := fab.SendFrame(wndFrame(1, 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&cc.frames); n != 2 {
+		t.Fatalf("control frame not flushed at once, %d writes", n)
+	}
+	<-ch_frame
+}
+
+func TestFlushAfterDeadline(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	fab := NewFabric(p1, 1)
+	defer fab.Close()
+
+	// holder buffered a frame, skipped flush for the writer waiting.
+	fab.acquire(false, time.Time{})
+	fab.bw.Write(dataFrame(1, PAYLOAD).Pack())
+	ch_err := make(chan error, 1)
+	go func() {
+		ch_err <- fab.SendFrameDeadline(
+			dataFrame(1, PAYLOAD), time.Now().Add(50*time.Millisecond))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	fab.flushMaybe(false)
+
+	// writer gives up before holder released.
+	if err := <-ch_err; err != ErrDeadline {
+		t.Fatalf("expect deadline, got %v", err)
+	}
+	fab.release()
+
+	p2.SetReadDeadline(time.Now().Add(time.Second))
+	f, err := ReadFrame(p2, nil)
+	if err != nil {
+		t.Fatalf("buffered frame not flushed: %v", err)
+	}
+	if string(f.Data) != PAYLOAD {
+		t.Fatalf("wrong frame: %s", f.Debug())
+	}
+}
+
+func benchmarkSmallWrites(b *testing.B, delay time.Duration) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	cc := &countConn{Conn: p1}
+	client := NewClient(cc)
+	client.FlushDelay = delay
+	server := NewTunnelServer(p2)
+	go client.Loop()
+	go server.Loop()
+	defer client.Close()
+	defer server.Close()
+
+	const streams = 16
+	var conns []net.Conn
+	for i := 0; i < streams; i++ {
+		c, err := client.Dial("test", "pair")
+		if err != nil {
+			b.Fatal(err)
+		}
+		conns = append(conns, c)
+		go io.Copy(io.Discard, <-accepted)
+	}
+
+	msg := make([]byte, 64)
+	b.SetBytes(int64(len(msg)))
+	atomic.StoreInt64(&cc.frames, 0)
+	b.ResetTimer()
+
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c net.Conn) {
+			defer wg.Done()
+			for i := 0; i < b.N/streams+1; i++ {
+				c.Write(msg)
+			}
+		}(c)
+	}
+	wg.Wait()
+	b.ReportMetric(float64(atomic.LoadInt64(&cc.frames))/float64(b.N), "writes/op")
+}
+
+func BenchmarkSmallWritesNoBatch(b *testing.B) { benchmarkSmallWrites(b, -1) }
+func BenchmarkSmallWritesBatch(b *testing.B)   { benchmarkSmallWrites(b, 0) }
+func BenchmarkSmallWritesDelay(b *testing.B) {
+	benchmarkSmallWrites(b, 200*time.Microsecond)
+}
+
+func BenchmarkStreamAllocs(b *testing.B) {
+	SetLogging()
+	c1, c2, stop, err := makePipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer stop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 3000)
+		for {
+			_, err := c2.Read(buf)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	data := make([]byte, netutil.BUFFERSIZE)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = c1.Write(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	c1.(*Conn).CloseWrite()
+	<-done
+}
+
+func TestBadFrame(t *testing.T) {
+	SetLogging()
+	for _, hdr := range [][]byte{
+		{MSG_UNKNOWN, 0, 0, 0, 0, 1},
+		{MSG_DATA, 0, 0x10, 1, 0, 1},
+		{0xff, 0, 0x10, 1, 0, 1},
+	} {
+		p1, p2 := net.Pipe()
+		server := NewTunnelServer(p2)
+		server.MaxReadSize = 0x1000
+		done := make(chan struct{})
+		go func() {
+			server.Loop()
+			close(done)
+		}()
+
+		go p1.Write(hdr)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("fabric should be closed for header %v", hdr)
+		}
+		p1.Close()
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add([]byte{MSG_DATA, 0, 0, 3, 0, 1, 'a', 'b', 'c'})
+	f.Add([]byte{MSG_WND, 0x80, 0, 2, 0, 1, '1', '0'})
+	f.Add([]byte{MSG_SYN, 0, 0xff, 0xff, 0, 1})
+	f.Add([]byte{0xff, 0, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r := bytes.NewReader(b)
+		for {
+			fr, err := readFrame(r, make([]byte, HEADER_SIZE), 0x1000, nil)
+			if err != nil {
+				return
+			}
+			if fr.Header.Type == MSG_UNKNOWN || int(fr.Header.Length) > 0x1000 {
+				t.Fatalf("invalid frame passed: %s", fr.Debug())
+			}
+			if len(fr.Data) != int(fr.Header.Length) {
+				t.Fatalf("data length mismatch: %s", fr.Debug())
+			}
+		}
+	})
+}
+
+type okAuth struct{}
+
+func (okAuth) AuthPass(string, string) bool { return true }
+
+// helloServer runs handshake on server side of a pipe, returns client side
+// and channel of handshake result.
+func helloServer() (p1 net.Conn, ch_err chan error) {
+	p1, p2 := net.Pipe()
+	ch_err = make(chan error, 1)
+	go func() {
+		_, err := AuthConnInfo(okAuth{}, p2)
+		ch_err <- err
+		p2.Close()
+	}()
+	return
+}
+
+func TestHello(t *testing.T) {
+	SetLogging()
+	for _, asked := range []uint32{0, CAP_CHECKSUM, CAP_CHECKSUM | 1<<16} {
+		// newer client asks for caps we don't know.
+		p1, ch_err := helloServer()
+		err := WriteFrame(p1, MSG_HELLO, 0, &Hello{
+			Version: PROTO_VERSION + 1, Caps: asked})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hello Hello
+		f, err := ReadFrame(p1, &hello)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Header.Type != MSG_HELLO || hello.Version != PROTO_VERSION ||
+			hello.Caps != asked&CAP_CHECKSUM {
+			t.Fatalf("asked %d, got %s %+v", asked, f.Debug(), hello)
+		}
+		err = WriteFrame(p1, MSG_AUTH, 0, &Auth{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var errno Result
+		_, err = ReadFrame(p1, &errno)
+		if err != nil || errno != ERR_NONE {
+			t.Fatalf("auth failed: %d %v", errno, err)
+		}
+		if err = <-ch_err; err != nil {
+			t.Fatal(err)
+		}
+		p1.Close()
+	}
+}
+
+func TestHelloMismatch(t *testing.T) {
+	SetLogging()
+	// older client, told our version before closed.
+	p1, ch_err := helloServer()
+	go WriteFrame(p1, MSG_HELLO, 0, &Hello{Version: MIN_VERSION - 1})
+	var hello Hello
+	_, err := ReadFrame(p1, &hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.Version != PROTO_VERSION {
+		t.Fatalf("server version not told: %+v", hello)
+	}
+	if err = <-ch_err; !errors.Is(err, ErrVersion) {
+		t.Fatalf("expect version mismatch, got %v", err)
+	}
+	p1.Close()
+
+	// client never say hello.
+	p1, ch_err = helloServer()
+	go WriteFrame(p1, MSG_AUTH, 0, &Auth{})
+	if err = <-ch_err; !errors.Is(err, ErrVersion) {
+		t.Fatalf("expect version mismatch, got %v", err)
+	}
+	p1.Close()
+}
+
+func TestUnknownFrame(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	server := NewTunnelServer(p2)
+	go server.Loop()
+	defer server.Close()
+
+	// frame type from newer peer skipped, unknown flags ignored.
+	f := NewFrame(0xff, 1)
+	f.Data = []byte("future")
+	f.Header.Length = uint16(len(f.Data))
+	go func() {
+		f.WriteTo(p1)
+		ping := NewFrame(MSG_PING, 0)
+		ping.Header.Flags = 0xff
+		ping.Marshal(uint64(1))
+		ping.WriteTo(p1)
+	}()
+	fpong, err := readPeer(p1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fpong.Header.Type != MSG_PONG {
+		t.Fatalf("expect pong, got %s", fpong.Debug())
+	}
+	p1.Close()
+}
+
+func TestUnknownFrameInStream(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	server := NewTunnelServer(p2)
+	go server.Loop()
+	defer server.Close()
+	defer p1.Close()
+
+	go WriteFrame(p1, MSG_SYN, 1, &Syn{Network: "test", Address: "pair"})
+	_, err := readPeer(p1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := <-accepted
+
+	go func() {
+		dataFrame(1, "ab").WriteTo(p1)
+		for i := 0; i < 3; i++ {
+			f := NewFrame(0xfe, 1)
+			f.Data = []byte("future")
+			f.Header.Length = uint16(len(f.Data))
+			f.WriteTo(p1)
+		}
+		dataFrame(1, "cd").WriteTo(p1)
+	}()
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(c, buf)
+	if err != nil || string(buf) != "abcd" {
+		t.Fatalf("stream disturbed: %q, %v", buf, err)
+	}
+	if st := c.Status(); st.State != ST_EST {
+		t.Fatalf("stream should be kept: %+v", st)
+	}
+	if n := server.Stats().FramesIn[MSG_UNKNOWN]; n != 3 {
+		t.Fatalf("expect 3 unknown frames, got %d", n)
+	}
+
+	// strict fabric breaks.
+	p1, p2 = net.Pipe()
+	strict := NewTunnelServer(p2)
+	strict.Strict = true
+	done := make(chan struct{})
+	go func() {
+		strict.Loop()
+		close(done)
+	}()
+	defer p1.Close()
+	f := NewFrame(0xfe, 1)
+	go f.WriteTo(p1)
+	go io.Copy(io.Discard, p1)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("strict fabric should be closed by unknown frame")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	SetLogging()
+	c1, c2, stop, err := makePipeCaps(CAP_CHECKSUM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	go io.Copy(c2, c2)
+	data := make([]byte, 100*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go c1.Write(data)
+	buf := make([]byte, len(data))
+	_, err = io.ReadFull(c1, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("data not match")
+	}
+
+	// one bit flipped on the wire.
+	p1, p2 := net.Pipe()
+	server := NewTunnelServer(p2)
+	server.SetCaps(CAP_CHECKSUM)
+	done := make(chan struct{})
+	go func() {
+		server.Loop()
+		close(done)
+	}()
+	f := wndFrame(3, 1024)
+	b := f.Header.appendTo(nil)
+	b = append(b, f.Data...)
+	b = binary.BigEndian.AppendUint32(b, crc32.Checksum(b, castagnoli))
+	b[len(b)-5] ^= 0x01
+	failed := ChecksumFailures()
+	go p1.Write(b)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("fabric should be closed for bad checksum")
+	}
+	if ChecksumFailures() != failed+1 {
+		t.Fatalf("checksum failure not counted")
+	}
+	p1.Close()
+}
+
+func TestSettings(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	client := NewClient(p1)
+	server := NewTunnelServer(p2)
+	server.InitialWindow = 1024
+	server.MaxReadSize = 1000
+	server.MaxStreams = 2
+	go client.Loop()
+	go server.Loop()
+	defer client.Close()
+	defer server.Close()
+
+	for client.peerWindow() != 1024 {
+		time.Sleep(time.Millisecond)
+	}
+	c1, err := client.Dial("test", "pair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := <-accepted
+	if st := c1.(*Conn).Status(); st.Window != 1024 {
+		t.Fatalf("peer window not applied: %+v", st)
+	}
+	if size := c1.(*Conn).frameSize(); size != 1000 {
+		t.Fatalf("peer frame size not applied: %d", size)
+	}
+	// frame larger than 1000 breaks the server.
+	data := make([]byte, 1024)
+	go c1.Write(data)
+	_, err = io.ReadFull(srv, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.Dial("test", "pair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-accepted
+	_, err = client.Dial("test", "pair")
+	if !errors.Is(err, ErrTooManyStreams) {
+		t.Fatalf("expect too many streams, got %v", err)
+	}
+}
+
+func TestSettingsLate(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	fab := NewFabric(p1, 1)
+	defer fab.Close()
+	go io.Copy(io.Discard, p2)
+
+	// stream created before settings took the defaults.
+	c := NewConn(fab)
+	_, err := fab.PutIntoNextId(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		fab.Loop()
+		close(done)
+	}()
+
+	settings := &Settings{Window: 1024, MaxFrameSize: 1000}
+	err = WriteFrame(p2, MSG_SETTINGS, 0, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fab.peerWindow() != 1024 {
+		time.Sleep(time.Millisecond)
+	}
+	if st := c.Status(); st.Window != 1024 {
+		t.Fatalf("window not moved: %+v", st)
+	}
+
+	// no change in the middle for now.
+	err = WriteFrame(p2, MSG_SETTINGS, 0, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("fabric should be closed for settings changed")
+	}
+}
+
+func TestMaxStreams(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	client := NewClient(p1)
+	server := NewTunnelServer(p2)
+	client.MaxStreams = 2
+	go client.Loop()
+	go server.Loop()
+	defer client.Close()
+	defer server.Close()
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		c, err := client.Dial("test", "pair")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+		<-accepted
+	}
+	_, err := client.Dial("test", "pair")
+	if !errors.Is(err, ErrTooManyStreams) {
+		t.Fatalf("expect too many streams, got %v", err)
+	}
+	if st := client.Stats(); st.Streams != 2 || st.MaxStreams != 2 {
+		t.Fatalf("wrong stats: %+v", st)
+	}
+
+	// freed one can be used again.
+	conns[0].(*Conn).Abort()
+	for client.Stats().Streams != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = client.Dial("test", "pair")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-accepted
+}
+
+func TestMaxStreamsRefused(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	server := NewTunnelServer(p2)
+	server.MaxStreams = 1
+	go server.Loop()
+	defer server.Close()
+
+	// peer not told, or just ignored it.
+	for i, expect := range []uint32{ERR_NONE, ERR_TOOMANYSTREAMS} {
+		go WriteFrame(p1, MSG_SYN, uint16(2*i+1), &Syn{Network: "test", Address: "pair"})
+		var errno uint32
+		f, err := readPeer(p1, &errno)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Header.Type != MSG_RESULT || errno != expect {
+			t.Fatalf("expect %d, got %s %d", expect, f.Debug(), errno)
+		}
+	}
+	<-accepted
+	if st := server.Stats(); st.PeerStreams != 1 {
+		t.Fatalf("wrong stats: %+v", st)
+	}
+	if errnoErr(ERR_TOOMANYSTREAMS) != ErrTooManyStreams {
+		t.Fatal("errno not mapped")
+	}
+}
+
+func readString(t *testing.T, r io.Reader, n int) string {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+// waitWindow waits window of c given back to base.
+func waitWindow(t *testing.T, c *Conn) {
+	for i := 0; i < 100; i++ {
+		c.lock.Lock()
+		window, base := c.window, c.wnd_base
+		c.lock.Unlock()
+		if window == base {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("window not given back")
+}
+
+func TestEarlyData(t *testing.T) {
+	ctx := context.Background()
+	echo := tcpEcho(t)
+	for _, caps := range []uint32{CAP_EARLY, 0} {
+		cli, _, _ := newBindPair(t, caps)
+
+		conn, err := cli.DialWithData(ctx, "tcp", echo, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := readString(t, conn, 5); s != "hello" {
+			t.Fatalf("wrong echo %q", s)
+		}
+		waitWindow(t, conn.(*Conn))
+		conn.Close()
+
+		// more than syn takes, rest follows in data.
+		data := bytes.Repeat([]byte("0123456789"), EARLY_DATA_MAX/5)
+		conn, err = cli.DialWithData(ctx, "tcp", echo, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := readString(t, conn, len(data)); s != string(data) {
+			t.Fatal("wrong echo of large data")
+		}
+		waitWindow(t, conn.(*Conn))
+		conn.Close()
+	}
+}
+
+func TestEarlyDataHandler(t *testing.T) {
+	cli, _, _ := newBindPair(t, CAP_EARLY)
+	c := NewConn(cli)
+	go c.fab.dialData(context.Background(), c, "test", "early", []byte("ping"))
+	srv := <-accepted
+	// handlers not knowing it read early data first.
+	srv.Write([]byte("pong"))
+	if s := readString(t, srv, 4); s != "ping" {
+		t.Fatalf("wrong early data %q", s)
+	}
+	if s := readString(t, c, 4); s != "pong" {
+		t.Fatalf("wrong reply %q", s)
+	}
+	waitWindow(t, c)
+
+	// early data without CAP_EARLY is a protocol error.
+	cli, _, _ = newBindPair(t, 0)
+	cli.early = true
+	_, err := cli.DialWithData(context.Background(), "test", "early", []byte("ping"))
+	if !errors.Is(err, ErrProtocol) {
+		t.Fatalf("expect protocol error, got %v", err)
+	}
+}
+
+// delayConn delivers writes after delay, without blocking writer.
+type delayConn struct {
+	net.Conn
+	delay  time.Duration
+	ch     chan delayed
+	closed chan struct{}
+	once   sync.Once
+}
+
+type delayed struct {
+	at   time.Time
+	data []byte
+}
+
+func newDelayConn(conn net.Conn, delay time.Duration) *delayConn {
+	d := &delayConn{
+		Conn:   conn,
+		delay:  delay,
+		ch:     make(chan delayed, 1024),
+		closed: make(chan struct{}),
+	}
+	go func() {
+		for {
+			select {
+			case w := <-d.ch:
+				time.Sleep(time.Until(w.at))
+				if _, err := conn.Write(w.data); err != nil {
+					return
+				}
+			case <-d.closed:
+				return
+			}
+		}
+	}()
+	return d
+}
+
+func (d *delayConn) Write(b []byte) (int, error) {
+	select {
+	case d.ch <- delayed{at: time.Now().Add(d.delay), data: append([]byte(nil), b...)}:
+		return len(b), nil
+	case <-d.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (d *delayConn) Close() error {
+	d.once.Do(func() { close(d.closed) })
+	return d.Conn.Close()
+}
+
+func TestEarlyDataLatency(t *testing.T) {
+	SetLogging()
+	const delay = 30 * time.Millisecond
+	echo := tcpEcho(t)
+	p1, p2 := net.Pipe()
+	client := NewClient(newDelayConn(p1, delay))
+	server := NewTunnelServer(newDelayConn(p2, delay))
+	client.SetCaps(CAP_EARLY)
+	server.SetCaps(CAP_EARLY)
+	go client.Loop()
+	go server.Loop()
+	defer client.Close()
+	defer server.Close()
+
+	// time to first byte of reply.
+	measure := func(early bool) time.Duration {
+		start := time.Now()
+		var conn net.Conn
+		var err error
+		if early {
+			conn, err = client.DialWithData(context.Background(), "tcp", echo, []byte("ping"))
+		} else {
+			conn, err = client.Dial("tcp", echo)
+			if err == nil {
+				_, err = conn.Write([]byte("ping"))
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		readString(t, conn, 4)
+		return time.Since(start)
+	}
+
+	plain, early := measure(false), measure(true)
+	t.Logf("first byte in %s, %s with early data.", plain, early)
+	// two round trips against one, a trip saved at least.
+	if early > plain-delay {
+		t.Fatalf("early data saved nothing: %s vs %s", early, plain)
+	}
+}
@@ -0,0 +1,378 @@
+package tunnel
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// plaintext in one record, length of ciphertext before it in uint16.
+// record with RECORD_REKEY in length is the first under keys of rekey.
+const (
+	MAX_RECORD   = 16 * 1024
+	RECORD_REKEY = 1 << 15
+)
+
+// keyExchange holds our ephemeral key until peer's came in hello.
+type keyExchange struct {
+	priv *ecdh.PrivateKey
+}
+
+func newKeyExchange() (kx *keyExchange, err error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	return &keyExchange{priv: priv}, nil
+}
+
+func (kx *keyExchange) Public() []byte {
+	return kx.priv.PublicKey().Bytes()
+}
+
+// wrap derives keys with peer's public key and psk, and returns conn
+// encrypted by them. Peer without the psk gets wrong keys, and fails on
+// first record. caps bound in keys, so hello can't be changed on the wire.
+func (kx *keyExchange) wrap(conn net.Conn, psk, peer []byte, client bool, caps uint32) (ac *aeadConn, err error) {
+	pub, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrEncrypt, err)
+	}
+	shared, err := kx.priv.ECDH(pub)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrEncrypt, err)
+	}
+
+	mac := hmac.New(sha256.New, psk)
+	mac.Write(shared)
+	prk := mac.Sum(nil)
+	wipe(shared)
+	rkey, wkey := deriveKeys(prk, kx.Public(), peer, client, caps)
+	wipe(prk)
+	ac, err = newAeadConn(conn, rkey, wkey)
+	if err != nil {
+		wipe(rkey)
+		wipe(wkey)
+		return
+	}
+	ac.r_secret, ac.w_secret, ac.client, ac.caps = rkey, wkey, client, caps
+	return
+}
+
+// deriveKeys expands prk into keys we read and write, bound to public
+// keys of both and caps.
+func deriveKeys(prk, ours, peer []byte, client bool, caps uint32) (rkey, wkey []byte) {
+	cpub, spub := ours, peer
+	if !client {
+		cpub, spub = spub, cpub
+	}
+	expand := func(label string) []byte {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write([]byte(label))
+		mac.Write(cpub)
+		mac.Write(spub)
+		binary.Write(mac, binary.BigEndian, caps)
+		return mac.Sum(nil)
+	}
+
+	c2s, s2c := expand("goproxy c2s"), expand("goproxy s2c")
+	if client {
+		return s2c, c2s
+	}
+	return c2s, s2c
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// aeadConn encrypts everything on conn into records of chacha20-poly1305,
+// frame headers included. Nonces count records in each direction, from 0
+// again after rekey.
+type aeadConn struct {
+	net.Conn
+	rlock   sync.Mutex
+	in      cipher.AEAD
+	r_nonce uint64
+	r_buf   []byte
+	r_rest  []byte
+	r_err   error
+	// keys of rekey, till peer switches to them. records before it still
+	// opened by in.
+	r_next  cipher.AEAD
+	wlock   sync.Mutex
+	out     cipher.AEAD
+	w_nonce uint64
+	w_buf   []byte
+	// switched to at the next record. set without wlock, never waits
+	// for records in writing.
+	w_next atomic.Pointer[cipher.AEAD]
+	// plaintext written under out, and when out set.
+	w_bytes uint64
+	w_keyed time.Time
+	// ch_due told once w_bytes over it, and after each switch.
+	due_bytes  uint64
+	ch_due     chan struct{}
+	close_once sync.Once
+	ch_closed  chan struct{}
+	// keys of each way last set, chained into those of next rekey.
+	klock    sync.Mutex
+	r_secret []byte
+	w_secret []byte
+	client   bool
+	caps     uint32
+	// rekey of keys we write, till peer answers.
+	kx *keyExchange
+}
+
+func newAeadConn(conn net.Conn, rkey, wkey []byte) (ac *aeadConn, err error) {
+	in, err := chacha20poly1305.New(rkey)
+	if err != nil {
+		return
+	}
+	out, err := chacha20poly1305.New(wkey)
+	if err != nil {
+		return
+	}
+	ac = &aeadConn{
+		Conn:      conn,
+		in:        in,
+		out:       out,
+		r_buf:     make([]byte, 2+MAX_RECORD+in.Overhead()),
+		w_buf:     make([]byte, 2+MAX_RECORD+out.Overhead()),
+		w_keyed:   time.Now(),
+		ch_due:    make(chan struct{}, 1),
+		ch_closed: make(chan struct{}),
+	}
+	return
+}
+
+func makeNonce(nonce []byte, n uint64) []byte {
+	for i := range nonce {
+		nonce[i] = 0
+	}
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], n)
+	return nonce
+}
+
+// NetConn returns conn under it.
+func (ac *aeadConn) NetConn() net.Conn {
+	return ac.Conn
+}
+
+func (ac *aeadConn) Close() error {
+	ac.close_once.Do(func() { close(ac.ch_closed) })
+	return ac.Conn.Close()
+}
+
+func (ac *aeadConn) Read(b []byte) (n int, err error) {
+	ac.rlock.Lock()
+	defer ac.rlock.Unlock()
+	if len(ac.r_rest) == 0 {
+		if ac.r_err != nil {
+			return 0, ac.r_err
+		}
+		err = ac.readRecord()
+		if err != nil {
+			return
+		}
+	}
+	n = copy(b, ac.r_rest)
+	ac.r_rest = ac.r_rest[n:]
+	return
+}
+
+// readRecord reads and opens next record into r_rest. After records
+// broken, nothing can be read any more.
+func (ac *aeadConn) readRecord() (err error) {
+	_, err = io.ReadFull(ac.Conn, ac.r_buf[:2])
+	if err != nil {
+		return
+	}
+	size := int(binary.BigEndian.Uint16(ac.r_buf[:2]))
+	if size&RECORD_REKEY != 0 {
+		if ac.r_next == nil {
+			ac.r_err = fmt.Errorf("%w: rekey not agreed.", ErrEncrypt)
+			return ac.r_err
+		}
+		// old keys dropped, peer never uses them again.
+		ac.in, ac.r_next, ac.r_nonce = ac.r_next, nil, 0
+		size &^= RECORD_REKEY
+	}
+	if size < ac.in.Overhead() || size > MAX_RECORD+ac.in.Overhead() {
+		ac.r_err = fmt.Errorf("%w: record size %d.", ErrEncrypt, size)
+		return ac.r_err
+	}
+	record := ac.r_buf[2 : 2+size]
+	_, err = io.ReadFull(ac.Conn, record)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return
+	}
+
+	var nonce [chacha20poly1305.NonceSize]byte
+	ac.r_rest, err = ac.in.Open(
+		record[:0], makeNonce(nonce[:], ac.r_nonce), record, nil)
+	if err != nil {
+		ac.r_err = fmt.Errorf("%w: record %d: %w", ErrEncrypt, ac.r_nonce, err)
+		return ac.r_err
+	}
+	ac.r_nonce++
+	return
+}
+
+func (ac *aeadConn) Write(b []byte) (n int, err error) {
+	ac.wlock.Lock()
+	defer ac.wlock.Unlock()
+	var nonce [chacha20poly1305.NonceSize]byte
+	for len(b) > 0 {
+		size := len(b)
+		if size > MAX_RECORD {
+			size = MAX_RECORD
+		}
+		var flag uint16
+		if next := ac.w_next.Swap(nil); next != nil {
+			ac.out = *next
+			ac.w_nonce, ac.w_bytes, ac.w_keyed = 0, 0, time.Now()
+			flag = RECORD_REKEY
+			ac.notifyDue()
+		}
+		record := ac.out.Seal(ac.w_buf[2:2], makeNonce(nonce[:], ac.w_nonce), b[:size], nil)
+		binary.BigEndian.PutUint16(ac.w_buf[:2], uint16(len(record))|flag)
+		_, err = ac.Conn.Write(ac.w_buf[:2+len(record)])
+		if err != nil {
+			return
+		}
+		ac.w_nonce++
+		if ac.due_bytes != 0 && ac.w_bytes < ac.due_bytes && ac.w_bytes+uint64(size) >= ac.due_bytes {
+			ac.notifyDue()
+		}
+		ac.w_bytes += uint64(size)
+		n += size
+		b = b[size:]
+	}
+	return
+}
+
+func (ac *aeadConn) notifyDue() {
+	select {
+	case ac.ch_due <- struct{}{}:
+	default:
+	}
+}
+
+// keyed tells when keys we write in set, and bytes written under them.
+func (ac *aeadConn) keyed() (t time.Time, written uint64) {
+	ac.wlock.Lock()
+	defer ac.wlock.Unlock()
+	return ac.w_keyed, ac.w_bytes
+}
+
+func (ac *aeadConn) setDueBytes(n uint64) {
+	ac.wlock.Lock()
+	defer ac.wlock.Unlock()
+	ac.due_bytes = n
+}
+
+// chain mixes shared of priv and peer into secret, and derives keys of
+// both ways from it. secret wiped.
+func (ac *aeadConn) chain(secret []byte, priv *ecdh.PrivateKey, peer []byte) (rkey, wkey []byte, err error) {
+	defer wipe(secret)
+	pub, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrEncrypt, err)
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrEncrypt, err)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(shared)
+	wipe(shared)
+	prk := mac.Sum(nil)
+	defer wipe(prk)
+	rkey, wkey = deriveKeys(prk, priv.PublicKey().Bytes(), peer, ac.client, ac.caps)
+	return
+}
+
+// startRekey returns our half of rekey for keys we write, nil if one
+// going.
+func (ac *aeadConn) startRekey() (kx *keyExchange, err error) {
+	ac.klock.Lock()
+	defer ac.klock.Unlock()
+	if ac.kx != nil {
+		return
+	}
+	kx, err = newKeyExchange()
+	if err != nil {
+		return
+	}
+	ac.kx = kx
+	return
+}
+
+// answerRekey takes rekey of keys peer writes, and returns our public key
+// for answer. New keys are read once peer flags a record, after answer.
+// Keys we write never changed by it, so rekeys of both ways can cross.
+func (ac *aeadConn) answerRekey(peer []byte) (pub []byte, err error) {
+	kx, err := newKeyExchange()
+	if err != nil {
+		return
+	}
+	ac.klock.Lock()
+	defer ac.klock.Unlock()
+	rkey, wkey, err := ac.chain(ac.r_secret, kx.priv, peer)
+	ac.r_secret = rkey
+	if err != nil {
+		return
+	}
+	wipe(wkey)
+	in, err := chacha20poly1305.New(rkey)
+	if err != nil {
+		return
+	}
+	// peer sends no rekey again before it flags, one next at most.
+	ac.rlock.Lock()
+	ac.r_next = in
+	ac.rlock.Unlock()
+	return kx.Public(), nil
+}
+
+// finishRekey takes answer of peer, we write in new keys from the next
+// record, flagged.
+func (ac *aeadConn) finishRekey(peer []byte) (err error) {
+	ac.klock.Lock()
+	defer ac.klock.Unlock()
+	kx := ac.kx
+	if kx == nil {
+		return fmt.Errorf("%w: rekey answer not asked.", ErrEncrypt)
+	}
+	ac.kx = nil
+	rkey, wkey, err := ac.chain(ac.w_secret, kx.priv, peer)
+	ac.w_secret = wkey
+	if err != nil {
+		return
+	}
+	wipe(rkey)
+	out, err := chacha20poly1305.New(wkey)
+	if err != nil {
+		return
+	}
+	ac.w_next.Store(&out)
+	return
+}
@@ -0,0 +1,154 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type keyAuth []byte
+
+func (keyAuth) AuthPass(string, string) bool { return true }
+func (ka keyAuth) PreSharedKey() []byte      { return ka }
+
+// sniffConn keeps all bytes written by client.
+type sniffConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (sc *sniffConn) Write(b []byte) (n int, err error) {
+	sc.buf.Write(b)
+	return sc.Conn.Write(b)
+}
+
+// pipeDialer runs server on the other side of a pipe, for each dial.
+type pipeDialer struct {
+	auth   PasswordAuthenticator
+	sniff  *sniffConn
+	ch_err chan error
+	// RekeyBytes of server fabrics, default if 0.
+	rekey uint64
+}
+
+func (pd *pipeDialer) Dial(network, address string) (conn net.Conn, err error) {
+	p1, p2 := net.Pipe()
+	go func() {
+		info, err := AuthConnInfo(pd.auth, p2)
+		pd.ch_err <- err
+		if err != nil {
+			p2.Close()
+			return
+		}
+		server := NewTunnelServer(info.Conn)
+		server.SetCaps(info.Caps)
+		server.RekeyBytes = pd.rekey
+		server.Account = info.Account
+		defer info.Account.Release()
+		server.Loop()
+	}()
+	pd.sniff = &sniffConn{Conn: p1}
+	return pd.sniff, nil
+}
+
+func dialEncrypted(auth PasswordAuthenticator, key []byte) (client *Client, pd *pipeDialer, err error) {
+	pd = &pipeDialer{auth: auth, ch_err: make(chan error, 1)}
+	dc := NewDialerCreator(pd, "pipe", "pipe", "user", "secret")
+	dc.Key = key
+	dc.Compress = true
+	client, err = dc.Create()
+	return
+}
+
+func TestEncrypt(t *testing.T) {
+	SetLogging()
+	client, pd, err := dialEncrypted(keyAuth("psk"), []byte("psk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-pd.ch_err; err != nil {
+		t.Fatal(err)
+	}
+	go client.Loop()
+	defer client.Close()
+
+	c, err := client.Dial("test", "secret.example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := <-accepted
+	defer c.Close()
+	defer srv.Close()
+
+	data := bytes.Repeat([]byte("plain text in fabric. "), 1000)
+	go c.Write(data)
+	got := make([]byte, len(data))
+	_, err = io.ReadFull(srv, got)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("data mismatch: %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	wire := pd.sniff.buf.Bytes()
+	for _, s := range []string{"secret", "plain text", "example.com"} {
+		if bytes.Contains(wire, []byte(s)) {
+			t.Fatalf("%q on the wire", s)
+		}
+	}
+}
+
+func TestEncryptWrongKey(t *testing.T) {
+	SetLogging()
+	_, pd, err := dialEncrypted(keyAuth("psk"), []byte("wrong"))
+	if err == nil {
+		t.Fatal("auth passed with wrong key")
+	}
+	if err = <-pd.ch_err; !errors.Is(err, ErrEncrypt) {
+		t.Fatalf("server should fail decrypting: %v", err)
+	}
+}
+
+func TestEncryptNotAgreed(t *testing.T) {
+	SetLogging()
+	// server without key, client never falls back.
+	_, _, err := dialEncrypted(okAuth{}, []byte("psk"))
+	if !errors.Is(err, ErrEncrypt) {
+		t.Fatalf("plain fabric with key: %v", err)
+	}
+}
+
+func TestAeadTamper(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	p1, p2 := net.Pipe()
+	w, _ := newAeadConn(p1, key, key)
+	r, _ := newAeadConn(&flipConn{Conn: p2}, key, key)
+	defer p1.Close()
+	defer p2.Close()
+
+	go w.Write([]byte("hello"))
+	_, err := r.Read(make([]byte, 16))
+	if !errors.Is(err, ErrEncrypt) {
+		t.Fatalf("tampered record accepted: %v", err)
+	}
+	// broken for good.
+	_, err = r.Read(make([]byte, 16))
+	if !errors.Is(err, ErrEncrypt) {
+		t.Fatalf("read after broken: %v", err)
+	}
+}
+
+// flipConn flips last byte read.
+type flipConn struct {
+	net.Conn
+}
+
+func (fc *flipConn) Read(b []byte) (n int, err error) {
+	n, err = fc.Conn.Read(b)
+	if n > 0 {
+		b[n-1] ^= 1
+	}
+	return
+}
@@ -0,0 +1,193 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DestLimits caps conns at the same time to each destination, host:port
+// after resolved, in all fabrics sharing it. So a client retrying in loop
+// can't get us banned by target. Set options before use.
+type DestLimits struct {
+	// conns to each destination, 0 means no limit. MaxPerDest of rule in
+	// ACL matched overrides it.
+	Max int
+	// stream over limit waits that long at most for one closed, then
+	// refused with ERR_TOOMANYSTREAMS. 0 refuses at once.
+	Wait time.Duration
+	// destinations without conns forgotten after it, DEST_IDLE if 0.
+	Idle time.Duration
+
+	lock  sync.Mutex
+	dests map[string]*destEntry
+	swept time.Time
+}
+
+type destEntry struct {
+	conns   int
+	waiting int
+	refused uint64
+	// when the last conn closed.
+	idle time.Time
+	// closed when a conn closed, waiting ones check again.
+	wake chan struct{}
+}
+
+// DestCount is a snapshot of a destination, for admin.
+type DestCount struct {
+	Dest    string
+	Conns   int
+	Waiting int
+	// refused since it kept in table.
+	Refused uint64
+}
+
+func NewDestLimits(max int, wait time.Duration) *DestLimits {
+	return &DestLimits{Max: max, Wait: wait}
+}
+
+// acquire counts a conn to dest, max 0 or negative means no limit. Over max
+// it waits for Wait or ctx, ErrTooManyStreams if none closed in it. call
+// release once conn closed.
+func (dl *DestLimits) acquire(ctx context.Context, dest string, max int) (release func(), err error) {
+	if max <= 0 {
+		return func() {}, nil
+	}
+	var timer *time.Timer
+	dl.lock.Lock()
+	dl.sweep(time.Now())
+	if dl.dests == nil {
+		dl.dests = make(map[string]*destEntry)
+	}
+	e, ok := dl.dests[dest]
+	if !ok {
+		e = &destEntry{}
+		dl.dests[dest] = e
+	}
+	for e.conns >= max {
+		if dl.Wait <= 0 {
+			e.refused++
+			dl.lock.Unlock()
+			return nil, ErrTooManyStreams
+		}
+		if timer == nil {
+			timer = time.NewTimer(dl.Wait)
+			defer timer.Stop()
+		}
+		if e.wake == nil {
+			e.wake = make(chan struct{})
+		}
+		wake := e.wake
+		e.waiting++
+		dl.lock.Unlock()
+
+		select {
+		case <-wake:
+		case <-timer.C:
+			err = ErrTooManyStreams
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		dl.lock.Lock()
+		e.waiting--
+		if err != nil {
+			e.refused++
+			dl.lock.Unlock()
+			return nil, err
+		}
+	}
+	e.conns++
+	dl.lock.Unlock()
+
+	var once sync.Once
+	return func() { once.Do(func() { dl.release(e) }) }, nil
+}
+
+func (dl *DestLimits) release(e *destEntry) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	e.conns--
+	if e.conns == 0 {
+		e.idle = time.Now()
+	}
+	if e.wake != nil {
+		close(e.wake)
+		e.wake = nil
+	}
+}
+
+// sweep forgets destinations idle longer than Idle, once in it at most.
+// call with lock held.
+func (dl *DestLimits) sweep(now time.Time) {
+	idle := dl.Idle
+	if idle == 0 {
+		idle = DEST_IDLE * time.Millisecond
+	}
+	if now.Sub(dl.swept) < idle {
+		return
+	}
+	dl.swept = now
+	for dest, e := range dl.dests {
+		if e.conns == 0 && e.waiting == 0 && now.Sub(e.idle) >= idle {
+			delete(dl.dests, dest)
+		}
+	}
+}
+
+// Top returns n destinations with most conns, all if n is 0.
+func (dl *DestLimits) Top(n int) (counts []DestCount) {
+	dl.lock.Lock()
+	for dest, e := range dl.dests {
+		counts = append(counts, DestCount{
+			Dest:    dest,
+			Conns:   e.conns,
+			Waiting: e.waiting,
+			Refused: e.refused,
+		})
+	}
+	dl.lock.Unlock()
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Conns != counts[j].Conns {
+			return counts[i].Conns > counts[j].Conns
+		}
+		return counts[i].Dest < counts[j].Dest
+	})
+	if n > 0 && len(counts) > n {
+		counts = counts[:n]
+	}
+	return
+}
+
+// limitDest counts conn of c to address resolved, by DestLimits of fabric
+// and MaxPerDest of rule matched. release is never nil, call it after conn
+// closed.
+func (fab *Fabric) limitDest(ctx context.Context, c *Conn, address string) (release func(), err error) {
+	dl := fab.DestLimits
+	if dl == nil {
+		return func() {}, nil
+	}
+	max := dl.Max
+	if p := fab.policy(); !p.empty() {
+		host, _, _ := net.SplitHostPort(c.Address)
+		name := host
+		if net.ParseIP(host) != nil {
+			name = ""
+		}
+		h, sport, _ := net.SplitHostPort(address)
+		port, _ := strconv.Atoi(sport)
+		if n := p.destMax(c.Network, name, net.ParseIP(h), port); n != 0 {
+			max = n
+		}
+	}
+	release, err = dl.acquire(ctx, address, max)
+	if err != nil {
+		logger.Noticef("%s too many conns to %s, refuse %s:%s.",
+			c.String(), address, c.Network, c.Address)
+		return func() {}, err
+	}
+	return
+}
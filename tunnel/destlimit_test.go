@@ -0,0 +1,122 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDestLimits(t *testing.T) {
+	ctx := context.Background()
+	dl := NewDestLimits(2, 0)
+	r1, err := dl.acquire(ctx, "10.0.0.1:80", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, _ := dl.acquire(ctx, "10.0.0.1:80", 2)
+	if _, err = dl.acquire(ctx, "10.0.0.1:80", 2); err != ErrTooManyStreams {
+		t.Fatalf("expect too many streams, got %v", err)
+	}
+	// others not affected, no limit for negative.
+	r3, err := dl.acquire(ctx, "10.0.0.2:80", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dl.acquire(ctx, "10.0.0.1:80", -1); err != nil {
+		t.Fatal(err)
+	}
+
+	top := dl.Top(1)
+	if len(top) != 1 || top[0].Dest != "10.0.0.1:80" || top[0].Conns != 2 || top[0].Refused != 1 {
+		t.Fatalf("wrong top: %+v", top)
+	}
+
+	// waits for one closed.
+	dl.Wait = time.Second
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		r1()
+		// twice counts once.
+		r1()
+	}()
+	start := time.Now()
+	r4, err := dl.acquire(ctx, "10.0.0.1:80", 2)
+	if err != nil || time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("expect waited, got %v in %s", err, time.Since(start))
+	}
+
+	// waits no longer than Wait or ctx.
+	dl.Wait = 50 * time.Millisecond
+	if _, err = dl.acquire(ctx, "10.0.0.1:80", 2); err != ErrTooManyStreams {
+		t.Fatalf("expect too many streams, got %v", err)
+	}
+	dl.Wait = time.Second
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err = dl.acquire(cctx, "10.0.0.1:80", 2); err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline, got %v", err)
+	}
+
+	// idle ones forgotten.
+	r2()
+	r3()
+	r4()
+	dl.Idle = 10 * time.Millisecond
+	time.Sleep(20 * time.Millisecond)
+	r5, _ := dl.acquire(ctx, "10.0.0.3:80", 2)
+	defer r5()
+	if top = dl.Top(0); len(top) != 1 || top[0].Dest != "10.0.0.3:80" {
+		t.Fatalf("idle not evicted: %+v", top)
+	}
+}
+
+// waitDests waits conns to all destinations closed.
+func waitDests(t *testing.T, dl *DestLimits) {
+	for i := 0; i < 100; i++ {
+		top := dl.Top(1)
+		if len(top) == 0 || top[0].Conns == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("conns not released")
+}
+
+func TestTcpProxyDestLimits(t *testing.T) {
+	echo := tcpEcho(t)
+	cli, srv := newConnPair(t)
+	dl := NewDestLimits(1, 0)
+	srv.fab.DestLimits = dl
+	client := &Client{Fabric: cli.fab}
+
+	conn, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Dial("tcp", echo)
+	if !errors.Is(err, ErrTooManyStreams) {
+		t.Fatalf("expect too many streams, got %v", err)
+	}
+	echoOnce(t, conn, "")
+	waitDests(t, dl)
+	conn, err = client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// exempted by rule.
+	srv.fab.Guard = NewGuard(&ACL{Rules: []*Rule{
+		{Nets: mustCIDRs(t, "127.0.0.0/8"), MaxPerDest: -1},
+	}})
+	conn2, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoOnce(t, conn2, "")
+	echoOnce(t, conn, "")
+	waitDests(t, dl)
+	if top := dl.Top(0); len(top) != 1 || top[0].Dest != echo || top[0].Refused != 1 {
+		t.Fatalf("wrong top: %+v", top)
+	}
+}
@@ -0,0 +1,82 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+// DgramConn carries datagrams over a stream, each one with 2 bytes length
+// before it, so boundaries are kept. Read and Write work like a connected
+// UDPConn.
+type DgramConn struct {
+	net.Conn
+	rlock sync.Mutex
+	rhdr  [2]byte
+	wlock sync.Mutex
+	wbuf  []byte
+}
+
+func NewDgramConn(conn net.Conn) *DgramConn {
+	return &DgramConn{Conn: conn}
+}
+
+// ReadMsg reads one datagram, the part over len(b) is dropped.
+func (d *DgramConn) ReadMsg(b []byte) (n int, err error) {
+	d.rlock.Lock()
+	defer d.rlock.Unlock()
+	_, err = io.ReadFull(d.Conn, d.rhdr[:])
+	if err != nil {
+		return
+	}
+	size := int(binary.BigEndian.Uint16(d.rhdr[:]))
+	n = size
+	if n > len(b) {
+		n = len(b)
+	}
+	_, err = io.ReadFull(d.Conn, b[:n])
+	if err != nil {
+		return 0, noEOF(err)
+	}
+	if size > n {
+		_, err = io.CopyN(io.Discard, d.Conn, int64(size-n))
+		if err != nil {
+			return 0, noEOF(err)
+		}
+	}
+	return
+}
+
+// WriteMsg writes b as one datagram.
+func (d *DgramConn) WriteMsg(b []byte) (n int, err error) {
+	if len(b) > MAX_DGRAM {
+		return 0, ErrDgramTooLarge
+	}
+	d.wlock.Lock()
+	defer d.wlock.Unlock()
+	d.wbuf = append(d.wbuf[:0], 0, 0)
+	binary.BigEndian.PutUint16(d.wbuf, uint16(len(b)))
+	d.wbuf = append(d.wbuf, b...)
+	_, err = d.Conn.Write(d.wbuf)
+	if err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+func (d *DgramConn) Read(b []byte) (n int, err error) {
+	return d.ReadMsg(b)
+}
+
+func (d *DgramConn) Write(b []byte) (n int, err error) {
+	return d.WriteMsg(b)
+}
+
+// noEOF tells stream broken in the middle of a datagram.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+package tunnel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDgramConn(t *testing.T) {
+	cli, srv := newConnPair(t)
+	dc, ds := NewDgramConn(cli), NewDgramConn(srv)
+
+	sizes := []int{0, 1, 3000, MAX_DGRAM}
+	data := randomData(MAX_DGRAM)
+	go func() {
+		for _, n := range sizes {
+			if _, err := dc.WriteMsg(data[:n]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	buf := make([]byte, MAX_DGRAM)
+	for _, size := range sizes {
+		n, err := ds.ReadMsg(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != size || !bytes.Equal(buf[:n], data[:size]) {
+			t.Fatalf("expect datagram of %d, got %d", size, n)
+		}
+	}
+
+	if _, err := dc.WriteMsg(make([]byte, MAX_DGRAM+1)); err != ErrDgramTooLarge {
+		t.Fatalf("expect too large, got %v", err)
+	}
+
+	// short buffer truncates one, next one kept.
+	go func() {
+		dc.Write([]byte("0123456789"))
+		dc.Write([]byte("abc"))
+	}()
+	n, err := ds.Read(buf[:4])
+	if err != nil || string(buf[:n]) != "0123" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+	n, err = ds.Read(buf)
+	if err != nil || string(buf[:n]) != "abc" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+}
+
+// udpEcho sends datagrams back, until closed.
+func udpEcho(t *testing.T) (addr string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, MAX_DGRAM)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], from)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestUdpProxy(t *testing.T) {
+	addr := udpEcho(t)
+	cli, _ := newConnPair(t)
+	client := &Client{Fabric: cli.fab}
+
+	conn, err := client.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDgramConn(conn)
+	defer d.Close()
+
+	buf := make([]byte, MAX_DGRAM)
+	for _, msg := range []string{"hello", "world", PAYLOAD} {
+		if _, err = d.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		d.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := d.Read(buf)
+		if err != nil || string(buf[:n]) != msg {
+			t.Fatalf("expect %q, got %q %v", msg, buf[:n], err)
+		}
+	}
+}
+
+func TestUdpIdle(t *testing.T) {
+	conn, err := net.Dial("udp", udpEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, srv := newConnPair(t)
+	p := &UdpProxy{IdleTimeout: 50 * time.Millisecond}
+	go p.relay(conn, NewDgramConn(srv))
+
+	// nothing either way, server closes the stream.
+	d := NewDgramConn(cli)
+	d.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	start := time.Now()
+	_, err = d.Read(buf)
+	if err == nil || isTimeout(err) {
+		t.Fatalf("expect stream closed, got %v", err)
+	}
+	if time.Since(start) < 40*time.Millisecond {
+		t.Fatal("closed before idle timeout")
+	}
+}
@@ -0,0 +1,77 @@
+package tunnel
+
+const (
+	dial_none = iota
+	dial_queued
+	dial_running
+)
+
+type pendingDial struct {
+	c       *Conn
+	handler Handler
+}
+
+// startDial runs handler for the stream, if MaxDialing allows. Or it waits
+// in backlog, or refused with ERR_DIALBUSY if backlog full.
+func (fab *Fabric) startDial(c *Conn, handler Handler) (err error) {
+	fab.dlock.Lock()
+	switch {
+	case fab.MaxDialing <= 0 || fab.dialing < fab.MaxDialing:
+		fab.dialing++
+		c.dial_state = dial_running
+		fab.dlock.Unlock()
+		go handler.Handle(c)
+		return
+	case len(fab.dial_queue) < fab.DialBacklog:
+		c.dial_state = dial_queued
+		fab.dial_queue = append(fab.dial_queue, pendingDial{c, handler})
+		fab.dlock.Unlock()
+		return
+	}
+	fab.dlock.Unlock()
+
+	logger.Infof("%s too many dialing, refuse stream %d.",
+		fab.String(), c.streamid)
+	return c.DenyWith(ERR_DIALBUSY)
+}
+
+// dialDone frees the place of stream after result sent or stream gone,
+// first one in backlog will be started.
+func (fab *Fabric) dialDone(c *Conn) {
+	// streams in backlog are all going, if fabric closed.
+	fab.plock.RLock()
+	closed := fab.closed
+	fab.plock.RUnlock()
+
+	fab.dlock.Lock()
+	switch c.dial_state {
+	case dial_none:
+		fab.dlock.Unlock()
+		return
+	case dial_queued:
+		for i, p := range fab.dial_queue {
+			if p.c == c {
+				fab.dial_queue = append(fab.dial_queue[:i], fab.dial_queue[i+1:]...)
+				break
+			}
+		}
+		c.dial_state = dial_none
+		fab.dlock.Unlock()
+		return
+	}
+	c.dial_state = dial_none
+	fab.dialing--
+
+	var next pendingDial
+	if len(fab.dial_queue) > 0 && !closed {
+		next = fab.dial_queue[0]
+		fab.dial_queue = fab.dial_queue[1:]
+		next.c.dial_state = dial_running
+		fab.dialing++
+	}
+	fab.dlock.Unlock()
+
+	if next.c != nil {
+		go next.handler.Handle(next.c)
+	}
+}
@@ -0,0 +1,95 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// holdHandler gives out streams still dialing, result not sent.
+type holdHandler chan *Conn
+
+func (h holdHandler) Handle(fabconn net.Conn) (err error) {
+	h <- fabconn.(*Conn)
+	return
+}
+
+var holding = make(holdHandler, 16)
+
+func init() {
+	RegisterNetwork("hold", holding)
+}
+
+func expectResult(t *testing.T, r net.Conn, streamid uint16, expect uint32) {
+	var errno uint32
+	f, err := readPeer(r, &errno)
+	if err != nil || f.Header.Type != MSG_RESULT || f.Header.Streamid != streamid || errno != expect {
+		t.Fatalf("expect result %d for %d, got %v %v %d", expect, streamid, f, err, errno)
+	}
+}
+
+func nextHolding(t *testing.T, address string) (c *Conn) {
+	select {
+	case c = <-holding:
+	case <-time.After(time.Second):
+		t.Fatalf("%s not dialing", address)
+	}
+	if c.Address != address {
+		t.Fatalf("expect %s dialing, got %s", address, c.Address)
+	}
+	return
+}
+
+func TestMaxDialing(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	server := NewTunnelServer(p2)
+	server.MaxDialing = 1
+	server.DialBacklog = 2
+	go server.Loop()
+	defer server.Close()
+	defer p1.Close()
+
+	go func() {
+		for i, address := range []string{"a", "b", "c", "d"} {
+			syn := &Syn{Network: "hold", Address: address}
+			WriteFrame(p1, MSG_SYN, uint16(2*i+1), syn)
+		}
+	}()
+	// over backlog refused, and not left in fabric.
+	expectResult(t, p1, 7, ERR_DIALBUSY)
+	a := nextHolding(t, "a")
+	// refused one removed after result sent.
+	time.Sleep(20 * time.Millisecond)
+	st := server.Stats()
+	if st.Dialing != 1 || st.DialQueued != 2 || st.PeerStreams != 3 {
+		t.Fatalf("wrong stats: %+v", st)
+	}
+
+	// queued ones go in order.
+	go a.Accept()
+	expectResult(t, p1, 1, ERR_NONE)
+	b := nextHolding(t, "b")
+
+	// reset in backlog leaves it.
+	go WriteFrame(p1, MSG_RST, 5, nil)
+	time.Sleep(20 * time.Millisecond)
+	if st = server.Stats(); st.Dialing != 1 || st.DialQueued != 0 || st.PeerStreams != 2 {
+		t.Fatalf("wrong stats: %+v", st)
+	}
+
+	// denied one frees its place too.
+	go b.Deny()
+	expectResult(t, p1, 3, ERR_CONNFAILED)
+	select {
+	case c := <-holding:
+		t.Fatalf("%s should not dialing", c.Address)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if st = server.Stats(); st.Dialing != 0 || st.DialQueued != 0 || st.PeerStreams != 1 {
+		t.Fatalf("wrong stats: %+v", st)
+	}
+	if errnoErr(ERR_DIALBUSY) != ErrDialBusy {
+		t.Fatal("wrong error of dial busy")
+	}
+}
@@ -0,0 +1,189 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DnsQuery asks peer to resolve Host, Id comes back in answer.
+type DnsQuery struct {
+	Id   uint32
+	Host string
+	// "ip", "ip4" or "ip6", like net.Resolver.
+	Network string
+}
+
+type DnsAddr struct {
+	IP net.IP
+	// in seconds.
+	TTL uint32
+}
+
+type DnsAnswer struct {
+	Id    uint32
+	Addrs []DnsAddr `json:",omitempty"`
+	// error of resolver in peer, empty if resolved.
+	Err      string `json:",omitempty"`
+	NotFound bool   `json:",omitempty"`
+}
+
+// IPResolver resolves hosts for peer, net.Resolver is one.
+type IPResolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// lookupTTL resolves by r, with DNS_TTL if r can't tell ttl.
+func lookupTTL(ctx context.Context, r IPResolver, network, host string) (addrs []DnsAddr, err error) {
+	if tr, ok := r.(TTLResolver); ok {
+		return tr.LookupIPTTL(ctx, network, host)
+	}
+	ips, err := r.LookupIP(ctx, network, host)
+	for _, ip := range ips {
+		addrs = append(addrs, DnsAddr{IP: ip, TTL: DNS_TTL})
+	}
+	return
+}
+
+// LookupIP resolves host by peer, CAP_DNS should be agreed.
+func (fab *Fabric) LookupIP(ctx context.Context, network, host string) (ips []net.IP, err error) {
+	addrs, err := fab.LookupIPTTL(ctx, network, host)
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return
+}
+
+// LookupIPTTL resolves host by peer, with ttl peer told.
+func (fab *Fabric) LookupIPTTL(ctx context.Context, network, host string) (addrs []DnsAddr, err error) {
+	if !fab.dns {
+		return nil, ErrNoDns
+	}
+	ch := make(chan *DnsAnswer, 1)
+	fab.qlock.Lock()
+	if fab.q_closed {
+		fab.qlock.Unlock()
+		return nil, net.ErrClosed
+	}
+	fab.next_query++
+	id := fab.next_query
+	fab.queries[id] = ch
+	fab.qlock.Unlock()
+
+	defer func() {
+		fab.qlock.Lock()
+		delete(fab.queries, id)
+		fab.qlock.Unlock()
+	}()
+
+	err = SendFrame(fab, MSG_DNS, 0, &DnsQuery{Id: id, Host: host, Network: network})
+	if err != nil {
+		return
+	}
+
+	var answer *DnsAnswer
+	select {
+	case answer = <-ch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if answer == nil {
+		return nil, net.ErrClosed
+	}
+	if answer.Err != "" {
+		return nil, &net.DNSError{
+			Err:        answer.Err,
+			Name:       host,
+			Server:     fab.String(),
+			IsNotFound: answer.NotFound,
+		}
+	}
+	return answer.Addrs, nil
+}
+
+// closeQueries fails lookups waiting, no more will be sent.
+func (fab *Fabric) closeQueries() {
+	fab.qlock.Lock()
+	defer fab.qlock.Unlock()
+	fab.q_closed = true
+	for id, ch := range fab.queries {
+		close(ch)
+		delete(fab.queries, id)
+	}
+}
+
+func (fab *Fabric) onDnsAnswer(f *Frame) {
+	var answer DnsAnswer
+	err := f.Unmarshal(&answer)
+	if err != nil {
+		return
+	}
+	fab.qlock.Lock()
+	ch, ok := fab.queries[answer.Id]
+	delete(fab.queries, answer.Id)
+	fab.qlock.Unlock()
+	if !ok {
+		// lookup gave up already.
+		logger.Debugf("%s dns answer for %d dropped.", fab.String(), answer.Id)
+		return
+	}
+	ch <- &answer
+}
+
+// onDns resolves in background, Loop should not wait for it.
+func (fab *Fabric) onDns(f *Frame) {
+	if !fab.dns {
+		logger.Warningf("%s dns query without CAP_DNS, ignored.", fab.String())
+		return
+	}
+	var query DnsQuery
+	err := f.Unmarshal(&query)
+	if err != nil {
+		return
+	}
+	if atomic.AddInt32(&fab.resolving, 1) > DNS_MAX_PENDING {
+		atomic.AddInt32(&fab.resolving, -1)
+		fab.sendAnswer(&DnsAnswer{Id: query.Id, Err: ErrnoText[ERR_DIALBUSY]})
+		return
+	}
+	go func() {
+		defer atomic.AddInt32(&fab.resolving, -1)
+		fab.sendAnswer(fab.resolve(&query))
+	}()
+}
+
+func (fab *Fabric) resolve(query *DnsQuery) (answer *DnsAnswer) {
+	answer = &DnsAnswer{Id: query.Id}
+	switch query.Network {
+	case "ip", "ip4", "ip6":
+	default:
+		answer.Err = "unknown network " + query.Network
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), DIAL_TIMEOUT*time.Millisecond)
+	defer cancel()
+	addrs, err := lookupTTL(ctx, fab.resolver(), query.Network, query.Host)
+	if err != nil {
+		logger.Infof("%s lookup %s: %s", fab.String(), query.Host, err.Error())
+		answer.Err = err.Error()
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			answer.Err = dnsErr.Err
+			answer.NotFound = dnsErr.IsNotFound
+		}
+		return
+	}
+	answer.Addrs = addrs
+	return
+}
+
+func (fab *Fabric) sendAnswer(answer *DnsAnswer) {
+	err := SendFrame(fab, MSG_DNSANSWER, 0, answer)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
@@ -0,0 +1,112 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers from map, slow ones wait before answer.
+type fakeResolver map[string]string
+
+func (r fakeResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if host == "slow.test" {
+		time.Sleep(50 * time.Millisecond)
+	}
+	addr, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return []net.IP{net.ParseIP(addr)}, nil
+}
+
+func newDnsPair(t *testing.T, caps uint32) (cli, srv *Fabric) {
+	SetLogging()
+	c1, c2, stop, err := makePipeCaps(caps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+	cli, srv = c1.(*Conn).fab, c2.(*Conn).fab
+	srv.Resolver = fakeResolver{
+		"slow.test": "10.0.0.1",
+		"fast.test": "10.0.0.2",
+		"ipv6.test": "fd00::1",
+	}
+	return
+}
+
+func TestLookupIP(t *testing.T) {
+	cli, _ := newDnsPair(t, CAP_DNS)
+	ctx := context.Background()
+
+	// answers out of order, matched by id.
+	var wg sync.WaitGroup
+	for host, expect := range map[string]string{
+		"slow.test": "10.0.0.1", "fast.test": "10.0.0.2", "ipv6.test": "fd00::1"} {
+		wg.Add(1)
+		go func(host, expect string) {
+			defer wg.Done()
+			ips, err := cli.LookupIP(ctx, "ip", host)
+			if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP(expect)) {
+				t.Errorf("lookup %s: %v %v", host, ips, err)
+			}
+		}(host, expect)
+	}
+	wg.Wait()
+
+	_, err := cli.LookupIP(ctx, "ip", "nowhere.test")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound || dnsErr.Name != "nowhere.test" {
+		t.Fatalf("expect not found, got %v", err)
+	}
+	if _, err = cli.LookupIP(ctx, "tcp", "fast.test"); err == nil {
+		t.Fatal("lookup with bad network should fail")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err = cli.LookupIP(ctx, "ip", "slow.test"); err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline, got %v", err)
+	}
+	// late answer of it dropped, nothing left waiting.
+	time.Sleep(60 * time.Millisecond)
+	cli.qlock.Lock()
+	n := len(cli.queries)
+	cli.qlock.Unlock()
+	if n != 0 {
+		t.Fatalf("%d queries left", n)
+	}
+}
+
+func TestLookupIPNoCap(t *testing.T) {
+	cli, _ := newDnsPair(t, 0)
+	if _, err := cli.LookupIP(context.Background(), "ip", "fast.test"); err != ErrNoDns {
+		t.Fatalf("expect no dns, got %v", err)
+	}
+}
+
+func TestLookupIPClosed(t *testing.T) {
+	cli, _ := newDnsPair(t, CAP_DNS)
+	ch := make(chan error, 1)
+	go func() {
+		_, err := cli.LookupIP(context.Background(), "ip", "slow.test")
+		ch <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cli.Close()
+	select {
+	case err := <-ch:
+		if err != net.ErrClosed {
+			t.Fatalf("expect closed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lookup not returned after fabric closed")
+	}
+	if _, err := cli.LookupIP(context.Background(), "ip", "fast.test"); err != net.ErrClosed {
+		t.Fatalf("expect closed, got %v", err)
+	}
+}
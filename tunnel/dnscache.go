@@ -0,0 +1,232 @@
+package tunnel
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TTLResolver tells how long addresses can be cached, DnsCache honors it.
+type TTLResolver interface {
+	LookupIPTTL(ctx context.Context, network, host string) ([]DnsAddr, error)
+}
+
+type dnsKey struct {
+	network string
+	host    string
+}
+
+type dnsEntry struct {
+	key     dnsKey
+	addrs   []DnsAddr
+	expires time.Time
+	// not found, addrs empty.
+	notFound bool
+}
+
+// dnsFlight is a lookup in progress, others asking the same wait for it.
+type dnsFlight struct {
+	done  chan struct{}
+	addrs []DnsAddr
+	err   error
+}
+
+// DnsCacheStats is a snapshot of cache.
+type DnsCacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Evicted uint64
+	Entries int
+}
+
+// DnsCache resolves by Resolver and keeps answers by ttl, in LRU of Size.
+// Lookups of the same name at the same time share one. Set options before
+// use, and share it by fabrics as Resolver.
+type DnsCache struct {
+	// net.DefaultResolver if nil. ttl of it used if it's a TTLResolver,
+	// or DNS_TTL.
+	Resolver IPResolver
+	// DNS_CACHE_SIZE if 0.
+	Size int
+	// ttl clamped in them, MaxTTL 0 means no ceiling.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// names not found cached for it, DNS_NEGATIVE_TTL if 0.
+	NegativeTTL time.Duration
+
+	lock    sync.Mutex
+	ll      *list.List
+	entries map[dnsKey]*list.Element
+	flights map[dnsKey]*dnsFlight
+	hits    uint64
+	misses  uint64
+	evicted uint64
+}
+
+func NewDnsCache(r IPResolver) *DnsCache {
+	return &DnsCache{Resolver: r}
+}
+
+func (dc *DnsCache) LookupIP(ctx context.Context, network, host string) (ips []net.IP, err error) {
+	addrs, err := dc.LookupIPTTL(ctx, network, host)
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return
+}
+
+// LookupIPTTL returns addresses with ttl left in cache.
+func (dc *DnsCache) LookupIPTTL(ctx context.Context, network, host string) (addrs []DnsAddr, err error) {
+	key := dnsKey{network: network, host: strings.ToLower(strings.TrimSuffix(host, "."))}
+	now := time.Now()
+
+	dc.lock.Lock()
+	if addrs, err, ok := dc.get(key, host, now); ok {
+		dc.lock.Unlock()
+		atomic.AddUint64(&dc.hits, 1)
+		return addrs, err
+	}
+	atomic.AddUint64(&dc.misses, 1)
+	if dc.flights == nil {
+		dc.flights = make(map[dnsKey]*dnsFlight)
+	}
+	fl, ok := dc.flights[key]
+	if !ok {
+		fl = &dnsFlight{done: make(chan struct{})}
+		dc.flights[key] = fl
+		go dc.resolve(key, fl)
+	}
+	dc.lock.Unlock()
+
+	select {
+	case <-fl.done:
+		return fl.addrs, fl.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// get returns entry not expired, call with lock held.
+func (dc *DnsCache) get(key dnsKey, host string, now time.Time) (addrs []DnsAddr, err error, ok bool) {
+	ele, ok := dc.entries[key]
+	if !ok {
+		return
+	}
+	e := ele.Value.(*dnsEntry)
+	if !now.Before(e.expires) {
+		dc.remove(ele)
+		return nil, nil, false
+	}
+	dc.ll.MoveToFront(ele)
+	if e.notFound {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}, true
+	}
+	left := uint32(e.expires.Sub(now) / time.Second)
+	for _, a := range e.addrs {
+		addrs = append(addrs, DnsAddr{IP: a.IP, TTL: left})
+	}
+	return addrs, nil, true
+}
+
+// resolve looks up key out of any caller, so callers gave up don't fail
+// others waiting.
+func (dc *DnsCache) resolve(key dnsKey, fl *dnsFlight) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), DIAL_TIMEOUT*time.Millisecond)
+	defer cancel()
+
+	r := dc.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	fl.addrs, fl.err = lookupTTL(ctx, r, key.network, key.host)
+
+	dc.lock.Lock()
+	delete(dc.flights, key)
+	dc.store(key, fl.addrs, fl.err)
+	dc.lock.Unlock()
+	close(fl.done)
+}
+
+// store caches answer, errors other than not found are not cached.
+// call with lock held.
+func (dc *DnsCache) store(key dnsKey, addrs []DnsAddr, err error) {
+	e := &dnsEntry{key: key, addrs: addrs}
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil && len(addrs) != 0:
+		ttl := addrs[0].TTL
+		for _, a := range addrs[1:] {
+			if a.TTL < ttl {
+				ttl = a.TTL
+			}
+		}
+		e.expires = time.Now().Add(dc.clamp(time.Duration(ttl) * time.Second))
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		e.notFound = true
+		ttl := dc.NegativeTTL
+		if ttl == 0 {
+			ttl = DNS_NEGATIVE_TTL * time.Millisecond
+		}
+		e.expires = time.Now().Add(ttl)
+	default:
+		return
+	}
+
+	if dc.entries == nil {
+		dc.entries = make(map[dnsKey]*list.Element)
+		dc.ll = list.New()
+	}
+	if ele, ok := dc.entries[key]; ok {
+		dc.remove(ele)
+	}
+	dc.entries[key] = dc.ll.PushFront(e)
+	size := dc.Size
+	if size <= 0 {
+		size = DNS_CACHE_SIZE
+	}
+	for dc.ll.Len() > size {
+		dc.remove(dc.ll.Back())
+		dc.evicted++
+	}
+}
+
+func (dc *DnsCache) clamp(ttl time.Duration) time.Duration {
+	if ttl < dc.MinTTL {
+		ttl = dc.MinTTL
+	}
+	if dc.MaxTTL != 0 && ttl > dc.MaxTTL {
+		ttl = dc.MaxTTL
+	}
+	return ttl
+}
+
+// call with lock held.
+func (dc *DnsCache) remove(ele *list.Element) {
+	dc.ll.Remove(ele)
+	delete(dc.entries, ele.Value.(*dnsEntry).key)
+}
+
+// Flush drops all entries, lookups in progress still cache their answers.
+func (dc *DnsCache) Flush() {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	dc.entries, dc.ll = nil, nil
+}
+
+func (dc *DnsCache) Stats() (st DnsCacheStats) {
+	st.Hits = atomic.LoadUint64(&dc.hits)
+	st.Misses = atomic.LoadUint64(&dc.misses)
+	dc.lock.Lock()
+	st.Evicted = dc.evicted
+	if dc.ll != nil {
+		st.Entries = dc.ll.Len()
+	}
+	dc.lock.Unlock()
+	return
+}
@@ -0,0 +1,206 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countResolver answers by fakeResolver with ttl, and counts lookups.
+type countResolver struct {
+	fakeResolver
+	ttl   uint32
+	calls int32
+	// lookups wait for it if not nil.
+	gate chan struct{}
+}
+
+func (r *countResolver) LookupIPTTL(ctx context.Context, network, host string) (addrs []DnsAddr, err error) {
+	atomic.AddInt32(&r.calls, 1)
+	if r.gate != nil {
+		<-r.gate
+	}
+	ips, err := r.fakeResolver.LookupIP(ctx, network, host)
+	for _, ip := range ips {
+		addrs = append(addrs, DnsAddr{IP: ip, TTL: r.ttl})
+	}
+	return
+}
+
+func newCountResolver(ttl uint32) *countResolver {
+	return &countResolver{
+		fakeResolver: fakeResolver{"a.test": "10.0.0.1", "b.test": "10.0.0.2", "c.test": "10.0.0.3"},
+		ttl:          ttl,
+	}
+}
+
+func TestDnsCacheHit(t *testing.T) {
+	ctx := context.Background()
+	r := newCountResolver(60)
+	dc := NewDnsCache(r)
+
+	for i := 0; i < 3; i++ {
+		ips, err := dc.LookupIP(ctx, "ip", "a.test")
+		if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+			t.Fatalf("wrong answer %v: %v", ips, err)
+		}
+	}
+	// names are case blind, families are not.
+	dc.LookupIP(ctx, "ip", "A.Test.")
+	dc.LookupIP(ctx, "ip4", "a.test")
+	if n := atomic.LoadInt32(&r.calls); n != 2 {
+		t.Fatalf("expect 2 lookups, got %d", n)
+	}
+	st := dc.Stats()
+	if st.Hits != 3 || st.Misses != 2 || st.Entries != 2 {
+		t.Fatalf("wrong stats %+v", st)
+	}
+
+	addrs, _ := dc.LookupIPTTL(ctx, "ip", "a.test")
+	if len(addrs) != 1 || addrs[0].TTL == 0 || addrs[0].TTL > 60 {
+		t.Fatalf("wrong ttl %+v", addrs)
+	}
+
+	dc.Flush()
+	if st := dc.Stats(); st.Entries != 0 {
+		t.Fatalf("entries left after flush: %+v", st)
+	}
+	dc.LookupIP(ctx, "ip", "a.test")
+	if n := atomic.LoadInt32(&r.calls); n != 3 {
+		t.Fatalf("expect lookup after flush, got %d", n)
+	}
+}
+
+func TestDnsCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	r := newCountResolver(0)
+	dc := NewDnsCache(r)
+	dc.MinTTL = 50 * time.Millisecond
+
+	// ttl 0 raised to floor.
+	dc.LookupIP(ctx, "ip", "a.test")
+	dc.LookupIP(ctx, "ip", "a.test")
+	if n := atomic.LoadInt32(&r.calls); n != 1 {
+		t.Fatalf("expect 1 lookup, got %d", n)
+	}
+	time.Sleep(80 * time.Millisecond)
+	dc.LookupIP(ctx, "ip", "a.test")
+	if n := atomic.LoadInt32(&r.calls); n != 2 {
+		t.Fatalf("expect lookup after expired, got %d", n)
+	}
+
+	// long ttl cut to ceiling.
+	r.ttl = 3600
+	dc.MaxTTL = 50 * time.Millisecond
+	dc.LookupIP(ctx, "ip", "b.test")
+	time.Sleep(80 * time.Millisecond)
+	dc.LookupIP(ctx, "ip", "b.test")
+	if n := atomic.LoadInt32(&r.calls); n != 4 {
+		t.Fatalf("expect lookup after ceiling, got %d", n)
+	}
+}
+
+func TestDnsCacheNegative(t *testing.T) {
+	ctx := context.Background()
+	r := newCountResolver(60)
+	dc := NewDnsCache(r)
+	dc.NegativeTTL = 50 * time.Millisecond
+
+	for i := 0; i < 2; i++ {
+		_, err := dc.LookupIP(ctx, "ip", "none.test")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound || dnsErr.Name != "none.test" {
+			t.Fatalf("expect not found, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&r.calls); n != 1 {
+		t.Fatalf("expect 1 lookup, got %d", n)
+	}
+	time.Sleep(80 * time.Millisecond)
+	dc.LookupIP(ctx, "ip", "none.test")
+	if n := atomic.LoadInt32(&r.calls); n != 2 {
+		t.Fatalf("expect lookup after expired, got %d", n)
+	}
+}
+
+func TestDnsCacheEvict(t *testing.T) {
+	ctx := context.Background()
+	r := newCountResolver(60)
+	dc := NewDnsCache(r)
+	dc.Size = 2
+
+	dc.LookupIP(ctx, "ip", "a.test")
+	dc.LookupIP(ctx, "ip", "b.test")
+	// a used lately, b evicted.
+	dc.LookupIP(ctx, "ip", "a.test")
+	dc.LookupIP(ctx, "ip", "c.test")
+	st := dc.Stats()
+	if st.Entries != 2 || st.Evicted != 1 {
+		t.Fatalf("wrong stats %+v", st)
+	}
+	dc.LookupIP(ctx, "ip", "a.test")
+	dc.LookupIP(ctx, "ip", "b.test")
+	if n := atomic.LoadInt32(&r.calls); n != 4 {
+		t.Fatalf("expect 4 lookups, got %d", n)
+	}
+}
+
+func TestDnsCacheShared(t *testing.T) {
+	r := newCountResolver(60)
+	r.gate = make(chan struct{})
+	dc := NewDnsCache(r)
+
+	// one gave up, others still get answer.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := dc.LookupIP(ctx, "ip", "a.test"); err != context.Canceled {
+		t.Fatalf("expect canceled, got %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := dc.LookupIP(context.Background(), "ip", "a.test")
+			errs <- err
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(r.gate)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&r.calls); n != 1 {
+		t.Fatalf("expect 1 lookup, got %d", n)
+	}
+}
+
+func TestDnsCacheRemote(t *testing.T) {
+	cli, srv := newDnsPair(t, CAP_DNS)
+	r := newCountResolver(30)
+	srv.Resolver = NewDnsCache(r)
+
+	// ttl left in server cache goes to client.
+	dc := NewDnsCache(cli)
+	addrs, err := dc.LookupIPTTL(context.Background(), "ip", "b.test")
+	if err != nil || len(addrs) != 1 || addrs[0].TTL == 0 || addrs[0].TTL > 30 {
+		t.Fatalf("wrong answer %+v: %v", addrs, err)
+	}
+	if _, err = dc.LookupIP(context.Background(), "ip", "none.test"); err == nil {
+		t.Fatal("expect not found")
+	}
+	dc.LookupIP(context.Background(), "ip", "none.test")
+	if n := atomic.LoadInt32(&r.calls); n != 2 {
+		t.Fatalf("expect 2 lookups, got %d", n)
+	}
+}
@@ -1,23 +1,249 @@
 package tunnel
 
 import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math/rand"
 	"net"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/shell909090/goproxy/netutil"
 )
 
 type Fabric struct {
 	net.Conn
 	startTime time.Time
-	wlock     sync.Mutex
+	// only one frame written at a time, control frames go first.
+	slock     sync.Mutex
+	sev       *sync.Cond
+	sending   bool
+	ctrl_wait int
+	waiting   int
+	// frames gathered here, flushed when nobody else waiting to send.
+	bw        *bufio.Writer
+	whdr      []byte
+	t_flush   *time.Timer
 	closed    bool
+	rhdr      [HEADER_SIZE]byte
+	rsum      [4]byte
 	plock     sync.RWMutex
 	next_id   uint16
 	weaves    map[uint16]Fiber
 	dft_fiber Fiber
+	// live streams in weaves, by id%2.
+	halves [2]int
+	peak   int
+	// streams ever opened, read without lock.
+	opened uint64
+	// why fabric ends, for SessionLog.
+	end_reason SessionEnd
+	// counted without lock.
+	traffic_in  trafficCounter
+	traffic_out trafficCounter
+	send_rate   tokenBucket
+	recv_rate   tokenBucket
+	dup_syns    uint64
+	// streams already reset by us, no more rst until id reused.
+	rsts map[uint16]struct{}
+	// when our ids freed, they will not be used again for a while.
+	freed map[uint16]time.Time
+	// takes streams from peer instead of ProtocolHandlers, if set.
+	listener *Listener
+	// read in auth, handled by Loop before the wire.
+	replayed *Frame
+	// streams from peer in handler before result, and waiting for it.
+	dlock      sync.Mutex
+	dialing    int
+	dial_queue []pendingDial
+	// lookups waiting for answer, by id.
+	qlock      sync.Mutex
+	next_query uint32
+	queries    map[uint32]chan *DnsAnswer
+	q_closed   bool
+	// queries from peer in resolving, counted without lock.
+	resolving int32
+	// binds waiting for answer and listeners peer bound for us, by id.
+	// listeners we bound for peer in binds.
+	block      sync.Mutex
+	next_bind  uint32
+	bind_waits map[uint32]chan *BindAnswer
+	bound      map[uint32]*Listener
+	binds      map[uint32]net.Listener
+	b_closed   bool
+
+	// how long a dial waits for result, DIAL_TIMEOUT by default.
+	DialTimeout time.Duration
+	// read bytes will be gathered up to it before window renew,
+	// WINDOW_DELAY later they will be sent anyway.
+	WindowThreshold uint32
+	// applied to every new conn, before options of each dial.
+	ConnOptions []ConnOption
+	// called with each stream accepted, before handler gets it. server can
+	// set rate limits by target here.
+	OnAccept func(c *Conn)
+	// called with each stream removed from fabric, no lock held. it may
+	// call conn back.
+	OnClose func(c *Conn)
+	// streams without any data for it will be reset, 0 means never.
+	// set it before Loop.
+	IdleTimeout time.Duration
+	// how long data frames wait for more frames before flush.
+	// 0 means flush when no more frame waiting, negative means never wait.
+	FlushDelay time.Duration
+	// ping peer every PingInterval, 0 means never. fabric will be closed
+	// after PingMiss intervals heard nothing, PING_MISS if 0. any frame
+	// from peer counts, ping skipped if heard in last interval, but not
+	// more than PingMiss times in a row, to keep RTT. set them before Loop.
+	PingInterval time.Duration
+	PingMiss     int
+	// frames from peer longer than it break the fabric, MAX_FRAME_SIZE
+	// by default. set it before Loop.
+	MaxReadSize int
+	// frames of unknown types break the fabric, instead of skipped.
+	// for testing peers.
+	Strict bool
+	// source ip handlers dial targets from, nil means any. BindFor
+	// overrides it by stream if set, nil from it means Bind.
+	Bind    net.IP
+	BindFor func(c *Conn) net.IP
+	// checks targets of streams from peer before handlers dial, nil
+	// allows everything. it may be shared by fabrics.
+	Guard *Guard
+	// rules of user checked before Guard, from auth backend if it's an
+	// ACLAuthenticator. nil checks Guard only.
+	UserGuard *Guard
+	// ports targets can be on, checked before Guard and resolving. those
+	// of user, from UserInfo, checked instead of Ports if not empty.
+	Ports     *PortFilter
+	UserPorts *PortFilter
+	// refuses targets resolved to loopback, link-local, private or our own
+	// addresses, after Guard. set by server for users not trusted.
+	DenyPrivate bool
+	// caps conns to each destination, shared by fabrics. nil means no
+	// limit.
+	DestLimits *DestLimits
+	// rewrites targets of streams from peer before routed, resolved and
+	// checked. nil rewrites nothing. it may be shared by fabrics.
+	Rewriter *Rewriter
+	// picks upstreams for tcp targets of streams from peer, nil dials all
+	// directly. it may be shared by fabrics.
+	Router *Router
+	// resolves queries from peer if CAP_DNS agreed, net.DefaultResolver
+	// if nil.
+	Resolver IPResolver
+	// gets a record for each stream from peer finished. Username goes
+	// into records, set by server after auth.
+	AccessLog *AccessLog
+	Username  string
+	// gets records of the fabric, AuthMethod goes into them. set by server
+	// after auth, before Loop.
+	SessionLog *SessionLog
+	AuthMethod string
+	// groups of user from auth backend, for rules by group.
+	Groups []string
+	// user is guest without credentials, marked in records.
+	Guest bool
+	// streams from peer counted in it, over MaxStreams of user refused.
+	// set by server after auth, before Loop.
+	Account *Account
+	// data of streams from peer counted in it by Username, new streams of
+	// user over quota refused. it may be shared by fabrics.
+	Quotas *Quotas
+	// listeners peer can ask for at the same time if CAP_BIND agreed, 0
+	// refuses all. ports limited in BindPortMin to BindPortMax if set.
+	MaxBinds    int
+	BindPortMin int
+	BindPortMax int
+	// pads data frames and sends cover frames, if CAP_PADDING agreed.
+	// set it before Loop.
+	Padding PaddingPolicy
+	// initial window of streams for peer, WINDOWSIZE by default.
+	// told to peer in settings, set it before Loop.
+	InitialWindow int32
+	// max streams peer can open to us, and we can open to peer.
+	// 0 means no limit. told to peer in settings, set it before Loop.
+	MaxStreams int
+	// streams from peer in handler before result at the same time, 0 means
+	// no limit. DialBacklog more wait for it, others refused.
+	MaxDialing  int
+	DialBacklog int
+	// peer can still renew token in it after expired, then fabric drained
+	// in it again. TOKEN_GRACE if 0. see SetToken.
+	TokenGrace time.Duration
+	// fetches fresh token, renewed before expires told by peer. set by
+	// DialerCreator.
+	TokenSource func() (string, error)
+	// keys of encrypted fabric renewed after RekeyBytes written under
+	// them, or RekeyInterval, if CAP_REKEY agreed. REKEY_BYTES and
+	// REKEY_INTERVAL if 0. set them before Loop.
+	RekeyBytes    uint64
+	RekeyInterval time.Duration
+
+	// token of peer checked by tokens. expiry, or renew of ours, by
+	// t_expire. protected by tlock.
+	tlock       sync.Mutex
+	tokens      TokenValidator
+	expires     time.Time
+	t_expire    *time.Timer
+	t_closed    bool
+	next_renew  uint32
+	renew_waits map[uint32]chan *Renew
+
+	hlock   sync.Mutex
+	missed  int
+	skipped int
+	srtt    time.Duration
+	// unixnano of last frame from peer, atomic. only kept with PingInterval.
+	heard int64
+
+	// we sent goaway, or peer did. protected by plock.
+	goaway      bool
+	peer_goaway bool
+	ch_drained  chan struct{}
+
+	// settings from peer, protected by plock. before they came,
+	// defaults every peer can take are used.
+	peer_settings bool
+	peer_window   int32
+	peer_frame    int
+	peer_streams  int
+
+	data_size   int
+	data_random bool
+	// CAP_CHECKSUM agreed in hello.
+	checksum bool
+	// CAP_COMPRESS agreed in hello, and if we compress data now.
+	compress    bool
+	compress_on int32
+	// CAP_PADDING agreed in hello.
+	padded bool
+	// CAP_DNS agreed in hello.
+	dns bool
+	// CAP_BIND agreed in hello.
+	reverse bool
+	// CAP_ADDRS agreed in hello.
+	addrs bool
+	// CAP_EARLY agreed in hello.
+	early bool
+	// CAP_TOKEN agreed in hello.
+	token bool
+	// CAP_REKEY agreed in hello.
+	rekey bool
+	// rekeys done, counted without lock.
+	rekeys uint64
+	// decompress into it, used by Loop only.
+	rzip []byte
+	// unknown frames skipped since last logged, used by Loop only.
+	unknown_skipped int
+	unknown_logged  time.Time
 }
 
 func NewFabric(conn net.Conn, next_id uint16) (fab *Fabric) {
@@ -27,10 +253,133 @@ func NewFabric(conn net.Conn, next_id uint16) (fab *Fabric) {
 		closed:    false,
 		next_id:   next_id,
 		weaves:    make(map[uint16]Fiber, 0),
+		rsts:      make(map[uint16]struct{}, 0),
+		freed:     make(map[uint16]time.Time, 0),
+		queries:   make(map[uint32]chan *DnsAnswer),
+
+		bind_waits: make(map[uint32]chan *BindAnswer),
+		bound:      make(map[uint32]*Listener),
+		binds:      make(map[uint32]net.Listener),
+
+		renew_waits: make(map[uint32]chan *Renew),
+
+		DialTimeout:     DIAL_TIMEOUT * time.Millisecond,
+		WindowThreshold: WINDOWSIZE / 2,
+		MaxReadSize:     MAX_FRAME_SIZE,
+		InitialWindow:   WINDOWSIZE,
+
+		peer_window: WINDOWSIZE,
+		peer_frame:  netutil.BUFFERSIZE,
+
+		data_size: netutil.BUFFERSIZE,
+	}
+	fab.sev = sync.NewCond(&fab.slock)
+	fab.bw = bufio.NewWriterSize(conn, 2*netutil.BUFFERSIZE)
+	return
+}
+
+// SetDataFrameSize sets the max payload of data frame. If random is true,
+// large writes are cut into random pieces between size/2 and size.
+func (fab *Fabric) SetDataFrameSize(size int, random bool) (err error) {
+	if size <= 0 || size > MAX_FRAME_SIZE {
+		return ErrFrameOverFlow
 	}
+	fab.data_size = size
+	fab.data_random = random
 	return
 }
 
+// SetCaps applies caps agreed in hello. set it before Loop.
+func (fab *Fabric) SetCaps(caps uint32) {
+	fab.checksum = caps&CAP_CHECKSUM != 0
+	fab.compress = caps&CAP_COMPRESS != 0
+	fab.SetCompress(fab.compress)
+	fab.padded = caps&CAP_PADDING != 0
+	fab.dns = caps&CAP_DNS != 0
+	fab.reverse = caps&CAP_BIND != 0
+	fab.addrs = caps&CAP_ADDRS != 0
+	fab.early = caps&CAP_EARLY != 0
+	fab.token = caps&CAP_TOKEN != 0
+	fab.rekey = caps&CAP_REKEY != 0
+}
+
+func (fab *Fabric) peerWindow() int32 {
+	fab.plock.RLock()
+	defer fab.plock.RUnlock()
+	return fab.peer_window
+}
+
+func (fab *Fabric) peerFrameSize() int {
+	fab.plock.RLock()
+	defer fab.plock.RUnlock()
+	return fab.peer_frame
+}
+
+// sendSettings tells peer how to send to us.
+func (fab *Fabric) sendSettings() {
+	err := SendFrame(fab, MSG_SETTINGS, 0, &Settings{
+		Window:       fab.InitialWindow,
+		MaxFrameSize: fab.MaxReadSize,
+		MaxStreams:   fab.MaxStreams,
+	})
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+// onSettings applies settings from peer to our send path. Settings can
+// only be sent once for now, changes in the middle are rejected.
+func (fab *Fabric) onSettings(f *Frame) (err error) {
+	var s Settings
+	err = f.Unmarshal(&s)
+	if err != nil {
+		return
+	}
+	if s.Window <= 0 || s.Window > MAX_WINDOW ||
+		s.MaxFrameSize <= 0 || s.MaxFrameSize > MAX_FRAME_SIZE ||
+		s.MaxStreams < 0 {
+		return fmt.Errorf("%w: %+v", ErrSettings, s)
+	}
+
+	fab.plock.Lock()
+	if fab.peer_settings {
+		fab.plock.Unlock()
+		return fmt.Errorf("%w: settings changed.", ErrSettings)
+	}
+	fab.peer_settings = true
+	fab.peer_window = s.Window
+	fab.peer_frame = s.MaxFrameSize
+	fab.peer_streams = s.MaxStreams
+	fab.plock.Unlock()
+
+	logger.Infof("%s peer settings: %+v.", fab.String(), s)
+	// streams created before took the defaults.
+	for _, c := range fab.GetConnections() {
+		c.applyWindow(s.Window)
+	}
+	return
+}
+
+// total frames failed in checksum, of all fabrics.
+var checksumFailed uint64
+
+// ChecksumFailures returns how many frames failed in checksum since start.
+func ChecksumFailures() uint64 {
+	return atomic.LoadUint64(&checksumFailed)
+}
+
+// chunkSize returns how many bytes of n should be sent in next data frame,
+// with max payload size.
+func (fab *Fabric) chunkSize(size, n int) int {
+	if fab.data_random {
+		size = size/2 + rand.Intn(size/2+1)
+	}
+	if n < size {
+		return n
+	}
+	return size
+}
+
 func (fab *Fabric) String() string {
 	return fmt.Sprintf(
 		"%s->%s",
@@ -44,8 +393,13 @@ func (fab *Fabric) Uptime() (d time.Duration) {
 }
 
 func (fab *Fabric) GetSize() int {
-	fab.plock.Lock()
-	defer fab.plock.Unlock()
+	return fab.NumStreams()
+}
+
+// NumStreams returns how many streams live in fabric.
+func (fab *Fabric) NumStreams() int {
+	fab.plock.RLock()
+	defer fab.plock.RUnlock()
 	return len(fab.weaves)
 }
 
@@ -56,18 +410,28 @@ func (cs ConnSlice) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
 func (cs ConnSlice) Less(i, j int) bool { return cs[i].streamid < cs[j].streamid }
 
 func (fab *Fabric) GetConnections() (conns ConnSlice) {
-	conns = func() (conns []*Conn) {
-		fab.plock.RLock()
-		defer fab.plock.RUnlock()
+	fab.plock.RLock()
+	defer fab.plock.RUnlock()
 
-		for _, f := range fab.weaves {
-			if c, ok := f.(*Conn); ok {
-				conns = append(conns, c)
-			}
+	// sort by key, streamid in conn may be set after put in.
+	ids := make([]int, 0, len(fab.weaves))
+	for id, f := range fab.weaves {
+		if _, ok := f.(*Conn); ok {
+			ids = append(ids, int(id))
 		}
-		return
-	}()
-	sort.Sort(conns)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		conns = append(conns, fab.weaves[uint16(id)].(*Conn))
+	}
+	return
+}
+
+// Streams returns status of all streams, sorted by streamid.
+func (fab *Fabric) Streams() (sts []ConnStatus) {
+	for _, c := range fab.GetConnections() {
+		sts = append(sts, c.Status())
+	}
 	return
 }
 
@@ -75,23 +439,82 @@ func (fab *Fabric) PutIntoNextId(f Fiber) (id uint16, err error) {
 	fab.plock.Lock()
 	defer fab.plock.Unlock()
 
-	startid := fab.next_id
-	for _, ok := fab.weaves[fab.next_id]; ok; _, ok = fab.weaves[fab.next_id] {
-		fab.next_id += 2
-		if fab.next_id == startid {
-			err = ErrStreamOutOfID
-			logger.Error(err.Error())
-			return
-		}
+	err = fab.checkLimit(fab.next_id)
+	if err != nil {
+		return
+	}
+	id, err = fab.nextFreeId()
+	if err != nil {
+		logger.Error(err.Error())
+		return
 	}
-	id = fab.next_id
-	fab.next_id += 2
 	fab.weaves[id] = f
+	fab.halves[id%2]++
+	fab.updatePeak()
+	atomic.AddUint64(&fab.opened, 1)
+	delete(fab.rsts, id)
 
 	logger.Debugf("%s put %p into %d.", fab.String(), f, id)
 	return
 }
 
+// checkLimit tells if one more stream can be put in the half of id.
+// streams we opened are limited by peer's settings too.
+// call with plock held.
+func (fab *Fabric) checkLimit(id uint16) (err error) {
+	n := fab.halves[id%2]
+	if fab.MaxStreams > 0 && n >= fab.MaxStreams {
+		return ErrTooManyStreams
+	}
+	if id%2 == fab.next_id%2 && fab.peer_streams > 0 && n >= fab.peer_streams {
+		return ErrTooManyStreams
+	}
+	return
+}
+
+// nextFreeId finds an id not in use, and not freed in ID_QUARANTINE.
+// A quarantined id will be used only if no other one left.
+// call with plock held.
+func (fab *Fabric) nextFreeId() (id uint16, err error) {
+	now := time.Now()
+	startid := fab.next_id
+	found := false
+	for {
+		id = fab.next_id
+		fab.next_id += 2
+		// id 0 is kept for frames not belong to any stream.
+		if _, ok := fab.weaves[id]; !ok && id != 0 {
+			freed, ok := fab.freed[id]
+			if !ok {
+				return id, nil
+			}
+			if now.Sub(freed) >= ID_QUARANTINE*time.Millisecond {
+				delete(fab.freed, id)
+				return id, nil
+			}
+			found = true
+		}
+		if fab.next_id == startid {
+			break
+		}
+	}
+	if !found {
+		return 0, ErrStreamOutOfID
+	}
+	// all free ids are quarantined, take the oldest one.
+	var oldest time.Time
+	for fid, freed := range fab.freed {
+		if _, ok := fab.weaves[fid]; ok {
+			continue
+		}
+		if oldest.IsZero() || freed.Before(oldest) {
+			id, oldest = fid, freed
+		}
+	}
+	delete(fab.freed, id)
+	return id, nil
+}
+
 func (fab *Fabric) PutIntoId(id uint16, f Fiber) (err error) {
 	fab.plock.Lock()
 	defer fab.plock.Unlock()
@@ -100,54 +523,478 @@ func (fab *Fabric) PutIntoId(id uint16, f Fiber) (err error) {
 	if ok {
 		return ErrIdExist
 	}
+	err = fab.checkLimit(id)
+	if err != nil {
+		return
+	}
 	fab.weaves[id] = f
+	fab.halves[id%2]++
+	fab.updatePeak()
+	atomic.AddUint64(&fab.opened, 1)
+	delete(fab.rsts, id)
 
 	logger.Debugf("%s put %p into %d.", fab.String(), f, id)
 	return
 }
 
+// sendReset tells peer to stop sending to streamid, and why.
+// only the first call sends rst, until the id is used again.
+func (fab *Fabric) sendReset(streamid uint16, code uint32) (err error) {
+	fab.plock.Lock()
+	_, sent := fab.rsts[streamid]
+	fab.rsts[streamid] = struct{}{}
+	fab.plock.Unlock()
+	if sent {
+		return
+	}
+	return SendFrame(fab, MSG_RST, streamid, code)
+}
+
+func (fab *Fabric) Dial(network, address string) (conn net.Conn, err error) {
+	return fab.DialOptions(network, address)
+}
+
+// DialOptions works like Dial, opts override the fabric's ConnOptions.
+func (fab *Fabric) DialOptions(network, address string, opts ...ConnOption) (conn net.Conn, err error) {
+	c := NewConn(fab, opts...)
+	ctx, cancel := context.WithTimeout(context.Background(), c.dial_timeout)
+	defer cancel()
+	return fab.dial(ctx, c, network, address)
+}
+
+func (fab *Fabric) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	return fab.dial(ctx, NewConn(fab), network, address)
+}
+
+// DialWithData works like DialContext, data sent as the first bytes of
+// stream, in syn if CAP_EARLY agreed. see Conn.ConnectWithData.
+func (fab *Fabric) DialWithData(ctx context.Context, network, address string, data []byte) (conn net.Conn, err error) {
+	return fab.dialData(ctx, NewConn(fab), network, address, data)
+}
+
+func (fab *Fabric) dial(ctx context.Context, c *Conn, network, address string) (conn net.Conn, err error) {
+	return fab.dialData(ctx, c, network, address, nil)
+}
+
+func (fab *Fabric) dialData(ctx context.Context, c *Conn, network, address string, data []byte) (conn net.Conn, err error) {
+	if fab.GoingAway() {
+		return nil, ErrGoaway
+	}
+	streamid, err := fab.PutIntoNextId(c)
+	if err != nil {
+		return
+	}
+	c.lock.Lock()
+	c.streamid = streamid
+	c.lock.Unlock()
+
+	logger.Debugf("%s try to dial %s:%s.", fab.String(), network, address)
+
+	err = c.connect(ctx, network, address, data)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	logger.Infof("%s connected.", c.String())
+	conn = c
+	return
+}
+
+// onDupSyn handles syn for id in use, as protocol error of that stream.
+// stream of peer's id is reset, ours is kept, peer told by rst anyway.
+func (fab *Fabric) onDupSyn(streamid uint16, fiber Fiber) {
+	atomic.AddUint64(&fab.dup_syns, 1)
+	c, ok := fiber.(*Conn)
+	if ok && streamid%2 != fab.next_id%2 {
+		logger.Errorf("%s duplicated syn for %d, reset.", fab.String(), streamid)
+		c.ResetWith(ERR_PROTOCOL)
+		return
+	}
+	logger.Errorf("%s duplicated syn for our %d, ignored.", fab.String(), streamid)
+	err := SendFrame(fab, MSG_RST, streamid, uint32(ERR_PROTOCOL))
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+func (fab *Fabric) onSyn(streamid uint16, syn *Syn) (err error) {
+	var c *Conn
+	if streamid%2 == fab.next_id%2 {
+		// peer should never take id from our half.
+		logger.Errorf("%s syn with id %d from wrong half.", fab.String(), streamid)
+		return ErrBadStreamId
+	}
+	if fab.refuseSyn() {
+		logger.Infof("%s going away, refuse stream %d.", fab.String(), streamid)
+		return SendFrame(fab, MSG_RESULT, streamid, ERR_GOAWAY)
+	}
+	fab.plock.RLock()
+	l := fab.listener
+	fab.plock.RUnlock()
+	if syn.Bind != 0 {
+		l = fab.boundListener(syn.Bind)
+		if l == nil {
+			logger.Infof("%s no listener for bind %d, refuse stream %d.",
+				fab.String(), syn.Bind, streamid)
+			return SendFrame(fab, MSG_RESULT, streamid, ERR_CLOSED)
+		}
+	}
+	if l != nil {
+		c, err = fab.accept(streamid, syn)
+		if err != nil {
+			return nil
+		}
+		if fab.OnAccept != nil {
+			fab.OnAccept(c)
+		}
+		return l.push(c)
+	}
+
+	handler, ok := ProtocolHandlers[syn.Network]
+	if !ok {
+		logger.Errorf("unknown network: %s.", syn.Network)
+		err = SendFrame(
+			fab, MSG_RESULT, streamid, ERR_UNKNOWN_PROTOCOL)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		return
+	}
+
+	asked := fab.rewrite(streamid, syn)
+	c, err = fab.accept(streamid, syn)
+	if err != nil {
+		// refused with result, fabric still works.
+		return nil
+	}
+	c.asked = asked
+	if fab.OnAccept != nil {
+		fab.OnAccept(c)
+	}
+	return fab.startDial(c, handler)
+}
+
+func (fab *Fabric) accept(streamid uint16, syn *Syn) (c *Conn, err error) {
+	if len(syn.Data) > EARLY_DATA_MAX || len(syn.Data) != 0 && !fab.early {
+		logger.Errorf("%s early data of %d bytes in syn %d refused.",
+			fab.String(), len(syn.Data), streamid)
+		e := SendFrame(fab, MSG_RESULT, streamid, ERR_PROTOCOL)
+		if e != nil {
+			logger.Error(e.Error())
+		}
+		return nil, ErrProtocol
+	}
+	uq, err := fab.quotaOf()
+	if err != nil {
+		logger.Warningf("%s user %s over quota, refuse stream %d.",
+			fab.String(), fab.Username, streamid)
+		e := SendFrame(fab, MSG_RESULT, streamid, ERR_QUOTA)
+		if e != nil {
+			logger.Error(e.Error())
+		}
+		return
+	}
+	if !fab.Account.addStream() {
+		logger.Warningf("%s user %s over stream limit, refuse stream %d.",
+			fab.String(), fab.Username, streamid)
+		e := SendFrame(fab, MSG_RESULT, streamid, ERR_TOOMANYSTREAMS)
+		if e != nil {
+			logger.Error(e.Error())
+		}
+		return nil, ErrTooManyStreams
+	}
+	c = NewConn(fab)
+	c.account = fab.Account
+	err = c.CheckAndSetStatus(ST_UNKNOWN, ST_SYN_RECV)
+	if err != nil {
+		c.account.doneStream()
+		logger.Error(err.Error())
+		return
+	}
+	c.streamid = streamid
+	c.Network = syn.Network
+	c.Address = syn.Address
+	if len(syn.Data) != 0 {
+		c.early = syn.Data
+		c.recved += uint64(len(syn.Data))
+	}
+
+	err = fab.PutIntoId(streamid, c)
+	if err != nil {
+		c.account.doneStream()
+		logger.Errorf("%s accept %d: %s", fab.String(), streamid, err.Error())
+		var errno uint32 = ERR_IDEXIST
+		if err == ErrTooManyStreams {
+			errno = ERR_TOOMANYSTREAMS
+		}
+		e := SendFrame(fab, MSG_RESULT, streamid, errno)
+		if e != nil {
+			logger.Error(e.Error())
+		}
+		return nil, err
+	}
+	if uq != nil {
+		c.quota = uq
+		uq.count(len(c.early))
+		uq.addConn(c)
+	}
+	return
+}
+
+// onResult handles result for stream not exist.
+func (fab *Fabric) onResult(f *Frame) (err error) {
+	result, err := f.unmarshalResult()
+	if err != nil {
+		return
+	}
+	if result.Errno == ERR_NONE {
+		// result came after connect timeout, tell peer to drop it.
+		logger.Warningf("late result, reset stream %d.", f.Header.Streamid)
+		return SendFrame(fab, MSG_RST, f.Header.Streamid, uint32(ERR_TIMEOUT))
+	}
+	return
+}
+
 func (fab *Fabric) SendFrame(f *Frame) (err error) {
-	logger.Debugf("sent %s", f.Debug())
+	return fab.SendFrameDeadline(f, time.Time{})
+}
 
-	b := f.Pack()
+// SendFrameDeadline works like SendFrame, but waiting for the fabric is also
+// bounded by deadline. Once a frame leaves, only WRITE_TIMEOUT can stop it,
+// a half written frame breaks all the streams in fabric.
+func (fab *Fabric) SendFrameDeadline(f *Frame, deadline time.Time) (err error) {
+	logger.Debugf("sent %s", f.Debug())
 
-	fab.wlock.Lock()
+	ctrl := f.Header.Type != MSG_DATA
+	if !ctrl {
+		// the writing stream waits, before taking the fabric.
+		err = fab.send_rate.wait(len(f.Data), deadline)
+		if err != nil {
+			return
+		}
+	}
+	err = fab.acquire(ctrl, deadline)
+	if err != nil {
+		return
+	}
 	fab.Conn.SetWriteDeadline(
 		time.Now().Add(WRITE_TIMEOUT * time.Millisecond))
-	n, err := fab.Conn.Write(b)
-	fab.wlock.Unlock()
+	fab.whdr = f.Header.appendTo(fab.whdr[:0])
+	_, err = fab.bw.Write(fab.whdr)
+	if err == nil {
+		_, err = fab.bw.Write(f.Data)
+	}
+	if err == nil && fab.checksum {
+		crc := crc32.Update(
+			crc32.Checksum(fab.whdr, castagnoli), castagnoli, f.Data)
+		fab.whdr = binary.BigEndian.AppendUint32(fab.whdr[:0], crc)
+		_, err = fab.bw.Write(fab.whdr)
+	}
+	if err == nil {
+		err = fab.flushMaybe(ctrl)
+	}
+	fab.release()
 
 	if err != nil {
+		// maybe half a frame on the wire, no way to sync again.
+		logger.Errorf("%s write broken: %s.", fab.String(), err.Error())
+		fab.Close()
 		return
 	}
-	if n != len(b) {
-		return io.ErrShortWrite
+	fab.traffic_out.count(f, fab.checksum)
+	logger.Debugf("%s wrote len(%d).", fab.String(), HEADER_SIZE+len(f.Data))
+	return
+}
+
+// flushMaybe flushes after control frame, or nobody else waiting.
+// call with the right to write.
+func (fab *Fabric) flushMaybe(ctrl bool) (err error) {
+	fab.slock.Lock()
+	idle := fab.waiting == 0
+	fab.slock.Unlock()
+
+	switch {
+	case ctrl || fab.FlushDelay < 0:
+	case !idle:
+		// the last one will flush.
+		return
+	case fab.FlushDelay > 0:
+		if fab.t_flush == nil {
+			fab.t_flush = time.AfterFunc(fab.FlushDelay, fab.delayedFlush)
+		}
+		return
+	}
+	return fab.bw.Flush()
+}
+
+func (fab *Fabric) delayedFlush() {
+	fab.acquire(true, time.Time{})
+	fab.t_flush = nil
+	fab.Conn.SetWriteDeadline(
+		time.Now().Add(WRITE_TIMEOUT * time.Millisecond))
+	err := fab.bw.Flush()
+	fab.release()
+	if err != nil {
+		logger.Errorf("%s write broken: %s.", fab.String(), err.Error())
+		fab.Close()
+	}
+}
+
+// acquire waits for the right to write a frame. Data frames wait until
+// no control frame waiting, so window, fin and rst never stuck behind
+// bulk data. Data of one stream keeps in order, as conn writes one by one.
+func (fab *Fabric) acquire(ctrl bool, deadline time.Time) (err error) {
+	fab.slock.Lock()
+	defer fab.slock.Unlock()
+	if ctrl {
+		fab.ctrl_wait++
+		defer func() { fab.ctrl_wait-- }()
+	}
+	if !deadline.IsZero() {
+		t := time.AfterFunc(time.Until(deadline), func() {
+			fab.slock.Lock()
+			fab.sev.Broadcast()
+			fab.slock.Unlock()
+		})
+		defer t.Stop()
 	}
-	logger.Debugf("%s wrote len(%d).", fab.String(), len(b))
+	fab.waiting++
+	defer func() { fab.waiting-- }()
+	for fab.sending || (!ctrl && fab.ctrl_wait > 0) {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			if fab.waiting == 1 {
+				// holder may have left frames unflushed for us, flush for it.
+				go fab.delayedFlush()
+			}
+			return ErrDeadline
+		}
+		fab.sev.Wait()
+	}
+	fab.sending = true
 	return
 }
 
+func (fab *Fabric) release() {
+	fab.slock.Lock()
+	fab.sending = false
+	fab.sev.Broadcast()
+	fab.slock.Unlock()
+}
+
+// CloseFiber removes fiber of streamid, nothing happens if already gone.
 func (fab *Fabric) CloseFiber(streamid uint16) (err error) {
+	fab.removeFiber(streamid, nil)
+	return
+}
+
+// removeFiber removes streamid if fiber is on it, any fiber if nil. false
+// if not removed, like removed already, or id reused by another stream.
+func (fab *Fabric) removeFiber(streamid uint16, fiber Fiber) bool {
 	fab.plock.Lock()
-	defer fab.plock.Unlock()
-	if _, ok := fab.weaves[streamid]; !ok {
-		return fmt.Errorf("streamid(%d) not exist.", streamid)
+	f, ok := fab.weaves[streamid]
+	if !ok || (fiber != nil && f != fiber) {
+		fab.plock.Unlock()
+		return false
 	}
 	delete(fab.weaves, streamid)
+	fab.halves[streamid%2]--
+	ours := streamid%2 == fab.next_id%2
+	if ours {
+		// frames of old stream may still on the way.
+		fab.freed[streamid] = time.Now()
+	}
+	if len(fab.weaves) == 0 && fab.ch_drained != nil {
+		close(fab.ch_drained)
+		fab.ch_drained = nil
+	}
+	fab.plock.Unlock()
 
 	logger.Infof("%s remove port %d.", fab.String(), streamid)
+	if c, ok := f.(*Conn); ok {
+		fab.dialDone(c)
+		if !ours {
+			fab.logAccess(c)
+			c.account.doneStream()
+			c.quota.doneConn(c)
+		}
+		if fab.OnClose != nil {
+			fab.OnClose(c)
+		}
+	}
+	return true
+}
+
+// GoingAway tells if new streams should not be created in this fabric,
+// closed one included.
+func (fab *Fabric) GoingAway() bool {
+	fab.plock.RLock()
+	defer fab.plock.RUnlock()
+	return fab.goaway || fab.peer_goaway || fab.closed
+}
+
+func (fab *Fabric) refuseSyn() bool {
+	fab.plock.RLock()
+	defer fab.plock.RUnlock()
+	return fab.goaway
+}
+
+// Shutdown tells peer no more new streams, waits for all streams finished
+// or ctx done, then closes the fabric.
+func (fab *Fabric) Shutdown(ctx context.Context) (err error) {
+	fab.plock.Lock()
+	fab.goaway = true
+	if fab.end_reason == SESSION_NONE {
+		fab.end_reason = SESSION_SHUTDOWN
+	}
+	var ch_drained chan struct{}
+	if len(fab.weaves) != 0 {
+		if fab.ch_drained == nil {
+			fab.ch_drained = make(chan struct{})
+		}
+		ch_drained = fab.ch_drained
+	}
+	fab.plock.Unlock()
+
+	logger.Noticef("%s shutdown.", fab.String())
+	err = SendFrame(fab, MSG_GOAWAY, 0, nil)
+	if err != nil {
+		logger.Error(err.Error())
+		fab.Close()
+		return
+	}
+
+	if ch_drained != nil {
+		select {
+		case <-ch_drained:
+		case <-ctx.Done():
+			err = ctx.Err()
+			logger.Warningf("%s shutdown with %d streams left: %s.",
+				fab.String(), fab.GetSize(), err.Error())
+		}
+	}
+	fab.Close()
 	return
 }
 
 func (fab *Fabric) Close() (err error) {
 	defer fab.Conn.Close()
 
-	fab.plock.RLock()
-	defer fab.plock.RUnlock()
+	fab.plock.Lock()
+	defer fab.plock.Unlock()
 	if fab.closed {
 		return
 	}
 	fab.closed = true
+	if fab.end_reason == SESSION_NONE {
+		fab.end_reason = SESSION_CLOSED
+	}
+	if fab.listener != nil {
+		go fab.listener.Close()
+	}
+	fab.closeQueries()
+	fab.closeBinds()
+	fab.closeTokens()
 
 	logger.Warningf(
 		"%s close all connects (%d).", fab.String(), len(fab.weaves))
@@ -166,27 +1013,224 @@ func (fab *Fabric) Close() (err error) {
 	return
 }
 
+// sweepIdle checks all conns for idle, until fabric closed.
+func (fab *Fabric) sweepIdle() {
+	ticker := time.NewTicker(fab.IdleTimeout / 2)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		fab.plock.RLock()
+		closed := fab.closed
+		fab.plock.RUnlock()
+		if closed {
+			return
+		}
+		for _, c := range fab.GetConnections() {
+			c.reapIdle(now, fab.IdleTimeout)
+		}
+	}
+}
+
+// Replay takes frame read before fabric, like syn of guest in AuthInfo.
+// Loop handles it first. call it before Loop.
+func (fab *Fabric) Replay(f *Frame) {
+	fab.replayed = f
+}
+
+// readFrame reads next frame from peer, and verifies checksum if agreed.
+func (fab *Fabric) readFrame() (f *Frame, err error) {
+	if f = fab.replayed; f != nil {
+		fab.replayed = nil
+		return
+	}
+	f, err = readFrame(fab.Conn, fab.rhdr[:], fab.MaxReadSize, nil)
+	if err != nil || !fab.checksum {
+		return
+	}
+	_, err = io.ReadFull(fab.Conn, fab.rsum[:])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return
+	}
+	crc := crc32.Update(
+		crc32.Checksum(fab.rhdr[:], castagnoli), castagnoli, f.Data)
+	if crc != binary.BigEndian.Uint32(fab.rsum[:]) {
+		atomic.AddUint64(&checksumFailed, 1)
+		err = fmt.Errorf("%w: %s", ErrChecksum, f.Debug())
+		if f.Header.Type == MSG_DATA {
+			putData(f.Data)
+		}
+		return nil, err
+	}
+	return
+}
+
+// skipUnknown drops frame of unknown type, logs at most once in
+// UNKNOWN_LOG_INTERVAL. called by Loop only.
+func (fab *Fabric) skipUnknown(f *Frame) {
+	fab.unknown_skipped++
+	now := time.Now()
+	if now.Sub(fab.unknown_logged) < UNKNOWN_LOG_INTERVAL*time.Millisecond {
+		return
+	}
+	logger.Infof("%s skip %d unknown frames, last %s",
+		fab.String(), fab.unknown_skipped, f.Debug())
+	fab.unknown_skipped = 0
+	fab.unknown_logged = now
+}
+
 func (fab *Fabric) Loop() {
+	defer fab.logSession(false)
 	defer fab.Close()
+	// returned for framing or conn, if not closed by us before.
+	defer fab.endWith(SESSION_ERROR)
+	fab.logSession(true)
+	if fab.IdleTimeout > 0 {
+		go fab.sweepIdle()
+	}
+	if fab.PingInterval > 0 {
+		go fab.heartbeat()
+	}
+	if fab.padding() != nil {
+		go fab.sendCover()
+	}
+	if ac := aeadOf(fab.Conn); fab.rekey && ac != nil {
+		go fab.rekeyLoop(ac)
+	}
+	// never wait for peer reading, before we read.
+	go fab.sendSettings()
 
 	for {
-		f, err := ReadFrame(fab.Conn, nil)
+		f, err := fab.readFrame()
 		switch err {
 		default:
-			logger.Error(err.Error())
+			if errors.Is(err, ErrChecksum) {
+				logger.Criticalf("%s corrupted on the wire: %s",
+					fab.String(), err.Error())
+				return
+			}
+			// framing lost, all streams reset by Close.
+			logger.Errorf("%s read frame: %s", fab.String(), err.Error())
 			return
 		case io.EOF:
 			logger.Warningf("%s connection closed.", fab.String())
+			fab.endWith(SESSION_PEER)
 			return
 		case nil:
 		}
 
+		fab.traffic_in.count(f, fab.checksum)
 		logger.Debugf("recv %s", f.Debug())
+		if fab.PingInterval > 0 {
+			atomic.StoreInt64(&fab.heard, time.Now().UnixNano())
+		}
+
+		if !knownType(f.Header.Type) {
+			if fab.Strict {
+				logger.Errorf("%s %s: %s", fab.String(), ErrUnknownMsg.Error(), f.Debug())
+				return
+			}
+			// from newer peer, whole frame already read.
+			fab.skipUnknown(f)
+			continue
+		}
+
+		switch f.Header.Type {
+		case MSG_HELLO:
+			// only in handshake, before auth.
+			logger.Warningf("%s unexpected hello, ignored.", fab.String())
+			continue
+		case MSG_PADDING:
+			// cover frame, nothing in it.
+			continue
+		case MSG_SETTINGS:
+			err = fab.onSettings(f)
+			if err != nil {
+				logger.Errorf("%s %s", fab.String(), err.Error())
+				return
+			}
+			continue
+		case MSG_PING:
+			f.Header.Type = MSG_PONG
+			err = fab.SendFrame(f)
+			if err != nil {
+				logger.Error(err.Error())
+			}
+			continue
+		case MSG_PONG:
+			fab.onPong(f)
+			continue
+		case MSG_DNS:
+			fab.onDns(f)
+			continue
+		case MSG_DNSANSWER:
+			fab.onDnsAnswer(f)
+			continue
+		case MSG_BIND:
+			fab.onBind(f)
+			continue
+		case MSG_BINDANSWER:
+			fab.onBindAnswer(f)
+			continue
+		case MSG_RENEW:
+			fab.onRenew(f)
+			continue
+		case MSG_REKEY:
+			err = fab.onRekey(f)
+			if err != nil {
+				logger.Errorf("%s %s", fab.String(), err.Error())
+				return
+			}
+			continue
+		case MSG_GOAWAY:
+			logger.Noticef("%s peer going away.", fab.String())
+			fab.plock.Lock()
+			fab.peer_goaway = true
+			fab.plock.Unlock()
+			continue
+		}
+
+		if f.Header.Type == MSG_DATA && f.Header.Flags&FLAG_PADDED != 0 {
+			err = fab.unpadData(f)
+			if err != nil {
+				logger.Errorf("%s %s", fab.String(), err.Error())
+				putData(f.Data)
+				return
+			}
+		}
+		if f.Header.Type == MSG_DATA && f.Header.Flags&FLAG_COMPRESSED != 0 {
+			err = fab.unzipData(f)
+			if err != nil {
+				logger.Errorf("%s %s", fab.String(), err.Error())
+				return
+			}
+		}
 
 		fab.plock.RLock()
 		fiber, ok := fab.weaves[f.Header.Streamid]
 		fab.plock.RUnlock()
+		if ok && fiber != nil && f.Header.Type == MSG_SYN {
+			fab.onDupSyn(f.Header.Streamid, fiber)
+			continue
+		}
 		if !ok || fiber == nil {
+			switch f.Header.Type {
+			case MSG_DATA:
+				logger.Infof("%s data for unknown stream %d, reset.",
+					fab.String(), f.Header.Streamid)
+				putData(f.Data)
+				err = fab.sendReset(f.Header.Streamid, ERR_CLOSED)
+				if err != nil {
+					logger.Error(err.Error())
+				}
+				continue
+			case MSG_RST, MSG_FIN:
+				// crossed with our rst, stream already gone.
+				logger.Debugf("%s drop %s for closed stream.",
+					fab.String(), f.Debug())
+				continue
+			}
 			fiber = fab.dft_fiber
 		}
 
@@ -0,0 +1,137 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// recordConn keeps bytes read from conn until anything written, so conn
+// not speaking hello can be handed to fallback as if never read. Hello
+// of server is the first thing written, nothing to peer before it.
+type recordConn struct {
+	net.Conn
+	lock  sync.Mutex
+	read  []byte
+	wrote bool
+}
+
+func (rc *recordConn) Read(b []byte) (n int, err error) {
+	n, err = rc.Conn.Read(b)
+	rc.lock.Lock()
+	if !rc.wrote {
+		rc.read = append(rc.read, b[:n]...)
+	}
+	rc.lock.Unlock()
+	return
+}
+
+func (rc *recordConn) Write(b []byte) (n int, err error) {
+	rc.lock.Lock()
+	rc.wrote, rc.read = true, nil
+	rc.lock.Unlock()
+	return rc.Conn.Write(b)
+}
+
+func (rc *recordConn) NetConn() net.Conn {
+	return rc.Conn
+}
+
+// replay returns conn reading bytes kept first, nil if anything written.
+func (rc *recordConn) replay() net.Conn {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.wrote {
+		return nil
+	}
+	return &replayConn{
+		Conn: rc.Conn,
+		r:    io.MultiReader(bytes.NewReader(rc.read), rc.Conn),
+	}
+}
+
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (rc *replayConn) Read(b []byte) (int, error) {
+	return rc.r.Read(b)
+}
+
+func (rc *replayConn) NetConn() net.Conn {
+	return rc.Conn
+}
+
+// connListener accepts conn once, and closed with it.
+type connListener struct {
+	ch         chan net.Conn
+	close_once sync.Once
+	ch_closed  chan struct{}
+	addr       net.Addr
+}
+
+func newConnListener(conn net.Conn) (l *connListener) {
+	l = &connListener{
+		ch:        make(chan net.Conn, 1),
+		ch_closed: make(chan struct{}),
+		addr:      conn.LocalAddr(),
+	}
+	l.ch <- &listenedConn{Conn: conn, l: l}
+	return
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ch:
+		return conn, nil
+	case <-l.ch_closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.close_once.Do(func() { close(l.ch_closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
+
+type listenedConn struct {
+	net.Conn
+	l *connListener
+}
+
+func (lc *listenedConn) Close() error {
+	lc.l.Close()
+	return lc.Conn.Close()
+}
+
+func (lc *listenedConn) NetConn() net.Conn {
+	return lc.Conn
+}
+
+// serveFallback serves conn by handler as https, in h2 if agreed in alpn,
+// until conn closed.
+func serveFallback(handler http.Handler, conn net.Conn) {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: FALLBACK_TIMEOUT * time.Millisecond,
+		IdleTimeout:       FALLBACK_TIMEOUT * time.Millisecond,
+	}
+	if state := tlsState(conn); state != nil && state.NegotiatedProtocol == "h2" {
+		(&http2.Server{}).ServeConn(conn, &http2.ServeConnOpts{
+			BaseConfig: srv,
+			Handler:    handler,
+		})
+		return
+	}
+	srv.Serve(newConnListener(conn))
+}
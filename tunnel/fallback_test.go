@@ -0,0 +1,79 @@
+package tunnel
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func TestFallback(t *testing.T) {
+	SetLogging()
+	srvcfg, clicfg := tlsConfigs(t)
+	srvcfg.ClientAuth = tls.NoClientCert
+	srvcfg.NextProtos = []string{"h2", "http/1.1"}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	addr := net.JoinHostPort("localhost", port)
+	ts := &tlsServer{author: passwordAuth{okAuth{}}, ch: make(chan *TunnelServer, 1)}
+	server := &Server{
+		Handler:     ts,
+		TLSConfig:   srvcfg,
+		AuthTimeout: 200 * time.Millisecond,
+		Fallback: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			io.WriteString(w, "just a web server")
+		}),
+	}
+	go server.Serve(ln)
+	web := &tls.Config{RootCAs: clicfg.RootCAs, NextProtos: []string{"http/1.1"}}
+	check := func(resp *http.Response, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "just a web server" {
+			t.Fatalf("wrong page: %q", body)
+		}
+	}
+
+	// browser.
+	transport := &http.Transport{TLSClientConfig: web}
+	defer transport.CloseIdleConnections()
+	check((&http.Client{Transport: transport}).Get("https://" + addr + "/"))
+
+	// probe waits for banner, then asks.
+	conn, err := tls.Dial("tcp", addr, web)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(300 * time.Millisecond)
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	check(http.ReadResponse(bufio.NewReader(conn), nil))
+
+	// clients told by auth, alpn as browsers.
+	dc := NewDialerCreator(netutil.DefaultTcpDialer, "tcp", addr, "user", "secret")
+	dc.TLSConfig = &tls.Config{RootCAs: clicfg.RootCAs, NextProtos: []string{"h2", "http/1.1"}}
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	tun := <-ts.ch
+	if state := tun.TLSState(); state == nil || state.NegotiatedProtocol != "h2" {
+		t.Fatalf("client should look like browser: %+v", state)
+	}
+	if n := server.Fallbacks(); n != 2 {
+		t.Fatalf("expect 2 fallbacks, got %d", n)
+	}
+}
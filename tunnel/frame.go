@@ -5,30 +5,100 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"sync"
+
+	"github.com/shell909090/goproxy/netutil"
 )
 
 type Header struct {
-	Type     uint8
+	Type uint8
+	// meaning depends on type, unknown flags should be ignored.
+	Flags    uint8
 	Length   uint16
 	Streamid uint16
 }
 
 func (hdr *Header) Debug() string {
-	return fmt.Sprintf("frame: type(%d), stream(%d), len(%d).",
-		hdr.Type, hdr.Streamid, hdr.Length)
+	return fmt.Sprintf("frame: type(%d), flags(%d), stream(%d), len(%d).",
+		hdr.Type, hdr.Flags, hdr.Streamid, hdr.Length)
 }
 
 type Result uint32
 
+// DialResult is result of stream with addresses handler dialed, sent
+// instead of errno after accepted if CAP_ADDRS agreed.
+type DialResult struct {
+	Errno uint32
+	// remote and local address of conn to target, in network of syn.
+	Remote string `json:",omitempty"`
+	Local  string `json:",omitempty"`
+}
+
+// unmarshalResult reads result of stream, errno alone or DialResult.
+func (f *Frame) unmarshalResult() (result DialResult, err error) {
+	if len(f.Data) != 0 && f.Data[0] == '{' {
+		err = f.Unmarshal(&result)
+		return
+	}
+	err = f.Unmarshal(&result.Errno)
+	return
+}
+
+// Hello sent by both side before auth. Caps from client are those it
+// asked for, caps from server are those agreed.
+type Hello struct {
+	Version uint16
+	Caps    uint32
+	// public key of X25519, only with CAP_ENCRYPT.
+	Key []byte `json:",omitempty"`
+	// challenge from server, only with CAP_CHALLENGE.
+	Nonce []byte `json:",omitempty"`
+}
+
+// checkVersion tells if peer in version can be talked to.
+func checkVersion(version uint16) (err error) {
+	if version < MIN_VERSION {
+		return fmt.Errorf("%w: peer in %d, need %d at least.",
+			ErrVersion, version, MIN_VERSION)
+	}
+	return
+}
+
+// Settings tells peer how to send to us, sent once when fabric starts.
+type Settings struct {
+	// initial send window of new streams.
+	Window int32
+	// max payload of data frames.
+	MaxFrameSize int
+	// max streams peer can open to us, 0 means no limit.
+	MaxStreams int
+}
+
+// Auth carries Password, or Nonce of client and Proof of key if
+// CAP_CHALLENGE agreed.
 type Auth struct {
 	Username string
-	Password string
+	Password string `json:",omitempty"`
+	Nonce    []byte `json:",omitempty"`
+	Proof    []byte `json:",omitempty"`
+	// bearer token instead of password, see TokenValidator.
+	Token string `json:",omitempty"`
+	// unix ms of client, bound in proof if CAP_TIMESTAMP agreed.
+	Time int64 `json:",omitempty"`
+	// no credentials, client wants in as guest. see GuestAuthenticator.
+	Anonymous bool `json:",omitempty"`
 }
 
 type Syn struct {
 	Network string
 	Address string
+	// id of BindRequest, for conns accepted in listener peer asked for.
+	Bind uint32 `json:",omitempty"`
+	// first bytes of stream if CAP_EARLY agreed, no more than
+	// EARLY_DATA_MAX.
+	Data []byte `json:",omitempty"`
 }
 
 // TODO: use json in wnd may cause performance problem.
@@ -39,14 +109,66 @@ type Frame struct {
 	Data []byte
 }
 
+// data of received frames no larger then BUFFERSIZE came from BufferPool,
+// give them back by putData after consumed. Nobody should keep it then.
+func getData(size int) []byte {
+	return netutil.BufferPool.Get().([]byte)[:size]
+}
+
+func putData(b []byte) {
+	if cap(b) == netutil.BUFFERSIZE {
+		netutil.BufferPool.Put(b[:cap(b)])
+	}
+}
+
+var framePool = sync.Pool{
+	New: func() interface{} {
+		return new(Frame)
+	},
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// knownType tells if t is a frame type of this version. Frames of other
+// types came from newer peer, should be skipped.
+func knownType(t uint8) bool {
+	return t > MSG_UNKNOWN && t <= MSG_LAST
+}
+
 func ReadFrame(r io.Reader, v interface{}) (f *Frame, err error) {
-	f = new(Frame)
-	err = binary.Read(r, binary.BigEndian, &f.Header)
+	var hdr [HEADER_SIZE]byte
+	return readFrame(r, hdr[:], MAX_FRAME_SIZE, v)
+}
+
+// readFrame reads frame with hdr as buffer of header. Header checked
+// before any allocation, frame longer than max or with type 0 means
+// peer broken, the stream can't be synced again.
+func readFrame(r io.Reader, hdr []byte, max int, v interface{}) (f *Frame, err error) {
+	_, err = io.ReadFull(r, hdr[:HEADER_SIZE])
 	if err != nil {
 		return
 	}
+	var h Header
+	h.Type = hdr[0]
+	h.Flags = hdr[1]
+	h.Length = binary.BigEndian.Uint16(hdr[2:4])
+	h.Streamid = binary.BigEndian.Uint16(hdr[4:6])
 
-	f.Data = make([]byte, f.Header.Length)
+	if h.Type == MSG_UNKNOWN {
+		return nil, fmt.Errorf("%w: type %d", ErrUnknownMsg, h.Type)
+	}
+	if int(h.Length) > max {
+		return nil, fmt.Errorf("%w: %d > %d", ErrFrameTooLarge, h.Length, max)
+	}
+
+	f = new(Frame)
+	f.Header = h
+
+	if f.Header.Type == MSG_DATA && int(f.Header.Length) <= netutil.BUFFERSIZE {
+		f.Data = getData(int(f.Header.Length))
+	} else {
+		f.Data = make([]byte, f.Header.Length)
+	}
 	_, err = io.ReadFull(r, f.Data)
 	if err != nil {
 		logger.Error(err.Error())
@@ -101,7 +223,7 @@ func (f *Frame) Marshal(v interface{}) (err error) {
 	if err != nil {
 		return
 	}
-	if len(f.Data) > (1<<16 - 1) {
+	if len(f.Data) > MAX_FRAME_SIZE {
 		return ErrFrameOverFlow
 	}
 	f.Header.Length = uint16(len(f.Data))
@@ -117,9 +239,16 @@ func (f *Frame) Unmarshal(v interface{}) (err error) {
 	return
 }
 
+// appendTo appends packed header to b.
+func (hdr *Header) appendTo(b []byte) []byte {
+	b = append(b, hdr.Type, hdr.Flags)
+	b = binary.BigEndian.AppendUint16(b, hdr.Length)
+	return binary.BigEndian.AppendUint16(b, hdr.Streamid)
+}
+
 func (f *Frame) Pack() (b []byte) {
 	var buf bytes.Buffer
-	buf.Grow(int(5 + f.Header.Length))
+	buf.Grow(HEADER_SIZE + int(f.Header.Length))
 	binary.Write(&buf, binary.BigEndian, f.Header)
 	buf.Write(f.Data)
 	return buf.Bytes()
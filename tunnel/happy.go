@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// splitFamily cuts addrs into those in family of the first one, and others.
+func splitFamily(addrs []string) (primary, fallback []string) {
+	var first bool
+	for i, addr := range addrs {
+		host, _, _ := net.SplitHostPort(addr)
+		ip := net.ParseIP(host)
+		is4 := ip != nil && ip.To4() != nil
+		if i == 0 {
+			first = is4
+		}
+		if is4 == first {
+			primary = append(primary, addr)
+		} else {
+			fallback = append(fallback, addr)
+		}
+	}
+	return
+}
+
+// dialSerial tries addrs one by one, returns the first error if all failed.
+func dialSerial(ctx context.Context, dial dialFunc, network string, addrs []string) (conn net.Conn, err error) {
+	for _, addr := range addrs {
+		var e error
+		conn, e = dial(ctx, network, addr)
+		if e == nil {
+			return conn, nil
+		}
+		if err == nil {
+			err = e
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return
+}
+
+// dialHappy dials addrs like RFC 6555. Family of the first one goes first,
+// the other starts after delay or when the first family all failed. The
+// loser is canceled, or closed if connected anyway.
+func dialHappy(ctx context.Context, dial dialFunc, network string, addrs []string, delay time.Duration) (conn net.Conn, err error) {
+	primary, fallback := splitFamily(addrs)
+	if len(fallback) == 0 {
+		return dialSerial(ctx, dial, network, primary)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	ch := make(chan result, 2)
+	start := func(addrs []string, primary bool) {
+		go func() {
+			c, e := dialSerial(ctx, dial, network, addrs)
+			ch <- result{c, e, primary}
+		}()
+	}
+
+	start(primary, true)
+	pending, started := 1, false
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if !started {
+				start(fallback, false)
+				pending, started = pending+1, true
+			}
+			continue
+		case r := <-ch:
+			pending--
+			if r.err == nil {
+				if pending != 0 {
+					go func() {
+						if r := <-ch; r.conn != nil {
+							r.conn.Close()
+						}
+					}()
+				}
+				return r.conn, nil
+			}
+			// error of primary family tells more.
+			if err == nil || r.primary {
+				err = r.err
+			}
+		}
+		if !started {
+			start(fallback, false)
+			pending, started = pending+1, true
+		}
+		if pending == 0 {
+			return nil, err
+		}
+	}
+}
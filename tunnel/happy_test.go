@@ -0,0 +1,135 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubDialer hangs on dead addresses until canceled, fails on refused ones,
+// and connects others over a pipe.
+type stubDialer struct {
+	dead    map[string]bool
+	refused map[string]bool
+
+	lock     sync.Mutex
+	canceled []string
+}
+
+func (s *stubDialer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	switch {
+	case s.dead[address]:
+		<-ctx.Done()
+		s.lock.Lock()
+		s.canceled = append(s.canceled, address)
+		s.lock.Unlock()
+		return nil, ctx.Err()
+	case s.refused[address]:
+		return nil, errors.New("refused " + address)
+	}
+	c1, c2 := net.Pipe()
+	c2.Close()
+	return c1, nil
+}
+
+func (s *stubDialer) canceledAddrs() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.canceled...)
+}
+
+const (
+	dead6 = "[2001:db8::1]:80"
+	live4 = "192.0.2.1:80"
+)
+
+func TestSplitFamily(t *testing.T) {
+	primary, fallback := splitFamily([]string{dead6, live4, "[2001:db8::2]:80", "192.0.2.2:80"})
+	if len(primary) != 2 || primary[1] != "[2001:db8::2]:80" || len(fallback) != 2 || fallback[0] != live4 {
+		t.Fatalf("wrong split: %v %v", primary, fallback)
+	}
+}
+
+func TestHappyFallback(t *testing.T) {
+	s := &stubDialer{dead: map[string]bool{dead6: true}}
+	start := time.Now()
+	conn, err := dialHappy(context.Background(), s.dial, "tcp", []string{dead6, live4}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if d := time.Since(start); d < 50*time.Millisecond || d > time.Second {
+		t.Fatalf("fallback should start after head start, took %s", d)
+	}
+
+	// loser canceled.
+	time.Sleep(20 * time.Millisecond)
+	if canceled := s.canceledAddrs(); len(canceled) != 1 || canceled[0] != dead6 {
+		t.Fatalf("expect %s canceled, got %v", dead6, canceled)
+	}
+}
+
+func TestHappyFailFast(t *testing.T) {
+	// first family refused, no waiting for head start.
+	s := &stubDialer{refused: map[string]bool{dead6: true}}
+	start := time.Now()
+	conn, err := dialHappy(context.Background(), s.dial, "tcp", []string{dead6, live4}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("fallback waited after failure, took %s", d)
+	}
+
+	s = &stubDialer{refused: map[string]bool{dead6: true, live4: true}}
+	_, err = dialHappy(context.Background(), s.dial, "tcp", []string{dead6, live4}, time.Second)
+	if err == nil || err.Error() != "refused "+dead6 {
+		t.Fatalf("expect error of first family, got %v", err)
+	}
+}
+
+func TestHappyTimeout(t *testing.T) {
+	s := &stubDialer{dead: map[string]bool{dead6: true, live4: true}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := dialHappy(ctx, s.dial, "tcp", []string{dead6, live4}, 10*time.Millisecond)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline, got %v", err)
+	}
+}
+
+// dualResolver gives ::1 before 127.0.0.1, like a host with both.
+type dualResolver struct{}
+
+func (dualResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	return []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1")}, nil
+}
+
+func TestTcpProxyHappy(t *testing.T) {
+	addr := tcpSink(t)
+	_, port, _ := net.SplitHostPort(addr)
+	cli, srv := newConnPair(t)
+	srv.fab.Resolver = dualResolver{}
+	client := &Client{Fabric: cli.fab}
+
+	// nothing on ::1, the live one reported as dialed.
+	target := net.JoinHostPort("dual.test", port)
+	conn, err := client.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var dialed net.Addr
+	for _, c := range srv.fab.GetConnections() {
+		if c.Address == target {
+			dialed = c.DialedAddr()
+		}
+	}
+	if dialed == nil || dialed.String() != addr {
+		t.Fatalf("expect dialed %s, got %v", addr, dialed)
+	}
+}
@@ -0,0 +1,170 @@
+package tunnel
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashAuthenticator checks passwords against bcrypt hashes by username,
+// so passwords never kept in plaintext. Users can be loaded again at
+// runtime, fabrics alive stay, new ones checked by new users. Keys not
+// known, clients send passwords on tls or encrypted fabrics.
+type HashAuthenticator struct {
+	hashes atomic.Pointer[map[string]string]
+}
+
+// NewHashAuthenticator takes hashes by username, users not in it refused.
+func NewHashAuthenticator(hashes map[string]string) (ha *HashAuthenticator, err error) {
+	ha = &HashAuthenticator{}
+	err = ha.Set(hashes)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// HashPassword makes hash of plaintext for HashAuthenticator, in bcrypt.
+func HashPassword(plaintext string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(plaintext), AUTH_HASH_COST)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// isHash tells if s is a bcrypt hash, not a password.
+func isHash(s string) bool {
+	if !strings.HasPrefix(s, "$2") {
+		return false
+	}
+	_, err := bcrypt.Cost([]byte(s))
+	return err == nil
+}
+
+// ParseHashes reads lines of "user:hash", blank lines and # comments
+// skipped. Passwords in plaintext refused, not mixed with hashes.
+func ParseHashes(r io.Reader) (hashes map[string]string, err error) {
+	hashes = make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		username, hash = strings.TrimSpace(username), strings.TrimSpace(hash)
+		switch {
+		case !ok || username == "":
+			return nil, fmt.Errorf("%w: line %d not user:hash.", ErrBadHash, n)
+		case !isHash(hash):
+			return nil, fmt.Errorf("%w: line %d, password of user %s not a bcrypt hash, plaintext refused.",
+				ErrBadHash, n, username)
+		}
+		if _, ok = hashes[username]; ok {
+			return nil, fmt.Errorf("%w: line %d, user %s again.", ErrBadHash, n, username)
+		}
+		hashes[username] = hash
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Set swaps users to hashes, all or nothing. Users kept if any of hashes
+// isn't one.
+func (ha *HashAuthenticator) Set(hashes map[string]string) error {
+	m := make(map[string]string, len(hashes))
+	for username, hash := range hashes {
+		if !isHash(hash) {
+			return fmt.Errorf("%w: password of user %s not a bcrypt hash, plaintext refused.",
+				ErrBadHash, username)
+		}
+		m[username] = hash
+	}
+	ha.hashes.Store(&m)
+	return nil
+}
+
+// Load swaps users to ones read from r, by ParseHashes. Users kept if
+// failed.
+func (ha *HashAuthenticator) Load(r io.Reader) error {
+	hashes, err := ParseHashes(r)
+	if err != nil {
+		return err
+	}
+	ha.hashes.Store(&hashes)
+	return nil
+}
+
+// LoadFile swaps users to ones in file of path.
+func (ha *HashAuthenticator) LoadFile(path string) (err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	err = ha.Load(file)
+	if err != nil {
+		return
+	}
+	logger.Noticef("%d users loaded from %s.", ha.Len(), path)
+	return
+}
+
+// Len tells how many users in use.
+func (ha *HashAuthenticator) Len() int {
+	p := ha.hashes.Load()
+	if p == nil {
+		return 0
+	}
+	return len(*p)
+}
+
+var (
+	dummy_once sync.Once
+	dummy_hash []byte
+)
+
+// dummyHash is checked for users not known, so they take as long as
+// wrong passwords.
+func dummyHash() []byte {
+	dummy_once.Do(func() {
+		b := make([]byte, 16)
+		rand.Read(b)
+		hash, err := HashPassword(base64.StdEncoding.EncodeToString(b))
+		if err != nil {
+			panic(err)
+		}
+		dummy_hash = []byte(hash)
+	})
+	return dummy_hash
+}
+
+func (ha *HashAuthenticator) Auth(username, password string) (info UserInfo, err error) {
+	var hash []byte
+	if p := ha.hashes.Load(); p != nil {
+		if s, ok := (*p)[username]; ok {
+			hash = []byte(s)
+		}
+	}
+	if hash == nil {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return info, ErrAuthFailed
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return info, ErrAuthFailed
+	}
+	info.Username = username
+	return
+}
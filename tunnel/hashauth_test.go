@@ -0,0 +1,93 @@
+package tunnel
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestHashAuthenticator(t *testing.T) {
+	SetLogging()
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(hash, "secret") || !isHash(hash) {
+		t.Fatalf("bad hash: %s", hash)
+	}
+	ha, err := NewHashAuthenticator(map[string]string{"alice": hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	as := newAuthServer(ha, 0)
+	dc := NewDialerCreator(as, "pipe", "pipe", "alice", "secret")
+	dc.Plaintext = true
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if info := <-as.ch; info.Username != "alice" {
+		t.Fatalf("wrong user: %+v", info)
+	}
+
+	for _, user := range [][2]string{{"alice", "wrong"}, {"alice", hash}, {"bob", "secret"}} {
+		_, err = ha.Auth(user[0], user[1])
+		if !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("%v: expect auth failed, got %v", user, err)
+		}
+	}
+}
+
+func TestHashReload(t *testing.T) {
+	SetLogging()
+	alice, _ := HashPassword("secret")
+	bob, _ := HashPassword("hunter2")
+	ha, err := NewHashAuthenticator(map[string]string{"alice": alice})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ha.Load(strings.NewReader("# users\n\nbob:" + bob + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ha.Len() != 1 {
+		t.Fatalf("expect 1 user, got %d", ha.Len())
+	}
+	if _, err = ha.Auth("alice", "secret"); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("alice should be gone: %v", err)
+	}
+	if info, err := ha.Auth("bob", "hunter2"); err != nil || info.Username != "bob" {
+		t.Fatalf("bob refused: %+v %v", info, err)
+	}
+}
+
+func TestParseHashes(t *testing.T) {
+	hash, _ := HashPassword("secret")
+	for _, s := range []string{
+		"alice:secret\n",
+		"alice:" + hash + "\nbob:hunter2\n",
+		"alice " + hash + "\n",
+		":" + hash + "\n",
+		"alice:" + hash + "\nalice:" + hash + "\n",
+	} {
+		_, err := ParseHashes(strings.NewReader(s))
+		if !errors.Is(err, ErrBadHash) {
+			t.Fatalf("%q: expect bad hash, got %v", s, err)
+		}
+	}
+
+	ha, _ := NewHashAuthenticator(map[string]string{"alice": hash})
+	err := ha.Load(strings.NewReader("alice:" + hash + "\nbob:hunter2\n"))
+	if !errors.Is(err, ErrBadHash) || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expect bad hash on line 2, got %v", err)
+	}
+	if _, err = ha.Auth("alice", "secret"); err != nil {
+		t.Fatalf("users should be kept if load failed: %v", err)
+	}
+	if _, err = NewHashAuthenticator(map[string]string{"bob": "hunter2"}); !errors.Is(err, ErrBadHash) {
+		t.Fatalf("plaintext should be refused: %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+)
+
+// Listener takes streams peer opened, instead of ProtocolHandlers. Conns
+// in backlog are accepted already, Accept just hands them out.
+type Listener struct {
+	fab *Fabric
+	// for listener peer bound, streams with bind of id come here.
+	id   uint32
+	addr net.Addr
+
+	lock      sync.Mutex
+	closed    bool
+	ch_conn   chan *Conn
+	ch_closed chan struct{}
+}
+
+// Listen registers a listener with backlog to fabric, streams opened by
+// peer after it go to the listener. Stream will be refused with
+// ERR_TOOMANYSTREAMS if backlog full.
+func (fab *Fabric) Listen(backlog int) (l *Listener, err error) {
+	if backlog <= 0 {
+		backlog = LISTEN_BACKLOG
+	}
+	l = newListener(fab, backlog)
+
+	fab.plock.Lock()
+	defer fab.plock.Unlock()
+	switch {
+	case fab.closed:
+		return nil, net.ErrClosed
+	case fab.listener != nil:
+		return nil, ErrListening
+	}
+	fab.listener = l
+	return
+}
+
+func newListener(fab *Fabric, backlog int) *Listener {
+	return &Listener{
+		fab:       fab,
+		ch_conn:   make(chan *Conn, backlog),
+		ch_closed: make(chan struct{}),
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	return l.AcceptConn()
+}
+
+// AcceptConn works like Accept, Target of conn tells what peer asked for.
+func (l *Listener) AcceptConn() (c *Conn, err error) {
+	select {
+	case c = <-l.ch_conn:
+		return
+	case <-l.ch_closed:
+	}
+	// conns queued before close will be reset by Close.
+	return nil, net.ErrClosed
+}
+
+// push queues the conn in backlog, called in Loop.
+func (l *Listener) push(c *Conn) (err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return c.DenyWith(ERR_CLOSED)
+	}
+	if len(l.ch_conn) == cap(l.ch_conn) {
+		logger.Warningf("%s backlog full, refuse stream %d.",
+			l.fab.String(), c.streamid)
+		return c.DenyWith(ERR_TOOMANYSTREAMS)
+	}
+	err = c.Accept()
+	if err != nil {
+		c.Final()
+		return
+	}
+	l.ch_conn <- c
+	return
+}
+
+// Close stops accepting, streams in backlog will be reset. Listener keeps
+// its place in fabric, streams opened later will be refused. One from
+// BindRemote is removed, and peer stops listening.
+func (l *Listener) Close() (err error) {
+	if l.id != 0 {
+		l.fab.unbind(l.id)
+	}
+	l.shut()
+	return
+}
+
+func (l *Listener) shut() {
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
+		return
+	}
+	l.closed = true
+	close(l.ch_closed)
+	l.lock.Unlock()
+
+	for {
+		select {
+		case c := <-l.ch_conn:
+			c.ResetWith(ERR_CLOSED)
+		default:
+			return
+		}
+	}
+}
+
+// Addr returns local address of fabric, or address peer listening on.
+func (l *Listener) Addr() net.Addr {
+	if l.addr != nil {
+		return l.addr
+	}
+	return l.fab.LocalAddr()
+}
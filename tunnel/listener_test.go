@@ -0,0 +1,101 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newListenPair(t *testing.T, backlog int) (client *Client, l *Listener) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	client = NewClient(p1)
+	server := NewTunnelServer(p2)
+	var err error
+	l, err = server.Listen(backlog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Loop()
+	go server.Loop()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return
+}
+
+func TestListener(t *testing.T) {
+	client, l := newListenPair(t, 1)
+	if _, err := l.fab.Listen(1); err != ErrListening {
+		t.Fatalf("expect listening, got %v", err)
+	}
+
+	// network not registered, listener takes it anyway.
+	cli, err := client.Dial("nowhere", "target:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	network, address := conn.(*Conn).Target()
+	if network != "nowhere" || address != "target:80" {
+		t.Fatalf("wrong target: %s %s", network, address)
+	}
+
+	go func() {
+		cli.Write([]byte(PAYLOAD))
+		cli.Close()
+	}()
+	b, err := io.ReadAll(conn)
+	if err != nil || string(b) != PAYLOAD {
+		t.Fatalf("read %q, %v", b, err)
+	}
+	conn.Close()
+
+	// one in backlog, next refused.
+	queued, err := client.Dial("nowhere", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Dial("nowhere", "b")
+	if !errors.Is(err, ErrTooManyStreams) {
+		t.Fatalf("expect too many streams, got %v", err)
+	}
+
+	// close resets backlog, and refuses later streams.
+	l.Close()
+	queued.SetReadDeadline(time.Now().Add(time.Second))
+	var buf [16]byte
+	if _, err = queued.Read(buf[:]); !errors.Is(err, ErrReset) {
+		t.Fatalf("expect reset, got %v", err)
+	}
+	if _, err = l.Accept(); err != net.ErrClosed {
+		t.Fatalf("expect closed, got %v", err)
+	}
+	if _, err = client.Dial("nowhere", "c"); err == nil {
+		t.Fatal("dial to closed listener should fail")
+	}
+}
+
+func TestListenerFabricClosed(t *testing.T) {
+	client, l := newListenPair(t, 0)
+	ch := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		ch <- err
+	}()
+	client.Close()
+	select {
+	case err := <-ch:
+		if err != net.ErrClosed {
+			t.Fatalf("expect closed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("accept not returned after fabric closed")
+	}
+}
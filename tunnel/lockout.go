@@ -0,0 +1,224 @@
+package tunnel
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Lockout slows down sources failed in auth, by ip, and bans them after
+// Threshold failures in a row. Conns from banned ones refused at accept,
+// before any frame. Set options before use.
+type Lockout struct {
+	// failures before banned, 0 never bans.
+	Threshold int
+	// ban lasts it, LOCKOUT_BAN if 0.
+	Ban time.Duration
+	// failure answered after it, doubled for each failure in a row, up to
+	// MaxDelay. LOCKOUT_DELAY and LOCKOUT_MAX_DELAY if 0.
+	Delay    time.Duration
+	MaxDelay time.Duration
+	// failures forgotten after it without more, LOCKOUT_FORGET if 0.
+	Forget time.Duration
+
+	lock    sync.Mutex
+	sources map[string]*lockEntry
+	swept   time.Time
+	// counted without lock.
+	failures uint64
+	bans     uint64
+	refused  uint64
+}
+
+type lockEntry struct {
+	failures int
+	last     time.Time
+	// banned till it, zero if not.
+	until time.Time
+}
+
+// LockoutEntry is a snapshot of a source failed, for admin.
+type LockoutEntry struct {
+	IP       string
+	Failures int
+	// zero if not banned.
+	Until time.Time
+}
+
+// LockoutStats counts all time, except sources kept and banned now.
+type LockoutStats struct {
+	Failures uint64
+	Bans     uint64
+	// conns refused by bans.
+	Refused uint64
+	Sources int
+	Banned  int
+}
+
+func NewLockout(threshold int, ban time.Duration) *Lockout {
+	return &Lockout{Threshold: threshold, Ban: ban}
+}
+
+// sourceIP is ip of addr, or addr itself if not ip.
+func sourceIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func orDefault(d time.Duration, ms int) time.Duration {
+	if d == 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return d
+}
+
+// Banned tells if conns from addr should be refused now.
+func (lo *Lockout) Banned(addr net.Addr) bool {
+	now := time.Now()
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+	lo.sweep(now, false)
+	e, ok := lo.sources[sourceIP(addr)]
+	if !ok || !now.Before(e.until) {
+		return false
+	}
+	atomic.AddUint64(&lo.refused, 1)
+	return true
+}
+
+// Failed counts a failure of addr, bans it if Threshold reached. Answer
+// failure after delay returned.
+func (lo *Lockout) Failed(addr net.Addr) (delay time.Duration) {
+	atomic.AddUint64(&lo.failures, 1)
+	now := time.Now()
+	ip := sourceIP(addr)
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+	if lo.sources == nil {
+		lo.sources = make(map[string]*lockEntry)
+	}
+	e, ok := lo.sources[ip]
+	if !ok {
+		if len(lo.sources) >= LOCKOUT_MAX_SOURCES {
+			lo.sweep(now, true)
+			lo.evict()
+		}
+		e = &lockEntry{}
+		lo.sources[ip] = e
+	}
+	e.failures++
+	e.last = now
+	if lo.Threshold > 0 && e.failures >= lo.Threshold && !now.Before(e.until) {
+		ban := orDefault(lo.Ban, LOCKOUT_BAN)
+		e.until = now.Add(ban)
+		atomic.AddUint64(&lo.bans, 1)
+		logger.Warningf("%s banned for %s after %d failures in auth.", ip, ban, e.failures)
+	}
+
+	delay = orDefault(lo.Delay, LOCKOUT_DELAY)
+	max := orDefault(lo.MaxDelay, LOCKOUT_MAX_DELAY)
+	for i := 1; i < e.failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return
+}
+
+// Passed forgets failures of addr.
+func (lo *Lockout) Passed(addr net.Addr) {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+	delete(lo.sources, sourceIP(addr))
+}
+
+// Unban forgets ip, tells if it was kept.
+func (lo *Lockout) Unban(ip string) bool {
+	lo.lock.Lock()
+	defer lo.lock.Unlock()
+	_, ok := lo.sources[ip]
+	if ok {
+		delete(lo.sources, ip)
+		logger.Noticef("%s unbanned.", ip)
+	}
+	return ok
+}
+
+// sweep forgets bans ended and failures older than Forget, once in Forget
+// at most unless force. call with lock held.
+func (lo *Lockout) sweep(now time.Time, force bool) {
+	forget := orDefault(lo.Forget, LOCKOUT_FORGET)
+	if !force && now.Sub(lo.swept) < forget {
+		return
+	}
+	lo.swept = now
+	for ip, e := range lo.sources {
+		if e.until.IsZero() && now.Sub(e.last) >= forget ||
+			!e.until.IsZero() && !now.Before(e.until) {
+			delete(lo.sources, ip)
+		}
+	}
+}
+
+// evict drops a source not banned if table still full, so spray from many
+// sources can't take all memory. call with lock held.
+func (lo *Lockout) evict() {
+	if len(lo.sources) < LOCKOUT_MAX_SOURCES {
+		return
+	}
+	for ip, e := range lo.sources {
+		if e.until.IsZero() {
+			delete(lo.sources, ip)
+			return
+		}
+	}
+}
+
+// List returns sources kept, banned ones first.
+func (lo *Lockout) List() (entries []LockoutEntry) {
+	now := time.Now()
+	lo.lock.Lock()
+	for ip, e := range lo.sources {
+		entry := LockoutEntry{IP: ip, Failures: e.failures}
+		if now.Before(e.until) {
+			entry.Until = e.until
+		}
+		entries = append(entries, entry)
+	}
+	lo.lock.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Until.IsZero() != entries[j].Until.IsZero() {
+			return !entries[i].Until.IsZero()
+		}
+		if entries[i].Failures != entries[j].Failures {
+			return entries[i].Failures > entries[j].Failures
+		}
+		return entries[i].IP < entries[j].IP
+	})
+	return
+}
+
+func (lo *Lockout) Stats() (st LockoutStats) {
+	st.Failures = atomic.LoadUint64(&lo.failures)
+	st.Bans = atomic.LoadUint64(&lo.bans)
+	st.Refused = atomic.LoadUint64(&lo.refused)
+	now := time.Now()
+	lo.lock.Lock()
+	st.Sources = len(lo.sources)
+	for _, e := range lo.sources {
+		if now.Before(e.until) {
+			st.Banned++
+		}
+	}
+	lo.lock.Unlock()
+	return
+}
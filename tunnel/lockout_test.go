@@ -0,0 +1,121 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+func TestLockout(t *testing.T) {
+	SetLogging()
+	lo := NewLockout(3, 50*time.Millisecond)
+	lo.Delay, lo.MaxDelay = 10*time.Millisecond, 40*time.Millisecond
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	other := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1000}
+
+	for i, expect := range []time.Duration{10, 20, 40, 40} {
+		if d := lo.Failed(addr); d != expect*time.Millisecond {
+			t.Fatalf("failure %d: expect delay %dms, got %s", i, expect, d)
+		}
+		if banned := lo.Banned(&net.TCPAddr{IP: addr.IP, Port: 2000}); banned != (i >= 2) {
+			t.Fatalf("failure %d: banned %v", i, banned)
+		}
+	}
+	lo.Failed(other)
+	if lo.Banned(other) {
+		t.Fatal("other source banned")
+	}
+	st := lo.Stats()
+	if st.Failures != 5 || st.Bans != 1 || st.Refused != 2 || st.Sources != 2 || st.Banned != 1 {
+		t.Fatalf("wrong stats: %+v", st)
+	}
+	if entries := lo.List(); len(entries) != 2 || entries[0].IP != "10.0.0.1" ||
+		entries[0].Failures != 4 || entries[0].Until.IsZero() || !entries[1].Until.IsZero() {
+		t.Fatalf("wrong list: %+v", entries)
+	}
+
+	// passed forgets failures.
+	lo.Passed(other)
+	if d := lo.Failed(other); d != 10*time.Millisecond {
+		t.Fatalf("failures not forgotten, delay %s", d)
+	}
+
+	if !lo.Unban("10.0.0.1") || lo.Banned(addr) || lo.Unban("10.0.0.1") {
+		t.Fatal("unban failed")
+	}
+
+	// ban ends, and swept.
+	lo.Forget = 20 * time.Millisecond
+	for i := 0; i < 3; i++ {
+		lo.Failed(addr)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if lo.Banned(addr) || lo.Stats().Sources != 0 {
+		t.Fatalf("ban not ended: %+v", lo.List())
+	}
+}
+
+// lockoutAuth checks users by map, failures slowed down by lo.
+type lockoutAuth struct {
+	MapAuthenticator
+	lo *Lockout
+}
+
+func (la lockoutAuth) AuthLockout() *Lockout { return la.lo }
+
+func (la lockoutAuth) Handle(conn net.Conn) (err error) {
+	_, err = AuthConnWith(la, conn, 0)
+	return
+}
+
+func TestLockoutServe(t *testing.T) {
+	SetLogging()
+	lo := NewLockout(2, time.Minute)
+	lo.Delay = 100 * time.Millisecond
+	la := lockoutAuth{MapAuthenticator{"alice": "secret"}, lo}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go (&Server{Handler: la, Lockout: lo}).Serve(ln)
+
+	dc := NewDialerCreator(netutil.DefaultTcpDialer, "tcp", ln.Addr().String(), "alice", "wrong")
+	dc.Plaintext = true
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		if _, err = dc.Create(); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("expect auth failed, got %v", err)
+		}
+		// doubled for each failure.
+		if d := time.Since(start); d < time.Duration(i+1)*lo.Delay {
+			t.Fatalf("failure %d answered in %s", i, d)
+		}
+	}
+
+	// refused at accept, even with right password.
+	dc = NewDialerCreator(netutil.DefaultTcpDialer, "tcp", ln.Addr().String(), "alice", "secret")
+	dc.Plaintext = true
+	if _, err = dc.Create(); err == nil || errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("expect closed at accept, got %v", err)
+	}
+	if st := lo.Stats(); st.Refused != 1 || st.Banned != 1 {
+		t.Fatalf("wrong stats: %+v", st)
+	}
+
+	lo.Unban("127.0.0.1")
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	for i := 0; len(lo.List()) != 0; i++ {
+		if i > 100 {
+			t.Fatalf("source not forgotten after passed: %+v", lo.List())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
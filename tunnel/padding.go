@@ -0,0 +1,145 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// PaddingPolicy decides how data frames padded, and when cover frames go.
+// Only used when CAP_PADDING agreed.
+type PaddingPolicy interface {
+	// Pad returns bytes to pad after payload of size bytes, 0 for none.
+	Pad(size int) int
+	// Cover returns how long fabric idles before next cover frame, and
+	// payload size of it. wait 0 means no cover frame any more.
+	Cover() (wait time.Duration, size int)
+}
+
+// BucketPadding pads payload up to smallest bucket can hold it, payloads
+// larger than all buckets not padded. Cover frames of CoverSize sent when
+// idle for CoverInterval, randomized by half, 0 means never.
+type BucketPadding struct {
+	Buckets       []int
+	CoverInterval time.Duration
+	CoverSize     int
+}
+
+func (bp *BucketPadding) Pad(size int) int {
+	for _, b := range bp.Buckets {
+		if b >= size {
+			return b - size
+		}
+	}
+	return 0
+}
+
+func (bp *BucketPadding) Cover() (wait time.Duration, size int) {
+	if bp.CoverInterval <= 0 {
+		return 0, 0
+	}
+	wait = bp.CoverInterval/2 + time.Duration(rand.Int63n(int64(bp.CoverInterval)))
+	return wait, bp.CoverSize
+}
+
+// padding returns policy if padding agreed.
+func (fab *Fabric) padding() PaddingPolicy {
+	if !fab.padded {
+		return nil
+	}
+	return fab.Padding
+}
+
+// padData pads payload of data frame with the policy. ok is false when no
+// padding needed. Type, flags and length in header are not changed.
+func (fab *Fabric) padData(data []byte) (b []byte, ok bool) {
+	policy := fab.padding()
+	if policy == nil {
+		return
+	}
+	pad := policy.Pad(2 + len(data))
+	if pad <= 0 {
+		return
+	}
+	// never over what peer can read.
+	if max := fab.peerFrameSize() - 2 - len(data); pad > max {
+		pad = max
+	}
+	if pad < 0 {
+		return
+	}
+
+	size := 2 + len(data) + pad
+	if size <= netutil.BUFFERSIZE {
+		b = getData(size)
+	} else {
+		b = make([]byte, size)
+	}
+	binary.BigEndian.PutUint16(b, uint16(pad))
+	copy(b[2:], data)
+	// buffer reused, old data must not go out. under encryption nobody
+	// sees it, zero is enough.
+	for i := 2 + len(data); i < size; i++ {
+		b[i] = 0
+	}
+	return b, true
+}
+
+// unpadData strips padding of data frame, payload still in the same
+// buffer from getData.
+func (fab *Fabric) unpadData(f *Frame) (err error) {
+	if !fab.padded {
+		return fmt.Errorf("%w: padded data not agreed.", ErrUnexpectedPkg)
+	}
+	if len(f.Data) < 2 {
+		return fmt.Errorf("%w: padded data too short.", ErrUnexpectedPkg)
+	}
+	pad := int(binary.BigEndian.Uint16(f.Data))
+	if 2+pad > len(f.Data) {
+		return fmt.Errorf("%w: padding %d over %d.", ErrUnexpectedPkg, pad, len(f.Data))
+	}
+	n := copy(f.Data, f.Data[2:len(f.Data)-pad])
+	f.Data = f.Data[:n]
+	f.Header.Length = uint16(n)
+	f.Header.Flags &^= FLAG_PADDED
+	return
+}
+
+// sendCover sends cover frames when nothing sent for a while, until
+// fabric closed or policy stops.
+func (fab *Fabric) sendCover() {
+	policy := fab.padding()
+	for {
+		wait, size := policy.Cover()
+		if wait <= 0 {
+			return
+		}
+		time.Sleep(wait)
+
+		fab.plock.RLock()
+		closed := fab.closed
+		fab.plock.RUnlock()
+		if closed {
+			return
+		}
+		_, _, last := fab.traffic_out.load()
+		if time.Since(last) < wait {
+			continue
+		}
+
+		if size > fab.peerFrameSize() {
+			size = fab.peerFrameSize()
+		}
+		f := NewFrame(MSG_PADDING, 0)
+		f.Data = make([]byte, size)
+		f.Header.Length = uint16(size)
+		err := fab.SendFrame(f)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestPadding(t *testing.T) {
+	SetLogging()
+	c1, c2, stop, err := makePipeCaps(CAP_PADDING | CAP_COMPRESS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	cli, srv := c1.(*Conn), c2.(*Conn)
+	cli.fab.Padding = &BucketPadding{Buckets: []int{512, 4096}}
+	// settings and result counted before.
+	time.Sleep(20 * time.Millisecond)
+
+	for _, size := range []int{1, 100, 1000, 3000, 5000} {
+		before := cli.fab.Stats()
+		data := textData(size)
+		go cli.Write(data)
+		got := make([]byte, size)
+		_, err = io.ReadFull(srv, got)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("data mismatch for %d: %v", size, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		out := cli.fab.Stats().Sub(before)
+		payload := int(out.BytesOut) - HEADER_SIZE*int(out.FramesOut[MSG_DATA])
+		if size < 4096 && payload != 512 && payload != 4096 {
+			t.Fatalf("%d bytes not padded to bucket: %d", size, payload)
+		}
+	}
+
+	// padding never counted in window.
+	if st := srv.Status(); st.Recved != 1+100+1000+3000+5000 {
+		t.Fatalf("wrong recved: %+v", st)
+	}
+}
+
+func TestPaddingNotAgreed(t *testing.T) {
+	c, _ := newRawConn(t)
+	f := &Frame{
+		Header: Header{Type: MSG_DATA, Flags: FLAG_PADDED},
+		Data:   []byte{0, 1, 'a', 0},
+	}
+	if c.fab.unpadData(f) == nil {
+		t.Fatal("padded data accepted without cap")
+	}
+	c.fab.padded = true
+	f.Data[1] = 3
+	if c.fab.unpadData(f) == nil {
+		t.Fatal("padding over payload accepted")
+	}
+	f.Data[1] = 1
+	if c.fab.unpadData(f) != nil || string(f.Data) != "a" {
+		t.Fatalf("padding not stripped: %q", f.Data)
+	}
+}
+
+func TestCoverFrames(t *testing.T) {
+	SetLogging()
+	c1, c2, stop, err := makePipeCaps(CAP_PADDING)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	cli, srv := c1.(*Conn), c2.(*Conn)
+	cli.fab.Padding = &BucketPadding{CoverInterval: 20 * time.Millisecond, CoverSize: 100}
+	go cli.fab.sendCover()
+
+	time.Sleep(300 * time.Millisecond)
+	if n := srv.fab.Stats().FramesIn[MSG_PADDING]; n == 0 {
+		t.Fatal("no cover frames when idle")
+	}
+	srv.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = srv.Read(make([]byte, 10))
+	if !isTimeout(err) {
+		t.Fatalf("cover frame delivered to stream: %v", err)
+	}
+}
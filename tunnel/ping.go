@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeat pings peer until fabric closed, and closes fabric when peer
+// stop answering.
+func (fab *Fabric) heartbeat() {
+	miss := fab.PingMiss
+	if miss <= 0 {
+		miss = PING_MISS
+	}
+
+	ticker := time.NewTicker(fab.PingInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		fab.plock.RLock()
+		closed := fab.closed
+		fab.plock.RUnlock()
+		if closed {
+			return
+		}
+
+		// any frame from peer tells it's alive, busy fabric needs no ping.
+		heard := now.Sub(time.Unix(0, atomic.LoadInt64(&fab.heard))) < fab.PingInterval
+		fab.hlock.Lock()
+		if heard {
+			fab.missed = 0
+		}
+		missed := fab.missed
+		skip := heard && fab.srtt != 0 && fab.skipped+1 < miss
+		if skip {
+			fab.skipped++
+		} else {
+			fab.missed++
+			fab.skipped = 0
+		}
+		fab.hlock.Unlock()
+		if skip {
+			continue
+		}
+		if missed >= miss {
+			logger.Errorf("%s missed %d pongs, close.", fab.String(), missed)
+			fab.endWith(SESSION_HEARTBEAT)
+			fab.Close()
+			return
+		}
+
+		// payload is opaque for peer, we put sending time in.
+		f := NewFrame(MSG_PING, 0)
+		f.Data = make([]byte, 8)
+		binary.BigEndian.PutUint64(f.Data, uint64(now.UnixNano()))
+		f.Header.Length = uint16(len(f.Data))
+		err := fab.SendFrame(f)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}
+}
+
+func (fab *Fabric) onPong(f *Frame) {
+	if len(f.Data) != 8 {
+		logger.Warningf("%s pong with wrong size %d.", fab.String(), len(f.Data))
+		return
+	}
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(f.Data)))
+	rtt := time.Since(sent)
+
+	fab.hlock.Lock()
+	defer fab.hlock.Unlock()
+	fab.missed = 0
+	if fab.srtt == 0 {
+		fab.srtt = rtt
+	} else {
+		// same smoothing as tcp.
+		fab.srtt += (rtt - fab.srtt) / 8
+	}
+	logger.Debugf("%s rtt %s, srtt %s.", fab.String(), rtt, fab.srtt)
+}
+
+// RTT returns smoothed round trip time, 0 if not measured yet.
+func (fab *Fabric) RTT() time.Duration {
+	fab.hlock.Lock()
+	defer fab.hlock.Unlock()
+	return fab.srtt
+}
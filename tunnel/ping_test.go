@@ -0,0 +1,108 @@
+package tunnel
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	client := NewClient(p1)
+	client.PingInterval = 20 * time.Millisecond
+	server := NewTunnelServer(p2)
+	go client.Loop()
+	go server.Loop()
+	defer client.Close()
+	defer server.Close()
+
+	time.Sleep(200 * time.Millisecond)
+	if client.RTT() <= 0 {
+		t.Fatal("rtt not measured")
+	}
+	client.plock.RLock()
+	closed := client.closed
+	client.plock.RUnlock()
+	if closed {
+		t.Fatal("fabric closed with peer alive")
+	}
+}
+
+func TestPingMiss(t *testing.T) {
+	c, _ := newRawConn(t)
+	fab := c.fab
+	fab.PingInterval = 20 * time.Millisecond
+	fab.PingMiss = 2
+	go fab.Loop()
+
+	time.Sleep(200 * time.Millisecond)
+	fab.plock.RLock()
+	closed := fab.closed
+	fab.plock.RUnlock()
+	if !closed {
+		t.Fatal("fabric not closed after pongs missed")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if st := c.Status(); st.State != ST_UNKNOWN {
+		t.Fatalf("stream not reset: %+v", st)
+	}
+}
+
+func TestPingBusy(t *testing.T) {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	fab := NewFabric(p1, 0)
+	fab.PingInterval = 20 * time.Millisecond
+	fab.PingMiss = 4
+	fab.srtt = time.Millisecond
+	go fab.Loop()
+	defer fab.Close()
+
+	// peer never answers pings, but keeps talking.
+	var pings int32
+	go func() {
+		for {
+			f, err := ReadFrame(p2, nil)
+			if err != nil {
+				return
+			}
+			if f.Header.Type == MSG_PING {
+				atomic.AddInt32(&pings, 1)
+			}
+		}
+	}()
+	ch_quiet := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ch_quiet:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			if WriteFrame(p2, MSG_PADDING, 0, nil) != nil {
+				return
+			}
+		}
+	}()
+
+	isClosed := func() bool {
+		fab.plock.RLock()
+		defer fab.plock.RUnlock()
+		return fab.closed
+	}
+	time.Sleep(300 * time.Millisecond)
+	if isClosed() {
+		t.Fatal("fabric closed with peer talking")
+	}
+	if n := atomic.LoadInt32(&pings); n == 0 || n > 8 {
+		t.Fatalf("expect a few pings for rtt only, got %d", n)
+	}
+
+	close(ch_quiet)
+	time.Sleep(300 * time.Millisecond)
+	if !isClosed() {
+		t.Fatal("fabric not closed after peer went quiet")
+	}
+}
@@ -0,0 +1,189 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// ClientCreator makes new client fabric to server, DialerCreator is one.
+type ClientCreator interface {
+	Create() (*Client, error)
+}
+
+// FabricPool keeps Size fabrics to the same server, new streams go to the
+// one with least streams. A dead fabric will be replaced in background.
+type FabricPool struct {
+	creator ClientCreator
+	Size    int
+
+	lock    sync.Mutex
+	clients []*Client
+	filling bool
+	closed  bool
+}
+
+func NewFabricPool(creator ClientCreator, size int) (p *FabricPool) {
+	if size <= 0 {
+		size = 1
+	}
+	return &FabricPool{
+		creator: creator,
+		Size:    size,
+	}
+}
+
+// Members returns fabrics alive in pool.
+func (p *FabricPool) Members() (clients []*Client) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append(clients, p.clients...)
+}
+
+// pick returns the client with least streams, lower rtt if equal.
+// call with lock held.
+func (p *FabricPool) pick() (best *Client) {
+	var size int
+	for _, c := range p.clients {
+		if c.GoingAway() {
+			continue
+		}
+		n := c.NumStreams()
+		if best == nil || n < size || (n == size && c.RTT() < best.RTT()) {
+			best, size = c, n
+		}
+	}
+	return
+}
+
+func (p *FabricPool) get() (c *Client, err error) {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil, ErrPoolClosed
+	}
+	c = p.pick()
+	short := len(p.clients) < p.Size
+	p.lock.Unlock()
+
+	if c == nil {
+		// nothing to use, wait for one.
+		return p.add()
+	}
+	if short {
+		go p.fill()
+	}
+	return
+}
+
+func (p *FabricPool) add() (c *Client, err error) {
+	c, err = p.creator.Create()
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		c.Close()
+		return nil, ErrPoolClosed
+	}
+	p.clients = append(p.clients, c)
+	p.lock.Unlock()
+
+	go p.run(c)
+	return
+}
+
+// run loops client, replaces it after it quit.
+func (p *FabricPool) run(c *Client) {
+	c.Loop()
+	logger.Noticef("%s quit from pool.", c.String())
+
+	p.lock.Lock()
+	for i, o := range p.clients {
+		if o == c {
+			p.clients = append(p.clients[:i], p.clients[i+1:]...)
+			break
+		}
+	}
+	closed := p.closed
+	p.lock.Unlock()
+
+	if !closed {
+		p.fill()
+	}
+}
+
+// fill creates fabrics until Size reached, or one failed. Failed ones
+// will be tried again by next dial.
+func (p *FabricPool) fill() {
+	p.lock.Lock()
+	if p.filling {
+		p.lock.Unlock()
+		return
+	}
+	p.filling = true
+	p.lock.Unlock()
+
+	defer func() {
+		p.lock.Lock()
+		p.filling = false
+		p.lock.Unlock()
+	}()
+
+	for {
+		p.lock.Lock()
+		done := p.closed || len(p.clients) >= p.Size
+		p.lock.Unlock()
+		if done {
+			return
+		}
+		_, err := p.add()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *FabricPool) Dial(network, address string) (conn net.Conn, err error) {
+	return p.dial(func(c *Client) (net.Conn, error) {
+		return c.Dial(network, address)
+	})
+}
+
+func (p *FabricPool) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	return p.dial(func(c *Client) (net.Conn, error) {
+		return c.DialContext(ctx, network, address)
+	})
+}
+
+// dial tries another fabric, if the picked one died in dialing.
+func (p *FabricPool) dial(fn func(*Client) (net.Conn, error)) (conn net.Conn, err error) {
+	for i := 0; i < 2; i++ {
+		var c *Client
+		c, err = p.get()
+		if err != nil {
+			return
+		}
+		conn, err = fn(c)
+		if err == nil || !c.GoingAway() {
+			return
+		}
+	}
+	return
+}
+
+// Close closes all fabrics in pool, no more will be created.
+func (p *FabricPool) Close() (err error) {
+	p.lock.Lock()
+	p.closed = true
+	clients := p.clients
+	p.clients = nil
+	p.lock.Unlock()
+
+	for _, c := range clients {
+		c.Close()
+	}
+	return
+}
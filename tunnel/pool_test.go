@@ -0,0 +1,66 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type pipeCreator struct{}
+
+func (pipeCreator) Create() (client *Client, err error) {
+	p1, p2 := net.Pipe()
+	server := NewTunnelServer(p2)
+	go server.Loop()
+	return NewClient(p1), nil
+}
+
+func waitMembers(t *testing.T, p *FabricPool, n int) (clients []*Client) {
+	for i := 0; i < 100; i++ {
+		clients = p.Members()
+		if len(clients) == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expect %d members, got %d", n, len(clients))
+	return
+}
+
+func TestFabricPool(t *testing.T) {
+	SetLogging()
+	p := NewFabricPool(pipeCreator{}, 3)
+	defer p.Close()
+
+	for i := 0; i < 6; i++ {
+		c, err := p.Dial("test", "pair")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		<-accepted
+	}
+	clients := waitMembers(t, p, 3)
+	for _, c := range clients {
+		if c.NumStreams() == 0 {
+			t.Fatalf("streams not spread: %s", c.String())
+		}
+	}
+
+	// one dead, dials go to others, and it will be replaced.
+	clients[0].Close()
+	for i := 0; i < 6; i++ {
+		c, err := p.Dial("test", "pair")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		<-accepted
+	}
+	clients = waitMembers(t, p, 3)
+
+	p.Close()
+	if _, err := p.Dial("test", "pair"); err != ErrPoolClosed {
+		t.Fatalf("expect pool closed, got %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// PortRange is ports in [Min, Max].
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// PortSet is ports targets can be on, empty means no restriction, not
+// none allowed.
+type PortSet []PortRange
+
+// ParsePorts parses ports and ranges like "80,443,8080-8090".
+func ParsePorts(s string) (ps PortSet, err error) {
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var r PortRange
+		min, max, ok := strings.Cut(part, "-")
+		r.Min, err = strconv.Atoi(strings.TrimSpace(min))
+		if err == nil {
+			r.Max = r.Min
+			if ok {
+				r.Max, err = strconv.Atoi(strings.TrimSpace(max))
+			}
+		}
+		if err != nil || r.Min < 1 || r.Max > 65535 || r.Min > r.Max {
+			return nil, fmt.Errorf("%w: %s", ErrBadPorts, part)
+		}
+		ps = append(ps, r)
+	}
+	return
+}
+
+func (ps PortSet) Contains(port int) bool {
+	if len(ps) == 0 {
+		return true
+	}
+	for _, r := range ps {
+		if port >= r.Min && port <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+func (ps PortSet) String() string {
+	parts := make([]string, 0, len(ps))
+	for _, r := range ps {
+		if r.Min == r.Max {
+			parts = append(parts, strconv.Itoa(r.Min))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", r.Min, r.Max))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// PortFilter holds the PortSet in use, it can be swapped when streams
+// dialing, like Guard. Zero value and nil restrict nothing.
+type PortFilter struct {
+	set atomic.Pointer[PortSet]
+}
+
+func NewPortFilter(ps PortSet) (pf *PortFilter) {
+	pf = &PortFilter{}
+	pf.Set(ps)
+	return
+}
+
+// Set takes ps for dials after it.
+func (pf *PortFilter) Set(ps PortSet) {
+	pf.set.Store(&ps)
+}
+
+func (pf *PortFilter) Get() PortSet {
+	if pf == nil {
+		return nil
+	}
+	if p := pf.set.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// checkPort refuses target on port not in UserPorts of fabric, or Ports if
+// user has none, before anything resolved.
+func (fab *Fabric) checkPort(network, address string) (err error) {
+	ps := fab.UserPorts.Get()
+	if len(ps) == 0 {
+		ps = fab.Ports.Get()
+	}
+	if len(ps) == 0 {
+		return
+	}
+	_, sport, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	port, err := strconv.Atoi(sport)
+	if err != nil {
+		return
+	}
+	if !ps.Contains(port) {
+		logger.Noticef("%s port %d of %s:%s not allowed, denied.",
+			fab.String(), port, network, address)
+		return ErrDenied
+	}
+	return
+}
@@ -0,0 +1,92 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	ps, err := ParsePorts("80, 443,8080-8090,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps.String() != "80,443,8080-8090" {
+		t.Fatalf("wrong ports: %s", ps)
+	}
+	for port, ok := range map[int]bool{80: true, 443: true, 8080: true, 8085: true, 8090: true, 22: false, 8091: false} {
+		if ps.Contains(port) != ok {
+			t.Errorf("port %d: expect %v", port, ok)
+		}
+	}
+	for _, s := range []string{"0", "65536", "90-80", "a", "80-", "-80"} {
+		if _, err = ParsePorts(s); !errors.Is(err, ErrBadPorts) {
+			t.Errorf("%q: expect bad ports, got %v", s, err)
+		}
+	}
+	// empty restricts nothing.
+	if ps, err = ParsePorts(""); err != nil || !ps.Contains(22) {
+		t.Fatalf("empty should allow all: %v %v", ps, err)
+	}
+	var pf *PortFilter
+	if pf.Get() != nil || (&PortFilter{}).Get() != nil {
+		t.Fatal("zero filter should restrict nothing")
+	}
+}
+
+// lookupCounter counts lookups, all names to ip.
+type lookupCounter struct {
+	ip string
+	n  int32
+}
+
+func (cr *lookupCounter) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	atomic.AddInt32(&cr.n, 1)
+	return []net.IP{net.ParseIP(cr.ip)}, nil
+}
+
+func TestPortFilter(t *testing.T) {
+	echo := tcpEcho(t)
+	_, sport, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(sport)
+	cli, srv := newConnPair(t)
+	cr := &lookupCounter{ip: "127.0.0.1"}
+	srv.fab.Resolver = cr
+	srv.fab.Guard = NewGuard(&ACL{})
+	srv.fab.Ports = NewPortFilter(PortSet{{80, 80}, {port, port}})
+	client := &Client{Fabric: cli.fab}
+
+	conn, err := client.Dial("tcp", net.JoinHostPort("echo.test", sport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pingConn(conn); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// never resolved.
+	if _, err = client.Dial("tcp", "echo.test:22"); !errors.Is(err, ErrDenied) {
+		t.Fatalf("expect denied, got %v", err)
+	}
+	if n := atomic.LoadInt32(&cr.n); n != 1 {
+		t.Fatalf("expect 1 lookup, got %d", n)
+	}
+
+	// ports of user instead.
+	srv.fab.UserPorts = NewPortFilter(PortSet{{22, 22}})
+	if _, err = client.Dial("tcp", echo); !errors.Is(err, ErrDenied) {
+		t.Fatalf("expect denied by user ports, got %v", err)
+	}
+	// swapped at runtime, empty restricts nothing.
+	srv.fab.UserPorts.Set(nil)
+	srv.fab.Ports.Set(nil)
+	conn, err = client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -4,6 +4,7 @@ import (
 	"container/list"
 	"io"
 	"sync"
+	"time"
 )
 
 type Queue struct {
@@ -11,6 +12,7 @@ type Queue struct {
 	ev     *sync.Cond
 	queue  *list.List
 	closed bool
+	wakeup uint32
 }
 
 func NewQueue() (q *Queue) {
@@ -35,24 +37,63 @@ func (q *Queue) Push(v interface{}) (err error) {
 }
 
 func (q *Queue) Pop(block bool) (v interface{}, err error) {
+	return q.PopTimeout(block, time.Time{})
+}
+
+// PopTimeout works like Pop, but returns ErrQueueTimeout after deadline,
+// nothing will be taken from queue then. Zero deadline means no timeout.
+func (q *Queue) PopTimeout(block bool, deadline time.Time) (v interface{}, err error) {
 	logger.Debugf("pop queue: %p, block: %t", q, block)
 	q.lock.Lock()
 	defer q.lock.Unlock()
 	var e *list.Element
-	for e = q.queue.Front(); e == nil; e = q.queue.Front() {
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	wakeup := q.wakeup
+	for {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return nil, ErrQueueTimeout
+		}
+		if e = q.queue.Front(); e != nil {
+			break
+		}
 		if q.closed {
 			return nil, io.EOF
 		}
 		if !block {
 			return
 		}
+		if !deadline.IsZero() && timer == nil {
+			timer = time.AfterFunc(time.Until(deadline), q.broadcast)
+		}
 		q.ev.Wait()
+		if q.wakeup != wakeup {
+			return nil, ErrQueueWakeup
+		}
 	}
 	v = e.Value
 	q.queue.Remove(e)
 	return
 }
 
+func (q *Queue) broadcast() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.ev.Broadcast()
+}
+
+// Wakeup makes all goroutines blocked in Pop return ErrQueueWakeup.
+func (q *Queue) Wakeup() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.wakeup++
+	q.ev.Broadcast()
+}
+
 func (q *Queue) Close() (err error) {
 	logger.Debugf("close queue: %p", q)
 	q.lock.Lock()
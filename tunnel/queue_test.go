@@ -0,0 +1,55 @@
+package tunnel
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestPopTimeout(t *testing.T) {
+	q := NewQueue()
+
+	start := time.Now()
+	_, err := q.PopTimeout(true, start.Add(50*time.Millisecond))
+	if err != ErrQueueTimeout {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("pop returned before deadline")
+	}
+
+	// expired deadline takes nothing.
+	q.Push(1)
+	_, err = q.PopTimeout(true, time.Now().Add(-time.Second))
+	if err != ErrQueueTimeout {
+		t.Fatalf("expect timeout, got %v", err)
+	}
+	v, err := q.PopTimeout(true, time.Now().Add(time.Second))
+	if err != nil || v != 1 {
+		t.Fatalf("expect 1, got %v %v", v, err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.Push(2)
+	}()
+	v, err = q.PopTimeout(true, time.Now().Add(time.Second))
+	if err != nil || v != 2 {
+		t.Fatalf("expect 2, got %v %v", v, err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.Wakeup()
+	}()
+	_, err = q.PopTimeout(true, time.Time{})
+	if err != ErrQueueWakeup {
+		t.Fatalf("expect wakeup, got %v", err)
+	}
+
+	q.Close()
+	_, err = q.PopTimeout(true, time.Now().Add(time.Second))
+	if err != io.EOF {
+		t.Fatalf("expect eof, got %v", err)
+	}
+}
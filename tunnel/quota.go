@@ -0,0 +1,401 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QuotaStore keeps bytes used by users, so quotas survive restart. Add
+// takes bytes counted since last time, Flush makes them durable. It can be
+// backed by redis or a file, and shared by servers.
+type QuotaStore interface {
+	Get(username string) (used uint64, err error)
+	Add(username string, delta uint64) error
+	Flush() error
+}
+
+// QuotaResetter resets usage of user in store, for Quotas.Reset.
+type QuotaResetter interface {
+	Reset(username string) error
+}
+
+// Quotas counts data both ways of streams from peer by user, in all
+// fabrics sharing it, and adds them to Store in QUOTA_FLUSH. Users over
+// Quota in limits refused new streams with ERR_QUOTA, and streams alive
+// reset, or slowed down to Trickle bytes per second if set. Set options
+// before use.
+type Quotas struct {
+	// nil keeps usage in memory only.
+	Store QuotaStore
+	// quota of user, 0 means no limit. asked for each stream.
+	Limit   func(username string) uint64
+	Trickle int
+
+	lock    sync.Mutex
+	users   map[string]*userQuota
+	ch_quit chan struct{}
+	wg      sync.WaitGroup
+}
+
+type userQuota struct {
+	quotas   *Quotas
+	username string
+	// counted without lock.
+	used    uint64
+	pending uint64
+	limit   uint64
+	over    int32
+	// streams alive, protected by lock of quotas.
+	conns map[*Conn]struct{}
+	// usage in store added to used once loaded. bytes counted before it
+	// stay pending, never added to store till then.
+	load_lock sync.Mutex
+	loaded    bool
+}
+
+// QuotaUsage is a snapshot of user, for admin.
+type QuotaUsage struct {
+	Username string
+	Used     uint64
+	// 0 means no limit.
+	Quota uint64
+	Over  bool
+}
+
+// NewQuotas flushes usage to store in background, until closed.
+func NewQuotas(store QuotaStore, limit func(username string) uint64) (q *Quotas) {
+	q = &Quotas{
+		Store:   store,
+		Limit:   limit,
+		users:   make(map[string]*userQuota),
+		ch_quit: make(chan struct{}),
+	}
+	q.wg.Add(1)
+	go q.loop()
+	return
+}
+
+func (q *Quotas) loop() {
+	defer q.wg.Done()
+	ticker := time.NewTicker(QUOTA_FLUSH * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-q.ch_quit:
+			return
+		}
+		err := q.Flush()
+		if err != nil {
+			logger.Errorf("flush quotas: %s", err.Error())
+		}
+	}
+}
+
+// Close stops background flush, and flushes the last time.
+func (q *Quotas) Close() error {
+	close(q.ch_quit)
+	q.wg.Wait()
+	return q.Flush()
+}
+
+// Flush adds usage counted since last time to store. Bytes failed in Add,
+// or of users not loaded from store yet, kept for next time.
+func (q *Quotas) Flush() (err error) {
+	if q.Store == nil {
+		return
+	}
+	q.lock.Lock()
+	users := make([]*userQuota, 0, len(q.users))
+	for _, uq := range q.users {
+		users = append(users, uq)
+	}
+	q.lock.Unlock()
+
+	for _, uq := range users {
+		if e := uq.load(); e != nil {
+			err = e
+			continue
+		}
+		delta := atomic.SwapUint64(&uq.pending, 0)
+		if delta == 0 {
+			continue
+		}
+		if e := q.Store.Add(uq.username, delta); e != nil {
+			atomic.AddUint64(&uq.pending, delta)
+			err = e
+		}
+	}
+	if e := q.Store.Flush(); err == nil {
+		err = e
+	}
+	return
+}
+
+// user returns quota of username, usage loaded from store till it's
+// done. limit asked again. uq returned with error of store too, counting
+// from 0 till loaded.
+func (q *Quotas) user(username string) (uq *userQuota, err error) {
+	q.lock.Lock()
+	uq, ok := q.users[username]
+	if !ok {
+		uq = &userQuota{quotas: q, username: username, loaded: q.Store == nil,
+			conns: make(map[*Conn]struct{})}
+		q.users[username] = uq
+	}
+	q.lock.Unlock()
+
+	err = uq.load()
+	var limit uint64
+	if q.Limit != nil {
+		limit = q.Limit(username)
+	}
+	atomic.StoreUint64(&uq.limit, limit)
+	switch {
+	case limit == 0 || atomic.LoadUint64(&uq.used) < limit:
+		// quota raised, or reset.
+		atomic.StoreInt32(&uq.over, 0)
+	case atomic.CompareAndSwapInt32(&uq.over, 0, 1):
+		// over already in store, or quota lowered.
+		go uq.limitConns()
+	}
+	return
+}
+
+// load adds usage in store to used, once.
+func (uq *userQuota) load() (err error) {
+	uq.load_lock.Lock()
+	defer uq.load_lock.Unlock()
+	if uq.loaded {
+		return
+	}
+	used, err := uq.quotas.Store.Get(uq.username)
+	if err != nil {
+		return
+	}
+	atomic.AddUint64(&uq.used, used)
+	uq.loaded = true
+	return
+}
+
+func (uq *userQuota) isOver() bool {
+	return atomic.LoadInt32(&uq.over) != 0
+}
+
+// count adds n bytes of stream, streams of user limited once over quota.
+// it may be called with lock of conn held.
+func (uq *userQuota) count(n int) {
+	if uq == nil || n == 0 {
+		return
+	}
+	used := atomic.AddUint64(&uq.used, uint64(n))
+	atomic.AddUint64(&uq.pending, uint64(n))
+	limit := atomic.LoadUint64(&uq.limit)
+	if limit != 0 && used >= limit && atomic.CompareAndSwapInt32(&uq.over, 0, 1) {
+		go uq.limitConns()
+	}
+}
+
+func (uq *userQuota) addConn(c *Conn) {
+	q := uq.quotas
+	q.lock.Lock()
+	uq.conns[c] = struct{}{}
+	q.lock.Unlock()
+	if uq.isOver() {
+		uq.limitConn(c)
+	}
+}
+
+func (uq *userQuota) doneConn(c *Conn) {
+	if uq == nil {
+		return
+	}
+	q := uq.quotas
+	q.lock.Lock()
+	delete(uq.conns, c)
+	q.lock.Unlock()
+}
+
+func (uq *userQuota) limitConns() {
+	q := uq.quotas
+	logger.Warningf("user %s over quota %d.", uq.username, atomic.LoadUint64(&uq.limit))
+	q.lock.Lock()
+	conns := make([]*Conn, 0, len(uq.conns))
+	for c := range uq.conns {
+		conns = append(conns, c)
+	}
+	q.lock.Unlock()
+	for _, c := range conns {
+		uq.limitConn(c)
+	}
+}
+
+func (uq *userQuota) limitConn(c *Conn) {
+	if t := uq.quotas.Trickle; t > 0 {
+		c.SetRateLimit(t)
+		c.SetReadRateLimit(t)
+		return
+	}
+	c.ResetWith(ERR_QUOTA)
+}
+
+// Usage tells usage of user, loaded from store if not seen yet.
+func (q *Quotas) Usage(username string) (u QuotaUsage, err error) {
+	uq, err := q.user(username)
+	if err != nil {
+		return
+	}
+	return uq.usage(), nil
+}
+
+func (uq *userQuota) usage() QuotaUsage {
+	return QuotaUsage{
+		Username: uq.username,
+		Used:     atomic.LoadUint64(&uq.used),
+		Quota:    atomic.LoadUint64(&uq.limit),
+		Over:     uq.isOver(),
+	}
+}
+
+// List returns users seen, by username.
+func (q *Quotas) List() (usages []QuotaUsage) {
+	q.lock.Lock()
+	for _, uq := range q.users {
+		usages = append(usages, uq.usage())
+	}
+	q.lock.Unlock()
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].Username < usages[j].Username
+	})
+	return
+}
+
+// Reset makes usage of user 0, in store too if it's a QuotaResetter. New
+// streams go again, streams slowed down stay slow.
+func (q *Quotas) Reset(username string) (err error) {
+	rs, reset := q.Store.(QuotaResetter)
+	if reset {
+		err = rs.Reset(username)
+		if err != nil {
+			return
+		}
+	}
+	q.lock.Lock()
+	uq, ok := q.users[username]
+	q.lock.Unlock()
+	if ok {
+		uq.load_lock.Lock()
+		atomic.StoreUint64(&uq.pending, 0)
+		atomic.StoreUint64(&uq.used, 0)
+		atomic.StoreInt32(&uq.over, 0)
+		// 0 in store now, nothing to load.
+		uq.loaded = uq.loaded || reset
+		uq.load_lock.Unlock()
+	}
+	logger.Noticef("quota of user %s reset.", username)
+	return
+}
+
+// FileQuotaStore keeps usage in a json file, by username. Written at
+// Flush, by rename so never half written. Not for servers sharing it.
+type FileQuotaStore struct {
+	path  string
+	lock  sync.Mutex
+	users map[string]uint64
+	dirty bool
+}
+
+// NewFileQuotaStore loads usage in path, empty if not exist.
+func NewFileQuotaStore(path string) (fs *FileQuotaStore, err error) {
+	fs = &FileQuotaStore{path: path, users: make(map[string]uint64)}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return fs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &fs.users)
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (fs *FileQuotaStore) Get(username string) (uint64, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.users[username], nil
+}
+
+func (fs *FileQuotaStore) Add(username string, delta uint64) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.users[username] += delta
+	fs.dirty = true
+	return nil
+}
+
+func (fs *FileQuotaStore) Reset(username string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	delete(fs.users, username)
+	fs.dirty = true
+	return nil
+}
+
+func (fs *FileQuotaStore) Flush() (err error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if !fs.dirty {
+		return
+	}
+	b, err := json.Marshal(fs.users)
+	if err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fs.path), filepath.Base(fs.path)+".*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp.Name(), fs.path)
+	if err == nil {
+		fs.dirty = false
+	}
+	return
+}
+
+// quotaOf returns quota of user for stream from peer, ErrQuotaExceeded if
+// over it. nil if no Quotas.
+func (fab *Fabric) quotaOf() (uq *userQuota, err error) {
+	if fab.Quotas == nil {
+		return
+	}
+	uq, err = fab.Quotas.user(fab.Username)
+	if err != nil {
+		// store may be down for a while, never refuse for it. stream
+		// counted still, usage in store added when it's back.
+		logger.Errorf("%s quota of user %s: %s", fab.String(), fab.Username, err.Error())
+		err = nil
+	}
+	if uq.isOver() {
+		return nil, ErrQuotaExceeded
+	}
+	return
+}
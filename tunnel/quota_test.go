@@ -0,0 +1,258 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// quotaClient returns client of fabric for alice, counted in q.
+func quotaClient(t *testing.T, q *Quotas) *Client {
+	SetLogging()
+	p1, p2 := net.Pipe()
+	server := NewTunnelServer(p2)
+	server.Username = "alice"
+	server.Quotas = q
+	go server.Loop()
+	client := NewClient(p1)
+	go client.Loop()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	return client
+}
+
+func quotaOf(limit uint64) func(string) uint64 {
+	return func(string) uint64 { return limit }
+}
+
+// echoBytes writes n bytes to echo conn, and reads them back.
+func echoBytes(conn net.Conn, n int) error {
+	go conn.Write(make([]byte, n))
+	_, err := io.ReadFull(conn, make([]byte, n))
+	return err
+}
+
+// waitUsed waits usage of alice reaching used.
+func waitUsed(t *testing.T, q *Quotas, used uint64) QuotaUsage {
+	for i := 0; ; i++ {
+		u, err := q.Usage("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Used >= used {
+			return u
+		}
+		if i > 100 {
+			t.Fatalf("expect %d used, got %+v", used, u)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	q := NewQuotas(nil, quotaOf(10000))
+	defer q.Close()
+	client := quotaClient(t, q)
+	echo := tcpEcho(t)
+
+	conn, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// both ways counted.
+	if err = echoBytes(conn, 3000); err != nil {
+		t.Fatal(err)
+	}
+	if u := waitUsed(t, q, 6000); u.Used != 6000 || u.Over || u.Quota != 10000 {
+		t.Fatalf("wrong usage: %+v", u)
+	}
+
+	// over quota, stream reset soon and new ones refused.
+	for i := 0; err == nil; i++ {
+		if i > 100 {
+			t.Fatal("stream not reset over quota")
+		}
+		err = echoBytes(conn, 1000)
+	}
+	if u := waitUsed(t, q, 10000); !u.Over {
+		t.Fatalf("expect over: %+v", u)
+	}
+	if _, err = client.Dial("tcp", echo); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expect over quota, got %v", err)
+	}
+
+	if err = q.Reset("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if u := q.List(); len(u) != 1 || u[0].Used != 0 || u[0].Over {
+		t.Fatalf("not reset: %+v", u)
+	}
+	conn, err = client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestQuotaTrickle(t *testing.T) {
+	q := NewQuotas(nil, quotaOf(1000))
+	defer q.Close()
+	q.Trickle = 10000
+	client := quotaClient(t, q)
+
+	conn, err := client.Dial("tcp", tcpEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = echoBytes(conn, 1000); err != nil {
+		t.Fatal(err)
+	}
+	waitUsed(t, q, 2000)
+	// slowed down, not cut.
+	start := time.Now()
+	if err = echoBytes(conn, 5000); err != nil {
+		t.Fatalf("stream should live on: %v", err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("not slowed down, 5000 bytes in %s", d)
+	}
+}
+
+func TestFileQuotaStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	fs, err := NewFileQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Add("alice", 20000)
+	fs.Add("bob", 10)
+	if err = fs.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// restarted, alice over already.
+	fs, err = NewFileQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := NewQuotas(fs, quotaOf(10000))
+	client := quotaClient(t, q)
+	if _, err = client.Dial("tcp", tcpEcho(t)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expect over quota, got %v", err)
+	}
+	if err = q.Reset("alice"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := client.Dial("tcp", tcpEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = echoBytes(conn, 100); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	waitUsed(t, q, 200)
+
+	// usage added at close.
+	if err = q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fs, err = NewFileQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := fs.Get("alice"); used != 200 {
+		t.Fatalf("expect 200 kept, got %d", used)
+	}
+	if used, _ := fs.Get("bob"); used != 10 {
+		t.Fatalf("expect 10 kept, got %d", used)
+	}
+}
+
+var errStoreDown = errors.New("store down.")
+
+// downStore keeps usage in memory, and fails while down.
+type downStore struct {
+	lock  sync.Mutex
+	down  bool
+	users map[string]uint64
+}
+
+func (ds *downStore) Get(username string) (uint64, error) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	if ds.down {
+		return 0, errStoreDown
+	}
+	return ds.users[username], nil
+}
+
+func (ds *downStore) Add(username string, delta uint64) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	if ds.down {
+		return errStoreDown
+	}
+	ds.users[username] += delta
+	return nil
+}
+
+func (ds *downStore) Flush() error { return nil }
+
+func (ds *downStore) setDown(down bool) {
+	ds.lock.Lock()
+	ds.down = down
+	ds.lock.Unlock()
+}
+
+func TestQuotaStoreDown(t *testing.T) {
+	ds := &downStore{down: true, users: map[string]uint64{"alice": 5000}}
+	q := NewQuotas(ds, quotaOf(10000))
+	defer q.Close()
+	client := quotaClient(t, q)
+	echo := tcpEcho(t)
+
+	// admitted and counted while store down.
+	conn, err := client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = echoBytes(conn, 1000); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if u := q.List(); len(u) == 1 && u[0].Used == 2000 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("not counted while store down: %+v", q.List())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = q.Flush(); err != errStoreDown {
+		t.Fatalf("expect store down, got %v", err)
+	}
+
+	// back, usage in store added once, bytes counted kept.
+	ds.setDown(false)
+	if u := waitUsed(t, q, 7000); u.Used != 7000 {
+		t.Fatalf("expect 7000 used, got %+v", u)
+	}
+	if err = q.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := ds.Get("alice"); used != 7000 {
+		t.Fatalf("expect 7000 in store, got %d", used)
+	}
+	// reset may come before all read back.
+	echoBytes(conn, 1500)
+	if u := waitUsed(t, q, 10000); !u.Over {
+		t.Fatalf("expect over: %+v", u)
+	}
+}
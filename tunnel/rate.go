@@ -0,0 +1,113 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket limits bytes per second. A write larger than burst goes
+// when bucket full, and leaves it in debt.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// closed when rate changed, waiters count again.
+	ch_set chan struct{}
+}
+
+// call with lock held.
+func (tb *tokenBucket) refill(now time.Time) {
+	if !tb.last.IsZero() {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+	}
+	tb.last = now
+}
+
+// set changes rate in bytes per second, 0 means no limit.
+// burst is rate if not positive.
+func (tb *tokenBucket) set(rate, burst int) {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	tb.refill(time.Now())
+	if burst <= 0 {
+		burst = rate
+	}
+	tb.rate = float64(rate)
+	tb.burst = float64(burst)
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	if tb.ch_set != nil {
+		close(tb.ch_set)
+		tb.ch_set = nil
+	}
+}
+
+// wait blocks until n bytes can go. If it can't before deadline, nothing
+// taken and ErrDeadline returned.
+func (tb *tokenBucket) wait(n int, deadline time.Time) (err error) {
+	for {
+		tb.lock.Lock()
+		if tb.rate == 0 {
+			tb.lock.Unlock()
+			return
+		}
+		now := time.Now()
+		tb.refill(now)
+		need := float64(n)
+		if need > tb.burst {
+			need = tb.burst
+		}
+		if tb.tokens >= need {
+			tb.tokens -= float64(n)
+			tb.lock.Unlock()
+			return
+		}
+		d := time.Duration((need - tb.tokens) / tb.rate * float64(time.Second))
+		if !deadline.IsZero() && now.Add(d).After(deadline) {
+			tb.lock.Unlock()
+			return ErrDeadline
+		}
+		if tb.ch_set == nil {
+			tb.ch_set = make(chan struct{})
+		}
+		ch_set := tb.ch_set
+		tb.lock.Unlock()
+
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ch_set:
+			t.Stop()
+		}
+	}
+}
+
+// fill returns tokens left now, negative means in debt.
+func (tb *tokenBucket) fill() int64 {
+	tb.lock.Lock()
+	defer tb.lock.Unlock()
+	if tb.rate == 0 {
+		return 0
+	}
+	tb.refill(time.Now())
+	return int64(tb.tokens)
+}
+
+// SetSendRate limits payload of data frames we send, in bytes per second.
+// Writers of streams wait, control frames never. 0 means no limit.
+func (fab *Fabric) SetSendRate(rate, burst int) {
+	fab.send_rate.set(rate, burst)
+}
+
+// SetRecvRate limits data read from streams, in bytes per second. Reads
+// wait after data taken, so window renew delayed, and peer slowed down.
+// 0 means no limit.
+func (fab *Fabric) SetRecvRate(rate, burst int) {
+	fab.recv_rate.set(rate, burst)
+}
@@ -0,0 +1,96 @@
+package tunnel
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	cli, srv := newConnPair(t)
+	// first burst free, then 10k more at 20k/s.
+	cli.fab.SetSendRate(20000, 10000)
+
+	data := make([]byte, 20000)
+	start := time.Now()
+	go cli.Write(data)
+	_, err := io.ReadFull(srv, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := time.Since(start)
+	if d < 400*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("rate not limited: %s", d)
+	}
+	if st := cli.fab.Stats(); st.SendTokens >= 10000 || st.RecvTokens != 0 {
+		t.Fatalf("wrong tokens: %+v", st)
+	}
+
+	// write can't go before deadline, nothing sent.
+	cli.fab.SetSendRate(100, 100)
+	cli.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = cli.Write(make([]byte, 1000))
+	if !isTimeout(err) {
+		t.Fatalf("write should timeout: %v", err)
+	}
+
+	cli.fab.SetSendRate(0, 0)
+	cli.SetWriteDeadline(time.Time{})
+	go cli.Write([]byte("ok"))
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(srv, buf)
+	if err != nil || string(buf) != "ok" {
+		t.Fatalf("stream broken after timeout: %q, %v", buf, err)
+	}
+}
+
+func TestRecvRateLimit(t *testing.T) {
+	cli, srv := newConnPair(t)
+	srv.fab.SetRecvRate(20000, 10000)
+
+	data := make([]byte, 20000)
+	start := time.Now()
+	go cli.Write(data)
+	_, err := io.ReadFull(srv, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatalf("rate not limited: %s", d)
+	}
+}
+
+func TestStreamRateLimit(t *testing.T) {
+	cli, srv := newConnPair(t)
+	cli.SetRateLimit(10000)
+
+	data := make([]byte, 20000)
+	start := time.Now()
+	go cli.Write(data)
+	_, err := io.ReadFull(srv, data[:5000])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rest goes at once after limit removed.
+	time.Sleep(100 * time.Millisecond)
+	cli.SetRateLimit(0)
+	_, err = io.ReadFull(srv, data[5000:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("writer not waked by new rate: %s", d)
+	}
+
+	// limit on peer's stream by reading slowly.
+	srv.SetReadRateLimit(20000)
+	start = time.Now()
+	go cli.Write(data)
+	_, err = io.ReadFull(srv, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatalf("read rate not limited: %s", d)
+	}
+}
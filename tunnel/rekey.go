@@ -0,0 +1,128 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Rekey carries public key of X25519 for new keys of encrypted fabric, if
+// CAP_REKEY agreed. Each side renews keys it writes in, peer answers with
+// its own. Keys chained from those before, so old ones can't be had
+// from new.
+type Rekey struct {
+	Key    []byte
+	Answer bool `json:",omitempty"`
+}
+
+// aeadOf returns encrypted conn under conn, through wrappers with
+// NetConn. nil if not encrypted.
+func aeadOf(conn net.Conn) *aeadConn {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *aeadConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (fab *Fabric) rekeyLimits() (bytes uint64, interval time.Duration) {
+	bytes, interval = fab.RekeyBytes, fab.RekeyInterval
+	if bytes == 0 {
+		bytes = REKEY_BYTES
+	}
+	if interval == 0 {
+		interval = REKEY_INTERVAL * time.Millisecond
+	}
+	return
+}
+
+// rekeyLoop starts rekey when keys we write in are used for RekeyBytes or
+// RekeyInterval, until conn closed.
+func (fab *Fabric) rekeyLoop(ac *aeadConn) {
+	limit, interval := fab.rekeyLimits()
+	ac.setDueBytes(limit)
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ac.ch_closed:
+			return
+		case <-ac.ch_due:
+		case <-timer.C:
+		}
+		keyed, written := ac.keyed()
+		left := interval - time.Since(keyed)
+		if written >= limit || left <= 0 {
+			err := fab.startRekey(ac)
+			if err != nil {
+				logger.Errorf("%s rekey: %s", fab.String(), err.Error())
+				return
+			}
+			left = interval
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(left)
+	}
+}
+
+func (fab *Fabric) startRekey(ac *aeadConn) (err error) {
+	kx, err := ac.startRekey()
+	if err != nil || kx == nil {
+		return
+	}
+	logger.Debugf("%s start rekey.", fab.String())
+	return SendFrame(fab, MSG_REKEY, 0, &Rekey{Key: kx.Public()})
+}
+
+// onRekey answers rekey from peer, or takes answer of ours. Errors break
+// the fabric. called by Loop only, so new keys of peer set before its
+// records under them read.
+func (fab *Fabric) onRekey(f *Frame) (err error) {
+	ac := aeadOf(fab.Conn)
+	if !fab.rekey || ac == nil {
+		return fmt.Errorf("%w: rekey not agreed.", ErrEncrypt)
+	}
+	var rekey Rekey
+	err = f.Unmarshal(&rekey)
+	if err != nil {
+		return
+	}
+	if rekey.Answer {
+		err = ac.finishRekey(rekey.Key)
+		if err == nil {
+			fab.rekeyed()
+		}
+		return
+	}
+
+	pub, err := ac.answerRekey(rekey.Key)
+	if err != nil {
+		return
+	}
+	fab.rekeyed()
+	// keys of peer already set, never wait for peer reading before we read.
+	go func() {
+		err := SendFrame(fab, MSG_REKEY, 0, &Rekey{Key: pub, Answer: true})
+		if err != nil {
+			logger.Error(err.Error())
+		}
+	}()
+	return
+}
+
+func (fab *Fabric) rekeyed() {
+	n := atomic.AddUint64(&fab.rekeys, 1)
+	logger.Infof("%s rekeyed, %d times.", fab.String(), n)
+}
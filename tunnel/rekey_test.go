@@ -0,0 +1,76 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestRekey(t *testing.T) {
+	SetLogging()
+	// both sides rekey, crossing each other now and then.
+	pd := &pipeDialer{auth: keyAuth("psk"), ch_err: make(chan error, 1), rekey: 48 * 1024}
+	dc := NewDialerCreator(pd, "pipe", "pipe", "user", "secret")
+	dc.Key = []byte("psk")
+	dc.RekeyBytes = 64 * 1024
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-pd.ch_err; err != nil {
+		t.Fatal(err)
+	}
+	go client.Loop()
+	defer client.Close()
+
+	c, err := client.Dial("test", "echo:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := <-accepted
+	defer c.Close()
+	defer srv.Close()
+	go io.Copy(srv, srv)
+
+	// echoed in rounds, each over RekeyBytes of both.
+	data := make([]byte, 80*1024)
+	got := make([]byte, len(data))
+	for i := 0; i < 32; i++ {
+		rand.Read(data)
+		go c.Write(data)
+		_, err = io.ReadFull(c, got)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("round %d mismatch across rekeys: %v", i, err)
+		}
+	}
+	if n := client.Stats().Rekeys; n < 4 {
+		t.Fatalf("expect several rekeys, got %d", n)
+	}
+}
+
+func TestRekeyNotAgreed(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	p1, p2 := net.Pipe()
+	w, _ := newAeadConn(p1, key, key)
+	r, _ := newAeadConn(p2, key, key)
+	defer p1.Close()
+	defer p2.Close()
+
+	// switched by writer, but reader never answered.
+	w.client = true
+	w.w_secret = bytes.Repeat([]byte{2}, 32)
+	w.startRekey()
+	kx, _ := newKeyExchange()
+	err := w.finishRekey(kx.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go w.Write([]byte("hello"))
+	_, err = r.Read(make([]byte, 16))
+	if !errors.Is(err, ErrEncrypt) {
+		t.Fatalf("record under keys unknown accepted: %v", err)
+	}
+}
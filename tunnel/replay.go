@@ -0,0 +1,117 @@
+package tunnel
+
+import (
+	"crypto/sha256"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReplayAuthenticator gives ReplayCache auth checked against, a default
+// one shared by all servers if not, or nil returned.
+type ReplayAuthenticator interface {
+	AuthReplays() *ReplayCache
+}
+
+// ReplayCache refuses handshakes captured and sent again: time of client
+// in proof should be in Skew if CAP_TIMESTAMP agreed, and token passes
+// auth once till it expires. Nonce of challenge new on each conn, proof on
+// it can't pass on another, so none kept here. Replays refused like wrong
+// passwords, counted apart. At most REPLAY_MAX tokens kept, those expiring
+// soonest forgotten first. Set options before use.
+type ReplayCache struct {
+	// AUTH_SKEW if 0.
+	Skew time.Duration
+	// tokens may pass again, for clients sharing one in fabrics. they
+	// can be replayed then, send them on tls or encrypted fabrics only.
+	TokenReuse bool
+
+	lock   sync.Mutex
+	tokens map[[sha256.Size]byte]time.Time
+	// counted without lock.
+	replays uint64
+}
+
+// ReplayStats counts replays all time, and tokens kept now.
+type ReplayStats struct {
+	Replays uint64
+	Tokens  int
+}
+
+var defaultReplays = &ReplayCache{}
+
+func authReplays(author Authenticator) *ReplayCache {
+	if ra, ok := backend(author).(ReplayAuthenticator); ok {
+		if rc := ra.AuthReplays(); rc != nil {
+			return rc
+		}
+	}
+	return defaultReplays
+}
+
+// remember keeps key in m till expires, m made if nil. Those expired
+// swept when full, then the one expiring soonest.
+func remember[K comparable](m map[K]time.Time, key K, expires time.Time) map[K]time.Time {
+	if m == nil {
+		m = make(map[K]time.Time)
+	}
+	if len(m) >= REPLAY_MAX {
+		now := time.Now()
+		for k, t := range m {
+			if !now.Before(t) {
+				delete(m, k)
+			}
+		}
+	}
+	if len(m) >= REPLAY_MAX {
+		var soonest K
+		var first time.Time
+		for k, t := range m {
+			if first.IsZero() || t.Before(first) {
+				soonest, first = k, t
+			}
+		}
+		delete(m, soonest)
+	}
+	m[key] = expires
+	return m
+}
+
+// checkTime tells if time of client in unix ms is in Skew of ours.
+func (rc *ReplayCache) checkTime(ms int64) bool {
+	skew := rc.Skew
+	if skew == 0 {
+		skew = AUTH_SKEW * time.Millisecond
+	}
+	d := time.Since(time.UnixMilli(ms))
+	return d <= skew && d >= -skew
+}
+
+// useToken tells if token never passed before, kept till expires. Token
+// carries jti so each one issued is new.
+func (rc *ReplayCache) useToken(token string, expires time.Time) bool {
+	if rc.TokenReuse {
+		return true
+	}
+	key := sha256.Sum256([]byte(token))
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if t, ok := rc.tokens[key]; ok && time.Now().Before(t) {
+		return false
+	}
+	rc.tokens = remember(rc.tokens, key, expires)
+	return true
+}
+
+func (rc *ReplayCache) replayed(username string) {
+	n := atomic.AddUint64(&rc.replays, 1)
+	logger.Warningf("user %s auth replayed, refused, %d replays so far.", username, n)
+}
+
+func (rc *ReplayCache) Stats() (st ReplayStats) {
+	st.Replays = atomic.LoadUint64(&rc.replays)
+	rc.lock.Lock()
+	st.Tokens = len(rc.tokens)
+	rc.lock.Unlock()
+	return
+}
@@ -0,0 +1,163 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replayAuth checks keys and tokens, replays in its own cache. tokens
+// accepted in plaintext, pipes aren't tls.
+type replayAuth struct {
+	KeyMapAuthenticator
+	HMACTokens
+	rc *ReplayCache
+}
+
+func (ra replayAuth) Auth(username, password string) (UserInfo, error) {
+	return ra.KeyMapAuthenticator.Auth(username, password)
+}
+
+func (ra replayAuth) AuthReplays() *ReplayCache {
+	return ra.rc
+}
+
+func (ra replayAuth) AllowPlaintext() bool { return true }
+
+func TestReplayNonce(t *testing.T) {
+	SetLogging()
+	key := DeriveKey("alice", "secret")
+	ca := KeyMapAuthenticator{"alice": key}
+	rc := &ReplayCache{}
+	nonce := bytes.Repeat([]byte{1}, AUTH_NONCE_SIZE)
+	cnonce := bytes.Repeat([]byte{2}, AUTH_NONCE_SIZE)
+	auth := &Auth{Username: "alice", Nonce: cnonce, Proof: authProof(key, nonce, cnonce, 0)}
+	if _, err := checkProof(ca, rc, auth, nonce, time.Now(), 0); err != nil {
+		t.Fatal(err)
+	}
+	// captured and sent on another conn, nonce of it differs.
+	other := bytes.Repeat([]byte{3}, AUTH_NONCE_SIZE)
+	if _, err := checkProof(ca, rc, auth, other, time.Now(), 0); err != ErrAuthFailed {
+		t.Fatalf("proof on other nonce should fail, got %v", err)
+	}
+	expired := time.Now().Add(-AUTH_NONCE_TTL * time.Millisecond)
+	if _, err := checkProof(ca, rc, auth, nonce, expired, 0); err != ErrReplayed {
+		t.Fatalf("nonce expired should be refused, got %v", err)
+	}
+
+	rc.Skew = time.Second
+	now := time.Now()
+	for d, ok := range map[time.Duration]bool{
+		0: true, 500 * time.Millisecond: true, -500 * time.Millisecond: true,
+		2 * time.Second: false, -2 * time.Second: false,
+	} {
+		if rc.checkTime(now.Add(d).UnixMilli()) != ok {
+			t.Fatalf("time off by %s should be %v", d, ok)
+		}
+	}
+}
+
+func TestReplayMax(t *testing.T) {
+	rc := &ReplayCache{}
+	expires := time.Now().Add(time.Minute)
+	for i := 0; i < REPLAY_MAX+10; i++ {
+		rc.useToken(strings.Repeat("t", i), expires.Add(time.Duration(i)))
+	}
+	if st := rc.Stats(); st.Tokens != REPLAY_MAX {
+		t.Fatalf("expect %d tokens kept, got %d", REPLAY_MAX, st.Tokens)
+	}
+	if !rc.useToken("", expires) {
+		t.Fatal("token expiring soonest should be forgotten first")
+	}
+	if rc.useToken(strings.Repeat("t", REPLAY_MAX+9), expires) {
+		t.Fatal("token passed should be kept")
+	}
+}
+
+func TestChallengeTimestamp(t *testing.T) {
+	SetLogging()
+	key := DeriveKey("alice", "secret")
+	ra := replayAuth{KeyMapAuthenticator: KeyMapAuthenticator{"alice": key}, rc: &ReplayCache{Skew: time.Second}}
+	as := newAuthServer(ra, 0)
+	cnonce := bytes.Repeat([]byte{1}, AUTH_NONCE_SIZE)
+	at := func(d time.Duration) func(nonce []byte) Auth {
+		return func(nonce []byte) Auth {
+			ms := time.Now().Add(d).UnixMilli()
+			return Auth{Username: "alice", Nonce: cnonce, Time: ms, Proof: authProof(key, nonce, cnonce, ms)}
+		}
+	}
+
+	conn, _ := as.Dial("pipe", "pipe")
+	if errno := rawAuth(t, conn, CAP_CHALLENGE|CAP_TIMESTAMP, at(0)); errno != ERR_NONE {
+		t.Fatalf("expect passed, got %d", errno)
+	}
+	<-as.ch
+
+	// captured long ago, or time not bound in proof.
+	conn, _ = as.Dial("pipe", "pipe")
+	if errno := rawAuth(t, conn, CAP_CHALLENGE|CAP_TIMESTAMP, at(-time.Minute)); errno != ERR_AUTH {
+		t.Fatalf("proof out of skew should be refused, got %d", errno)
+	}
+	if err := <-as.ch_err; err == nil {
+		t.Fatal("expect error")
+	}
+	conn, _ = as.Dial("pipe", "pipe")
+	if errno := rawAuth(t, conn, CAP_CHALLENGE|CAP_TIMESTAMP, func(nonce []byte) Auth {
+		return Auth{Username: "alice", Nonce: cnonce, Time: time.Now().UnixMilli(), Proof: authProof(key, nonce, cnonce, 0)}
+	}); errno != ERR_AUTH {
+		t.Fatalf("proof without time should be refused, got %d", errno)
+	}
+	<-as.ch_err
+	if st := ra.rc.Stats(); st.Replays != 1 {
+		t.Fatalf("expect 1 replay, got %+v", st)
+	}
+
+	// clients before it still pass.
+	dc := NewDialerCreator(as, "pipe", "pipe", "alice", "secret")
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	<-as.ch
+}
+
+func TestTokenReplay(t *testing.T) {
+	SetLogging()
+	ra := replayAuth{HMACTokens: HMACTokens{Key: []byte("secret")}, rc: &ReplayCache{}}
+	token := ra.Issue("alice", time.Now().Add(time.Minute))
+	if token == ra.Issue("alice", time.Now().Add(time.Minute)) {
+		t.Fatal("tokens should differ by jti")
+	}
+	as := newAuthServer(ra, 0)
+	dc := NewDialerCreator(as, "pipe", "pipe", "alice", "")
+	dc.Plaintext = true
+	dc.Token = func() (string, error) { return token, nil }
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	<-as.ch
+
+	_, err = dc.Create()
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("token replayed should be refused as wrong one, got %v", err)
+	}
+	if err = <-as.ch_err; err == nil {
+		t.Fatal("expect error")
+	}
+	if st := ra.rc.Stats(); st.Replays != 1 || st.Tokens != 1 {
+		t.Fatalf("expect 1 replay and 1 token kept, got %+v", st)
+	}
+
+	ra.rc.TokenReuse = true
+	client, err = dc.Create()
+	if err != nil {
+		t.Fatalf("token reuse allowed: %v", err)
+	}
+	client.Close()
+	<-as.ch
+}
@@ -0,0 +1,96 @@
+package tunnel
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+// Rewrite changes targets matched by Rule, before names resolved and
+// checked by Guard. Deny in Rule is ignored.
+type Rewrite struct {
+	Rule
+	// replaces the whole target, host:port. Host and Port ignored if set.
+	Redirect string
+	// replaces host of target if not empty.
+	Host string
+	// replaces port of target if not 0.
+	Port int
+}
+
+func (rw *Rewrite) apply(host, port string) string {
+	if rw.Redirect != "" {
+		return rw.Redirect
+	}
+	if rw.Host != "" {
+		host = rw.Host
+	}
+	if rw.Port != 0 {
+		port = strconv.Itoa(rw.Port)
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Rewriter holds the rewrites in use, the first one matched applies. They
+// can be swapped when streams dialing, like ACL in Guard. Zero value
+// rewrites nothing.
+type Rewriter struct {
+	rules atomic.Pointer[[]*Rewrite]
+}
+
+func NewRewriter(rules []*Rewrite) (rw *Rewriter) {
+	rw = &Rewriter{}
+	rw.Set(rules)
+	return
+}
+
+// Set takes rules for streams after it. Don't change them after given,
+// make new ones.
+func (rw *Rewriter) Set(rules []*Rewrite) {
+	rw.rules.Store(&rules)
+}
+
+func (rw *Rewriter) Get() []*Rewrite {
+	p := rw.rules.Load()
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+// Apply returns target rewritten by the first rule matched, ok false and
+// address as is if none. nil Rewriter rewrites nothing.
+func (rw *Rewriter) Apply(network, address string) (target string, ok bool) {
+	if rw == nil {
+		return address, false
+	}
+	host, sport, err := net.SplitHostPort(address)
+	if err != nil {
+		return address, false
+	}
+	port, _ := strconv.Atoi(sport)
+	name, ip := host, net.ParseIP(host)
+	if ip != nil {
+		name = ""
+	}
+	for _, r := range rw.Get() {
+		if r.match(network, name, ip, port) {
+			atomic.AddUint64(&r.hits, 1)
+			return r.apply(host, sport), true
+		}
+	}
+	return address, false
+}
+
+// rewrite changes target in syn by Rewriter of fabric, returns the one
+// peer asked if changed, for access log.
+func (fab *Fabric) rewrite(streamid uint16, syn *Syn) (asked string) {
+	target, ok := fab.Rewriter.Apply(syn.Network, syn.Address)
+	if !ok || target == syn.Address {
+		return ""
+	}
+	logger.Infof("%s rewrite %s:%s in stream %d to %s.",
+		fab.String(), syn.Network, syn.Address, streamid, target)
+	asked, syn.Address = syn.Address, target
+	return
+}
@@ -0,0 +1,95 @@
+package tunnel
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRewriter(t *testing.T) {
+	rw := NewRewriter([]*Rewrite{
+		{Rule: Rule{Domains: []string{"old.test"}}, Host: "new.test"},
+		{Rule: Rule{Nets: mustCIDRs(t, "10.0.0.0/8"), PortMin: 8080, PortMax: 8080}, Port: 80},
+		{Rule: Rule{Domains: []string{"moved.test"}}, Host: "x.test", Redirect: "10.1.1.1:443"},
+		{Rule: Rule{Nets: mustCIDRs(t, "2001:db8::/32")}, Port: 8443},
+	})
+	for _, c := range []struct {
+		address string
+		target  string
+		ok      bool
+	}{
+		{"www.old.test:443", "new.test:443", true},
+		{"10.2.2.2:8080", "10.2.2.2:80", true},
+		{"10.2.2.2:8081", "10.2.2.2:8081", false},
+		{"moved.test:80", "10.1.1.1:443", true},
+		{"[2001:db8::1]:443", "[2001:db8::1]:8443", true},
+		{"other.test:80", "other.test:80", false},
+		{"bad address", "bad address", false},
+	} {
+		target, ok := rw.Apply("tcp", c.address)
+		if target != c.target || ok != c.ok {
+			t.Errorf("%s: expect %s %v, got %s %v", c.address, c.target, c.ok, target, ok)
+		}
+	}
+	if n := rw.Get()[0].Hits(); n != 1 {
+		t.Fatalf("expect 1 hit, got %d", n)
+	}
+
+	// swapped as a whole.
+	rw.Set(nil)
+	if _, ok := rw.Apply("tcp", "www.old.test:443"); ok {
+		t.Fatal("rewritten after rules cleared")
+	}
+	if target, ok := (*Rewriter)(nil).Apply("tcp", "x.test:1"); ok || target != "x.test:1" {
+		t.Fatalf("nil rewriter should rewrite nothing, got %s", target)
+	}
+}
+
+func TestTcpProxyRewrite(t *testing.T) {
+	echo := tcpEcho(t)
+	cli, srv := newConnPair(t)
+	ch := make(chan AccessRecord, 4)
+	l := NewAccessLog(func(rec AccessRecord) { ch <- rec }, 0)
+	defer l.Close()
+	srv.fab.AccessLog = l
+	rw := NewRewriter([]*Rewrite{
+		{Rule: Rule{Domains: []string{"app.test"}}, Redirect: echo},
+	})
+	srv.fab.Rewriter = rw
+	client := &Client{Fabric: cli.fab}
+
+	// never resolved, dialed as rewritten.
+	conn, err := client.Dial("tcp", "www.app.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoOnce(t, conn, "")
+	rec := nextRecord(t, ch)
+	if rec.Address != "www.app.test:80" || rec.Rewritten != echo || rec.Target != echo {
+		t.Fatalf("wrong record: %+v", rec)
+	}
+
+	// checked after rewritten, rules swapped at runtime.
+	srv.fab.Guard = NewGuard(&ACL{Rules: []*Rule{
+		{Nets: mustCIDRs(t, "10.0.0.0/8"), Deny: true},
+	}})
+	rw.Set([]*Rewrite{{Rule: Rule{Domains: []string{"app.test"}}, Host: "10.0.0.1"}})
+	_, err = client.Dial("tcp", "www.app.test:80")
+	if !errors.Is(err, ErrDenied) {
+		t.Fatalf("expect denied, got %v", err)
+	}
+	rec = nextRecord(t, ch)
+	if rec.Address != "www.app.test:80" || rec.Rewritten != "10.0.0.1:80" || rec.Target != "" {
+		t.Fatalf("wrong record of denied: %+v", rec)
+	}
+
+	// not rewritten.
+	conn, err = client.Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoOnce(t, conn, "")
+	rec = nextRecord(t, ch)
+	if rec.Address != echo || rec.Rewritten != "" {
+		t.Fatalf("wrong record: %+v", rec)
+	}
+}
@@ -1,9 +1,16 @@
 package tunnel
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,70 +18,420 @@ type PasswordAuthenticator interface {
 	AuthPass(string, string) bool
 }
 
+// KeyAuthenticator gives pre-shared key, server agrees CAP_ENCRYPT only
+// if authenticator is one and key not empty.
+type KeyAuthenticator interface {
+	PreSharedKey() []byte
+}
+
+// LockoutAuthenticator slows down and bans sources failed in auth by
+// Lockout given, and forgets them after passed.
+type LockoutAuthenticator interface {
+	AuthLockout() *Lockout
+}
+
+// ACLAuthenticator attaches rules of user in auth backend, asked after
+// auth passed. Rules in it checked before global ones in Guard of fabric,
+// and decide if matched. Default of it decides only if DefaultDeny. Swap
+// ACL in Guard returned for new streams of user, nil checks Guard only.
+type ACLAuthenticator interface {
+	UserGuard(username string) *Guard
+}
+
+// AuthInfo is what we learned from client in auth.
+type AuthInfo struct {
+	Username string
+	Groups   []string
+	// give it to fabric, if authenticator is an ACLAuthenticator.
+	UserGuard *Guard
+	// from UserInfo, give it to fabric as UserPorts.
+	Ports *PortFilter
+	// should be given to fabric by SetCaps.
+	Caps uint32
+	// fabric should be on it, encrypted if CAP_ENCRYPT agreed.
+	Conn net.Conn
+	// usage of user if authenticator is a LimitAuthenticator, give it to
+	// fabric, and release it after fabric closed.
+	Account *Account
+	// state of tls conn under it, nil if not on tls.
+	TLS *tls.ConnectionState
+	// token in auth expires, zero if not by token. give it to fabric by
+	// SetToken.
+	Expires time.Time
+	// how user passed, "cert", "challenge", "token", "password" or
+	// "guest".
+	Method string
+	// user is guest, no credentials. give it to fabric.
+	Guest bool
+	// syn guest sent instead of auth, give it to fabric by Replay.
+	Syn *Frame
+}
+
+// AuthConn can't be used with KeyAuthenticator, conn may be encrypted
+// after it.
 func AuthConn(auth PasswordAuthenticator, conn net.Conn) (err error) {
-	ti := time.AfterFunc(AUTH_TIMEOUT*time.Millisecond, func() {
-		logger.Errorf("auth timeout %s.", conn.RemoteAddr())
-		conn.Close()
-	})
+	_, err = AuthConnInfo(auth, conn)
+	return
+}
+
+// AuthConnInfo works like AuthConn, and returns user and caps agreed with
+// client, so server can set up fabric for the user.
+func AuthConnInfo(auth PasswordAuthenticator, conn net.Conn) (info AuthInfo, err error) {
+	return AuthConnWith(passwordAuth{auth}, conn, 0)
+}
 
-	err = onAuth(auth, conn)
+// AuthConnWith works like AuthConnInfo, users checked by auth. Client
+// should finish hello and auth in timeout, or ErrAuthTimeout. 0 means
+// AUTH_TIMEOUT. Deadline of conn from Server is kept if earlier, so tls
+// and auth share it. Cleared after auth passed, for fabric. No stream can
+// be opened before it, fabric not created yet.
+func AuthConnWith(auth Authenticator, conn net.Conn, timeout time.Duration) (info AuthInfo, err error) {
+	if timeout == 0 {
+		timeout = AUTH_TIMEOUT * time.Millisecond
+	}
+	deadline := time.Now().Add(timeout)
+	if d := acceptDeadline(conn); !d.IsZero() && d.Before(deadline) {
+		deadline = d
+	}
+	// stalled reads unblock on it, not only the next one.
+	conn.SetDeadline(deadline)
+
+	info, err = onAuth(auth, conn)
 	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) || !time.Now().Before(deadline) {
+			err = fmt.Errorf("%w: %s", ErrAuthTimeout, conn.RemoteAddr())
+		}
 		logger.Error(err.Error())
 		return
 	}
 
-	ti.Stop()
+	// fails only if closed, fabric finds it.
+	conn.SetDeadline(time.Time{})
 	return
 }
 
-func onAuth(author PasswordAuthenticator, stream io.ReadWriteCloser) (err error) {
-	var auth Auth
-	fauth, err := ReadFrame(stream, &auth)
+// acceptedConn carries deadline set at accept, for AuthConnWith.
+type acceptedConn struct {
+	net.Conn
+	deadline time.Time
+}
+
+func (ac *acceptedConn) NetConn() net.Conn {
+	return ac.Conn
+}
+
+// acceptDeadline returns deadline of conn from Server, through wrappers
+// with NetConn. zero if not from Server.
+func acceptDeadline(conn net.Conn) time.Time {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *acceptedConn:
+			return c.deadline
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return time.Time{}
+		}
+	}
+	return time.Time{}
+}
+
+// onHello replies hello from client with caps agreed. Our version sent
+// anyway, so client knows why if versions mismatch. After it, talk on
+// the conn returned. nonce sent if challenge and client asked for it.
+// CAP_TOKEN agreed if tokens.
+func onHello(conn net.Conn, psk []byte, challenge, tokens bool) (caps uint32, nonce []byte, out net.Conn, err error) {
+	// type checked before length, browsers never wait for us reading
+	// what they won't send.
+	var hdr [HEADER_SIZE]byte
+	_, err = io.ReadFull(conn, hdr[:])
 	if err != nil {
 		logger.Error(err.Error())
 		return
 	}
-
-	if fauth.Header.Type != MSG_AUTH {
-		return ErrUnexpectedPkg
+	if hdr[0] != MSG_HELLO {
+		return 0, nil, nil, fmt.Errorf("%w: no hello from peer.", ErrVersion)
+	}
+	fhello, err := ReadFrame(io.MultiReader(bytes.NewReader(hdr[:]), conn), nil)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	var hello Hello
+	err = fhello.Unmarshal(&hello)
+	if err != nil {
+		return
 	}
 
-	if !author.AuthPass(auth.Username, auth.Password) {
-		logger.Errorf("user %s auth failed with password: %s.",
-			auth.Username, auth.Password)
-		err = WriteFrame(
-			stream, MSG_RESULT, fauth.Header.Streamid, ERR_AUTH)
+	caps = hello.Caps & (CAP_CHECKSUM | CAP_COMPRESS | CAP_PADDING | CAP_DNS | CAP_BIND | CAP_ADDRS | CAP_EARLY)
+	reply := Hello{Version: PROTO_VERSION}
+	var kx *keyExchange
+	if len(psk) != 0 && hello.Caps&CAP_ENCRYPT != 0 {
+		kx, err = newKeyExchange()
 		if err != nil {
 			return
 		}
-		err = fmt.Errorf("user %s auth failed, password:%s.",
-			auth.Username, auth.Password)
+		caps |= CAP_ENCRYPT | hello.Caps&CAP_REKEY
+		reply.Key = kx.Public()
+	}
+	if challenge && hello.Caps&CAP_CHALLENGE != 0 {
+		nonce, err = newNonce()
+		if err != nil {
+			return
+		}
+		caps |= CAP_CHALLENGE | hello.Caps&CAP_TIMESTAMP
+		reply.Nonce = nonce
+	}
+	if tokens && hello.Caps&CAP_TOKEN != 0 {
+		caps |= CAP_TOKEN
+	}
+	reply.Caps = caps
+	err = WriteFrame(conn, MSG_HELLO, 0, &reply)
+	if err != nil {
+		logger.Error(err.Error())
+		return 0, nil, nil, err
+	}
+	err = checkVersion(hello.Version)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	out = conn
+	if kx != nil {
+		out, err = kx.wrap(conn, psk, hello.Key, false, caps)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+	}
+	return
+}
+
+// checkAuth checks proof in auth if challenged, or password or token if
+// plaintext allowed, after users passed by tls state. Password refused if keys kept
+// and link is plain, or client might be fooled to send it.
+func checkAuth(author Authenticator, auth *Auth, nonce []byte, issued time.Time, info *AuthInfo) (user UserInfo, err error) {
+	if info.TLS != nil {
+		if cert, ok := backend(author).(CertAuthenticator); ok {
+			if user, ok = cert.AuthCert(info.TLS, auth.Username); ok {
+				info.Method = "cert"
+				return
+			}
+		}
+	}
+	ca, _ := backend(author).(ChallengeAuthenticator)
+	rc := authReplays(author)
+	if nonce != nil && len(auth.Proof) != 0 {
+		info.Method = "challenge"
+		return checkProof(ca, rc, auth, nonce, issued, info.Caps)
+	}
+	plaintext := ca == nil || info.Caps&CAP_ENCRYPT != 0 || info.TLS != nil
+	if pa, ok := backend(author).(PlaintextAuthenticator); ok && pa.AllowPlaintext() {
+		plaintext = true
+	}
+	info.Method = "password"
+	if auth.Token != "" {
+		info.Method = "token"
+	}
+	if !plaintext {
+		logger.Errorf("user %s sent %s in plaintext, refused.", auth.Username, info.Method)
+		return user, ErrAuthFailed
+	}
+	if auth.Token != "" {
+		return checkToken(author, rc, auth, info)
+	}
+	return author.Auth(auth.Username, auth.Password)
+}
+
+func authLockout(author Authenticator) *Lockout {
+	if la, ok := backend(author).(LockoutAuthenticator); ok {
+		return la.AuthLockout()
+	}
+	return nil
+}
+
+func onAuth(author Authenticator, conn net.Conn) (info AuthInfo, err error) {
+	var psk []byte
+	if ka, ok := backend(author).(KeyAuthenticator); ok {
+		psk = ka.PreSharedKey()
+	}
+	_, challenge := backend(author).(ChallengeAuthenticator)
+	_, tokens := backend(author).(TokenValidator)
+	var nonce []byte
+	info.TLS = tlsState(conn)
+	info.Caps, nonce, conn, err = onHello(conn, psk, challenge, tokens)
+	if err != nil {
 		return
 	}
+	info.Conn = conn
+	// nonce lives here, only auth frame read next checked on it.
+	issued := time.Now()
+
+	var auth Auth
+	fauth, err := ReadFrame(conn, nil)
+	if err != nil {
+		logger.Error(err.Error())
+		return info, err
+	}
+
+	var guest UserInfo
+	guests := false
+	if ga, ok := backend(author).(GuestAuthenticator); ok {
+		guest, guests = ga.GuestUser()
+	}
+	switch {
+	case fauth.Header.Type == MSG_AUTH:
+		err = fauth.Unmarshal(&auth)
+		if err != nil {
+			return info, err
+		}
+	case fauth.Header.Type == MSG_SYN && guests:
+		// guest never asked for result of auth, syn goes to fabric.
+		info.Syn = fauth
+		auth.Anonymous = true
+	default:
+		// syn before auth, or anything else, refused.
+		WriteFrame(conn, MSG_RESULT, fauth.Header.Streamid, ERR_AUTH)
+		return info, ErrUnexpectedPkg
+	}
+
+	if auth.Anonymous {
+		if !guests {
+			logger.Errorf("guest from %s refused.", conn.RemoteAddr())
+			WriteFrame(conn, MSG_RESULT, fauth.Header.Streamid, ERR_AUTH)
+			return info, ErrAuthFailed
+		}
+		return onGuest(author, guest, conn, fauth, info)
+	}
+
+	user, err := checkAuth(author, &auth, nonce, issued, &info)
+	if err != nil {
+		logger.Errorf("user %s auth failed by %s.",
+			auth.Username, info.Method)
+		if fa, ok := backend(author).(FailAuthenticator); ok {
+			fa.AuthFailed(auth.Username, conn.RemoteAddr())
+		}
+		if lo := authLockout(author); lo != nil {
+			time.Sleep(lo.Failed(conn.RemoteAddr()))
+		}
+		err = WriteFrame(
+			conn, MSG_RESULT, fauth.Header.Streamid, ERR_AUTH)
+		if err != nil {
+			return info, err
+		}
+		err = fmt.Errorf("user %s auth failed by %s.",
+			auth.Username, info.Method)
+		return info, err
+	}
+	if user.Username == "" {
+		user.Username = auth.Username
+	}
+
+	err = info.admit(author, conn, user, fauth.Header.Streamid)
+	if err != nil {
+		return info, err
+	}
 
 	err = WriteFrame(
-		stream, MSG_RESULT, fauth.Header.Streamid, ERR_NONE)
+		conn, MSG_RESULT, fauth.Header.Streamid, ERR_NONE)
 	if err != nil {
 		logger.Error(err.Error())
-		return
+		info.Account.Release()
+		info.Account = nil
+		return info, err
+	}
+
+	if lo := authLockout(author); lo != nil {
+		lo.Passed(conn.RemoteAddr())
 	}
+	info.setUser(author, user)
+	logger.Infof("user %s auth passed, caps: %d.", user.Username, info.Caps)
+	return
+}
 
-	logger.Info("auth passed.")
+// admit counts fabric of user in author if it's a LimitAuthenticator.
+func (info *AuthInfo) admit(author Authenticator, conn net.Conn, user UserInfo, streamid uint16) (err error) {
+	la, ok := backend(author).(LimitAuthenticator)
+	if !ok {
+		return
+	}
+	info.Account, err = la.Accounts().Admit(user.Username, la.Limits(user.Username))
+	if err != nil {
+		logger.Errorf("user %s refused: %s", user.Username, err.Error())
+		if e := WriteFrame(conn, MSG_RESULT, streamid, ERR_TOOMANYFABRICS); e != nil {
+			return e
+		}
+	}
 	return
 }
 
+func (info *AuthInfo) setUser(author Authenticator, user UserInfo) {
+	info.Username, info.Groups, info.Ports = user.Username, user.Groups, user.Ports
+	if aa, ok := backend(author).(ACLAuthenticator); ok {
+		info.UserGuard = aa.UserGuard(user.Username)
+	}
+}
+
+// onGuest lets client in as user, result of auth sent only if asked by
+// auth. Guests aren't failures in lockout, nor passed.
+func onGuest(author Authenticator, user UserInfo, conn net.Conn, fauth *Frame, info AuthInfo) (AuthInfo, error) {
+	if user.Username == "" {
+		user.Username = GUEST_USER
+	}
+	info.Method, info.Guest = "guest", true
+
+	err := info.admit(author, conn, user, fauth.Header.Streamid)
+	if err != nil {
+		return info, err
+	}
+	if info.Syn == nil {
+		err = WriteFrame(conn, MSG_RESULT, fauth.Header.Streamid, ERR_NONE)
+		if err != nil {
+			logger.Error(err.Error())
+			info.Account.Release()
+			info.Account = nil
+			return info, err
+		}
+	}
+	info.setUser(author, user)
+	logger.Noticef("guest from %s passed as %s, caps: %d.",
+		conn.RemoteAddr(), user.Username, info.Caps)
+	return info, nil
+}
+
 type Handler interface {
 	Handle(net.Conn) error
 }
 
 var ProtocolHandlers map[string]Handler
 
+// DefaultTcpProxy handles tcp, tcp4 and tcp6 syn.
+var DefaultTcpProxy = new(TcpProxy)
+
+// DefaultUdpProxy handles udp, udp4 and udp6 syn, streams of them carry
+// datagrams as DgramConn.
+var DefaultUdpProxy = new(UdpProxy)
+
+// DefaultUdpAssociate handles ASSOC_NETWORK syn.
+var DefaultUdpAssociate = new(UdpAssociate)
+
+// DefaultUnixProxy handles unix syn, and refuses unixpacket.
+var DefaultUnixProxy = new(UnixProxy)
+
 func init() {
-	p := new(TcpProxy)
+	p := DefaultTcpProxy
+	u := DefaultUdpProxy
 	ProtocolHandlers = map[string]Handler{
 		"tcp":  p,
 		"tcp4": p,
 		"tcp6": p,
+		"udp":  u,
+		"udp4": u,
+		"udp6": u,
+
+		"unix":       DefaultUnixProxy,
+		"unixpacket": DefaultUnixProxy,
+
+		ASSOC_NETWORK: DefaultUdpAssociate,
 	}
 }
 
@@ -89,6 +446,35 @@ func RegisterNetwork(network string, handler Handler) (ok bool) {
 
 type Server struct {
 	Handler
+	// conns accepted are tls, handshake done before Handle. Handler gets
+	// *tls.Conn. conns failed in verify of client certs closed there. go
+	// never renegotiates as server, so peer can't change identity after it.
+	TLSConfig *tls.Config
+	// conns from sources banned in it closed at accept, before tls.
+	Lockout *Lockout
+	// tls, hello and auth should be done in it from accept, or conn closed.
+	// set as deadline of conn, Handler clears it after auth, AuthConnWith
+	// does. AUTH_TIMEOUT if 0.
+	AuthTimeout time.Duration
+	timeouts    uint64
+	// conns on tls sent anything but hello, or nothing in AuthTimeout,
+	// browsers or probes, served by Fallback as https instead of closed,
+	// or given to FallbackConn if set. bytes read replayed to them, they
+	// never see our protocol. conns sent hello closed as usual. advertise
+	// alpn of web servers in TLSConfig, like h2 and http/1.1.
+	Fallback     http.Handler
+	FallbackConn func(conn net.Conn)
+	fallbacks    uint64
+}
+
+// AuthTimeouts tells how many conns closed for not authed in AuthTimeout.
+func (server *Server) AuthTimeouts() uint64 {
+	return atomic.LoadUint64(&server.timeouts)
+}
+
+// Fallbacks tells how many conns handed to Fallback or FallbackConn.
+func (server *Server) Fallbacks() uint64 {
+	return atomic.LoadUint64(&server.fallbacks)
 }
 
 func (server *Server) Serve(listener net.Listener) (err error) {
@@ -96,28 +482,93 @@ func (server *Server) Serve(listener net.Listener) (err error) {
 
 	for {
 		conn, err = listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			logger.Error(err.Error())
 			continue
 		}
-		go func() {
-			defer conn.Close()
-			err = server.Handle(conn)
-			if err != nil {
-				logger.Error(err.Error())
-			}
-		}()
+		if server.Lockout != nil && server.Lockout.Banned(conn.RemoteAddr()) {
+			logger.Debugf("%s banned, refused.", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go server.serveConn(conn)
 	}
 	return
 }
 
+func (server *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	timeout := server.AuthTimeout
+	if timeout == 0 {
+		timeout = AUTH_TIMEOUT * time.Millisecond
+	}
+	deadline := time.Now().Add(timeout)
+	err := conn.SetDeadline(deadline)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	conn = &acceptedConn{Conn: conn, deadline: deadline}
+
+	if server.TLSConfig != nil {
+		tc := tls.Server(conn, server.TLSConfig)
+		err = tlsHandshake(tc, time.Until(deadline))
+		if err != nil {
+			server.countTimeout(err)
+			logger.Errorf("%s from %s.", err.Error(), conn.RemoteAddr())
+			return
+		}
+		conn = tc
+	}
+	var rc *recordConn
+	if server.TLSConfig != nil && (server.Fallback != nil || server.FallbackConn != nil) {
+		rc = &recordConn{Conn: conn}
+		conn = rc
+	}
+	err = server.Handle(conn)
+	if err == nil {
+		return
+	}
+	server.countTimeout(err)
+	if rc != nil {
+		if fc := rc.replay(); fc != nil {
+			logger.Infof("%s from %s, handed to fallback.", err.Error(), fc.RemoteAddr())
+			server.fallback(fc)
+			return
+		}
+	}
+	logger.Error(err.Error())
+}
+
+func (server *Server) fallback(conn net.Conn) {
+	atomic.AddUint64(&server.fallbacks, 1)
+	// deadline of auth not for it, fallback keeps its own.
+	conn.SetDeadline(time.Time{})
+	if server.FallbackConn != nil {
+		server.FallbackConn(conn)
+		return
+	}
+	serveFallback(server.Fallback, conn)
+}
+
+func (server *Server) countTimeout(err error) {
+	if errors.Is(err, ErrAuthTimeout) || errors.Is(err, os.ErrDeadlineExceeded) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		atomic.AddUint64(&server.timeouts, 1)
+	}
+}
+
 type TunnelServer struct {
 	*Fabric
 }
 
+// NewTunnelServer takes even stream ids, as acceptor of the connection.
 func NewTunnelServer(conn net.Conn) (s *TunnelServer) {
 	s = &TunnelServer{
-		Fabric: NewFabric(conn, 1),
+		Fabric: NewFabric(conn, 2),
 	}
 	s.Fabric.dft_fiber = s
 	return
@@ -133,6 +584,11 @@ func (s *TunnelServer) SendFrame(f *Frame) (err error) {
 			return
 		}
 		err = s.onSyn(f.Header.Streamid, &syn)
+	case MSG_WND:
+		// window renew may cross with fin, stream already gone.
+		logger.Debugf("drop window renew for closed stream: %s", f.Debug())
+	case MSG_RESULT:
+		err = s.onResult(f)
 	default:
 		err = ErrUnexpectedPkg
 		logger.Infof(f.Debug())
@@ -141,52 +597,6 @@ func (s *TunnelServer) SendFrame(f *Frame) (err error) {
 	return
 }
 
-func (s *TunnelServer) onSyn(streamid uint16, syn *Syn) (err error) {
-	var c *Conn
-	handler, ok := ProtocolHandlers[syn.Network]
-	if !ok {
-		logger.Errorf("unknown network: %s.", syn.Network)
-		err = SendFrame(
-			s.Fabric, MSG_RESULT, streamid, ERR_UNKNOWN_PROTOCOL)
-		if err != nil {
-			logger.Error(err.Error())
-			return
-		}
-		return
-	}
-
-	c, err = s.accept(streamid, syn)
-	if err != nil {
-		return
-	}
-	go handler.Handle(c)
-	return
-}
-
-func (s *TunnelServer) accept(streamid uint16, syn *Syn) (c *Conn, err error) {
-	c = NewConn(s.Fabric)
-	err = c.CheckAndSetStatus(ST_UNKNOWN, ST_SYN_RECV)
-	if err != nil {
-		logger.Error(err.Error())
-		return
-	}
-	c.streamid = streamid
-	c.Network = syn.Network
-	c.Address = syn.Address
-
-	err = s.Fabric.PutIntoId(streamid, c)
-	if err != nil {
-		logger.Error(err.Error())
-		err = SendFrame(
-			s.Fabric, MSG_RESULT, streamid, ERR_IDEXIST)
-		if err != nil {
-			logger.Error(err.Error())
-			return
-		}
-	}
-	return
-}
-
 // never called as default fiber.
 func (s *TunnelServer) CloseFiber(streamid uint16) (err error) {
 	panic("server's CloseFiber should never been called.")
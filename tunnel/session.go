@@ -0,0 +1,139 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"sync/atomic"
+	"time"
+)
+
+// why a fabric ended.
+const (
+	SESSION_NONE = iota
+	// connection closed by peer.
+	SESSION_PEER
+	// pongs missed, see PingInterval.
+	SESSION_HEARTBEAT
+	// token of peer expired and not renewed.
+	SESSION_EXPIRED
+	// drained by Shutdown.
+	SESSION_SHUTDOWN
+	// closed by us, without drain.
+	SESSION_CLOSED
+	// framing lost, or connection broken.
+	SESSION_ERROR
+)
+
+type SessionEnd uint8
+
+func (e SessionEnd) String() string {
+	s, ok := SessionEndText[uint8(e)]
+	if !ok {
+		return "unknown"
+	}
+	return s
+}
+
+var SessionEndText = map[uint8]string{
+	SESSION_NONE:      "none",
+	SESSION_PEER:      "peer",
+	SESSION_HEARTBEAT: "heartbeat",
+	SESSION_EXPIRED:   "expired",
+	SESSION_SHUTDOWN:  "shutdown",
+	SESSION_CLOSED:    "closed",
+	SESSION_ERROR:     "error",
+}
+
+// SessionRecord tells about a fabric, at end of it, or start if Starts of
+// SessionLog.
+type SessionRecord struct {
+	// record at start, only addresses, tls and user in it.
+	Started bool
+	Remote  string
+	Local   string
+	// empty if not on tls. Peer is CertIdentity of client cert.
+	TLSVersion string
+	TLSCipher  string
+	TLSServer  string
+	TLSPeer    string
+	// user authenticated, and how, from AuthInfo. AuthMethod is "guest"
+	// for guests.
+	Username   string
+	AuthMethod string
+	Guest      bool
+	Start      time.Time
+	// zero at start.
+	End    time.Time
+	Reason SessionEnd
+	// streams opened both ways, and bytes on the wire.
+	Streams  uint64
+	BytesIn  uint64
+	BytesOut uint64
+}
+
+// SessionLog calls fn with records of fabrics, out of data path like
+// AccessLog. Set options before use.
+type SessionLog struct {
+	recordQueue[SessionRecord]
+	// fabrics recorded at start too, not only at end.
+	Starts bool
+}
+
+// NewSessionLog queues size records at most, ACCESS_LOG_QUEUE if 0.
+func NewSessionLog(fn func(rec SessionRecord), size int) (l *SessionLog) {
+	l = &SessionLog{}
+	l.start(fn, size)
+	return
+}
+
+// endWith keeps why fabric ends, the first one counts.
+func (fab *Fabric) endWith(reason SessionEnd) {
+	fab.plock.Lock()
+	if fab.end_reason == SESSION_NONE {
+		fab.end_reason = reason
+	}
+	fab.plock.Unlock()
+}
+
+// sessionRecord returns record of fabric now, without counters if started.
+func (fab *Fabric) sessionRecord(started bool) (rec SessionRecord) {
+	rec = SessionRecord{
+		Started:    started,
+		Username:   fab.Username,
+		AuthMethod: fab.AuthMethod,
+		Guest:      fab.Guest,
+		Start:      fab.startTime,
+	}
+	if addr := fab.Conn.RemoteAddr(); addr != nil {
+		rec.Remote = addr.String()
+	}
+	if addr := fab.Conn.LocalAddr(); addr != nil {
+		rec.Local = addr.String()
+	}
+	if state := tlsState(fab.Conn); state != nil {
+		rec.TLSVersion = tls.VersionName(state.Version)
+		rec.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+		rec.TLSServer = state.ServerName
+		if len(state.PeerCertificates) != 0 {
+			rec.TLSPeer = CertIdentity(state.PeerCertificates[0])
+		}
+	}
+	if started {
+		return
+	}
+	rec.End = time.Now()
+	fab.plock.RLock()
+	rec.Reason = fab.end_reason
+	fab.plock.RUnlock()
+	rec.Streams = atomic.LoadUint64(&fab.opened)
+	rec.BytesIn, _, _ = fab.traffic_in.load()
+	rec.BytesOut, _, _ = fab.traffic_out.load()
+	return
+}
+
+// logSession sends record of fabric to SessionLog, at start only if Starts.
+func (fab *Fabric) logSession(started bool) {
+	if fab.SessionLog == nil || started && !fab.SessionLog.Starts {
+		return
+	}
+	fab.SessionLog.Log(fab.sessionRecord(started))
+}
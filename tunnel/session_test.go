@@ -0,0 +1,131 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// sessionServer runs fabrics for conns passed auth, records them in l.
+type sessionServer struct {
+	author Authenticator
+	l      *SessionLog
+	ch     chan *TunnelServer
+}
+
+func (ss *sessionServer) Handle(conn net.Conn) (err error) {
+	info, err := AuthConnWith(ss.author, conn, 0)
+	if err != nil {
+		return
+	}
+	tun := NewTunnelServer(info.Conn)
+	tun.SetCaps(info.Caps)
+	tun.Username, tun.AuthMethod = info.Username, info.Method
+	tun.SessionLog = ss.l
+	ss.ch <- tun
+	tun.Loop()
+	return
+}
+
+func nextSession(t *testing.T, ch chan SessionRecord) (rec SessionRecord) {
+	select {
+	case rec = <-ch:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no session record")
+	}
+	return
+}
+
+func TestSessionRecord(t *testing.T) {
+	SetLogging()
+	ch := make(chan SessionRecord, 4)
+	l := NewSessionLog(func(rec SessionRecord) { ch <- rec }, 0)
+	defer l.Close()
+	l.Starts = true
+
+	srvcfg, clicfg := tlsConfigs(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ss := &sessionServer{author: certAuth{}, l: l, ch: make(chan *TunnelServer, 1)}
+	go (&Server{Handler: ss, TLSConfig: srvcfg}).Serve(ln)
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	dc := NewDialerCreator(netutil.DefaultTcpDialer, "tcp", net.JoinHostPort("localhost", port), "user", "")
+	dc.TLSConfig = clicfg
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Loop()
+	<-ss.ch
+
+	rec := nextSession(t, ch)
+	if !rec.Started || rec.Username != "user" || rec.AuthMethod != "cert" ||
+		rec.TLSVersion != "TLS 1.3" || rec.TLSPeer != "user" || rec.TLSServer != "localhost" ||
+		rec.Remote == "" || rec.Local != ln.Addr().String() || rec.Start.IsZero() || !rec.End.IsZero() {
+		t.Fatalf("wrong start record: %+v", rec)
+	}
+
+	conn, err := client.Dial("tcp", tcpEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pingConn(conn); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	client.Close()
+
+	rec = nextSession(t, ch)
+	if rec.Started || rec.Reason != SESSION_PEER || rec.Streams != 1 ||
+		rec.BytesIn == 0 || rec.BytesOut == 0 || rec.Username != "user" || rec.TLSCipher == "" {
+		t.Fatalf("wrong end record: %+v", rec)
+	}
+	if !rec.End.After(rec.Start) {
+		t.Fatalf("wrong time in record: %+v", rec)
+	}
+}
+
+func TestSessionEnd(t *testing.T) {
+	SetLogging()
+	ch := make(chan SessionRecord, 4)
+	l := NewSessionLog(func(rec SessionRecord) { ch <- rec }, 0)
+	defer l.Close()
+
+	for _, c := range []struct {
+		reason SessionEnd
+		end    func(server *TunnelServer)
+	}{
+		{SESSION_CLOSED, func(server *TunnelServer) { server.Close() }},
+		{SESSION_SHUTDOWN, func(server *TunnelServer) { server.Shutdown(context.Background()) }},
+		// client never answers.
+		{SESSION_HEARTBEAT, nil},
+	} {
+		p1, p2 := net.Pipe()
+		server := NewTunnelServer(p2)
+		server.SessionLog = l
+		if c.end == nil {
+			server.PingInterval, server.PingMiss = 20*time.Millisecond, 2
+			go io.Copy(io.Discard, p1)
+		} else {
+			client := NewClient(p1)
+			go client.Loop()
+			defer client.Close()
+		}
+		go server.Loop()
+		if c.end != nil {
+			c.end(server)
+		}
+		if rec := nextSession(t, ch); rec.Reason != c.reason {
+			t.Fatalf("expect %s, got %s", c.reason, rec.Reason)
+		}
+		p1.Close()
+	}
+}
@@ -1,25 +1,241 @@
 package tunnel
 
 import (
+	"context"
+	"errors"
 	"net"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/shell909090/goproxy/netutil"
 )
 
 type TcpProxy struct {
+	// zero means DIAL_TIMEOUT.
+	// keep it less then client's, so client can get ERR_TIMEOUT.
+	Timeout time.Duration
+	// head start of the first family in dialing names with both, zero
+	// means HAPPY_DELAY. negative dials by netutil.DefaultTcpDialer, in
+	// order of system resolver.
+	FallbackDelay time.Duration
+	// set on conns dialed, to targets or upstream proxies.
+	TcpOptions
+}
+
+// TcpOptions are socket options of tcp conns to targets, zero value keeps
+// those of net.
+type TcpOptions struct {
+	// interval of keepalive probes, for links through stateful firewalls.
+	// 0 means default of net, negative disables.
+	KeepAlive time.Duration
+	// turns Nagle's algorithm on, net sets TCP_NODELAY by default.
+	Nagle bool
+	// sizes of socket buffers, 0 means system default.
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+// apply sets options on conn, if it is a tcp one.
+func (o *TcpOptions) apply(conn net.Conn) (err error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	switch {
+	case o.KeepAlive > 0:
+		err = tc.SetKeepAlive(true)
+		if err == nil {
+			err = tc.SetKeepAlivePeriod(o.KeepAlive)
+		}
+	case o.KeepAlive < 0:
+		err = tc.SetKeepAlive(false)
+	}
+	if err == nil && o.Nagle {
+		err = tc.SetNoDelay(false)
+	}
+	if err == nil && o.ReadBuffer > 0 {
+		err = tc.SetReadBuffer(o.ReadBuffer)
+	}
+	if err == nil && o.WriteBuffer > 0 {
+		err = tc.SetWriteBuffer(o.WriteBuffer)
+	}
+	return
 }
 
 func (p *TcpProxy) DialMaybeTimeout(network, address string) (conn net.Conn, err error) {
 	if dialer, ok := netutil.DefaultTcpDialer.(netutil.TimeoutDialer); ok {
-		conn, err = dialer.DialTimeout(
-			network, address, DIAL_TIMEOUT*time.Second)
+		timeout := p.Timeout
+		if timeout == 0 {
+			timeout = DIAL_TIMEOUT * time.Millisecond
+		}
+		conn, err = dialer.DialTimeout(network, address, timeout)
 	} else {
 		conn, err = netutil.DefaultTcpDialer.Dial(network, address)
 	}
 	return
 }
 
+// bindIP returns source ip for dials of c, nil means any.
+func (fab *Fabric) bindIP(c *Conn) (ip net.IP) {
+	if fab.BindFor != nil {
+		ip = fab.BindFor(c)
+	}
+	if ip == nil {
+		ip = fab.Bind
+	}
+	return
+}
+
+// dialFrom dials from ip if not nil, network should be tcp or udp.
+func dialFrom(ip net.IP, network, address string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	switch {
+	case ip == nil:
+	case strings.HasPrefix(network, "udp"):
+		d.LocalAddr = &net.UDPAddr{IP: ip}
+	default:
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	return d.Dial(network, address)
+}
+
+// isBindError tells if dial from a source ip failed for it. the ip is not
+// ours, or target in another family.
+func isBindError(err error) bool {
+	var aerr *net.AddrError
+	if errors.As(err, &aerr) && aerr.Err == "mismatched local address type" {
+		return true
+	}
+	return errors.Is(err, syscall.EADDRNOTAVAIL) ||
+		strings.Contains(err.Error(), "no suitable address")
+}
+
+// dialErrno maps dial error to errno in result, bound tells if dialed
+// from a source ip.
+func dialErrno(err error, bound bool) uint32 {
+	switch err {
+	case ErrDenied:
+		return ERR_DENIED
+	case ErrTooManyStreams:
+		return ERR_TOOMANYSTREAMS
+	}
+	var uerr *UpstreamError
+	if errors.As(err, &uerr) {
+		return uerr.Errno
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return ERR_NXDOMAIN
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return ERR_TIMEOUT
+	}
+	if bound && isBindError(err) {
+		return ERR_BIND
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ERR_REFUSED
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return ERR_UNREACHABLE
+	case errors.Is(err, syscall.ENOENT):
+		return ERR_NOSOCKET
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return ERR_PERMISSION
+	}
+	return ERR_CONNFAILED
+}
+
+// denyDial refuses stream failed in dialing.
+func denyDial(c *Conn, err error, bound bool) {
+	switch err {
+	case ErrDenied:
+		logger.Noticef("%s %s:%s denied.", c.String(), c.Network, c.Address)
+	case ErrTooManyStreams:
+		// logged in limitDest.
+	default:
+		logger.Error(err.Error())
+	}
+	c.DenyWith(dialErrno(err, bound))
+}
+
+// dial connects target of c from ip, names resolved by Resolver of fabric
+// and checked by Guard. Targets routed to upstream go there as asked, from
+// where dialer of it says, names resolved by upstream. They are still
+// resolved here to be checked if Guard or DenyPrivate set, so must be
+// resolvable on server then. Conns counted in DestLimits by the first
+// address, call release after conn closed.
+func (p *TcpProxy) dial(c *Conn, ip net.IP) (conn net.Conn, release func(), err error) {
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = DIAL_TIMEOUT * time.Millisecond
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	release = func() {}
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
+	if d := c.fab.Router.Select(c.Network, c.Address); d != Direct {
+		var address string
+		var v Verdict
+		address, v, err = c.fab.checkTarget(c.Network, c.Address)
+		c.setVerdict(v)
+		if err == nil {
+			release, err = c.fab.limitDest(ctx, c, address)
+		}
+		if err != nil {
+			return
+		}
+		conn, err = d.DialContext(ctx, c.Network, c.Address)
+		return
+	}
+	if p.FallbackDelay < 0 {
+		var address string
+		var v Verdict
+		address, v, err = c.fab.checkTarget(c.Network, c.Address)
+		c.setVerdict(v)
+		if err == nil {
+			release, err = c.fab.limitDest(ctx, c, address)
+		}
+		if err != nil {
+			return
+		}
+		if ip != nil {
+			conn, err = dialFrom(ip, c.Network, address, timeout)
+		} else {
+			conn, err = p.DialMaybeTimeout(c.Network, address)
+		}
+		return
+	}
+
+	addrs, v, err := c.fab.resolveTarget(ctx, c.Network, c.Address)
+	c.setVerdict(v)
+	if err == nil {
+		release, err = c.fab.limitDest(ctx, c, addrs[0])
+	}
+	if err != nil {
+		return
+	}
+	d := &net.Dialer{}
+	if ip != nil {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	delay := p.FallbackDelay
+	if delay == 0 {
+		delay = HAPPY_DELAY * time.Millisecond
+	}
+	conn, err = dialHappy(ctx, d.DialContext, c.Network, addrs, delay)
+	return
+}
+
 func (p *TcpProxy) Handle(fabconn net.Conn) (err error) {
 	var conn net.Conn
 	c, ok := fabconn.(*Conn)
@@ -30,20 +246,119 @@ func (p *TcpProxy) Handle(fabconn net.Conn) (err error) {
 	logger.Debugf("%s try to connect %s:%s.",
 		c.String(), c.Network, c.Address)
 
-	conn, err = p.DialMaybeTimeout(c.Network, c.Address)
+	ip := c.fab.bindIP(c)
+	conn, release, err := p.dial(c, ip)
 	if err != nil {
-		logger.Error(err.Error())
-		c.Deny()
+		denyDial(c, err, ip != nil)
+		return
+	}
+	c.setDialed(conn)
+	err = p.apply(conn)
+	if err != nil {
+		logger.Warningf("%s set options: %s", c.String(), err.Error())
+	}
+	// client spoke first, target gets it before client knows connected.
+	err = c.writeEarly(conn)
+	if err != nil {
+		conn.Close()
+		release()
+		denyDial(c, err, false)
 		return
 	}
 
 	err = c.Accept()
 	if err != nil {
+		// stream reset while dialing.
+		conn.Close()
+		release()
 		return
 	}
 
-	go netutil.CopyLink(conn, c)
-	logger.Noticef("%s connected to %s:%s.",
+	// fin from client only ends writing, target may reply after eof.
+	go func() {
+		netutil.CopyHalf(conn, c)
+		release()
+	}()
+	logger.Noticef("%s connected to %s:%s at %s from %s.",
+		c.String(), c.Network, c.Address, conn.RemoteAddr(), conn.LocalAddr())
+	return
+}
+
+type UdpProxy struct {
+	// both side idle longer than it, stream closed. zero means
+	// UDP_IDLE_TIMEOUT.
+	IdleTimeout time.Duration
+}
+
+func (p *UdpProxy) Handle(fabconn net.Conn) (err error) {
+	c, ok := fabconn.(*Conn)
+	if !ok {
+		panic("proxy with no fab conn.")
+	}
+
+	logger.Debugf("%s try to connect %s:%s.",
 		c.String(), c.Network, c.Address)
+
+	ip := c.fab.bindIP(c)
+	address, v, err := c.fab.checkTarget(c.Network, c.Address)
+	c.setVerdict(v)
+	if err != nil {
+		denyDial(c, err, ip != nil)
+		return
+	}
+
+	conn, err := dialFrom(ip, c.Network, address, DIAL_TIMEOUT*time.Millisecond)
+	if err != nil {
+		denyDial(c, err, ip != nil)
+		return
+	}
+	c.setDialed(conn)
+
+	err = c.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	go p.relay(conn, NewDgramConn(c))
+	logger.Noticef("%s connected to %s:%s at %s from %s.",
+		c.String(), c.Network, c.Address, conn.RemoteAddr(), conn.LocalAddr())
 	return
 }
+
+// relay copies datagrams both way, until one side broken or idle timeout.
+// there is no fin on udp, so idle is the only way to end it from outside.
+func (p *UdpProxy) relay(conn net.Conn, d *DgramConn) {
+	timeout := p.IdleTimeout
+	if timeout == 0 {
+		timeout = UDP_IDLE_TIMEOUT * time.Millisecond
+	}
+	var once sync.Once
+	done := func() {
+		conn.Close()
+		d.Close()
+	}
+	t_idle := time.AfterFunc(timeout, func() {
+		logger.Infof("%s udp idle timeout.", d.Conn.(*Conn).String())
+		once.Do(done)
+	})
+	defer t_idle.Stop()
+
+	copyMsg := func(dst, src net.Conn) {
+		defer once.Do(done)
+		buf := make([]byte, MAX_DGRAM)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				return
+			}
+			t_idle.Reset(timeout)
+			_, err = dst.Write(buf[:n])
+			if err != nil {
+				return
+			}
+		}
+	}
+	go copyMsg(d, conn)
+	copyMsg(conn, d)
+}
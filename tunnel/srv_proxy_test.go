@@ -0,0 +1,286 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func tcpSink(t *testing.T) (addr string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// outbound returns OutboundAddr of stream to address in fab.
+func outbound(fab *Fabric, address string) net.Addr {
+	for _, c := range fab.GetConnections() {
+		if c.Address == address {
+			return c.OutboundAddr()
+		}
+	}
+	return nil
+}
+
+func TestBind(t *testing.T) {
+	addr := tcpSink(t)
+	cli, srv := newConnPair(t)
+	client := &Client{Fabric: cli.fab}
+
+	srv.fab.Bind = net.ParseIP("127.0.0.2")
+	conn, err := client.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	from, ok := outbound(srv.fab, addr).(*net.TCPAddr)
+	if !ok || !from.IP.Equal(srv.fab.Bind) {
+		t.Fatalf("expect dialed from %s, got %v", srv.fab.Bind, from)
+	}
+
+	// not ours, or not the family of target.
+	for _, ip := range []string{"192.0.2.1", "::1"} {
+		srv.fab.BindFor = func(c *Conn) net.IP {
+			return net.ParseIP(ip)
+		}
+		_, err = client.Dial("tcp", addr)
+		if !errors.Is(err, ErrBind) {
+			t.Fatalf("bind %s: expect bind error, got %v", ip, err)
+		}
+	}
+
+	// nil from BindFor falls back to Bind.
+	srv.fab.BindFor = func(c *Conn) net.IP { return nil }
+	conn, err = client.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+}
+
+func TestDialErrno(t *testing.T) {
+	opErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	for _, c := range []struct {
+		err   error
+		bound bool
+		errno uint32
+	}{
+		{ErrDenied, false, ERR_DENIED},
+		{&net.DNSError{Err: "no such host", Name: "x.test", IsNotFound: true}, false, ERR_NXDOMAIN},
+		{&net.DNSError{Err: "i/o timeout", Name: "x.test", IsTimeout: true}, false, ERR_TIMEOUT},
+		{&net.DNSError{Err: "server misbehaving", Name: "x.test"}, false, ERR_CONNFAILED},
+		{context.DeadlineExceeded, false, ERR_TIMEOUT},
+		{opErr(syscall.ETIMEDOUT), false, ERR_TIMEOUT},
+		{opErr(syscall.ECONNREFUSED), false, ERR_REFUSED},
+		{opErr(syscall.ENETUNREACH), false, ERR_UNREACHABLE},
+		{opErr(syscall.EHOSTUNREACH), false, ERR_UNREACHABLE},
+		{opErr(syscall.EADDRNOTAVAIL), true, ERR_BIND},
+		{opErr(syscall.EADDRNOTAVAIL), false, ERR_CONNFAILED},
+		{errors.New("something else"), false, ERR_CONNFAILED},
+	} {
+		if errno := dialErrno(c.err, c.bound); errno != c.errno {
+			t.Errorf("%v: expect %s, got %s", c.err, ErrnoText[c.errno], ErrnoText[errno])
+		}
+	}
+
+	for errno, expect := range map[uint32]error{
+		ERR_CONNFAILED:  ErrDialFailed,
+		ERR_NXDOMAIN:    ErrNxDomain,
+		ERR_REFUSED:     ErrDialRefused,
+		ERR_UNREACHABLE: ErrUnreachable,
+		ERR_TIMEOUT:     ErrDialTimeout,
+	} {
+		if err := errnoErr(errno); err != expect {
+			t.Errorf("errno %d: expect %v, got %v", errno, expect, err)
+		}
+	}
+}
+
+type nxResolver struct{}
+
+func (nxResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestDialResult(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+
+	cli, srv := newConnPair(t)
+	srv.fab.Resolver = nxResolver{}
+	client := &Client{Fabric: cli.fab}
+
+	_, err = client.Dial("tcp", closed)
+	if !errors.Is(err, ErrDialRefused) {
+		t.Fatalf("expect refused, got %v", err)
+	}
+	_, err = client.Dial("tcp", "nosuch.test:80")
+	if !errors.Is(err, ErrNxDomain) {
+		t.Fatalf("expect nxdomain, got %v", err)
+	}
+}
+
+func TestResultAddrs(t *testing.T) {
+	addr := tcpSink(t)
+	SetLogging()
+	for _, caps := range []uint32{CAP_ADDRS, 0} {
+		c1, c2, stop, err := makePipeCaps(caps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stop()
+		cli, srv := c1.(*Conn), c2.(*Conn)
+		conn, err := cli.fab.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		remote, local := conn.RemoteAddr(), conn.(*Conn).OutboundAddr()
+		if caps == 0 {
+			// old server tells errno only.
+			if _, ok := remote.(*Addr); !ok || local != nil {
+				t.Fatalf("expect fabric addr, got %v %v", remote, local)
+			}
+			continue
+		}
+		if tcp, ok := remote.(*net.TCPAddr); !ok || tcp.String() != addr {
+			t.Fatalf("expect remote %s, got %v", addr, remote)
+		}
+		if from := outbound(srv.fab, addr); local == nil || from == nil || local.String() != from.String() {
+			t.Fatalf("expect local %v, got %v", from, local)
+		}
+	}
+}
+
+func TestUnmarshalResult(t *testing.T) {
+	for data, expect := range map[string]DialResult{
+		"3": {Errno: ERR_CONNFAILED},
+		"0": {},
+		`{"Errno":0,"Remote":"[::1]:80","Local":"[::1]:1234"}`: {Remote: "[::1]:80", Local: "[::1]:1234"},
+	} {
+		f := &Frame{Data: []byte(data)}
+		r, err := f.unmarshalResult()
+		if err != nil || r != expect {
+			t.Errorf("%s: got %+v, %v", data, r, err)
+		}
+	}
+	if a := parseAddr("udp", "[::1]:53"); a == nil || a.Network() != "udp" || a.String() != "[::1]:53" {
+		t.Fatalf("wrong udp addr: %v", a)
+	}
+	if a := parseAddr("tcp", "localhost:80"); a != nil {
+		t.Fatalf("names should not be parsed: %v", a)
+	}
+}
+
+// eofServer replies size of request only after eof, like legacy protocols.
+func eofServer(t *testing.T) string {
+	return serveTest(t, func(conn net.Conn) {
+		defer conn.Close()
+		n, _ := io.Copy(io.Discard, conn)
+		fmt.Fprintf(conn, "got %d", n)
+	})
+}
+
+func TestTcpProxyHalfClose(t *testing.T) {
+	addr := eofServer(t)
+	cli, _ := newConnPair(t)
+	client := &Client{Fabric: cli.fab}
+
+	conn, err := client.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	if err = conn.(*Conn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply, err := io.ReadAll(conn)
+	if err != nil || string(reply) != "got 5" {
+		t.Fatalf("wrong reply %q: %v", reply, err)
+	}
+}
+
+func sockopt(t *testing.T, conn *net.TCPConn, level, opt int) (v int) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestTcpOptions(t *testing.T) {
+	conn, err := net.Dial("tcp", tcpEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tc := conn.(*net.TCPConn)
+
+	o := &TcpOptions{}
+	if err = o.apply(tc); err != nil {
+		t.Fatal(err)
+	}
+	if sockopt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) == 0 {
+		t.Fatal("nodelay of net not kept")
+	}
+
+	o = &TcpOptions{KeepAlive: time.Second, Nagle: true, ReadBuffer: 1 << 16, WriteBuffer: 1 << 16}
+	if err = o.apply(tc); err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case sockopt(t, tc, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0:
+		t.Fatal("nagle not on")
+	case sockopt(t, tc, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) == 0:
+		t.Fatal("keepalive not on")
+	case sockopt(t, tc, syscall.SOL_SOCKET, syscall.SO_RCVBUF) < 1<<16:
+		t.Fatal("read buffer not set")
+	case sockopt(t, tc, syscall.SOL_SOCKET, syscall.SO_SNDBUF) < 1<<16:
+		t.Fatal("write buffer not set")
+	}
+
+	o = &TcpOptions{KeepAlive: -1}
+	o.apply(tc)
+	if sockopt(t, tc, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0 {
+		t.Fatal("keepalive not off")
+	}
+	// not tcp, nothing to do.
+	p1, p2 := net.Pipe()
+	defer p2.Close()
+	if err = o.apply(p1); err != nil {
+		t.Fatal(err)
+	}
+}
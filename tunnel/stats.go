@@ -0,0 +1,116 @@
+package tunnel
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// trafficCounter counts frames of one direction, by atomic.
+type trafficCounter struct {
+	bytes  uint64
+	frames [MSG_LAST + 1]uint64
+	last   int64
+}
+
+func (tc *trafficCounter) count(f *Frame, checksum bool) {
+	n := HEADER_SIZE + len(f.Data)
+	if checksum {
+		n += 4
+	}
+	atomic.AddUint64(&tc.bytes, uint64(n))
+	tp := f.Header.Type
+	if !knownType(tp) {
+		tp = MSG_UNKNOWN
+	}
+	atomic.AddUint64(&tc.frames[tp], 1)
+	atomic.StoreInt64(&tc.last, time.Now().UnixNano())
+}
+
+func (tc *trafficCounter) load() (bytes uint64, frames [MSG_LAST + 1]uint64, last time.Time) {
+	bytes = atomic.LoadUint64(&tc.bytes)
+	for i := range frames {
+		frames[i] = atomic.LoadUint64(&tc.frames[i])
+	}
+	if ns := atomic.LoadInt64(&tc.last); ns != 0 {
+		last = time.Unix(0, ns)
+	}
+	return
+}
+
+// FabricStats is a snapshot of fabric, safe to copy.
+type FabricStats struct {
+	// streams opened by us and peer, and the limits of them.
+	Streams     int
+	PeerStreams int
+	MaxStreams  int
+	// MaxStreams in settings from peer, 0 means no limit.
+	PeerMaxStreams int
+	// most streams alive at the same time, both side.
+	PeakStreams int
+
+	// bytes on the wire, headers included.
+	BytesIn  uint64
+	BytesOut uint64
+	// indexed by type, types unknown counted in MSG_UNKNOWN.
+	FramesIn  [MSG_LAST + 1]uint64
+	FramesOut [MSG_LAST + 1]uint64
+	// zero if nothing yet.
+	LastRecv time.Time
+	LastSend time.Time
+	// tokens left in rate limits, negative means in debt.
+	// 0 if no limit.
+	SendTokens int64
+	RecvTokens int64
+	// syn for streams already exist.
+	DupSyns uint64
+	// streams from peer in handler before result, and waiting for it.
+	Dialing    int
+	DialQueued int
+	// keys of encrypted fabric renewed.
+	Rekeys uint64
+}
+
+// Sub returns counters increased since old, for rates. Streams and limits
+// are kept as in st.
+func (st FabricStats) Sub(old FabricStats) (d FabricStats) {
+	d = st
+	d.BytesIn -= old.BytesIn
+	d.BytesOut -= old.BytesOut
+	d.DupSyns -= old.DupSyns
+	d.Rekeys -= old.Rekeys
+	for i := range d.FramesIn {
+		d.FramesIn[i] -= old.FramesIn[i]
+		d.FramesOut[i] -= old.FramesOut[i]
+	}
+	return
+}
+
+func (fab *Fabric) Stats() (st FabricStats) {
+	fab.plock.RLock()
+	st = FabricStats{
+		Streams:        fab.halves[fab.next_id%2],
+		PeerStreams:    fab.halves[1-fab.next_id%2],
+		MaxStreams:     fab.MaxStreams,
+		PeerMaxStreams: fab.peer_streams,
+		PeakStreams:    fab.peak,
+	}
+	fab.plock.RUnlock()
+
+	st.BytesIn, st.FramesIn, st.LastRecv = fab.traffic_in.load()
+	st.BytesOut, st.FramesOut, st.LastSend = fab.traffic_out.load()
+	st.SendTokens = fab.send_rate.fill()
+	st.RecvTokens = fab.recv_rate.fill()
+	st.DupSyns = atomic.LoadUint64(&fab.dup_syns)
+	st.Rekeys = atomic.LoadUint64(&fab.rekeys)
+	fab.dlock.Lock()
+	st.Dialing, st.DialQueued = fab.dialing, len(fab.dial_queue)
+	fab.dlock.Unlock()
+	return
+}
+
+// updatePeak records peak of streams. call with plock held.
+func (fab *Fabric) updatePeak() {
+	if n := len(fab.weaves); n > fab.peak {
+		fab.peak = n
+	}
+}
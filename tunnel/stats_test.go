@@ -0,0 +1,37 @@
+package tunnel
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	cli, srv := newConnPair(t)
+	before := cli.fab.Stats()
+	if before.PeakStreams != 1 || before.Streams != 1 || before.LastSend.IsZero() {
+		t.Fatalf("wrong stats: %+v", before)
+	}
+
+	data := make([]byte, 3000)
+	go cli.Write(data)
+	_, err := io.ReadFull(srv, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// window renew may still on the way.
+	time.Sleep(50 * time.Millisecond)
+	out := cli.fab.Stats().Sub(before)
+	in := srv.fab.Stats()
+	if out.FramesOut[MSG_DATA] == 0 ||
+		out.BytesOut < uint64(len(data)+HEADER_SIZE*int(out.FramesOut[MSG_DATA])) {
+		t.Fatalf("data not counted: %+v", out)
+	}
+	if in.FramesIn[MSG_DATA] != out.FramesOut[MSG_DATA] || in.PeerStreams != 1 {
+		t.Fatalf("recved not match sent: %+v", in)
+	}
+	if out.FramesIn[MSG_WND] == 0 || out.Streams != 1 {
+		t.Fatalf("window renew not counted: %+v", out)
+	}
+}
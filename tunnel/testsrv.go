@@ -31,19 +31,26 @@ func (m *MockServer) AuthPass(username, password string) bool {
 }
 
 func (m *MockServer) Handle(conn net.Conn) (err error) {
-	err = AuthConn(m, conn)
+	info, err := AuthConnInfo(m, conn)
 	if err != nil {
 		logger.Error(err.Error())
 		return
 	}
 
-	tun := NewTunnelServer(conn)
+	tun := NewTunnelServer(info.Conn)
+	tun.SetCaps(info.Caps)
 	tun.Loop()
 	logger.Warning("server loop quit")
 	return
 }
 
+var logOnce sync.Once
+
 func SetLogging() {
+	logOnce.Do(setLogging)
+}
+
+func setLogging() {
 	logBackend := logging.NewLogBackend(os.Stderr, "",
 		stdlog.Ltime|stdlog.Lmicroseconds|stdlog.Lshortfile)
 	logging.SetBackend(logBackend)
@@ -0,0 +1,176 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// CertAuthenticator passes users by tls state, client certs for example.
+// ok false goes on checking password or proof as usual.
+type CertAuthenticator interface {
+	AuthCert(state *tls.ConnectionState, username string) (info UserInfo, ok bool)
+}
+
+// CertIdentity is the first uri in san of cert, or cn if no uri.
+func CertIdentity(cert *x509.Certificate) string {
+	if len(cert.URIs) != 0 {
+		return cert.URIs[0].String()
+	}
+	return cert.Subject.CommonName
+}
+
+// CertUser passes user as identity of leaf cert of peer, by identity or
+// CertIdentity if nil. Username claimed by client ignored. Certs must be
+// verified by tls.Config, by ClientCAs or CertPins.
+func CertUser(state *tls.ConnectionState, identity func(*x509.Certificate) string) (info UserInfo, ok bool) {
+	if len(state.PeerCertificates) == 0 {
+		return
+	}
+	if identity == nil {
+		identity = CertIdentity
+	}
+	info.Username = identity(state.PeerCertificates[0])
+	return info, info.Username != ""
+}
+
+// CertFingerprint is sha256 of cert in hex.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// SPKIPin is sha256 of public key info in cert in hex, the same after
+// cert renewed with the same key.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// SPKIPinFile returns SPKIPin of the first cert in pem file of path.
+func SPKIPinFile(path string) (pin string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return "", fmt.Errorf("no cert in %s.", path)
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return
+		}
+		return SPKIPin(cert), nil
+	}
+}
+
+// parsePins takes sha256 in hex, colons and case ignored.
+func parsePins(fingerprints []string) (pins map[string]bool, err error) {
+	pins = make(map[string]bool, len(fingerprints))
+	for _, fp := range fingerprints {
+		fp = strings.ToLower(strings.ReplaceAll(fp, ":", ""))
+		if b, e := hex.DecodeString(fp); e != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("wrong fingerprint %s.", fp)
+		}
+		pins[fp] = true
+	}
+	return
+}
+
+// PinServer makes client on config accept server only if SPKIPin of its
+// leaf cert in pins, more than one while server rotating keys. Chain
+// verified by RootCAs of config as well if chain, or not at all, so
+// servers self signed can be pinned. Checked on resumed conns too.
+func PinServer(config *tls.Config, chain bool, pins ...string) (err error) {
+	set, err := parsePins(pins)
+	if err != nil {
+		return
+	}
+	config.InsecureSkipVerify = !chain
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("%w: server presented no cert.", ErrCertNotPinned)
+		}
+		if pin := SPKIPin(state.PeerCertificates[0]); !set[pin] {
+			return fmt.Errorf("%w: server presented %s.", ErrCertNotPinned, pin)
+		}
+		return nil
+	}
+	return
+}
+
+// CertPins returns VerifyConnection for tls.Config, passes leaf certs with
+// fingerprints given only, in hex, colons and case ignored. Use it with
+// tls.RequireAnyClientCert to trust no ca. It runs on resumed conns too,
+// where VerifyPeerCertificate not.
+func CertPins(fingerprints ...string) (verify func(tls.ConnectionState) error, err error) {
+	pins, err := parsePins(fingerprints)
+	if err != nil {
+		return
+	}
+	verify = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 || !pins[CertFingerprint(state.PeerCertificates[0])] {
+			return ErrCertNotPinned
+		}
+		return nil
+	}
+	return
+}
+
+// tlsHandshake runs handshake on conn in timeout, errors in it are
+// ErrTLSHandshake, before any frame.
+func tlsHandshake(conn *tls.Conn, timeout time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err = conn.HandshakeContext(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrTLSHandshake, err)
+	}
+	return
+}
+
+// tlsAlert tells if err is alert from tls peer. In tls 1.3, client cert
+// refused by server found in first read after handshake.
+func tlsAlert(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "remote error"
+}
+
+// tlsState returns state of tls conn under conn, through wrappers with
+// NetConn. nil if not on tls.
+func tlsState(conn net.Conn) *tls.ConnectionState {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			state := c.ConnectionState()
+			return &state
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// TLSState returns cipher, peer certs and alpn negotiated on conn of
+// fabric, nil if fabric not on tls.
+func (fab *Fabric) TLSState() *tls.ConnectionState {
+	return tlsState(fab.Conn)
+}
@@ -0,0 +1,370 @@
+package tunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// makeCert issues cert of cn by parent, self signed if parent nil.
+func makeCert(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signKey := tmpl, any(key)
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+	} else {
+		signer, signKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// tlsConfigs returns configs of server asking for client certs, and of
+// client trusting server.
+func tlsConfigs(t *testing.T) (srv, cli *tls.Config) {
+	ca := makeCert(t, "test ca", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	srv = &tls.Config{
+		Certificates: []tls.Certificate{makeCert(t, "localhost", &ca)},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		NextProtos:   []string{"goproxy"},
+	}
+	cli = &tls.Config{
+		Certificates: []tls.Certificate{makeCert(t, "user", &ca)},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS13,
+		NextProtos:   []string{"goproxy"},
+	}
+	return
+}
+
+// certAuth passes users by cn of client cert, knows no password.
+type certAuth struct{}
+
+func (certAuth) Auth(string, string) (UserInfo, error) { return UserInfo{}, ErrAuthFailed }
+
+func (certAuth) AuthCert(state *tls.ConnectionState, username string) (info UserInfo, ok bool) {
+	if len(state.PeerCertificates) == 0 || state.PeerCertificates[0].Subject.CommonName != username {
+		return
+	}
+	return UserInfo{Username: username}, true
+}
+
+// certUsers passes users by identity in client certs only.
+type certUsers struct{}
+
+func (certUsers) Auth(string, string) (UserInfo, error) { return UserInfo{}, ErrAuthFailed }
+
+func (certUsers) AuthCert(state *tls.ConnectionState, username string) (UserInfo, bool) {
+	return CertUser(state, nil)
+}
+
+// tlsServer runs fabrics for conns passed auth, tells them in ch.
+type tlsServer struct {
+	author  Authenticator
+	ch      chan *TunnelServer
+	handled int32
+}
+
+func (ts *tlsServer) Handle(conn net.Conn) (err error) {
+	atomic.AddInt32(&ts.handled, 1)
+	info, err := AuthConnWith(ts.author, conn, 0)
+	if err != nil {
+		return
+	}
+	tun := NewTunnelServer(info.Conn)
+	tun.SetCaps(info.Caps)
+	tun.Username = info.Username
+	ts.ch <- tun
+	tun.Loop()
+	return
+}
+
+func serveTLS(t *testing.T, config *tls.Config, author Authenticator) (addr string, ts *tlsServer) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	ts = &tlsServer{author: author, ch: make(chan *TunnelServer, 1)}
+	server := &Server{Handler: ts, TLSConfig: config}
+	go server.Serve(ln)
+	return ln.Addr().String(), ts
+}
+
+func TestTLSFabric(t *testing.T) {
+	SetLogging()
+	srvcfg, clicfg := tlsConfigs(t)
+	addr, ts := serveTLS(t, srvcfg, certAuth{})
+	_, port, _ := net.SplitHostPort(addr)
+
+	dc := NewDialerCreator(netutil.DefaultTcpDialer, "tcp", net.JoinHostPort("localhost", port), "user", "")
+	dc.TLSConfig = clicfg
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// frames batched on tls as on tcp.
+	client.FlushDelay = time.Millisecond
+	go client.Loop()
+	tun := <-ts.ch
+
+	state := tun.TLSState()
+	if state == nil || state.NegotiatedProtocol != "goproxy" || len(state.PeerCertificates) != 1 ||
+		state.PeerCertificates[0].Subject.CommonName != "user" {
+		t.Fatalf("wrong tls state in server: %+v", state)
+	}
+	state = client.TLSState()
+	if state == nil || state.Version != tls.VersionTLS13 || state.PeerCertificates[0].Subject.CommonName != "localhost" {
+		t.Fatalf("wrong tls state in client: %+v", state)
+	}
+
+	conn, err := client.Dial("tcp", tcpEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	go conn.Write(data)
+	got := make([]byte, len(data))
+	if _, err = io.ReadFull(conn, got); err != nil || string(got) != string(data) {
+		t.Fatalf("wrong echo over tls: %v", err)
+	}
+}
+
+func TestTLSHandshakeError(t *testing.T) {
+	SetLogging()
+	srvcfg, clicfg := tlsConfigs(t)
+	addr, _ := serveTLS(t, srvcfg, certAuth{})
+
+	// server not trusted.
+	other, _ := tlsConfigs(t)
+	dc := NewDialerCreator(netutil.DefaultTcpDialer, "tcp", addr, "user", "")
+	dc.TLSConfig = &tls.Config{RootCAs: other.ClientCAs, ServerName: "localhost"}
+	if _, err := dc.Create(); !errors.Is(err, ErrTLSHandshake) {
+		t.Fatalf("expect handshake failed, got %v", err)
+	}
+
+	// client without cert, refused by server in handshake. tls 1.3 client
+	// finds it in the first read.
+	nocert := clicfg.Clone()
+	nocert.Certificates = nil
+	dc.TLSConfig = nocert
+	if _, err := dc.Create(); !errors.Is(err, ErrTLSHandshake) {
+		t.Fatalf("expect handshake failed, got %v", err)
+	}
+
+	// not tls at all, fails in hello, not as protocol error.
+	dc.TLSConfig = nil
+	if _, err := dc.Create(); err == nil || errors.Is(err, ErrTLSHandshake) {
+		t.Fatalf("expect failed in hello, got %v", err)
+	}
+}
+
+func TestCertIdentity(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}
+	if id := CertIdentity(cert); id != "alice" {
+		t.Fatalf("expect cn, got %s", id)
+	}
+	u, _ := url.Parse("spiffe://example.org/bob")
+	cert.URIs = []*url.URL{u}
+	if id := CertIdentity(cert); id != "spiffe://example.org/bob" {
+		t.Fatalf("expect uri, got %s", id)
+	}
+}
+
+func TestCertUsers(t *testing.T) {
+	SetLogging()
+	srvcfg, clicfg := tlsConfigs(t)
+	addr, ts := serveTLS(t, srvcfg, certUsers{})
+
+	// username claimed not taken, no password needed.
+	dc := NewDialerCreator(netutil.DefaultTcpDialer, "tcp", addr, "mallory", "")
+	dc.TLSConfig = clicfg.Clone()
+	dc.TLSConfig.ServerName = "localhost"
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go client.Loop()
+	if tun := <-ts.ch; tun.Username != "user" {
+		t.Fatalf("expect user by cert, got %s", tun.Username)
+	}
+
+	// no cert no user, password not checked.
+	srvcfg.ClientAuth = tls.RequestClientCert
+	addr, ts = serveTLS(t, srvcfg, certUsers{})
+	dc = NewDialerCreator(netutil.DefaultTcpDialer, "tcp", addr, "user", "secret")
+	dc.TLSConfig = &tls.Config{RootCAs: clicfg.RootCAs, ServerName: "localhost"}
+	if _, err = dc.Create(); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("expect auth failed, got %v", err)
+	}
+}
+
+func TestCertPins(t *testing.T) {
+	SetLogging()
+	srvcfg, clicfg := tlsConfigs(t)
+	pinned := clicfg.Certificates[0].Leaf
+	verify, err := CertPins(strings.ToUpper(CertFingerprint(pinned)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = CertPins("00:11"); err == nil {
+		t.Fatal("expect wrong fingerprint refused")
+	}
+	// no ca trusted, pins only.
+	srvcfg.ClientCAs = nil
+	srvcfg.ClientAuth = tls.RequireAnyClientCert
+	srvcfg.VerifyConnection = verify
+	addr, ts := serveTLS(t, srvcfg, certUsers{})
+
+	// resumed conns checked by pins again.
+	clicfg.ServerName = "localhost"
+	clicfg.ClientSessionCache = tls.NewLRUClientSessionCache(4)
+	dc := NewDialerCreator(netutil.DefaultTcpDialer, "tcp", addr, "", "")
+	dc.TLSConfig = clicfg
+	for i := 0; i < 2; i++ {
+		client, err := dc.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go client.Loop()
+		tun := <-ts.ch
+		if tun.Username != "user" || tun.TLSState().DidResume != (i == 1) {
+			t.Fatalf("wrong conn %d: %s, resumed %v", i, tun.Username, tun.TLSState().DidResume)
+		}
+		client.Close()
+	}
+
+	// cert of the same name, not pinned.
+	other := clicfg.Clone()
+	other.Certificates = []tls.Certificate{makeCert(t, "user", nil)}
+	other.ClientSessionCache = nil
+	dc.TLSConfig = other
+	handled := atomic.LoadInt32(&ts.handled)
+	if _, err = dc.Create(); !errors.Is(err, ErrTLSHandshake) {
+		t.Fatalf("expect handshake failed, got %v", err)
+	}
+	if atomic.LoadInt32(&ts.handled) != handled {
+		t.Fatal("conn not pinned handled")
+	}
+}
+
+func TestPinServer(t *testing.T) {
+	SetLogging()
+	srvcfg, clicfg := tlsConfigs(t)
+	addr, ts := serveTLS(t, srvcfg, certAuth{})
+	// server rotated to a key of its own.
+	rotated := srvcfg.Clone()
+	rotated.Certificates = []tls.Certificate{makeCert(t, "localhost", nil)}
+	addr2, ts2 := serveTLS(t, rotated, certAuth{})
+	pin := SPKIPin(srvcfg.Certificates[0].Leaf)
+	pin2 := SPKIPin(rotated.Certificates[0].Leaf)
+
+	dial := func(addr string, chain bool, pins ...string) error {
+		cfg := clicfg.Clone()
+		cfg.ServerName = "localhost"
+		err := PinServer(cfg, chain, pins...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dc := NewDialerCreator(netutil.DefaultTcpDialer, "tcp", addr, "user", "")
+		dc.TLSConfig = cfg
+		client, err := dc.Create()
+		if err != nil {
+			return err
+		}
+		client.Close()
+		return nil
+	}
+
+	// pinned, chain checked or not.
+	for _, chain := range []bool{true, false} {
+		if err := dial(addr, chain, strings.ToUpper(pin)); err != nil {
+			t.Fatalf("chain %v: %v", chain, err)
+		}
+		<-ts.ch
+	}
+	// self signed, passes by pin only.
+	if err := dial(addr2, false, pin2); err != nil {
+		t.Fatal(err)
+	}
+	<-ts2.ch
+	if err := dial(addr2, true, pin2); !errors.Is(err, ErrTLSHandshake) || errors.Is(err, ErrCertNotPinned) {
+		t.Fatalf("expect chain refused, got %v", err)
+	}
+
+	// trusted by ca, but not pinned.
+	err := dial(addr, true, pin2)
+	if !errors.Is(err, ErrCertNotPinned) || !strings.Contains(err.Error(), pin) {
+		t.Fatalf("expect pin presented in error, got %v", err)
+	}
+
+	// both pinned while rotating.
+	for _, a := range []string{addr, addr2} {
+		if err := dial(a, false, pin, pin2); err != nil {
+			t.Fatalf("%s: %v", a, err)
+		}
+	}
+	<-ts.ch
+	<-ts2.ch
+}
+
+func TestSPKIPinFile(t *testing.T) {
+	_, clicfg := tlsConfigs(t)
+	leaf := clicfg.Certificates[0].Leaf
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PARAMETERS", Bytes: []byte{6, 8}})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})...)
+	err := os.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin, err := SPKIPinFile(path)
+	if err != nil || pin != SPKIPin(leaf) {
+		t.Fatalf("wrong pin %s: %v", pin, err)
+	}
+	os.WriteFile(path, []byte("nothing"), 0600)
+	if _, err = SPKIPinFile(path); err == nil {
+		t.Fatal("expect no cert found")
+	}
+}
@@ -0,0 +1,324 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TokenValidator checks bearer tokens from clients, sent in auth instead
+// of password, and in MSG_RENEW later. Fabric drained after expires if
+// not renewed.
+type TokenValidator interface {
+	ValidateToken(token string) (info UserInfo, expires time.Time, err error)
+}
+
+// Renew carries fresh token to server, and when it expires back in answer
+// of the same Id. Server tells it with Id 0 after auth.
+type Renew struct {
+	Id    uint32
+	Token string `json:",omitempty"`
+	// in unix ms.
+	Expires int64  `json:",omitempty"`
+	Errno   uint32 `json:",omitempty"`
+}
+
+// HMACTokens issues tokens signed by Key in HMAC-SHA256, and validates
+// them. Passwords never pass.
+type HMACTokens struct {
+	Key []byte
+}
+
+func (ht HMACTokens) sign(payload string) string {
+	mac := hmac.New(sha256.New, ht.Key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns token of username till expires, as base64url of username,
+// expires in unix ms, random jti and base64url of mac, joined by dots.
+// Each passes auth once, see ReplayCache.
+func (ht HMACTokens) Issue(username string, expires time.Time) string {
+	jti := make([]byte, TOKEN_JTI_SIZE)
+	rand.Read(jti)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(username)) +
+		"." + strconv.FormatInt(expires.UnixMilli(), 10) +
+		"." + base64.RawURLEncoding.EncodeToString(jti)
+	return payload + "." + ht.sign(payload)
+}
+
+func (ht HMACTokens) ValidateToken(token string) (info UserInfo, expires time.Time, err error) {
+	i := strings.LastIndexByte(token, '.')
+	if len(ht.Key) == 0 || i < 0 ||
+		!hmac.Equal([]byte(token[i+1:]), []byte(ht.sign(token[:i]))) {
+		return info, expires, ErrTokenInvalid
+	}
+	// jti in the rest, none in tokens before it.
+	name, ms, _ := strings.Cut(token[:i], ".")
+	ms, _, _ = strings.Cut(ms, ".")
+	username, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil {
+		return info, expires, ErrTokenInvalid
+	}
+	n, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return info, expires, ErrTokenInvalid
+	}
+	expires = time.UnixMilli(n)
+	if !time.Now().Before(expires) {
+		return info, expires, ErrTokenExpired
+	}
+	return UserInfo{Username: string(username)}, expires, nil
+}
+
+func (ht HMACTokens) Auth(username, password string) (UserInfo, error) {
+	return UserInfo{}, ErrAuthFailed
+}
+
+// checkToken passes user by token in auth, and tells when it expires.
+// Token passed before refused by rc.
+func checkToken(author Authenticator, rc *ReplayCache, auth *Auth, info *AuthInfo) (user UserInfo, err error) {
+	tv, ok := backend(author).(TokenValidator)
+	if !ok {
+		return user, ErrAuthFailed
+	}
+	user, info.Expires, err = tv.ValidateToken(auth.Token)
+	if err != nil {
+		logger.Errorf("user %s token refused: %s", auth.Username, err.Error())
+		return
+	}
+	if !rc.useToken(auth.Token, info.Expires) {
+		rc.replayed(auth.Username)
+		return UserInfo{}, ErrReplayed
+	}
+	return
+}
+
+// SetToken drains fabric after token of peer expires and TokenGrace,
+// unless peer renews it, checked by tv for the same Username. Server calls
+// it after auth by token, before Loop. Peer told when it expires if
+// CAP_TOKEN agreed.
+func (fab *Fabric) SetToken(tv TokenValidator, expires time.Time) {
+	fab.tlock.Lock()
+	fab.tokens = tv
+	fab.tlock.Unlock()
+	fab.setExpiry(expires)
+	if fab.token {
+		// never wait for peer reading, before we read.
+		go func() {
+			err := SendFrame(fab, MSG_RENEW, 0, &Renew{Expires: expires.UnixMilli()})
+			if err != nil {
+				logger.Error(err.Error())
+			}
+		}()
+	}
+}
+
+// TokenExpires tells when token of fabric expires, zero if not by token.
+func (fab *Fabric) TokenExpires() time.Time {
+	fab.tlock.Lock()
+	defer fab.tlock.Unlock()
+	return fab.expires
+}
+
+func (fab *Fabric) tokenGrace() time.Duration {
+	if fab.TokenGrace > 0 {
+		return fab.TokenGrace
+	}
+	return TOKEN_GRACE * time.Millisecond
+}
+
+func (fab *Fabric) setExpiry(expires time.Time) {
+	fab.tlock.Lock()
+	defer fab.tlock.Unlock()
+	if fab.t_closed {
+		return
+	}
+	fab.expires = expires
+	if fab.t_expire != nil {
+		fab.t_expire.Stop()
+	}
+	fab.t_expire = time.AfterFunc(time.Until(expires), func() {
+		fab.onExpired(expires)
+	})
+}
+
+// onExpired waits grace for peer to renew, then drains fabric by Shutdown
+// in grace again. Streams live on till then.
+func (fab *Fabric) onExpired(expires time.Time) {
+	grace := fab.tokenGrace()
+	fab.tlock.Lock()
+	defer fab.tlock.Unlock()
+	if fab.t_closed || !fab.expires.Equal(expires) {
+		return
+	}
+	logger.Warningf("%s token expired, drained in %s if not renewed.", fab.String(), grace)
+	fab.t_expire = time.AfterFunc(grace, func() {
+		fab.tlock.Lock()
+		renewed := fab.t_closed || !fab.expires.Equal(expires)
+		fab.tlock.Unlock()
+		if renewed {
+			return
+		}
+		logger.Warningf("%s token not renewed, drain.", fab.String())
+		fab.endWith(SESSION_EXPIRED)
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		fab.Shutdown(ctx)
+	})
+}
+
+// RenewToken sends fresh token to peer, fabric and streams live on till
+// expires returned. CAP_TOKEN should be agreed.
+func (fab *Fabric) RenewToken(ctx context.Context, token string) (expires time.Time, err error) {
+	if !fab.token {
+		return expires, ErrNoToken
+	}
+	ch := make(chan *Renew, 1)
+	fab.tlock.Lock()
+	if fab.t_closed {
+		fab.tlock.Unlock()
+		return expires, net.ErrClosed
+	}
+	fab.next_renew++
+	id := fab.next_renew
+	fab.renew_waits[id] = ch
+	fab.tlock.Unlock()
+
+	defer func() {
+		fab.tlock.Lock()
+		delete(fab.renew_waits, id)
+		fab.tlock.Unlock()
+	}()
+
+	err = SendFrame(fab, MSG_RENEW, 0, &Renew{Id: id, Token: token})
+	if err != nil {
+		return
+	}
+	var answer *Renew
+	select {
+	case answer = <-ch:
+	case <-ctx.Done():
+		return expires, ctx.Err()
+	}
+	if answer == nil {
+		return expires, net.ErrClosed
+	}
+	if answer.Errno != ERR_NONE {
+		return expires, errnoErr(answer.Errno)
+	}
+	expires = time.UnixMilli(answer.Expires)
+	logger.Noticef("%s token renewed, expires at %s.", fab.String(), expires)
+	fab.scheduleRenew(expires)
+	return
+}
+
+// scheduleRenew renews token by TokenSource after 3/4 of time left, if
+// set.
+func (fab *Fabric) scheduleRenew(expires time.Time) {
+	fab.tlock.Lock()
+	defer fab.tlock.Unlock()
+	fab.expires = expires
+	if fab.TokenSource == nil || fab.t_closed {
+		return
+	}
+	if fab.t_expire != nil {
+		fab.t_expire.Stop()
+	}
+	fab.t_expire = time.AfterFunc(time.Until(expires)*3/4, func() {
+		fab.renew(expires)
+	})
+}
+
+func (fab *Fabric) renew(expires time.Time) {
+	token, err := fab.TokenSource()
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), AUTH_TIMEOUT*time.Millisecond)
+		_, err = fab.RenewToken(ctx, token)
+		cancel()
+	}
+	if err == nil {
+		return
+	}
+	logger.Errorf("%s renew token: %s", fab.String(), err.Error())
+	// try again in time left, server drains us after grace anyway.
+	if time.Until(expires) > time.Second {
+		fab.scheduleRenew(expires)
+	}
+}
+
+func (fab *Fabric) onRenew(f *Frame) {
+	var renew Renew
+	err := f.Unmarshal(&renew)
+	if err != nil {
+		return
+	}
+	if renew.Token == "" {
+		fab.onRenewAnswer(&renew)
+		return
+	}
+
+	answer := &Renew{Id: renew.Id}
+	fab.tlock.Lock()
+	tv := fab.tokens
+	fab.tlock.Unlock()
+	if tv == nil {
+		logger.Warningf("%s renew but not by token, refused.", fab.String())
+		answer.Errno = ERR_DENIED
+	} else {
+		info, expires, err := tv.ValidateToken(renew.Token)
+		if err == nil && info.Username != fab.Username {
+			// identity never changes in a fabric.
+			err = ErrAuthFailed
+		}
+		if err != nil {
+			logger.Errorf("%s renew refused: %s", fab.String(), err.Error())
+			answer.Errno = ERR_AUTH
+		} else {
+			fab.setExpiry(expires)
+			answer.Expires = expires.UnixMilli()
+		}
+	}
+	err = SendFrame(fab, MSG_RENEW, 0, answer)
+	if err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+func (fab *Fabric) onRenewAnswer(renew *Renew) {
+	if renew.Id == 0 {
+		// told by server after auth.
+		fab.scheduleRenew(time.UnixMilli(renew.Expires))
+		return
+	}
+	fab.tlock.Lock()
+	ch, ok := fab.renew_waits[renew.Id]
+	delete(fab.renew_waits, renew.Id)
+	fab.tlock.Unlock()
+	if !ok {
+		logger.Debugf("%s renew answer for %d dropped.", fab.String(), renew.Id)
+		return
+	}
+	ch <- renew
+}
+
+// closeTokens stops timers, and wakes up renews waiting, after fabric
+// closed.
+func (fab *Fabric) closeTokens() {
+	fab.tlock.Lock()
+	defer fab.tlock.Unlock()
+	fab.t_closed = true
+	if fab.t_expire != nil {
+		fab.t_expire.Stop()
+	}
+	for id, ch := range fab.renew_waits {
+		close(ch)
+		delete(fab.renew_waits, id)
+	}
+}
@@ -0,0 +1,226 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tokenServer runs fabrics for pipes passed auth by tokens, tells them in
+// ch.
+type tokenServer struct {
+	tokens HMACTokens
+	grace  time.Duration
+	ch     chan *TunnelServer
+}
+
+func newTokenServer() *tokenServer {
+	return &tokenServer{
+		tokens: HMACTokens{Key: []byte("secret")},
+		ch:     make(chan *TunnelServer, 1),
+	}
+}
+
+func (ts *tokenServer) Dial(network, address string) (net.Conn, error) {
+	p1, p2 := net.Pipe()
+	go func() {
+		info, err := AuthConnWith(ts.tokens, p2, 0)
+		if err != nil {
+			p2.Close()
+			return
+		}
+		tun := NewTunnelServer(info.Conn)
+		tun.SetCaps(info.Caps)
+		tun.Username = info.Username
+		tun.TokenGrace = ts.grace
+		tun.SetToken(ts.tokens, info.Expires)
+		ts.ch <- tun
+		tun.Loop()
+	}()
+	return p1, nil
+}
+
+// source issues tokens of username for d, counts them in n.
+func (ts *tokenServer) source(username string, d time.Duration, n *int32) func() (string, error) {
+	return func() (string, error) {
+		atomic.AddInt32(n, 1)
+		return ts.tokens.Issue(username, time.Now().Add(d)), nil
+	}
+}
+
+func pingConn(conn net.Conn) error {
+	buf := make([]byte, 4)
+	_, err := conn.Write([]byte("ping"))
+	if err == nil {
+		_, err = io.ReadFull(conn, buf)
+	}
+	return err
+}
+
+func TestHMACTokens(t *testing.T) {
+	ht := HMACTokens{Key: []byte("secret")}
+	expires := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	token := ht.Issue("alice.b", expires)
+	info, got, err := ht.ValidateToken(token)
+	if err != nil || info.Username != "alice.b" || !got.Equal(expires) {
+		t.Fatalf("wrong token: %+v, %s, %v", info, got, err)
+	}
+
+	for _, token := range []string{
+		token[:len(token)-1], token + "a", "", "...",
+		HMACTokens{Key: []byte("other")}.Issue("alice", expires),
+	} {
+		if _, _, err = ht.ValidateToken(token); !errors.Is(err, ErrTokenInvalid) {
+			t.Fatalf("%q: expect invalid, got %v", token, err)
+		}
+	}
+	if _, _, err = (HMACTokens{}).ValidateToken(HMACTokens{}.Issue("alice", expires)); !errors.Is(err, ErrTokenInvalid) {
+		t.Fatalf("expect invalid without key, got %v", err)
+	}
+	if _, _, err = ht.ValidateToken(ht.Issue("alice", time.Now())); !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("expect expired, got %v", err)
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	SetLogging()
+	ts := newTokenServer()
+	var n int32
+	// username claimed not taken.
+	dc := NewDialerCreator(ts, "pipe", "pipe", "mallory", "")
+	dc.Token = ts.source("bob", time.Minute, &n)
+	if _, err := dc.Create(); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("expect token not sent in plaintext, got %v", err)
+	}
+	if n != 0 {
+		t.Fatal("token fetched for plaintext")
+	}
+
+	dc.Plaintext = true
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go client.Loop()
+	tun := <-ts.ch
+	if tun.Username != "bob" {
+		t.Fatalf("expect user by token, got %s", tun.Username)
+	}
+	// told by server after auth.
+	for i := 0; client.TokenExpires().IsZero(); i++ {
+		if i > 100 {
+			t.Fatal("expiry not told")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !client.TokenExpires().Equal(tun.TokenExpires()) {
+		t.Fatalf("wrong expiry: %s, server %s", client.TokenExpires(), tun.TokenExpires())
+	}
+
+	// identity can't be changed in renew.
+	ctx := context.Background()
+	if _, err = client.RenewToken(ctx, ts.tokens.Issue("alice", time.Now().Add(time.Minute))); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("expect renew of other user refused, got %v", err)
+	}
+	if _, err = client.RenewToken(ctx, "bad"); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("expect bad token refused, got %v", err)
+	}
+
+	dc.Token = func() (string, error) { return ts.tokens.Issue("bob", time.Now()), nil }
+	if _, err = dc.Create(); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("expect expired token refused, got %v", err)
+	}
+}
+
+func TestTokenRenew(t *testing.T) {
+	SetLogging()
+	ts := newTokenServer()
+	ts.grace = 50 * time.Millisecond
+	var n int32
+	dc := NewDialerCreator(ts, "pipe", "pipe", "", "")
+	dc.Plaintext = true
+	dc.Token = ts.source("bob", 200*time.Millisecond, &n)
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go client.Loop()
+	tun := <-ts.ch
+	first := tun.TokenExpires()
+
+	conn, err := client.Dial("tcp", tcpEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// renewed several times, stream and fabric never touched.
+	for i := 0; i < 10; i++ {
+		time.Sleep(60 * time.Millisecond)
+		if err = pingConn(conn); err != nil {
+			t.Fatalf("stream broken in renew: %v", err)
+		}
+	}
+	if atomic.LoadInt32(&n) < 3 || client.GoingAway() || !tun.TokenExpires().After(first) {
+		t.Fatalf("not renewed: %d tokens, expires %s", atomic.LoadInt32(&n), tun.TokenExpires())
+	}
+}
+
+func TestTokenExpired(t *testing.T) {
+	SetLogging()
+	ts := newTokenServer()
+	ts.grace = 300 * time.Millisecond
+	var issued int32
+	dc := NewDialerCreator(ts, "pipe", "pipe", "", "")
+	dc.Plaintext = true
+	// no token to renew after the first.
+	dc.Token = func() (string, error) {
+		if !atomic.CompareAndSwapInt32(&issued, 0, 1) {
+			return "", errors.New("no token")
+		}
+		return ts.tokens.Issue("bob", time.Now().Add(300*time.Millisecond)), nil
+	}
+	client, err := dc.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go client.Loop()
+	<-ts.ch
+	start := time.Now()
+
+	conn, err := client.Dial("tcp", tcpEcho(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// expired, in grace.
+	time.Sleep(time.Until(start.Add(450 * time.Millisecond)))
+	if err = pingConn(conn); err != nil || client.GoingAway() {
+		t.Fatalf("fabric should live in grace: %v", err)
+	}
+
+	// draining, streams live on, no new stream.
+	time.Sleep(time.Until(start.Add(750 * time.Millisecond)))
+	if !client.GoingAway() {
+		t.Fatal("fabric should be draining")
+	}
+	if err = pingConn(conn); err != nil {
+		t.Fatalf("stream should live in drain: %v", err)
+	}
+	if _, err = client.Dial("tcp", tcpEcho(t)); !errors.Is(err, ErrGoaway) {
+		t.Fatalf("expect goaway, got %v", err)
+	}
+
+	// drained.
+	time.Sleep(time.Until(start.Add(1200 * time.Millisecond)))
+	if err = pingConn(conn); err == nil {
+		t.Fatal("stream should be closed after drain")
+	}
+}
@@ -2,6 +2,9 @@ package tunnel
 
 import (
 	"errors"
+	"fmt"
+	"net"
+	"os"
 
 	logging "github.com/op/go-logging"
 )
@@ -11,7 +14,65 @@ const (
 	DIAL_TIMEOUT  = 20000
 	WRITE_TIMEOUT = 10000
 	CLOSE_TIMEOUT = 30000
-	WINDOWSIZE    = 4 * 1024 * 1024
+	WINDOW_DELAY  = 10
+	PING_MISS     = 3
+	ID_QUARANTINE = 5000
+	// unknown frames logged once in it.
+	UNKNOWN_LOG_INTERVAL = 60000
+	// udp streams without datagram either way are closed.
+	UDP_IDLE_TIMEOUT = 60000
+	// head start of the first family in dialing, RFC 6555 says 300ms.
+	HAPPY_DELAY = 300
+	// ttl in dns answers, in seconds. net.Resolver tells none.
+	DNS_TTL = 60
+	// dns queries from peer resolving at the same time.
+	DNS_MAX_PENDING = 64
+	// names in DnsCache, least used evicted.
+	DNS_CACHE_SIZE = 4096
+	// names not found cached for it.
+	DNS_NEGATIVE_TTL = 5000
+	// destinations without conns forgotten by DestLimits.
+	DEST_IDLE = 60000
+	// random bytes in challenge, from both side.
+	AUTH_NONCE_SIZE = 32
+	// iterations of DeriveKey.
+	AUTH_KDF_ROUNDS = 4096
+	// nonce of challenge passes auth in it, once. time of client in proof
+	// off ours by AUTH_SKEW at most. REPLAY_MAX tokens remembered at most.
+	AUTH_NONCE_TTL = 10000
+	AUTH_SKEW      = 30000
+	REPLAY_MAX     = 65536
+	// bcrypt cost of HashPassword.
+	AUTH_HASH_COST = 10
+	// fabric with token expired drained after it, peer can still renew.
+	TOKEN_GRACE = 30000
+	// random bytes in jti of HMACTokens.
+	TOKEN_JTI_SIZE = 12
+	// encrypted fabric rekeyed after so many bytes written, or ms passed,
+	// under the same keys.
+	REKEY_BYTES    = 1 << 30
+	REKEY_INTERVAL = 3600000
+	// auth failures answered after delay, doubled each time up to max.
+	// sources banned for LOCKOUT_BAN, failures forgotten after
+	// LOCKOUT_FORGET. at most LOCKOUT_MAX_SOURCES tracked.
+	LOCKOUT_DELAY       = 100
+	LOCKOUT_MAX_DELAY   = 5000
+	LOCKOUT_BAN         = 600000
+	LOCKOUT_FORGET      = 600000
+	LOCKOUT_MAX_SOURCES = 65536
+	// usage of quotas added to store in it.
+	QUOTA_FLUSH = 10000
+	// requests to fallback of server read in it, conns idle for it closed.
+	FALLBACK_TIMEOUT = 30000
+	// access records waiting for logger, more are dropped.
+	ACCESS_LOG_QUEUE = 1024
+	// type, flags, length and streamid.
+	HEADER_SIZE = 6
+	// Length in header is uint16.
+	MAX_FRAME_SIZE = 1<<16 - 1
+	WINDOWSIZE     = 4 * 1024 * 1024
+	// window renew make it larger will be treated as protocol error.
+	MAX_WINDOW = 1 << 30
 	// WINDOWSIZE = 100
 )
 
@@ -24,6 +85,94 @@ const (
 	MSG_WND
 	MSG_FIN
 	MSG_RST
+	MSG_PING
+	MSG_PONG
+	MSG_GOAWAY
+	MSG_HELLO
+	MSG_SETTINGS
+	MSG_PADDING
+	MSG_DNS
+	MSG_DNSANSWER
+	MSG_BIND
+	MSG_BINDANSWER
+	MSG_RENEW
+	MSG_REKEY
+	// last type known in this version.
+	MSG_LAST = MSG_REKEY
+)
+
+// version in hello. peer in newer version should talk in ours,
+// peer older than MIN_VERSION can't be talked to.
+const (
+	PROTO_VERSION = 2
+	MIN_VERSION   = 2
+)
+
+// capabilities asked in hello, only those both side agreed will be used.
+const (
+	// every frame followed by crc32c of header and data.
+	CAP_CHECKSUM = 1 << iota
+	// data frames may be compressed by deflate.
+	CAP_COMPRESS
+	// all after hello encrypted, with keys from Key in hello and psk.
+	CAP_ENCRYPT
+	// data frames may be padded, cover frames may be sent.
+	CAP_PADDING
+	// hosts may be resolved by peer, in MSG_DNS.
+	CAP_DNS
+	// peer may listen for us, in MSG_BIND.
+	CAP_BIND
+	// results of streams accepted carry addresses dialed.
+	CAP_ADDRS
+	// syn may carry the first bytes of stream, in Data.
+	CAP_EARLY
+	// client proves it knows key of user on Nonce in hello of server,
+	// instead of password in auth.
+	CAP_CHALLENGE
+	// client auths by token, renews it in MSG_RENEW before expired.
+	CAP_TOKEN
+	// proof of challenge binds Time of client in auth too.
+	CAP_TIMESTAMP
+	// encrypted fabric gets new keys in MSG_REKEY from time to time.
+	CAP_REKEY
+)
+
+// flags in header.
+const (
+	// payload of data frame compressed, window counts it uncompressed.
+	FLAG_COMPRESSED = 1 << iota
+	// payload of data frame starts with length of padding in uint16,
+	// padding at the end. stripped before decompressed.
+	FLAG_PADDED
+)
+
+const (
+	// data smaller than it never compressed.
+	COMPRESS_MIN = 256
+	// frames sent as is after one not compressible.
+	COMPRESS_SKIP = 16
+	// streams accepted but not taken by listener.
+	LISTEN_BACKLOG = 64
+	// accept of listener bound for peer retried after temporary errors,
+	// delay doubled from min to max, in ms.
+	BIND_RETRY_MIN = 5
+	BIND_RETRY_MAX = 1000
+	// early data in syn, counted in window like data frames.
+	EARLY_DATA_MAX = 8 * 1024
+	// largest datagram in DgramConn.
+	MAX_DGRAM = 65535
+	// limits of udp associate, in one stream and one relay.
+	ASSOC_MAX_TARGETS = 64
+	ASSOC_MAX_SOURCES = 16
+	// network in syn of udp associate streams.
+	ASSOC_NETWORK = "udp-associate"
+	// user guests run as, and limits of them if that user has none. rate
+	// in bytes per second both ways, of each fabric.
+	GUEST_USER        = "anonymous"
+	GUEST_MAX_STREAMS = 8
+	GUEST_MAX_FABRICS = 64
+	GUEST_RATE        = 65536
+	GUEST_PORTS       = "80,443"
 )
 
 const (
@@ -35,6 +184,16 @@ const (
 	ST_FIN_SENT = 0x06
 )
 
+type State uint8
+
+func (st State) String() string {
+	s, ok := StatusText[uint8(st)]
+	if !ok {
+		return "UNKNOWN"
+	}
+	return s
+}
+
 var StatusText = map[uint8]string{
 	ST_UNKNOWN:  "UNKNOWN",
 	ST_SYN_RECV: "SYN_RECV",
@@ -52,6 +211,31 @@ const (
 	ERR_TIMEOUT
 	ERR_CLOSED
 	ERR_UNKNOWN_PROTOCOL
+	ERR_GOAWAY
+	ERR_TOOMANYSTREAMS
+	// reasons in rst, ERR_NONE there means unspecified.
+	ERR_PROTOCOL
+	ERR_ABORT
+	ERR_IDLE
+	ERR_OVERFLOW
+	ERR_DENIED
+	// result for syn over MaxDialing and backlog.
+	ERR_DIALBUSY
+	// source ip of server can't be used for target.
+	ERR_BIND
+	// results of dial in server, ERR_CONNFAILED for the others.
+	ERR_NXDOMAIN
+	ERR_REFUSED
+	ERR_UNREACHABLE
+	// answer for bind over MaxBinds.
+	ERR_TOOMANYBINDS
+	// results of unix socket dial, no socket at path or not permitted.
+	ERR_NOSOCKET
+	ERR_PERMISSION
+	// result of auth, user holds MaxFabrics already.
+	ERR_TOOMANYFABRICS
+	// result of syn and reason of rst, user over quota of data.
+	ERR_QUOTA
 )
 
 var ErrnoText = map[uint32]string{
@@ -61,6 +245,25 @@ var ErrnoText = map[uint32]string{
 	ERR_CONNFAILED: "connected failed",
 	ERR_TIMEOUT:    "timeout",
 	ERR_CLOSED:     "connect closed",
+
+	ERR_UNKNOWN_PROTOCOL: "unknown protocol",
+	ERR_GOAWAY:           "fabric going away",
+	ERR_TOOMANYSTREAMS:   "too many streams",
+	ERR_PROTOCOL:         "protocol error",
+	ERR_ABORT:            "aborted",
+	ERR_IDLE:             "idle timeout",
+	ERR_OVERFLOW:         "read queue overflow",
+	ERR_DENIED:           "denied",
+	ERR_DIALBUSY:         "too many dialing",
+	ERR_BIND:             "bind address invalid",
+	ERR_NXDOMAIN:         "no such host",
+	ERR_REFUSED:          "connection refused",
+	ERR_UNREACHABLE:      "network unreachable",
+	ERR_TOOMANYBINDS:     "too many binds",
+	ERR_NOSOCKET:         "no such socket",
+	ERR_PERMISSION:       "permission denied",
+	ERR_TOOMANYFABRICS:   "too many fabrics",
+	ERR_QUOTA:            "over quota",
 }
 
 var (
@@ -70,8 +273,171 @@ var (
 	ErrUnexpectedPkg  = errors.New("unexpected package.")
 	ErrIdExist        = errors.New("frame sync stream id exist.")
 	ErrState          = errors.New("status error.")
+	ErrQueueWakeup    = errors.New("queue wakeup.")
+	ErrQueueTimeout   = errors.New("queue timeout.")
+	ErrBrokenPipe     = errors.New("broken pipe.")
+	ErrFabricWrite    = errors.New("fabric write failed.")
+	ErrLinger         = errors.New("linger timeout, unsent data dropped.")
+	ErrDialTimeout    = errors.New("dial timeout.")
+	ErrDialRefused    = errors.New("dial refused.")
+	ErrDialFailed     = errors.New("dial failed.")
+	ErrNxDomain       = errors.New("no such host on peer.")
+	ErrUnreachable    = errors.New("network unreachable on peer.")
+	ErrAuthFailed     = errors.New("auth failed.")
+	ErrGoaway         = errors.New("fabric going away.")
+	ErrBadStreamId    = errors.New("stream id from wrong half.")
+	ErrFrameTooLarge  = errors.New("frame length over limit.")
+	ErrUnknownMsg     = errors.New("unknown message type.")
+	ErrChecksum       = errors.New("frame checksum mismatch.")
+	ErrCompress       = errors.New("bad compressed data.")
+	ErrEncrypt        = errors.New("fabric encryption failed.")
+	ErrVersion        = errors.New("protocol version mismatch.")
+	ErrSettings       = errors.New("bad settings from peer.")
+	ErrTooManyStreams = errors.New("too many streams.")
+	ErrPoolClosed     = errors.New("fabric pool closed.")
+	ErrReset          = errors.New("stream reset by peer.")
+	ErrProtocol       = errors.New("protocol error.")
+	ErrAborted        = errors.New("stream aborted.")
+	ErrIdleTimeout    = errors.New("idle timeout.")
+	ErrOverflow       = errors.New("read queue overflow.")
+	ErrDenied         = errors.New("denied.")
+	ErrListening      = errors.New("fabric already has a listener.")
+	ErrDialBusy       = errors.New("too many dialing.")
+	ErrDgramTooLarge  = errors.New("datagram too large.")
+	ErrUdpHeader      = errors.New("bad socks5 udp header.")
+	ErrNoDns          = errors.New("dns not agreed with peer.")
+	ErrBind           = errors.New("bind address invalid on peer.")
+	ErrNoBind         = errors.New("bind not agreed with peer.")
+	ErrTooManyBinds   = errors.New("too many binds.")
+	ErrNoSocket       = errors.New("no such socket on peer.")
+	ErrPermission     = errors.New("permission denied on peer.")
+	ErrTooManyFabrics = errors.New("too many fabrics of user.")
+	ErrTLSHandshake   = errors.New("tls handshake failed.")
+	ErrCertNotPinned  = errors.New("cert not pinned.")
+	ErrTokenInvalid   = errors.New("token invalid.")
+	ErrTokenExpired   = errors.New("token expired.")
+	ErrNoToken        = errors.New("token not agreed with peer.")
+	ErrQuotaExceeded  = errors.New("user over quota.")
+	ErrAuthTimeout    = errors.New("auth timeout.")
+	ErrBadPorts       = errors.New("bad port range.")
+	ErrBadHash        = errors.New("bad password hash.")
+	ErrReplayed       = errors.New("auth replayed.")
 )
 
+// errnoErr maps errno in result to error.
+func errnoErr(errno uint32) error {
+	switch errno {
+	case ERR_NONE:
+		return nil
+	case ERR_AUTH:
+		return ErrAuthFailed
+	case ERR_IDEXIST:
+		return ErrIdExist
+	case ERR_CONNFAILED:
+		return ErrDialFailed
+	case ERR_TIMEOUT:
+		return ErrDialTimeout
+	case ERR_CLOSED:
+		return ErrBrokenPipe
+	case ERR_UNKNOWN_PROTOCOL:
+		return ErrUnknownNetwork
+	case ERR_GOAWAY:
+		return ErrGoaway
+	case ERR_TOOMANYSTREAMS:
+		return ErrTooManyStreams
+	case ERR_PROTOCOL:
+		return ErrProtocol
+	case ERR_ABORT:
+		return ErrAborted
+	case ERR_IDLE:
+		return ErrIdleTimeout
+	case ERR_OVERFLOW:
+		return ErrOverflow
+	case ERR_DENIED:
+		return ErrDenied
+	case ERR_DIALBUSY:
+		return ErrDialBusy
+	case ERR_BIND:
+		return ErrBind
+	case ERR_NXDOMAIN:
+		return ErrNxDomain
+	case ERR_REFUSED:
+		return ErrDialRefused
+	case ERR_UNREACHABLE:
+		return ErrUnreachable
+	case ERR_TOOMANYBINDS:
+		return ErrTooManyBinds
+	case ERR_NOSOCKET:
+		return ErrNoSocket
+	case ERR_PERMISSION:
+		return ErrPermission
+	case ERR_TOOMANYFABRICS:
+		return ErrTooManyFabrics
+	case ERR_QUOTA:
+		return ErrQuotaExceeded
+	}
+	return fmt.Errorf("unknown errno %d.", errno)
+}
+
+// ResetError is what read and write get after peer reset the stream.
+// It is ErrReset and ErrBrokenPipe, and the error of Code if known.
+type ResetError struct {
+	Code uint32
+}
+
+func (e *ResetError) Error() string {
+	if e.Code == ERR_NONE {
+		return "stream reset by peer, unspecified."
+	}
+	text, ok := ErrnoText[e.Code]
+	if !ok {
+		text = fmt.Sprintf("code %d", e.Code)
+	}
+	return fmt.Sprintf("stream reset by peer, %s.", text)
+}
+
+func (e *ResetError) Is(target error) bool {
+	if target == ErrReset || target == ErrBrokenPipe {
+		return true
+	}
+	return e.Code != ERR_NONE && target == errnoErr(e.Code)
+}
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+func (e *timeoutError) Is(target error) bool {
+	return target == os.ErrDeadlineExceeded
+}
+
+var ErrDeadline net.Error = &timeoutError{}
+
+// StreamError tells which stream and operation an error came from.
+type StreamError struct {
+	Fabric   string
+	Streamid uint16
+	Op       string
+	Err      error
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("%s(%d) %s: %s", e.Fabric, e.Streamid, e.Op, e.Err.Error())
+}
+
+func (e *StreamError) Unwrap() error { return e.Err }
+
+func (e *StreamError) Timeout() bool {
+	var nerr net.Error
+	return errors.As(e.Err, &nerr) && nerr.Timeout()
+}
+
+func (e *StreamError) Temporary() bool {
+	return e.Timeout()
+}
+
 var (
 	logger = logging.MustGetLogger("msocks")
 )
@@ -79,6 +445,7 @@ var (
 type Tunnel interface {
 	String() string
 	GetSize() int
+	GoingAway() bool
 	Loop()
 	Close() error
 }
@@ -0,0 +1,72 @@
+package tunnel
+
+import (
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// UnixProxy dials unix sockets on server host, Address in syn is the path.
+// Only paths allowed by Paths rules in UserGuard or Guard of fabric can be
+// dialed. unixpacket is not supported yet.
+type UnixProxy struct {
+	// zero means DIAL_TIMEOUT.
+	Timeout time.Duration
+}
+
+func (p *UnixProxy) Handle(fabconn net.Conn) (err error) {
+	c, ok := fabconn.(*Conn)
+	if !ok {
+		panic("proxy with no fab conn.")
+	}
+
+	logger.Debugf("%s try to connect %s:%s.",
+		c.String(), c.Network, c.Address)
+
+	if c.Network != "unix" {
+		logger.Noticef("%s %s not supported.", c.String(), c.Network)
+		c.DenyWith(ERR_UNKNOWN_PROTOCOL)
+		return
+	}
+	if !filepath.IsAbs(c.Address) {
+		logger.Noticef("%s socket path %s not absolute.", c.String(), c.Address)
+		c.DenyWith(ERR_DENIED)
+		return
+	}
+	v, err := c.fab.checkPath(c.Address)
+	c.setVerdict(v)
+	if err != nil {
+		denyDial(c, err, false)
+		return
+	}
+
+	timeout := p.Timeout
+	if timeout == 0 {
+		timeout = DIAL_TIMEOUT * time.Millisecond
+	}
+	conn, err := net.DialTimeout("unix", c.Address, timeout)
+	if err != nil {
+		denyDial(c, err, false)
+		return
+	}
+	c.setDialed(conn)
+	// client spoke first, target gets it before client knows connected.
+	err = c.writeEarly(conn)
+	if err != nil {
+		conn.Close()
+		denyDial(c, err, false)
+		return
+	}
+
+	err = c.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	go netutil.CopyHalf(conn, c)
+	logger.Noticef("%s connected to %s:%s.", c.String(), c.Network, c.Address)
+	return
+}
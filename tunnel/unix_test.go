@@ -0,0 +1,104 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func unixEcho(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "echo.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return path
+}
+
+func TestUnixProxy(t *testing.T) {
+	path := unixEcho(t)
+	dir := filepath.Dir(path)
+	cli, srv, _ := newBindPair(t, CAP_ADDRS)
+	client := &Client{Fabric: cli}
+
+	// no acl allows no socket.
+	_, err := client.Dial("unix", path)
+	if !errors.Is(err, ErrDenied) {
+		t.Fatalf("expect denied, got %v", err)
+	}
+
+	srv.Guard = NewGuard(&ACL{Rules: []*Rule{
+		{Paths: []string{filepath.Join(dir, "secret.sock")}, Deny: true},
+		{Paths: []string{dir + "/"}},
+		{PortMin: 1, PortMax: 65535},
+	}})
+	conn, err := client.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := conn.RemoteAddr(); a.Network() != "unix" || a.String() != path {
+		t.Fatalf("wrong remote %s:%s", a.Network(), a)
+	}
+	echoOnce(t, conn, "")
+
+	for _, c := range []struct {
+		network, address string
+		err              error
+	}{
+		{"unix", filepath.Join(dir, "secret.sock"), ErrDenied},
+		{"unix", filepath.Join(dir, "none.sock"), ErrNoSocket},
+		{"unix", dir + "/../" + filepath.Base(dir) + "x/echo.sock", ErrDenied},
+		{"unix", "echo.sock", ErrDenied},
+		{"unix", "/tmp/other.sock", ErrDenied},
+		{"unixpacket", path, ErrUnknownNetwork},
+	} {
+		_, err := client.Dial(c.network, c.address)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s:%s: expect %v, got %v", c.network, c.address, c.err, err)
+		}
+	}
+}
+
+func TestUnixErrno(t *testing.T) {
+	for _, c := range []struct {
+		err   error
+		errno uint32
+	}{
+		{&net.OpError{Op: "dial", Net: "unix", Err: os.NewSyscallError("connect", syscall.ENOENT)}, ERR_NOSOCKET},
+		{&net.OpError{Op: "dial", Net: "unix", Err: os.NewSyscallError("connect", syscall.EACCES)}, ERR_PERMISSION},
+		{&net.OpError{Op: "dial", Net: "unix", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, ERR_REFUSED},
+	} {
+		if errno := dialErrno(c.err, false); errno != c.errno {
+			t.Errorf("%v: expect %s, got %s", c.err, ErrnoText[c.errno], ErrnoText[errno])
+		}
+	}
+}
+
+func TestRulePaths(t *testing.T) {
+	acl := &ACL{Rules: []*Rule{{Paths: []string{"/run/"}}}}
+	// rules with paths never match ip targets, and others never unix.
+	if r, _ := acl.Allow("tcp", "", net.ParseIP("10.0.0.1"), 80); r != nil {
+		t.Fatalf("ip target matched %+v", r)
+	}
+	acl = &ACL{Rules: []*Rule{{Network: "unix"}}}
+	if _, ok := acl.AllowPath("/run/x.sock"); ok {
+		t.Fatal("rule without paths allowed socket")
+	}
+}
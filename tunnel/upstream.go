@@ -0,0 +1,349 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Dialer connects targets of streams for handlers, net.Dialer is one.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Direct in route means TcpProxy dials target itself, from Bind of fabric
+// and with happy eyeballs. Upstreams use it to reach proxies by default.
+var Direct Dialer = &net.Dialer{}
+
+// Route sends targets matched by Rule through Dialer, nil means Direct.
+// Deny in Rule is ignored, Guard decides that.
+type Route struct {
+	Rule
+	Dialer Dialer
+}
+
+// Router picks dialer by the first route matched. Targets are matched
+// before names resolved, so Nets only match targets asked by ip. Names
+// routed are given to dialer as is, but resolved on server to be checked
+// if fabric has Guard or DenyPrivate.
+// Don't change it after given to fabric, make a new one.
+type Router struct {
+	Routes []*Route
+}
+
+// Select returns dialer for target, Direct if no route matched. nil Router
+// dials everything directly.
+func (rt *Router) Select(network, address string) Dialer {
+	if rt == nil {
+		return Direct
+	}
+	host, sport, err := net.SplitHostPort(address)
+	if err != nil {
+		return Direct
+	}
+	port, _ := strconv.Atoi(sport)
+	name, ip := host, net.ParseIP(host)
+	if ip != nil {
+		name = ""
+	}
+	for _, r := range rt.Routes {
+		if r.match(network, name, ip, port) {
+			atomic.AddUint64(&r.hits, 1)
+			if r.Dialer == nil {
+				return Direct
+			}
+			return r.Dialer
+		}
+	}
+	return Direct
+}
+
+// UpstreamError is failure told by upstream proxy, or in talking to it.
+// Errno is what client gets in result.
+type UpstreamError struct {
+	Proxy string
+	Errno uint32
+	Msg   string
+	Err   error
+}
+
+func (e *UpstreamError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("upstream %s: %s: %s", e.Proxy, e.Msg, e.Err.Error())
+	}
+	return fmt.Sprintf("upstream %s: %s.", e.Proxy, e.Msg)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// upstreamErr wraps error in reaching proxy, target never tried. only
+// timeout tells client anything.
+func upstreamErr(proxy, msg string, err error) error {
+	errno := uint32(ERR_CONNFAILED)
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() ||
+		errors.Is(err, context.DeadlineExceeded) {
+		errno = ERR_TIMEOUT
+	}
+	return &UpstreamError{Proxy: proxy, Errno: errno, Msg: msg, Err: err}
+}
+
+func isTcp(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return true
+	}
+	return false
+}
+
+// dialProxy connects proxy by forward, deadline of ctx set on it for
+// handshake.
+func dialProxy(ctx context.Context, forward Dialer, proxy string) (conn net.Conn, err error) {
+	if forward == nil {
+		forward = Direct
+	}
+	conn, err = forward.DialContext(ctx, "tcp", proxy)
+	if err != nil {
+		return nil, upstreamErr(proxy, "connect", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return
+}
+
+// socks5 reply codes.
+const (
+	SOCKS_SUCCEEDED = iota
+	SOCKS_FAILURE
+	SOCKS_NOT_ALLOWED
+	SOCKS_NET_UNREACHABLE
+	SOCKS_HOST_UNREACHABLE
+	SOCKS_REFUSED
+	SOCKS_TTL_EXPIRED
+	SOCKS_CMD_UNSUPPORTED
+	SOCKS_ATYP_UNSUPPORTED
+)
+
+var socksErrno = map[byte]uint32{
+	SOCKS_NOT_ALLOWED:      ERR_DENIED,
+	SOCKS_NET_UNREACHABLE:  ERR_UNREACHABLE,
+	SOCKS_HOST_UNREACHABLE: ERR_UNREACHABLE,
+	SOCKS_REFUSED:          ERR_REFUSED,
+	SOCKS_TTL_EXPIRED:      ERR_TIMEOUT,
+}
+
+// Socks5Dialer connects tcp targets by CONNECT of socks5 proxy, RFC 1928.
+// Names are sent as is, resolved by proxy.
+type Socks5Dialer struct {
+	Proxy string
+	// auth by RFC 1929 if Username not empty.
+	Username string
+	Password string
+	// reaches proxy by it, Direct if nil. proxies can be chained.
+	Forward Dialer
+}
+
+func (d *Socks5Dialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	if !isTcp(network) {
+		return nil, ErrUnknownNetwork
+	}
+	host, sport, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	port, err := strconv.ParseUint(sport, 10, 16)
+	if err != nil {
+		return
+	}
+	if net.ParseIP(host) == nil && len(host) > 255 {
+		return nil, &net.DNSError{Err: "name too long", Name: host}
+	}
+
+	conn, err = dialProxy(ctx, d.Forward, d.Proxy)
+	if err != nil {
+		return
+	}
+	err = d.handshake(conn, host, uint16(port))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return
+}
+
+func (d *Socks5Dialer) handshake(conn net.Conn, host string, port uint16) (err error) {
+	fail := func(msg string, err error) error {
+		return upstreamErr(d.Proxy, msg, err)
+	}
+	refuse := func(errno uint32, msg string) error {
+		return &UpstreamError{Proxy: d.Proxy, Errno: errno, Msg: msg}
+	}
+
+	methods := []byte{5, 1, 0}
+	if d.Username != "" {
+		methods = []byte{5, 2, 0, 2}
+	}
+	if _, err = conn.Write(methods); err != nil {
+		return fail("send methods", err)
+	}
+	var buf [4]byte
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return fail("read method", err)
+	}
+	switch {
+	case buf[0] != 5:
+		return refuse(ERR_CONNFAILED, "not socks5")
+	case buf[1] == 2 && d.Username != "":
+		auth := []byte{1, byte(len(d.Username))}
+		auth = append(auth, d.Username...)
+		auth = append(auth, byte(len(d.Password)))
+		auth = append(auth, d.Password...)
+		if _, err = conn.Write(auth); err != nil {
+			return fail("send auth", err)
+		}
+		if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+			return fail("read auth", err)
+		}
+		if buf[1] != 0 {
+			return refuse(ERR_DENIED, "auth failed")
+		}
+	case buf[1] != 0:
+		return refuse(ERR_DENIED, "no acceptable auth method")
+	}
+
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(req, ATYP_DOMAIN, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, ATYP_IPV4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, ATYP_IPV6)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+	if _, err = conn.Write(req); err != nil {
+		return fail("send request", err)
+	}
+
+	// ver, rep, rsv, atyp, then bound address we don't care.
+	if _, err = io.ReadFull(conn, buf[:4]); err != nil {
+		return fail("read reply", err)
+	}
+	if buf[1] != SOCKS_SUCCEEDED {
+		errno, ok := socksErrno[buf[1]]
+		if !ok {
+			errno = ERR_CONNFAILED
+		}
+		return refuse(errno, fmt.Sprintf("reply %d", buf[1]))
+	}
+	var alen int
+	switch buf[3] {
+	case ATYP_IPV4:
+		alen = net.IPv4len
+	case ATYP_IPV6:
+		alen = net.IPv6len
+	case ATYP_DOMAIN:
+		if _, err = io.ReadFull(conn, buf[:1]); err != nil {
+			return fail("read reply", err)
+		}
+		alen = int(buf[0])
+	default:
+		return refuse(ERR_CONNFAILED, "bad address in reply")
+	}
+	if _, err = io.ReadFull(conn, make([]byte, alen+2)); err != nil {
+		return fail("read reply", err)
+	}
+	return nil
+}
+
+// HttpDialer connects tcp targets by CONNECT of http proxy.
+type HttpDialer struct {
+	Proxy string
+	// basic auth if Username not empty.
+	Username string
+	Password string
+	// reaches proxy by it, Direct if nil. proxies can be chained.
+	Forward Dialer
+}
+
+// httpErrno maps status from proxy to errno, ERR_CONNFAILED if unknown.
+func httpErrno(status int) uint32 {
+	switch status {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return ERR_DENIED
+	case http.StatusGatewayTimeout, http.StatusRequestTimeout:
+		return ERR_TIMEOUT
+	}
+	return ERR_CONNFAILED
+}
+
+func (d *HttpDialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	if !isTcp(network) {
+		return nil, ErrUnknownNetwork
+	}
+	conn, err = dialProxy(ctx, d.Forward, d.Proxy)
+	if err != nil {
+		return
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.Username != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString(
+			[]byte(d.Username+":"+d.Password)))
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, upstreamErr(d.Proxy, "send connect", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, upstreamErr(d.Proxy, "read response", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, &UpstreamError{
+			Proxy: d.Proxy, Errno: httpErrno(resp.StatusCode), Msg: resp.Status}
+	}
+	resp.Body.Close()
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() != 0 {
+		// target talked first, in the same read.
+		return &bufConn{Conn: conn, r: br}, nil
+	}
+	return
+}
+
+// bufConn reads what buffered first.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
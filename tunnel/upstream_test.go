@@ -0,0 +1,297 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// serveTest accepts in a listener closed with test, by serve in goroutines.
+func serveTest(t *testing.T, serve func(conn net.Conn)) (addr string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func tcpEcho(t *testing.T) string {
+	return serveTest(t, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+}
+
+// fakeSocks5 is socks5 proxy with user/pass auth, replies rep if not 0,
+// or connects target asked. targets asked told in asked.
+func fakeSocks5(t *testing.T, rep byte, asked chan string) string {
+	return serveTest(t, func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 512)
+		io.ReadFull(conn, buf[:2])
+		io.ReadFull(conn, buf[:buf[1]])
+		conn.Write([]byte{5, 2})
+		io.ReadFull(conn, buf[:2])
+		ulen := int(buf[1])
+		io.ReadFull(conn, buf[:ulen+1])
+		user := string(buf[:ulen])
+		io.ReadFull(conn, buf[:buf[ulen]])
+		if user != "user" {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+
+		io.ReadFull(conn, buf[:4])
+		var host string
+		switch buf[3] {
+		case ATYP_IPV4:
+			io.ReadFull(conn, buf[:4])
+			host = net.IP(buf[:4]).String()
+		case ATYP_DOMAIN:
+			io.ReadFull(conn, buf[:1])
+			n := int(buf[0])
+			io.ReadFull(conn, buf[:n])
+			host = string(buf[:n])
+		}
+		io.ReadFull(conn, buf[:2])
+		address := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf))))
+		select {
+		case asked <- address:
+		default:
+		}
+
+		reply := []byte{5, rep, 0, ATYP_IPV4, 127, 0, 0, 1, 0, 0}
+		if rep != 0 {
+			conn.Write(reply)
+			return
+		}
+		target, err := net.Dial("tcp", address)
+		if err != nil {
+			reply[1] = SOCKS_REFUSED
+			conn.Write(reply)
+			return
+		}
+		conn.Write(reply)
+		netutil.CopyLink(target, conn)
+	})
+}
+
+// fakeHttpProxy replies status if not 200, or connects target asked.
+func fakeHttpProxy(t *testing.T, status int) string {
+	return serveTest(t, func(conn net.Conn) {
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		if status != http.StatusOK {
+			io.WriteString(conn, "HTTP/1.1 "+strconv.Itoa(status)+" No\r\nContent-Length: 0\r\n\r\n")
+			return
+		}
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		// greeting sent with the response, like a server talks first.
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\nhi")
+		netutil.CopyLink(target, conn)
+	})
+}
+
+func echoOnce(t *testing.T, conn net.Conn, greeting string) {
+	defer conn.Close()
+	buf := make([]byte, len(greeting)+4)
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != greeting+"ping" {
+		t.Fatalf("wrong echo %q: %v", buf, err)
+	}
+}
+
+func TestUpstreamDialers(t *testing.T) {
+	ctx := context.Background()
+	echo := tcpEcho(t)
+	asked := make(chan string, 4)
+	socks := &Socks5Dialer{Proxy: fakeSocks5(t, 0, asked), Username: "user", Password: "pass"}
+
+	conn, err := socks.DialContext(ctx, "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoOnce(t, conn, "")
+
+	// names go to proxy as is.
+	_, port, _ := net.SplitHostPort(echo)
+	conn, err = socks.DialContext(ctx, "tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoOnce(t, conn, "")
+	if a := <-asked; a != echo {
+		t.Fatalf("wrong target asked: %s", a)
+	}
+	if a := <-asked; a != "localhost:"+port {
+		t.Fatalf("wrong target asked: %s", a)
+	}
+
+	// http through socks.
+	chain := &HttpDialer{Proxy: fakeHttpProxy(t, http.StatusOK), Forward: socks}
+	conn, err = chain.DialContext(ctx, "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoOnce(t, conn, "hi")
+
+	if _, err = socks.DialContext(ctx, "udp", echo); err != ErrUnknownNetwork {
+		t.Fatalf("expect unknown network, got %v", err)
+	}
+}
+
+func TestUpstreamErrno(t *testing.T) {
+	ctx := context.Background()
+	echo := tcpEcho(t)
+	asked := make(chan string)
+	closed := serveTest(t, func(conn net.Conn) { conn.Close() })
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	nothing := ln.Addr().String()
+	ln.Close()
+
+	for _, c := range []struct {
+		d     Dialer
+		errno uint32
+	}{
+		{&Socks5Dialer{Proxy: fakeSocks5(t, SOCKS_REFUSED, asked), Username: "user"}, ERR_REFUSED},
+		{&Socks5Dialer{Proxy: fakeSocks5(t, SOCKS_HOST_UNREACHABLE, asked), Username: "user"}, ERR_UNREACHABLE},
+		{&Socks5Dialer{Proxy: fakeSocks5(t, SOCKS_NOT_ALLOWED, asked), Username: "user"}, ERR_DENIED},
+		{&Socks5Dialer{Proxy: fakeSocks5(t, SOCKS_FAILURE, asked), Username: "user"}, ERR_CONNFAILED},
+		{&Socks5Dialer{Proxy: fakeSocks5(t, 0, asked), Username: "nobody"}, ERR_DENIED},
+		{&HttpDialer{Proxy: fakeHttpProxy(t, http.StatusProxyAuthRequired)}, ERR_DENIED},
+		{&HttpDialer{Proxy: fakeHttpProxy(t, http.StatusGatewayTimeout)}, ERR_TIMEOUT},
+		{&HttpDialer{Proxy: fakeHttpProxy(t, http.StatusBadGateway)}, ERR_CONNFAILED},
+		// proxy itself refused, not the target.
+		{&HttpDialer{Proxy: nothing}, ERR_CONNFAILED},
+		{&Socks5Dialer{Proxy: closed}, ERR_CONNFAILED},
+	} {
+		_, err := c.d.DialContext(ctx, "tcp", echo)
+		var uerr *UpstreamError
+		if !errors.As(err, &uerr) || dialErrno(err, false) != c.errno {
+			t.Errorf("%+v: expect %s, got %v", c.d, ErrnoText[c.errno], err)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	socks, web := &Socks5Dialer{}, &HttpDialer{}
+	rt := &Router{Routes: []*Route{
+		{Rule: Rule{Domains: []string{"corp.test"}}, Dialer: socks},
+		{Rule: Rule{Nets: mustCIDRs(t, "10.0.0.0/8")}, Dialer: socks},
+		{Rule: Rule{Domains: []string{"direct.corp.test"}}},
+		{Rule: Rule{PortMin: 80}, Dialer: web},
+	}}
+	for _, c := range []struct {
+		address string
+		d       Dialer
+	}{
+		{"wiki.corp.test:443", socks},
+		{"10.1.1.1:22", socks},
+		{"8.8.8.8:80", web},
+		{"example.test:80", web},
+		{"example.test:443", Direct},
+		{"bad address", Direct},
+	} {
+		if d := rt.Select("tcp", c.address); d != c.d {
+			t.Errorf("%s: wrong dialer %T", c.address, d)
+		}
+	}
+	if n := rt.Routes[0].Hits(); n != 1 {
+		t.Fatalf("expect 1 hit, got %d", n)
+	}
+	if d := (*Router)(nil).Select("tcp", "x:1"); d != Direct {
+		t.Fatalf("nil router should dial directly, got %T", d)
+	}
+}
+
+// recordDialer connects every target to echo, and remembers them.
+type recordDialer struct {
+	echo string
+	lock sync.Mutex
+	seen []string
+}
+
+func (d *recordDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.lock.Lock()
+	d.seen = append(d.seen, network+":"+address)
+	d.lock.Unlock()
+	return net.Dial("tcp", d.echo)
+}
+
+func TestTcpProxyRouted(t *testing.T) {
+	rec := &recordDialer{echo: tcpEcho(t)}
+	cli, srv := newConnPair(t)
+	srv.fab.Router = &Router{Routes: []*Route{
+		{Rule: Rule{Domains: []string{"routed.test"}}, Dialer: rec},
+	}}
+	client := &Client{Fabric: cli.fab}
+
+	// never resolved here.
+	conn, err := client.Dial("tcp", "www.routed.test:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoOnce(t, conn, "")
+	rec.lock.Lock()
+	seen := rec.seen
+	rec.lock.Unlock()
+	if len(seen) != 1 || seen[0] != "tcp:www.routed.test:80" {
+		t.Fatalf("wrong dials: %v", seen)
+	}
+
+	// checked by address resolved here, proxy still gets the name.
+	asked := make(chan string, 1)
+	srv.fab.Router = &Router{Routes: []*Route{
+		{Rule: Rule{Domains: []string{"routed.test"}}, Dialer: rec},
+		{Rule: Rule{Domains: []string{"socks.test"}}, Dialer: &Socks5Dialer{
+			Proxy: fakeSocks5(t, SOCKS_REFUSED, asked), Username: "user", Password: "pass"}},
+	}}
+	srv.fab.Resolver = fakeResolver{"www.socks.test": "93.184.216.34"}
+	srv.fab.Guard = NewGuard(&ACL{})
+	srv.fab.DenyPrivate = true
+	// proxy refuses, never dials out.
+	client.Dial("tcp", "www.socks.test:80")
+	if a := <-asked; a != "www.socks.test:80" {
+		t.Fatalf("proxy should get the name, got %s", a)
+	}
+	srv.fab.Resolver = fakeResolver{"www.socks.test": "127.0.0.1"}
+	_, err = client.Dial("tcp", "www.socks.test:80")
+	if !errors.Is(err, ErrDenied) {
+		t.Fatalf("name resolved to private should be denied, got %v", err)
+	}
+	srv.fab.DenyPrivate = false
+
+	// routed targets still checked.
+	srv.fab.Guard = NewGuard(&ACL{Rules: []*Rule{{PortMin: 80, Deny: true}}})
+	_, err = client.Dial("tcp", "10.0.0.1:80")
+	if !errors.Is(err, ErrDenied) {
+		t.Fatalf("expect denied, got %v", err)
+	}
+}